@@ -0,0 +1,212 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type album struct {
+	// the source directory the album's tracks live in
+	directory string
+	// the album's jobs, in planned order
+	jobs []job
+}
+
+// groups jobs by the source directory they come from, keeping albums in planned order
+func groupJobsByAlbum(jobs []job) []album {
+	var albums []album
+	indexes := make(map[string]int)
+
+	for _, j := range jobs {
+		directory := filepath.Dir(j.sourceFile)
+		index, ok := indexes[directory]
+		if !ok {
+			index = len(albums)
+			indexes[directory] = index
+			albums = append(albums, album{directory: directory})
+		}
+		albums[index].jobs = append(albums[index].jobs, j)
+	}
+
+	return albums
+}
+
+// like worker, but completes a whole album before taking on another one.
+// when stagingRoot is set albums are built there and only moved into the destination once every track succeeded
+func albumWorker(ctx context.Context, id int, albums <-chan album, results chan<- jobReport, workDir string, stagingRoot string) {
+	for a := range albums {
+		// simulated albums have nothing to stage
+		if stagingRoot == "" || simulateRate > 0 {
+			for _, j := range a.jobs {
+				results <- processJob(ctx, id, j, workDir)
+			}
+			continue
+		}
+
+		for _, report := range processAlbumAtomically(ctx, id, a, workDir, stagingRoot) {
+			results <- report
+		}
+	}
+}
+
+func processAlbumAtomically(ctx context.Context, id int, a album, workDir string, stagingRoot string) []jobReport {
+	reports := make([]jobReport, 0, len(a.jobs))
+
+	// albums are deferred as a whole, including ones handed out just as the run was cancelled
+	if len(a.jobs) > 0 && (a.jobs[0].deferred || ctx.Err() != nil) {
+		for _, j := range a.jobs {
+			reports = append(reports, jobReport{workerId: id, job: j, deferred: true})
+		}
+		return reports
+	}
+
+	// fails every job in the album that doesn't have a report yet
+	failRemaining := func(err error) []jobReport {
+		for _, j := range a.jobs[len(reports):] {
+			reports = append(reports, jobReport{workerId: id, error: err, job: j})
+		}
+		return reports
+	}
+
+	if err := os.MkdirAll(stagingRoot, os.ModePerm); err != nil {
+		return failRemaining(err)
+	}
+	staging, err := os.MkdirTemp(stagingRoot, "album")
+	if err != nil {
+		return failRemaining(err)
+	}
+	defer os.RemoveAll(staging)
+
+	// the folder art of every destination folder the album lands in is staged apart, and placed with the tracks
+	artDirs := make(map[string]string)
+	for _, j := range a.jobs {
+		dir := filepath.Dir(j.destinationFile)
+		if artDirs[dir] != "" {
+			continue
+		}
+		artDirs[dir] = filepath.Join(staging, "art-"+strconv.Itoa(len(artDirs)))
+		if err := os.Mkdir(artDirs[dir], os.ModePerm); err != nil {
+			return failRemaining(err)
+		}
+	}
+
+	for i, j := range a.jobs {
+		// tracks are staged under their index, two sources can map to the same output name
+		staged := j
+		staged.stagedFile = filepath.Join(staging, strconv.Itoa(i)+filepath.Ext(j.destinationFile))
+		staged.stagedArtDir = artDirs[filepath.Dir(j.destinationFile)]
+
+		report := processJob(ctx, id, staged, workDir)
+		report.job = j
+		// cancelled partway, the album is left for the next run as a whole
+		if report.deferred {
+			reports = reports[:0]
+			for _, j := range a.jobs {
+				reports = append(reports, jobReport{workerId: id, job: j, deferred: true})
+			}
+			return reports
+		}
+		reports = append(reports, report)
+		// protected tracks are left out, the rest of the album still gets placed
+		if report.protected {
+			continue
+		}
+
+		// no point finishing the album, it isn't going to be placed
+		if report.error != nil {
+			for k := 0; k < i; k++ {
+				reports[k].error = fmt.Errorf("discarded %s, another track in %s failed", a.jobs[k].sourceFile, a.directory)
+				reports[k].skipped = true
+			}
+			for _, skipped := range a.jobs[i+1:] {
+				reports = append(reports, jobReport{workerId: id, error: fmt.Errorf("skipped %s, another track in %s failed", skipped.sourceFile, a.directory), job: skipped, skipped: true})
+			}
+			return reports
+		}
+	}
+
+	// everything succeeded, move the album into place: its tracks, their lyrics and the folder art
+	var moves []albumMove
+	for i, j := range a.jobs {
+		if reports[i].protected {
+			continue
+		}
+		staged := filepath.Join(staging, strconv.Itoa(i)+filepath.Ext(j.destinationFile))
+		moves = append(moves, albumMove{from: staged, to: j.destinationFile})
+		// a copied .lrc sidecar was staged along with its track
+		if _, err := os.Stat(lyricsSidecarPath(staged)); err == nil {
+			moves = append(moves, albumMove{from: lyricsSidecarPath(staged), to: lyricsSidecarPath(j.destinationFile)})
+		}
+	}
+	for dir, artDir := range artDirs {
+		for _, name := range []string{folderArtName, extractedArtName} {
+			if _, err := os.Stat(filepath.Join(artDir, name)); err == nil {
+				moves = append(moves, albumMove{from: filepath.Join(artDir, name), to: filepath.Join(dir, name)})
+			}
+		}
+	}
+	if err := placeAlbum(moves, staging); err != nil {
+		for i := range reports {
+			if !reports[i].protected {
+				reports[i].error = fmt.Errorf("couldn't place %s, nothing of it was kept: %w", a.directory, err)
+			}
+		}
+	}
+
+	return reports
+}
+
+// a file of a staged album and where it goes in the destination
+type albumMove struct {
+	from string
+	to   string
+	// where the output it replaces was put aside, to be put back if the album can't be placed
+	previous string
+}
+
+// moves a staged album into the destination as a whole. when a move fails the ones before it are taken back,
+// outputs they replaced are put back and folders made for the album are removed, so the destination is left as it was
+func placeAlbum(moves []albumMove, staging string) error {
+	var createdDirectories [][]string
+	var placed []albumMove
+	var err error
+	for i, move := range moves {
+		var created []string
+		if created, err = mkdirAllTracked(filepath.Dir(move.to)); err != nil {
+			err = destinationError(err)
+			break
+		}
+		createdDirectories = append(createdDirectories, created)
+		if _, statErr := destination.Stat(move.to); statErr == nil {
+			move.previous = filepath.Join(staging, "previous-"+strconv.Itoa(i))
+			if err = destination.Rename(move.to, move.previous); err != nil {
+				break
+			}
+		}
+		if err = safeRename(move.from, move.to); err != nil {
+			err = destinationError(err)
+			if move.previous != "" {
+				destination.Rename(move.previous, move.to)
+			}
+			break
+		}
+		placed = append(placed, move)
+	}
+	if err == nil {
+		return nil
+	}
+
+	for i := len(placed) - 1; i >= 0; i-- {
+		destination.Remove(placed[i].to)
+		if placed[i].previous != "" {
+			destination.Rename(placed[i].previous, placed[i].to)
+		}
+	}
+	for i := len(createdDirectories) - 1; i >= 0; i-- {
+		removeCreatedDirectories(createdDirectories[i])
+	}
+	return err
+}
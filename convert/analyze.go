@@ -0,0 +1,381 @@
+package convert
+
+import (
+	"context"
+	"flag"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the bitrates lossy sources are grouped by, in kilobits, each up to the next
+var analysisBitrates = []struct {
+	from int
+	name string
+}{
+	{0, "under 128k"},
+	{128, "128k to 191k"},
+	{192, "192k to 255k"},
+	{256, "256k to 319k"},
+	{320, "320k and up"},
+}
+
+// how many files and how much space part of the library takes up
+type compositionGroup struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+// what analyze found in a library
+type libraryComposition struct {
+	Files    int              `json:"files"`
+	Size     int64            `json:"size"`
+	Duration float64          `json:"duration"`
+	Lossless compositionGroup `json:"lossless"`
+	Lossy    compositionGroup `json:"lossy"`
+	// largest first
+	Codecs []compositionGroup `json:"codecs"`
+	// of the lossy sources only, a lossless one's bitrate says nothing about its quality
+	Bitrates    []compositionGroup `json:"bitrates"`
+	SampleRates []compositionGroup `json:"sampleRates"`
+	// audio files ffprobe couldn't read
+	Unreadable []string `json:"unreadable,omitempty"`
+	Protected  []string `json:"protected,omitempty"`
+	// audio files without a title or an artist
+	Untagged []string `json:"untagged,omitempty"`
+	// album folders without a cover image whose tracks have no art embedded either
+	MissingArt []string `json:"missingArt,omitempty"`
+	// what isn't audio, by extension, largest first
+	NonAudio     []compositionGroup `json:"nonAudio,omitempty"`
+	NonAudioSize int64              `json:"nonAudioSize"`
+}
+
+func runAnalyze(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	blacklist := flags.String("blacklist", "PioneerDJ,Ableton,Logic", "comma separated list of directory names to skip")
+	probeWorkers := flags.Int("probe-workers", defaultProbeWorkers, "the number of files probed at once, raise it for libraries on network shares")
+	list := flags.Bool("list", false, "list the files and album folders behind every finding instead of only counting them")
+	jsonOutput := flags.Bool("json", false, "print the report as a json event")
+	flags.Parse(args)
+	console.json = *jsonOutput
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		exit(2)
+	}
+
+	if err := selectSource(flags.Arg(0)); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	srcDir, err := filepath.Abs(sourcePath(flags.Arg(0)))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	console.roots = []string{srcDir}
+	loadProbeCache()
+
+	ctx, stop := interruptContext()
+	defer stop()
+	composition, err := analyzeLibrary(ctx, srcDir, splitList(*blacklist), *probeWorkers)
+	if ctx.Err() != nil {
+		console.println("interrupted, nothing was reported")
+		exit(1)
+	} else if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = saveProbeCache(); err != nil {
+		console.println("couldn't save the probe cache:", err)
+	}
+
+	console.report("analysis", composition, func() {
+		printComposition(composition, *list)
+	})
+}
+
+// walks a library reading every audio file's stream and tags, nothing in it is changed
+func analyzeLibrary(ctx context.Context, srcDir string, blacklist []string, probeWorkers int) (libraryComposition, error) {
+	var composition libraryComposition
+
+	var files []string
+	sizes := make(map[string]int64)
+	// of every folder with audio in it, whether it has a cover image
+	folders := make(map[string]bool)
+	nonAudio := make(map[string]*compositionGroup)
+	err := source.Walk(srcDir, func(curPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		relativeDir, err := filepath.Rel(srcDir, filepath.Dir(curPath))
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == toolDirName {
+			return fs.SkipDir
+		}
+		if entry.IsDir() || directoryIsBlacklisted(relativeDir, blacklist) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		extension := strings.ToLower(filepath.Ext(entry.Name()))
+		directory := filepath.Dir(curPath)
+		if isAudioExtension(extension) {
+			files = append(files, curPath)
+			sizes[curPath] = info.Size()
+			if _, ok := folders[directory]; !ok {
+				folders[directory] = false
+			}
+			return nil
+		}
+
+		if isCoverImage(entry.Name()) {
+			folders[directory] = true
+		}
+		if extension == "" {
+			extension = "no extension"
+		}
+		if nonAudio[extension] == nil {
+			nonAudio[extension] = &compositionGroup{Name: extension}
+		}
+		nonAudio[extension].Files++
+		nonAudio[extension].Size += info.Size()
+		composition.NonAudioSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return composition, err
+	}
+
+	prefetchProbes(ctx, files, probeWorkers)
+	if err = ctx.Err(); err != nil {
+		return composition, err
+	}
+
+	codecs := make(map[string]*compositionGroup)
+	bitrates := make(map[string]*compositionGroup)
+	sampleRates := make(map[int]*compositionGroup)
+	for _, file := range files {
+		size := sizes[file]
+		composition.Files++
+		composition.Size += size
+
+		probe, err := probeSource(file)
+		if err != nil {
+			console.debugf("couldn't read %s: %s\n", file, err)
+			composition.Unreadable = append(composition.Unreadable, file)
+			continue
+		}
+		composition.Duration += probe.duration.Seconds()
+		if probe.protected {
+			composition.Protected = append(composition.Protected, file)
+		}
+		if probe.art {
+			folders[filepath.Dir(file)] = true
+		}
+		title, _ := findTag(probe.tags, "title")
+		artist, _ := findTag(probe.tags, "artist")
+		if strings.TrimSpace(title) == "" || strings.TrimSpace(artist) == "" {
+			composition.Untagged = append(composition.Untagged, file)
+		}
+
+		addToGroup(codecs, probe.codec, size)
+		if isLosslessCodec(probe.codec) {
+			composition.Lossless.Files++
+			composition.Lossless.Size += size
+		} else {
+			composition.Lossy.Files++
+			composition.Lossy.Size += size
+			addToGroup(bitrates, bitrateGroup(probe.bitrate), size)
+		}
+		if sampleRates[probe.sampleRate] == nil {
+			sampleRates[probe.sampleRate] = &compositionGroup{Name: sampleRateName(probe.sampleRate)}
+		}
+		sampleRates[probe.sampleRate].Files++
+		sampleRates[probe.sampleRate].Size += size
+	}
+
+	composition.Lossless.Name, composition.Lossy.Name = "lossless", "lossy"
+	composition.Codecs = largestGroups(codecs)
+	composition.NonAudio = largestGroups(nonAudio)
+	for _, bucket := range analysisBitrates {
+		if group := bitrates[bucket.name]; group != nil {
+			composition.Bitrates = append(composition.Bitrates, *group)
+		}
+	}
+	if group := bitrates["unknown"]; group != nil {
+		composition.Bitrates = append(composition.Bitrates, *group)
+	}
+	var rates []int
+	for rate := range sampleRates {
+		rates = append(rates, rate)
+	}
+	// unknown rates, 0, go last
+	sort.Slice(rates, func(i, j int) bool { return rates[j] == 0 || (rates[i] != 0 && rates[i] < rates[j]) })
+	for _, rate := range rates {
+		composition.SampleRates = append(composition.SampleRates, *sampleRates[rate])
+	}
+
+	for folder, art := range folders {
+		// the discs of an album share its art
+		if _, ok := discNumber(filepath.Base(folder)); ok && folders[filepath.Dir(folder)] {
+			art = true
+		}
+		if !art {
+			composition.MissingArt = append(composition.MissingArt, folder)
+		}
+	}
+	sort.Strings(composition.MissingArt)
+	sort.Strings(composition.Untagged)
+	sort.Strings(composition.Unreadable)
+	sort.Strings(composition.Protected)
+
+	return composition, nil
+}
+
+func printComposition(composition libraryComposition, list bool) {
+	if composition.Files == 0 {
+		console.println("no audio files found")
+	} else {
+		console.printf("%s audio files, %s, %s of audio\n", formatCount(composition.Files), formatSize(composition.Size), time.Duration(composition.Duration*float64(time.Second)).Round(time.Minute))
+		printCompositionGroups("", []compositionGroup{composition.Lossless, composition.Lossy})
+		printCompositionGroups("codec", composition.Codecs)
+		printCompositionGroups("lossy bitrate", composition.Bitrates)
+		printCompositionGroups("sample rate", composition.SampleRates)
+	}
+
+	console.println()
+	findings := []struct {
+		files   []string
+		message string
+	}{
+		{composition.Unreadable, "audio files couldn't be read"},
+		{composition.Protected, "audio files are drm protected and can't be converted"},
+		{composition.Untagged, "audio files are missing a title or an artist"},
+		{composition.MissingArt, "album folders have no cover image and no art in their tracks"},
+	}
+	hidden := false
+	for _, finding := range findings {
+		if len(finding.files) == 0 {
+			continue
+		}
+		console.printf("%s %s\n", formatCount(len(finding.files)), finding.message)
+		if !list {
+			hidden = true
+			continue
+		}
+		for _, file := range finding.files {
+			console.printf("    %s\n", console.relative(file))
+		}
+	}
+	if hidden {
+		console.println("(-list lists them)")
+	}
+
+	if len(composition.NonAudio) > 0 {
+		files := 0
+		for _, group := range composition.NonAudio {
+			files += group.Files
+		}
+		console.printf("\n%s files that aren't audio take up %s\n", formatCount(files), formatSize(composition.NonAudioSize))
+		shown := composition.NonAudio
+		// the bulk is in the first few, the long tail of .txt and .nfo doesn't help decide anything
+		if len(shown) > 10 {
+			shown = shown[:10]
+		}
+		printCompositionGroups("extension", shown)
+	}
+}
+
+func printCompositionGroups(title string, groups []compositionGroup) {
+	if len(groups) == 0 {
+		return
+	}
+	console.println()
+	if title != "" {
+		console.printf("%-16s %10s %10s\n", title, "files", "size")
+	}
+	for _, group := range groups {
+		console.printf("%-16s %10s %10s\n", group.Name, formatCount(group.Files), formatSize(group.Size))
+	}
+}
+
+func addToGroup(groups map[string]*compositionGroup, name string, size int64) {
+	if name == "" {
+		name = "unknown"
+	}
+	if groups[name] == nil {
+		groups[name] = &compositionGroup{Name: name}
+	}
+	groups[name].Files++
+	groups[name].Size += size
+}
+
+func largestGroups(groups map[string]*compositionGroup) []compositionGroup {
+	var sorted []compositionGroup
+	for _, group := range groups {
+		sorted = append(sorted, *group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Size != sorted[j].Size {
+			return sorted[i].Size > sorted[j].Size
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+func bitrateGroup(bitrate int) string {
+	if bitrate == 0 {
+		return "unknown"
+	}
+	name := analysisBitrates[0].name
+	for _, bucket := range analysisBitrates {
+		if bitrate >= bucket.from {
+			name = bucket.name
+		}
+	}
+	return name
+}
+
+// ie 44.1 kHz
+func sampleRateName(rate int) string {
+	if rate == 0 {
+		return "unknown"
+	}
+	return strconv.FormatFloat(float64(rate)/1000, 'f', -1, 64) + " kHz"
+}
+
+// the codecs ffprobe reports for lossless audio, pcm comes in many flavors
+func isLosslessCodec(codec string) bool {
+	switch codec {
+	case "flac", "alac", "wavpack", "ape", "tta", "tak", "shorten", "mlp", "truehd", "wmalossless":
+		return true
+	}
+	return strings.HasPrefix(codec, "pcm_")
+}
+
+// images an album folder's cover usually is, any jpeg or png counts as players pick up all sorts of names
+func isCoverImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// metaflac, when it's installed, carries over the flac metadata blocks ffmpeg drops
+var metaflacPath = "metaflac"
+
+// checks whether metaflac can be run, without it cuesheets and seektables are lost going flac to flac
+func metaflacAvailable() bool {
+	_, err := exec.LookPath(metaflacPath)
+	return err == nil
+}
+
+// tags archival rips carry that players only read back if the container keeps tags it doesn't know
+func isArchivalTag(key string) bool {
+	key = strings.ToLower(key)
+	return strings.HasPrefix(key, "replaygain_") || key == "cuesheet"
+}
+
+// whether metaflac will copy the source's cuesheet and seektable blocks into the job's output
+func carriesFlacBlocks(j job) bool {
+	return j.encode && !j.retag && strings.EqualFold(filepath.Ext(j.sourceFile), ".flac") && strings.EqualFold(j.format.fileExtension, ".flac") && metaflacAvailable()
+}
+
+// copies the cuesheet and seektable blocks of a flac source into its flac output, ffmpeg only carries the tags over
+func carryFlacBlocks(ctx context.Context, j job, outputFile string) error {
+	if !carriesFlacBlocks(j) {
+		return nil
+	}
+
+	// metaflac fails on sources without a cuesheet, which is most of them
+	cuesheet, err := toolCommand(ctx, metaflacPath, "--export-cuesheet-to=-", j.sourceFile).Output()
+	if err == nil && len(bytes.TrimSpace(cuesheet)) > 0 {
+		cmd := toolCommand(ctx, metaflacPath, "--import-cuesheet-from=-", outputFile)
+		cmd.Stdin = bytes.NewReader(cuesheet)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("couldn't copy the cuesheet of %s: %s", j.sourceFile, strings.TrimSpace(string(out)))
+		}
+	}
+
+	// importing a cuesheet adds seekpoints on its own, otherwise the output gets a seektable if the source had one
+	if !hasFlacBlock(ctx, j.sourceFile, "SEEKTABLE") || hasFlacBlock(ctx, outputFile, "SEEKTABLE") {
+		return nil
+	}
+	if out, err := toolCommand(ctx, metaflacPath, "--add-seekpoint=10s", outputFile).CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't add a seektable to the output of %s: %s", j.sourceFile, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// checks whether a flac has a metadata block of a type, ie SEEKTABLE
+func hasFlacBlock(ctx context.Context, file string, blockType string) bool {
+	out, err := toolCommand(ctx, metaflacPath, "--list", "--block-type="+blockType, file).Output()
+	return err == nil && len(bytes.TrimSpace(out)) > 0
+}
@@ -0,0 +1,76 @@
+package convert
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where the tracks of zipped albums and disc images are extracted while they're converted
+func archiveExtractDir(outDir string) string {
+	return filepath.Join(outDir, toolDirName, "archives")
+}
+
+func isArchiveExtension(extension string) bool {
+	return strings.ToLower(extension) == ".zip"
+}
+
+// lists the audio files in a zip archive or disc image by their path inside it, only the central directory of zips is read
+func listArchive(archivePath string) ([]string, error) {
+	switch strings.ToLower(filepath.Ext(archivePath)) {
+	case ".iso":
+		return listISO(archivePath)
+	case ".cue":
+		return listCueSheet(archivePath)
+	}
+
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var entries []string
+	for _, file := range reader.File {
+		name := filepath.Clean(filepath.FromSlash(file.Name))
+		// entries that would escape their album folder aren't worth the risk
+		if file.FileInfo().IsDir() || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if isAudioExtension(filepath.Ext(name)) {
+			entries = append(entries, name)
+		}
+	}
+
+	return entries, nil
+}
+
+// extracts a single entry of a zip archive or disc image to target
+func extractArchiveEntry(archivePath string, entryName string, target string) error {
+	switch strings.ToLower(filepath.Ext(archivePath)) {
+	case ".iso":
+		return extractISOEntry(archivePath, entryName, target)
+	case ".cue":
+		return extractCueTrack(archivePath, entryName, target)
+	}
+
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		if filepath.Clean(filepath.FromSlash(file.Name)) != entryName {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		return extractZipFile(file, target)
+	}
+
+	return fmt.Errorf("%s is no longer in %s", entryName, archivePath)
+}
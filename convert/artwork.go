@@ -0,0 +1,127 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the cover images albums usually come with, in the order they're preferred for an album's folder.jpg
+var coverArtNames = []string{"folder.jpg", "cover.jpg", "front.jpg", "folder.jpeg", "cover.jpeg", "front.jpeg"}
+
+// the name players without embedded art support look for, and the one art extracted for them from the tracks is written to
+const (
+	folderArtName    = "folder.jpg"
+	extractedArtName = "cover.jpg"
+)
+
+// album folders whose art has been written or found to be impossible this run, so the rest of their tracks
+// don't each go looking for it
+var folderArt = struct {
+	sync.Mutex
+	done map[string]bool
+}{done: make(map[string]bool)}
+
+// returns a copy of the format that leaves out cover art, for containers that can't hold it
+// and players that slow to a crawl with it
+func withoutArt(format audioFormat) audioFormat {
+	var arguments []string
+	for i := 0; i < len(format.ffmpegArguments); i++ {
+		switch format.ffmpegArguments[i] {
+		case "-c:v":
+			i++
+			continue
+		case "-vn":
+			continue
+		}
+		arguments = append(arguments, format.ffmpegArguments[i])
+	}
+	format.ffmpegArguments = append(arguments, "-vn")
+	return format
+}
+
+// drops the embedded art of a copied output, keeping its audio and tags as they are
+func stripArtwork(ctx context.Context, file string) error {
+	stripped := strings.TrimSuffix(file, filepath.Ext(file)) + "-stripped" + filepath.Ext(file)
+	defer os.Remove(stripped)
+
+	out, err := toolCommand(ctx, ffmpegPath, "-loglevel", "error", "-y", "-i", longPath(file), "-map", "0:a", "-map_metadata", "0", "-c", "copy", "-id3v2_version", "3", longPath(stripped)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("couldn't strip the art of %s: %s", file, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(stripped, file)
+}
+
+// leaves a cover image in the album folder of a job, once per album. with its art stripped that's a single folder.jpg,
+// the album's own cover image when the source folder has one and the art of the track otherwise. with -extract-art
+// it's the art of the album's first finished track in cover.jpg, unless the folder already has a cover.
+// albums without any art are left alone. the art is written into artDir, the album's folder in the destination unless
+// the album is staged to be placed as a whole
+func writeFolderArt(ctx context.Context, j job, stagingDir string, artDir string) error {
+	dir := filepath.Dir(j.destinationFile)
+	folderArt.Lock()
+	if folderArt.done[dir] {
+		folderArt.Unlock()
+		return nil
+	}
+	folderArt.done[dir] = true
+	folderArt.Unlock()
+
+	destination := filepath.Join(artDir, folderArtName)
+	existing := []string{folderArtName}
+	if !j.options.stripArt {
+		destination, existing = filepath.Join(artDir, extractedArtName), coverArtNames
+	}
+	// the album's folder in the destination is what players see, whatever is staged
+	for _, name := range existing {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return nil
+		}
+	}
+	if err := checkWritable(destination); err != nil {
+		return err
+	}
+
+	if j.options.stripArt {
+		if copied, err := copyCoverArt(filepath.Dir(j.sourceFile), destination, j.options.stallTimeout); copied || err != nil {
+			return err
+		}
+	}
+
+	// pngs are converted, a folder.jpg has to be a jpeg for the players that read it
+	extracted := filepath.Join(stagingDir, fmt.Sprintf("art-%d.jpg", time.Now().UnixNano()))
+	defer os.Remove(extracted)
+	out, err := toolCommand(ctx, ffmpegPath, "-loglevel", "error", "-y", "-i", longPath(j.sourceFile), "-map", "0:v:0", "-frames:v", "1", "-q:v", "2", "-f", "mjpeg", longPath(extracted)).CombinedOutput()
+	if err != nil {
+		// most likely there's no art to extract
+		console.debugf("%s has no art for %s: %s\n", j.sourceFile, destination, strings.TrimSpace(string(out)))
+		return nil
+	}
+	return moveIntoPlace(extracted, destination, j.options.stallTimeout)
+}
+
+// copies the first of the usual cover images in a source folder, returning false when it has none
+func copyCoverArt(sourceDir string, destination string, stallTimeout time.Duration) (bool, error) {
+	for _, name := range coverArtNames {
+		in, err := os.Open(filepath.Join(sourceDir, name))
+		if err != nil {
+			continue
+		}
+		defer in.Close()
+		out, err := os.Create(destination)
+		if err != nil {
+			return true, err
+		}
+		if _, err = copyWithStallTimeout(out, in, stallTimeout); err != nil {
+			out.Close()
+			os.Remove(destination)
+			return true, err
+		}
+		return true, out.Close()
+	}
+	return false, nil
+}
@@ -0,0 +1,48 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// a way of running encode jobs
+type encodeBackend struct {
+	// lists the audio encoders the backend can encode with
+	encoders func() ([]string, error)
+	// encodes a single job, copy jobs never reach the backend
+	encode func(ctx context.Context, id int, j job, startTime time.Time) jobReport
+}
+
+// the available backends, keyed by the name -backend takes. builds with the libav tag add an in-process one
+var encodeBackends = map[string]encodeBackend{
+	"exec": {encoders: getFfmpegEncoders, encode: execEncode},
+}
+
+// the backend the run encodes with, and its name
+var (
+	backend         = encodeBackends["exec"]
+	selectedBackend = "exec"
+)
+
+func backendNames() []string {
+	var names []string
+	for name := range encodeBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func selectBackend(name string) error {
+	selected, ok := encodeBackends[name]
+	if !ok {
+		if name == "libav" {
+			return fmt.Errorf("this build doesn't include the libav backend, rebuild with -tags libav")
+		}
+		return fmt.Errorf("unknown backend %s, valid backends are %v", name, backendNames())
+	}
+	backend, selectedBackend = selected, name
+	return nil
+}
@@ -0,0 +1,392 @@
+//go:build libav && cgo
+// +build libav,cgo
+
+package convert
+
+/*
+#cgo pkg-config: libavformat libavcodec libavutil libswresample
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <libavformat/avformat.h>
+#include <libavcodec/avcodec.h>
+#include <libavutil/audio_fifo.h>
+#include <libavutil/opt.h>
+#include <libswresample/swresample.h>
+
+// the audio encoders linked in, one at a time so go doesn't have to deal with the iterator
+static const char *cmm_next_encoder(uintptr_t *state) {
+	void *opaque = (void *)*state;
+	const AVCodec *codec;
+	while ((codec = av_codec_iterate(&opaque))) {
+		if (av_codec_is_encoder(codec) && codec->type == AVMEDIA_TYPE_AUDIO) {
+			break;
+		}
+	}
+	*state = (uintptr_t)opaque;
+	return codec ? codec->name : NULL;
+}
+
+static int cmm_fail(char *errbuf, int errlen, const char *what, int ret) {
+	char reason[AV_ERROR_MAX_STRING_SIZE] = {0};
+	if (ret >= 0) {
+		ret = AVERROR(EINVAL);
+	}
+	av_strerror(ret, reason, sizeof(reason));
+	snprintf(errbuf, errlen, "%s: %s", what, reason);
+	return ret;
+}
+
+// sends a frame, or NULL to flush, and writes out every packet the encoder has ready
+static int cmm_write_frame(AVCodecContext *enc, AVFormatContext *out, AVStream *stream, AVFrame *frame) {
+	int ret = avcodec_send_frame(enc, frame);
+	if (ret < 0) {
+		return ret;
+	}
+
+	AVPacket *pkt = av_packet_alloc();
+	if (!pkt) {
+		return AVERROR(ENOMEM);
+	}
+	while ((ret = avcodec_receive_packet(enc, pkt)) >= 0) {
+		av_packet_rescale_ts(pkt, enc->time_base, stream->time_base);
+		pkt->stream_index = stream->index;
+		if ((ret = av_interleaved_write_frame(out, pkt)) < 0) {
+			break;
+		}
+	}
+	av_packet_free(&pkt);
+
+	if (ret == AVERROR(EAGAIN) || ret == AVERROR_EOF) {
+		return 0;
+	}
+	return ret;
+}
+
+// resamples a decoded frame into the fifo, a NULL frame drains what the resampler buffered
+static int cmm_resample(SwrContext *swr, AVAudioFifo *fifo, AVCodecContext *enc, const AVFrame *frame) {
+	int in_samples = frame ? frame->nb_samples : 0;
+	int max = swr_get_out_samples(swr, in_samples);
+	if (max <= 0) {
+		return max;
+	}
+
+	uint8_t **samples = NULL;
+	int ret = av_samples_alloc_array_and_samples(&samples, NULL, enc->ch_layout.nb_channels, max, enc->sample_fmt, 0);
+	if (ret < 0) {
+		return ret;
+	}
+
+	ret = swr_convert(swr, samples, max, frame ? (const uint8_t **)frame->extended_data : NULL, in_samples);
+	if (ret > 0) {
+		ret = av_audio_fifo_write(fifo, (void **)samples, ret);
+	}
+
+	av_freep(&samples[0]);
+	av_freep(&samples);
+	return ret < 0 ? ret : 0;
+}
+
+// encodes the fifo in frame sized chunks, when flushing the short remainder goes out as well
+static int cmm_encode_fifo(AVAudioFifo *fifo, AVCodecContext *enc, AVFormatContext *out, AVStream *stream, int64_t *pts, int flush) {
+	// pcm and other variable frame size encoders take anything
+	int frame_size = enc->frame_size > 0 ? enc->frame_size : 4096;
+
+	while (av_audio_fifo_size(fifo) >= frame_size || (flush && av_audio_fifo_size(fifo) > 0)) {
+		int n = FFMIN(av_audio_fifo_size(fifo), frame_size);
+
+		AVFrame *frame = av_frame_alloc();
+		if (!frame) {
+			return AVERROR(ENOMEM);
+		}
+		frame->nb_samples = n;
+		frame->format = enc->sample_fmt;
+		frame->sample_rate = enc->sample_rate;
+		av_channel_layout_copy(&frame->ch_layout, &enc->ch_layout);
+
+		int ret = av_frame_get_buffer(frame, 0);
+		if (ret >= 0 && av_audio_fifo_read(fifo, (void **)frame->data, n) < n) {
+			ret = AVERROR(EIO);
+		}
+		if (ret >= 0) {
+			frame->pts = *pts;
+			*pts += n;
+			ret = cmm_write_frame(enc, out, stream, frame);
+		}
+		av_frame_free(&frame);
+		if (ret < 0) {
+			return ret;
+		}
+	}
+
+	return 0;
+}
+
+// picks the supported rate closest above the source's, falling back to the highest one
+static int cmm_sample_rate(const AVCodec *encoder, int source) {
+	if (!encoder->supported_samplerates) {
+		return source;
+	}
+
+	int best = 0, highest = 0;
+	for (const int *rate = encoder->supported_samplerates; *rate; rate++) {
+		if (*rate >= source && (best == 0 || *rate < best)) {
+			best = *rate;
+		}
+		if (*rate > highest) {
+			highest = *rate;
+		}
+	}
+	return best ? best : highest;
+}
+
+// keeps the source's sample format when the encoder takes it, so lossless targets keep their bit depth
+static enum AVSampleFormat cmm_sample_format(const AVCodec *encoder, enum AVSampleFormat source) {
+	if (!encoder->sample_fmts) {
+		return source;
+	}
+
+	for (const enum AVSampleFormat *format = encoder->sample_fmts; *format != AV_SAMPLE_FMT_NONE; format++) {
+		if (*format == source) {
+			return source;
+		}
+	}
+	return encoder->sample_fmts[0];
+}
+
+// decodes the first audio stream of input and encodes it to output, carrying the tags over.
+// empty muxer, encoder and profile strings leave the choice to libav
+static int cmm_transcode(const char *input, const char *output, const char *muxer, const char *encoder_name, int64_t bitrate, const char *profile, char *errbuf, int errlen) {
+	AVFormatContext *in = NULL, *out = NULL;
+	AVCodecContext *dec = NULL, *enc = NULL;
+	SwrContext *swr = NULL;
+	AVAudioFifo *fifo = NULL;
+	AVPacket *pkt = NULL;
+	AVFrame *frame = NULL;
+	AVStream *stream = NULL;
+	const AVCodec *decoder = NULL, *encoder = NULL;
+	int64_t pts = 0;
+	int ret, index;
+
+	if ((ret = avformat_open_input(&in, input, NULL, NULL)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "opening the source", ret);
+		goto end;
+	}
+	if ((ret = avformat_find_stream_info(in, NULL)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "reading the source's streams", ret);
+		goto end;
+	}
+	if ((index = av_find_best_stream(in, AVMEDIA_TYPE_AUDIO, -1, -1, &decoder, 0)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "finding an audio stream", index);
+		goto end;
+	}
+
+	dec = avcodec_alloc_context3(decoder);
+	if (!dec) {
+		ret = cmm_fail(errbuf, errlen, "allocating the decoder", AVERROR(ENOMEM));
+		goto end;
+	}
+	avcodec_parameters_to_context(dec, in->streams[index]->codecpar);
+	dec->pkt_timebase = in->streams[index]->time_base;
+	if ((ret = avcodec_open2(dec, decoder, NULL)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "opening the decoder", ret);
+		goto end;
+	}
+
+	if ((ret = avformat_alloc_output_context2(&out, NULL, muxer[0] ? muxer : NULL, output)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "setting up the output container", ret);
+		goto end;
+	}
+	if (encoder_name[0]) {
+		encoder = avcodec_find_encoder_by_name(encoder_name);
+	} else {
+		encoder = avcodec_find_encoder(av_guess_codec(out->oformat, NULL, output, NULL, AVMEDIA_TYPE_AUDIO));
+	}
+	if (!encoder) {
+		ret = cmm_fail(errbuf, errlen, "finding the encoder", AVERROR_ENCODER_NOT_FOUND);
+		goto end;
+	}
+
+	enc = avcodec_alloc_context3(encoder);
+	stream = avformat_new_stream(out, NULL);
+	if (!enc || !stream) {
+		ret = cmm_fail(errbuf, errlen, "allocating the encoder", AVERROR(ENOMEM));
+		goto end;
+	}
+	av_channel_layout_copy(&enc->ch_layout, &dec->ch_layout);
+	enc->sample_rate = cmm_sample_rate(encoder, dec->sample_rate);
+	enc->sample_fmt = cmm_sample_format(encoder, dec->sample_fmt);
+	enc->time_base = (AVRational){1, enc->sample_rate};
+	if (bitrate > 0) {
+		enc->bit_rate = bitrate;
+	}
+	if (profile[0] && (ret = av_opt_set(enc, "profile", profile, AV_OPT_SEARCH_CHILDREN)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "setting the encoder profile", ret);
+		goto end;
+	}
+	if (out->oformat->flags & AVFMT_GLOBALHEADER) {
+		enc->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+	}
+	if ((ret = avcodec_open2(enc, encoder, NULL)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "opening the encoder", ret);
+		goto end;
+	}
+	avcodec_parameters_from_context(stream->codecpar, enc);
+	stream->time_base = enc->time_base;
+
+	// tags live on the container for most sources, on the stream for ogg
+	av_dict_copy(&out->metadata, in->metadata, 0);
+	av_dict_copy(&stream->metadata, in->streams[index]->metadata, 0);
+
+	if (!(out->oformat->flags & AVFMT_NOFILE) && (ret = avio_open(&out->pb, output, AVIO_FLAG_WRITE)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "opening the output", ret);
+		goto end;
+	}
+	if ((ret = avformat_write_header(out, NULL)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "writing the output header", ret);
+		goto end;
+	}
+
+	if ((ret = swr_alloc_set_opts2(&swr, &enc->ch_layout, enc->sample_fmt, enc->sample_rate, &dec->ch_layout, dec->sample_fmt, dec->sample_rate, 0, NULL)) < 0 || (ret = swr_init(swr)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "setting up the resampler", ret);
+		goto end;
+	}
+	fifo = av_audio_fifo_alloc(enc->sample_fmt, enc->ch_layout.nb_channels, 1);
+	pkt = av_packet_alloc();
+	frame = av_frame_alloc();
+	if (!fifo || !pkt || !frame) {
+		ret = cmm_fail(errbuf, errlen, "allocating buffers", AVERROR(ENOMEM));
+		goto end;
+	}
+
+	// a NULL packet once the source runs out flushes the decoder through the same loop
+	int eof = 0;
+	while (!eof) {
+		if ((ret = av_read_frame(in, pkt)) < 0) {
+			eof = 1;
+		} else if (pkt->stream_index != index) {
+			av_packet_unref(pkt);
+			continue;
+		}
+
+		ret = avcodec_send_packet(dec, eof ? NULL : pkt);
+		av_packet_unref(pkt);
+		if (ret < 0 && ret != AVERROR_EOF) {
+			ret = cmm_fail(errbuf, errlen, "decoding", ret);
+			goto end;
+		}
+
+		while ((ret = avcodec_receive_frame(dec, frame)) >= 0) {
+			ret = cmm_resample(swr, fifo, enc, frame);
+			av_frame_unref(frame);
+			if (ret < 0 || (ret = cmm_encode_fifo(fifo, enc, out, stream, &pts, 0)) < 0) {
+				ret = cmm_fail(errbuf, errlen, "encoding", ret);
+				goto end;
+			}
+		}
+		if (ret != AVERROR(EAGAIN) && ret != AVERROR_EOF) {
+			ret = cmm_fail(errbuf, errlen, "decoding", ret);
+			goto end;
+		}
+	}
+
+	if ((ret = cmm_resample(swr, fifo, enc, NULL)) < 0 ||
+	    (ret = cmm_encode_fifo(fifo, enc, out, stream, &pts, 1)) < 0 ||
+	    (ret = cmm_write_frame(enc, out, stream, NULL)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "flushing the encoder", ret);
+		goto end;
+	}
+	if ((ret = av_write_trailer(out)) < 0) {
+		ret = cmm_fail(errbuf, errlen, "finishing the output", ret);
+		goto end;
+	}
+	ret = 0;
+
+end:
+	av_frame_free(&frame);
+	av_packet_free(&pkt);
+	if (fifo) {
+		av_audio_fifo_free(fifo);
+	}
+	swr_free(&swr);
+	avcodec_free_context(&enc);
+	avcodec_free_context(&dec);
+	if (out && !(out->oformat->flags & AVFMT_NOFILE)) {
+		avio_closep(&out->pb);
+	}
+	avformat_free_context(out);
+	avformat_close_input(&in);
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// room for the error message cmm_transcode writes
+const libavErrorSize = 512
+
+func init() {
+	encodeBackends["libav"] = encodeBackend{encoders: getLibavEncoders, encode: libavEncode}
+}
+
+// the audio encoders libav was built with, no ffmpeg executable needed
+func getLibavEncoders() ([]string, error) {
+	var encoders []string
+	var state C.uintptr_t
+
+	for {
+		name := C.cmm_next_encoder(&state)
+		if name == nil {
+			break
+		}
+		encoders = append(encoders, C.GoString(name))
+	}
+
+	return encoders, nil
+}
+
+// encodes a job in-process with libavcodec, saving the cost of starting ffmpeg for every file.
+// only the audio stream is written, cover art is left behind
+func libavEncode(ctx context.Context, id int, j job, startTime time.Time) jobReport {
+	// the transcode can't be interrupted once it's started, a cancelled run just doesn't start it
+	if err := ctx.Err(); err != nil {
+		return jobReport{workerId: id, error: err, job: j}
+	}
+
+	// the profile is the only codec option a format passes to ffmpeg
+	profile := formatProfile(j.format)
+
+	input := C.CString(j.sourceFile)
+	defer C.free(unsafe.Pointer(input))
+	output := C.CString(j.destinationFile)
+	defer C.free(unsafe.Pointer(output))
+	muxer := C.CString(j.format.muxer)
+	defer C.free(unsafe.Pointer(muxer))
+	encoder := C.CString(j.options.encoder)
+	defer C.free(unsafe.Pointer(encoder))
+	cProfile := C.CString(profile)
+	defer C.free(unsafe.Pointer(cProfile))
+	errbuf := (*C.char)(C.calloc(libavErrorSize, 1))
+	defer C.free(unsafe.Pointer(errbuf))
+
+	var bitrate int64
+	if j.format.isLossy {
+		bitrate = int64(j.options.bitrate) * 1000
+	}
+
+	ret := C.cmm_transcode(input, output, muxer, encoder, C.int64_t(bitrate), cProfile, errbuf, libavErrorSize)
+	elaspedTime := time.Since(startTime)
+
+	var err error
+	if ret < 0 {
+		err = fmt.Errorf("worker %d's execution failed: %w", id, &encoderError{encoder: "libav", exitCode: int(ret), stderr: []string{C.GoString(errbuf)}})
+	}
+
+	return jobReport{exitCode: int(ret), workerId: id, error: err, elaspedTime: elaspedTime, job: j}
+}
@@ -0,0 +1,173 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// groups the plan into batches of up to size encode jobs, each run by a single ffmpeg.
+// copy jobs don't start ffmpeg at all, so each one is a batch of its own
+func groupJobsInBatches(jobs []job, size int) [][]job {
+	var batches [][]job
+	var current []job
+
+	for _, j := range jobs {
+		if !j.encode {
+			batches = append(batches, []job{j})
+			continue
+		}
+		current = append(current, j)
+		if len(current) >= size {
+			batches = append(batches, current)
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
+// like worker, but takes whole batches at a time
+func batchWorker(ctx context.Context, id int, batches <-chan []job, results chan<- jobReport, workDir string) {
+	for batch := range batches {
+		for _, report := range processBatch(ctx, id, batch, workDir) {
+			results <- report
+		}
+	}
+}
+
+// runs a batch with one ffmpeg invocation. if it fails there's no telling which input was at fault,
+// so the batch is thrown away and its jobs are run one at a time to get a report of their own
+func processBatch(ctx context.Context, id int, batch []job, workDir string) []jobReport {
+	reports := make([]jobReport, 0, len(batch))
+
+	// simulated jobs are only pretend, there's nothing to batch
+	if simulateRate > 0 {
+		for _, j := range batch {
+			reports = append(reports, processJob(ctx, id, j, workDir))
+		}
+		return reports
+	}
+
+	// deferred jobs, copies, retags, zipped tracks and lone encodes gain nothing from batching
+	var encodes []job
+	for _, j := range batch {
+		// and neither do encodes the cache already has
+		if j.options.cacheDir != "" && !j.deferred && j.encode && !j.retag && j.archive == "" {
+			j = addJobMetadata(j)
+			if key, err := encodeCacheKey(j); err == nil {
+				j.cacheKey = key
+			}
+		}
+		if j.deferred || !j.encode || j.retag || j.archive != "" || j.options.verifyRips || drmExtensions[strings.ToLower(filepath.Ext(j.sourceFile))] || isCachedEncode(j) {
+			reports = append(reports, processJob(ctx, id, j, workDir))
+		} else {
+			encodes = append(encodes, j)
+		}
+	}
+	if len(encodes) < 2 || ctx.Err() != nil {
+		for _, j := range encodes {
+			reports = append(reports, processJob(ctx, id, j, workDir))
+		}
+		return reports
+	}
+
+	startTime := time.Now()
+
+	if err := os.MkdirAll(workDir, os.ModePerm); err != nil {
+		for _, j := range encodes {
+			reports = append(reports, jobReport{workerId: id, error: err, job: j})
+		}
+		return reports
+	}
+
+	// kept in the batch, so jobs run one by one after all and their reports don't probe them again
+	for i := range encodes {
+		encodes[i] = addJobMetadata(encodes[i])
+	}
+	args := []string{"-loglevel", "error", "-y"}
+	for _, j := range encodes {
+		args = append(args, buildFfmpegInputArgs(j, j.options)...)
+	}
+	stagedFiles := make([]string, len(encodes))
+	for i, j := range encodes {
+		stagedFiles[i] = filepath.Join(workDir, fmt.Sprintf("job-%d-%d-%d%s", id, startTime.UnixNano(), i, filepath.Ext(j.destinationFile)))
+		defer os.Remove(stagedFiles[i])
+
+		staged := j
+		staged.destinationFile = stagedFiles[i]
+		// ffmpeg's automatic stream selection looks across every input, so each output maps its own
+		args = append(args, "-map", fmt.Sprintf("%d:a:0", i))
+		// mapping art to a container that can't hold it, ie ogg or opus, fails the whole batch
+		if outputContainers[strings.ToLower(filepath.Ext(j.destinationFile))].supportsArt && !containsArg(j.format.ffmpegArguments, "-vn") {
+			args = append(args, "-map", fmt.Sprintf("%d:v:0?", i))
+		}
+		args = append(args, buildFfmpegOutputArgs(j.format, staged, j.options, i)...)
+	}
+
+	for _, j := range encodes {
+		console.jobEvent("started", j)
+	}
+	console.debugf("worker %d running %s\n", id, commandLine(ffmpegPath, args))
+	out, err := toolCommand(ctx, ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		// one by one they'd only fill the destination up again
+		batchErr := &encoderError{encoder: "ffmpeg", exitCode: exitCodeOf(err), stderr: captureStderr(bytes.NewReader(out))}
+		if errors.Is(batchErr, errDestinationFull) {
+			for _, j := range encodes {
+				reports = append(reports, jobReport{workerId: id, error: fmt.Errorf("worker %d's batch failed: %w", id, batchErr), job: j})
+			}
+			return reports
+		}
+		console.debugf("worker %d's batch of %d failed, retrying its jobs one by one: %s\n", id, len(encodes), strings.TrimSpace(string(out)))
+		for _, j := range encodes {
+			reports = append(reports, processJob(ctx, id, j, workDir))
+		}
+		return reports
+	}
+
+	// there's no per file timing within a batch, share it out evenly
+	elaspedTime := time.Since(startTime) / time.Duration(len(encodes))
+	for i, j := range encodes {
+		report := jobReport{workerId: id, elaspedTime: elaspedTime, job: j}
+		report.error = carryFlacBlocks(ctx, j, stagedFiles[i])
+		if report.error == nil && needsBitPerfectCheck(j) {
+			report.pcmHash, report.error = verifyBitPerfect(ctx, j.sourceFile, stagedFiles[i])
+		}
+		if report.error == nil && j.cacheKey != "" {
+			storeCachedEncode(j, stagedFiles[i])
+		}
+		if report.error == nil {
+			report.error = placeOutput(stagedFiles[i], j.destinationFile, j.options.stallTimeout)
+		}
+		if report.error == nil && j.options.lyricsSidecars == "copy" {
+			report.error = copyLyricsSidecar(j, j.destinationFile)
+		}
+		if report.error == nil && (j.options.stripArt || j.options.extractArt) {
+			report.error = writeFolderArt(ctx, j, workDir, filepath.Dir(j.destinationFile))
+		}
+		if report.error == nil {
+			report.fingerprint = fingerprintSource(j)
+		}
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+func containsArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
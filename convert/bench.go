@@ -0,0 +1,327 @@
+package convert
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a single encoder/bitrate combination being benchmarked
+type benchSetting struct {
+	encoder string
+	bitrate int
+}
+
+type benchResult struct {
+	setting benchSetting
+	// total wall time spent encoding the sample
+	elaspedTime time.Duration
+	// total size of the encoded sample in bytes
+	outputSize int64
+	// average signal to distortion ratio across the sample, if measured
+	sdr float64
+	// number of sample files that failed to encode
+	failures int
+}
+
+// matches the per channel output of ffmpeg's asdr filter, ie "SDR ch0: 24.51 dB"
+var sdrPattern = regexp.MustCompile(`SDR ch\d+: (-?[0-9.]+|inf) dB`)
+
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	formatName := flags.String("format", "aac", "the format to benchmark")
+	encoderList := flags.String("encoders", "", "comma separated list of encoders to compare (defaults to every available encoder for the format)")
+	bitrateList := flags.String("bitrates", "", "comma separated list of bitrates in kilobits to compare (defaults to the format's preferred bitrate)")
+	sampleCount := flags.Int("samples", 5, "the number of source files to encode with each setting")
+	measureQuality := flags.Bool("quality", false, "also measure signal to distortion against the source (slow, ffmpeg 6.1+)")
+	jsonOutput := flags.Bool("json", false, "print the results as a json event, and every other line as one too")
+	flags.Parse(args)
+	console.json = *jsonOutput
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		exit(2)
+	}
+
+	format, err := getAudioFormatFromName(*formatName)
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	available, err := getFfmpegEncoders()
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	var encoders []string
+	if *encoderList != "" {
+		encoders = splitList(*encoderList)
+	} else {
+		for _, encoder := range format.encoders {
+			if isEncoderAvailable(available, encoder) {
+				encoders = append(encoders, encoder)
+			}
+		}
+	}
+	// lossless formats have no encoder preference, use ffmpeg's default
+	if len(encoders) == 0 && format.encoders == nil {
+		encoders = []string{""}
+	}
+	for _, encoder := range encoders {
+		if encoder != "" && !isEncoderAvailable(available, encoder) {
+			console.printf("encoder %s isn't available in your ffmpeg build\n", encoder)
+			exit(1)
+		}
+	}
+	if len(encoders) == 0 {
+		console.printf("no encoders for %s are available in your ffmpeg build (%v)\n", format.name, format.encoders)
+		exit(1)
+	}
+
+	// 0 resolves to the format's preferred bitrate, the way convert's -bitrate does
+	bitrates := []int{0}
+	if *bitrateList != "" {
+		bitrates = nil
+		for _, item := range splitList(*bitrateList) {
+			bitrate, err := strconv.Atoi(strings.TrimSuffix(item, "k"))
+			if err != nil {
+				console.printf("invalid bitrate %s\n", item)
+				exit(1)
+			}
+			bitrates = append(bitrates, bitrate)
+		}
+	}
+	var settings []benchSetting
+	for _, encoder := range encoders {
+		for _, requested := range bitrates {
+			bitrate, err := resolveBitrate(*format, encoder, requested, nil)
+			if err != nil {
+				console.println(err)
+				exit(1)
+			}
+			settings = append(settings, benchSetting{encoder: encoder, bitrate: bitrate})
+		}
+	}
+
+	srcDir, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	samples, err := pickBenchSamples(srcDir, *sampleCount)
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if len(samples) == 0 {
+		console.println("no lossless source files were found to benchmark with")
+		exit(1)
+	}
+
+	// the total audio duration lets us report speed as a multiple of realtime
+	var sampleDuration time.Duration
+	for _, sample := range samples {
+		duration, err := getDuration(sample)
+		if err != nil {
+			console.printf("couldn't read the duration of %s: %s\n", sample, err)
+			continue
+		}
+		sampleDuration += duration
+	}
+
+	tempDir, err := os.MkdirTemp("", "convert-muh-music-bench")
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	defer os.RemoveAll(tempDir)
+
+	console.printf("benchmarking %d files (%s of audio) with %d settings\n", len(samples), sampleDuration.Round(time.Second), len(settings))
+
+	var results []benchResult
+	for _, setting := range settings {
+		results = append(results, benchSettingOnSamples(*format, setting, samples, tempDir, *measureQuality))
+	}
+
+	console.report("bench", benchReportData(results, sampleDuration, *measureQuality), func() {
+		header := fmt.Sprintf("%-12s %8s %10s %10s %10s", "encoder", "bitrate", "time", "speed", "size")
+		if *measureQuality {
+			header += fmt.Sprintf(" %8s", "sdr")
+		}
+		console.printf("\n%s\n", header)
+		for _, result := range results {
+			encoder := result.setting.encoder
+			if encoder == "" {
+				encoder = "default"
+			}
+			speed := "-"
+			if sampleDuration > 0 && result.elaspedTime > 0 {
+				speed = fmt.Sprintf("%.1fx", sampleDuration.Seconds()/result.elaspedTime.Seconds())
+			}
+			line := fmt.Sprintf("%-12s %7dk %10s %10s %8.1fMB", encoder, result.setting.bitrate, result.elaspedTime.Round(time.Millisecond), speed, float64(result.outputSize)/1000000)
+			if *measureQuality {
+				line += fmt.Sprintf(" %6.1fdB", result.sdr)
+			}
+			if result.failures > 0 {
+				line += fmt.Sprintf(" (%d failed)", result.failures)
+			}
+			console.printf("%s\n", line)
+		}
+	})
+}
+
+// the results as -json reports them, times in seconds and sizes in bytes. speed is a multiple of realtime, 0 when
+// the samples' duration isn't known, and sdr is left out unless it was measured
+func benchReportData(results []benchResult, sampleDuration time.Duration, measuredQuality bool) interface{} {
+	type resultData struct {
+		Encoder  string   `json:"encoder"`
+		Bitrate  int      `json:"bitrate"`
+		Elapsed  float64  `json:"elapsed"`
+		Speed    float64  `json:"speed,omitempty"`
+		Size     int64    `json:"size"`
+		SDR      *float64 `json:"sdr,omitempty"`
+		Failures int      `json:"failures"`
+	}
+	data := struct {
+		Duration float64      `json:"duration"`
+		Results  []resultData `json:"results"`
+	}{Duration: sampleDuration.Seconds()}
+
+	for _, result := range results {
+		shown := resultData{Encoder: result.setting.encoder, Bitrate: result.setting.bitrate, Elapsed: result.elaspedTime.Seconds(), Size: result.outputSize, Failures: result.failures}
+		if sampleDuration > 0 && result.elaspedTime > 0 {
+			shown.Speed = sampleDuration.Seconds() / result.elaspedTime.Seconds()
+		}
+		// json has no infinity for a lossless encode's sdr
+		if measuredQuality && !math.IsInf(result.sdr, 0) && !math.IsNaN(result.sdr) {
+			sdr := result.sdr
+			shown.SDR = &sdr
+		}
+		data.Results = append(data.Results, shown)
+	}
+	return data
+}
+
+// picks up to count lossless audio files spread evenly through the source library
+func pickBenchSamples(srcDir string, count int) ([]string, error) {
+	var candidates []string
+
+	err := filepath.WalkDir(srcDir, func(curPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		extension := filepath.Ext(entry.Name())
+		// only lossless sources are ever encoded, so they're all we care about
+		if !entry.IsDir() && isAudioExtension(extension) && !isLossyExtension(extension) {
+			candidates = append(candidates, curPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if count <= 0 || len(candidates) <= count {
+		return candidates, nil
+	}
+
+	samples := make([]string, 0, count)
+	step := float64(len(candidates)) / float64(count)
+	for i := 0; i < count; i++ {
+		samples = append(samples, candidates[int(float64(i)*step)])
+	}
+
+	return samples, nil
+}
+
+// encodes every sample with the given setting one at a time, so timings aren't skewed by other encodes
+func benchSettingOnSamples(format audioFormat, setting benchSetting, samples []string, tempDir string, measureQuality bool) benchResult {
+	result := benchResult{setting: setting}
+	var measured int
+
+	for i, sample := range samples {
+		destinationFile := filepath.Join(tempDir, fmt.Sprintf("%d-%s-%d%s", i, setting.encoder, setting.bitrate, format.fileExtension))
+		options := jobOptions{bitrate: setting.bitrate, encoder: setting.encoder}
+		benchJob := job{sourceFile: sample, destinationFile: destinationFile, encode: true, format: format, options: options}
+
+		startTime := time.Now()
+		out, err := toolCommand(context.Background(), ffmpegPath, buildFfmpegArgs(format, benchJob, options)...).CombinedOutput()
+		result.elaspedTime += time.Since(startTime)
+		if err != nil {
+			console.printf("encoding %s with %s failed: %s\n", sample, setting.encoder, strings.TrimSpace(string(out)))
+			result.failures++
+			continue
+		}
+
+		if info, err := os.Stat(destinationFile); err == nil {
+			result.outputSize += info.Size()
+		}
+
+		if measureQuality {
+			sdr, err := measureSdr(sample, destinationFile)
+			if err != nil {
+				console.printf("measuring the quality of %s failed: %s\n", destinationFile, err)
+			} else {
+				result.sdr += sdr
+				measured++
+			}
+		}
+
+		os.Remove(destinationFile)
+	}
+
+	if measured > 0 {
+		result.sdr = result.sdr / float64(measured)
+	}
+
+	return result
+}
+
+// measures the signal to distortion ratio of an encode against its source, averaged across channels.
+// encoder delay is not compensated for, so the numbers are only meaningful relative to each other
+func measureSdr(sourceFile string, encodedFile string) (float64, error) {
+	cmd := toolCommand(context.Background(), ffmpegPath, "-hide_banner", "-i", longPath(sourceFile), "-i", longPath(encodedFile), "-filter_complex", "[0:a][1:a]asdr", "-f", "null", "-")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("ffmpeg: %s", strings.TrimSpace(string(out)))
+	}
+
+	var total float64
+	var channels int
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		match := sdrPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		// identical signals report inf, which isn't useful for averaging
+		value, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			continue
+		}
+		total += value
+		channels++
+	}
+
+	if channels == 0 {
+		return 0, fmt.Errorf("no sdr measurement in ffmpeg output, is your ffmpeg older than 6.1?")
+	}
+
+	return total / float64(channels), nil
+}
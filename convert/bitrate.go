@@ -0,0 +1,198 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the bitrates an encoder takes for stereo, in kilobits. encoders missing from the table aren't checked
+type bitrateRange struct {
+	min int
+	max int
+}
+
+var encoderBitrates = map[string]bitrateRange{
+	"libmp3lame": {min: 8, max: 320},
+	"libshine":   {min: 32, max: 320},
+	"libfdk_aac": {min: 8, max: 576},
+	"aac":        {min: 8, max: 512},
+	"libvorbis":  {min: 45, max: 500},
+	"libopus":    {min: 6, max: 510},
+}
+
+// narrower ranges for encoder profiles, keyed by encoder and profile. spectral band replication only works at low bitrates
+var profileBitrates = map[string]bitrateRange{
+	"libfdk_aac aac_he": {min: 16, max: 128},
+}
+
+// the channel counts of the layouts ffmpeg lists for encoders, layouts missing here are ignored
+var layoutChannels = map[string]int{
+	"mono":   1,
+	"stereo": 2,
+	"2.1":    3,
+	"3.0":    3,
+	"quad":   4,
+	"4.0":    4,
+	"4.1":    5,
+	"5.0":    5,
+	"5.1":    6,
+	"6.0":    6,
+	"6.1":    7,
+	"7.0":    7,
+	"7.1":    8,
+}
+
+// reads the [bitrate] table, the default bitrate of each format in place of its preferred one, ie
+//
+//	[bitrate]
+//	aac = 192
+//	opus = 96
+func readBitrates(root configTable) (map[string]int, error) {
+	table, ok := root["bitrate"].(configTable)
+	if !ok {
+		if root["bitrate"] != nil {
+			return nil, fmt.Errorf("bitrate has to be a table")
+		}
+		return nil, nil
+	}
+
+	var names []string
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bitrates := make(map[string]int)
+	for _, name := range names {
+		format, err := getAudioFormatFromName(name)
+		if err != nil {
+			return nil, fmt.Errorf("bitrate: %s", err)
+		}
+		if !format.isLossy {
+			return nil, fmt.Errorf("bitrate: %s is lossless, it has no bitrate", format.name)
+		}
+		value, ok := table[name].(int64)
+		if !ok || value <= 0 {
+			return nil, fmt.Errorf("bitrate: %s should be a number of kilobits, ie 192", name)
+		}
+		bitrates[format.name] = int(value)
+	}
+	return bitrates, nil
+}
+
+// works out the bitrate to encode at: -bitrate, from the command line or a profile, wins over the config's [bitrate] table,
+// which wins over the format's preferred bitrate. the result is checked against what the encoder takes
+func resolveBitrate(format audioFormat, encoder string, requested int, configured map[string]int) (int, error) {
+	if requested < 0 {
+		return 0, fmt.Errorf("-bitrate can't be negative")
+	}
+	if !format.isLossy {
+		if requested != 0 {
+			return 0, fmt.Errorf("%s is lossless, it has no bitrate to set", format.name)
+		}
+		return 0, nil
+	}
+
+	bitrate := format.preferredBitrate
+	if value, ok := configured[format.name]; ok {
+		bitrate = value
+	}
+	if requested != 0 {
+		bitrate = requested
+	}
+
+	if limits, ok := encoderBitrates[encoder]; ok && (bitrate < limits.min || bitrate > limits.max) {
+		return 0, fmt.Errorf("%s takes bitrates from %dk to %dk, %dk is out of range", encoder, limits.min, limits.max, bitrate)
+	}
+	if profile := formatProfile(format); profile != "" {
+		if limits, ok := profileBitrates[encoder+" "+profile]; ok && (bitrate < limits.min || bitrate > limits.max) {
+			return 0, fmt.Errorf("%s takes bitrates from %dk to %dk for %s, %dk is out of range", encoder, limits.min, limits.max, format.name, bitrate)
+		}
+	}
+	return bitrate, nil
+}
+
+// the encoder profile a format asks for, ie aac_he, empty if it leaves it to the encoder
+func formatProfile(format audioFormat) string {
+	for i, arg := range format.ffmpegArguments {
+		if arg == "-profile:a" && i+1 < len(format.ffmpegArguments) {
+			return format.ffmpegArguments[i+1]
+		}
+	}
+	return ""
+}
+
+// what ffmpeg says an encoder takes, nil when it doesn't say, which means anything goes
+type encoderCapabilities struct {
+	sampleRates []int
+	channels    []int
+}
+
+func getEncoderCapabilities(encoder string) (encoderCapabilities, error) {
+	var capabilities encoderCapabilities
+	out, err := toolCommand(context.Background(), ffmpegPath, "-hide_banner", "-h", "encoder="+encoder).Output()
+	if err != nil {
+		return capabilities, err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "Supported sample rates":
+			for _, field := range strings.Fields(parts[1]) {
+				if rate, err := strconv.Atoi(field); err == nil {
+					capabilities.sampleRates = append(capabilities.sampleRates, rate)
+				}
+			}
+		case "Supported channel layouts":
+			for _, field := range strings.Fields(parts[1]) {
+				if count, ok := layoutChannels[field]; ok && !containsInt(capabilities.channels, count) {
+					capabilities.channels = append(capabilities.channels, count)
+				}
+			}
+		}
+	}
+	return capabilities, nil
+}
+
+// checks the sample rate and channel count asked for are ones the encoder can write, before any job is queued
+func checkEncoderSettings(encoder string, options jobOptions) error {
+	if encoder == "" || (options.sampleRate == 0 && options.channels == 0) {
+		return nil
+	}
+
+	capabilities, err := getEncoderCapabilities(encoder)
+	if err != nil {
+		return fmt.Errorf("couldn't ask ffmpeg what %s supports: %s", encoder, err)
+	}
+	if options.sampleRate != 0 && capabilities.sampleRates != nil && !containsInt(capabilities.sampleRates, options.sampleRate) {
+		return fmt.Errorf("%s can't encode at %dHz, it takes %s", encoder, options.sampleRate, joinInts(capabilities.sampleRates))
+	}
+	if options.channels != 0 && capabilities.channels != nil && !containsInt(capabilities.channels, options.channels) {
+		return fmt.Errorf("%s can't encode %d channels, it takes %s", encoder, options.channels, joinInts(capabilities.channels))
+	}
+	return nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(values []int) string {
+	var texts []string
+	for _, value := range values {
+		texts = append(texts, strconv.Itoa(value))
+	}
+	return strings.Join(texts, ", ")
+}
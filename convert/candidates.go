@@ -0,0 +1,75 @@
+package convert
+
+import (
+	"os"
+	"time"
+)
+
+// leaves sources out of the plan by their size or length, ie 2 second sound effects, empty files from a failed
+// download or 6 hour livestream rips. zero values don't filter
+type candidateFilter struct {
+	minSize     int64
+	minDuration time.Duration
+	maxDuration time.Duration
+}
+
+func (f candidateFilter) active() bool {
+	return f.minSize > 0 || f.needsDurations()
+}
+
+func (f candidateFilter) needsDurations() bool {
+	return f.minDuration > 0 || f.maxDuration > 0
+}
+
+// drops the jobs whose sources the filter leaves out, along with their disc tracks, whose indexes are moved to match.
+// zipped tracks aren't extracted yet and sidecars aren't audio, they're kept
+func filterCandidates(jobs []job, discTracks []discTrack, filter candidateFilter) ([]job, []discTrack) {
+	newIndex := make([]int, len(jobs))
+	var kept []job
+	for i, j := range jobs {
+		newIndex[i] = -1
+		if j.archive == "" && !j.sidecar && !filter.takes(j.sourceFile) {
+			continue
+		}
+		newIndex[i] = len(kept)
+		kept = append(kept, j)
+	}
+
+	var keptTracks []discTrack
+	for _, track := range discTracks {
+		if newIndex[track.index] >= 0 {
+			track.index = newIndex[track.index]
+			keptTracks = append(keptTracks, track)
+		}
+	}
+	return kept, keptTracks
+}
+
+func (f candidateFilter) takes(sourceFile string) bool {
+	if f.minSize > 0 {
+		info, err := os.Stat(sourceFile)
+		if err == nil && info.Size() < f.minSize {
+			console.debugf("skipping %s, it's only %s\n", sourceFile, formatSize(info.Size()))
+			return false
+		}
+	}
+
+	if !f.needsDurations() {
+		return true
+	}
+	probe, err := probeSource(sourceFile)
+	if err != nil {
+		// an unreadable file fails its job with an error worth seeing, rather than going missing silently
+		console.debugf("couldn't read the length of %s: %s\n", sourceFile, err)
+		return true
+	}
+	if f.minDuration > 0 && probe.duration < f.minDuration {
+		console.debugf("skipping %s, it only runs %s\n", sourceFile, probe.duration.Round(time.Second))
+		return false
+	}
+	if f.maxDuration > 0 && probe.duration > f.maxDuration {
+		console.debugf("skipping %s, it runs %s\n", sourceFile, probe.duration.Round(time.Second))
+		return false
+	}
+	return true
+}
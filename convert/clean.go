@@ -0,0 +1,338 @@
+package convert
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type cleanupItem struct {
+	// the file or directory to remove
+	path string
+	// why it's being removed
+	reason string
+	// leftovers of our own, which are deleted rather than trashed
+	partial bool
+}
+
+func runClean(args []string) {
+	flags := flag.NewFlagSet("clean", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	libraryFlags := addLibraryFlags(flags)
+	dryRun := flags.Bool("dry-run", false, "only print what would be removed")
+	useTrash := flags.Bool("trash", true, "move removed outputs into the destination's trash instead of deleting them, so they can be put back")
+	jsonOutput := flags.Bool("json", false, "print every removal as a json event")
+	trashDays := flags.Int("trash-days", 30, "empty trash left by cleans older than this many days (0 to keep it forever)")
+	allEmptyDirs := flags.Bool("all-empty-dirs", false, "also remove directories that were already empty, not only the ones emptied by removing outputs. they may not be the tool's")
+	flags.Parse(args)
+	// set before the config is loaded so its warnings come out as events, and again after in case a profile sets it
+	console.json = *jsonOutput
+
+	cfg, err := libraryFlags.loadConfig(flags)
+	if err != nil {
+		console.println("couldn't load the config:", err)
+		exit(1)
+	}
+	console.json = *jsonOutput
+	loadProbeCache()
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		exit(2)
+	}
+
+	srcDir, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = selectDestination(flags.Arg(1)); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	destDir, err := filepath.Abs(destinationPath(flags.Arg(1)))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = checkLibraryPaths(srcDir, destDir); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if !*dryRun {
+		if err = checkDestinationWritable(destDir); err != nil {
+			console.println(err)
+			exit(1)
+		}
+	}
+
+	format, err := libraryFlags.format()
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	plan, err := libraryFlags.planOptions()
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	// outputs the rules give other formats are as wanted as the rest
+	// art makes no difference to where outputs go
+	if err = overrideRuleFormats(cfg.rules, *libraryFlags.extension, false); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	plan.rules = cfg.rules
+
+	state, err := loadState(destDir)
+	if err != nil {
+		console.println("couldn't load the library's state:", err)
+		exit(1)
+	}
+	// albums the latest run left out of its sample don't belong in the destination
+	plan.sample = state.Sample
+
+	// every output the source library maps to, anything else in the destination is fair game
+	// interrupted while planning, nothing has been removed yet
+	ctx, stop := interruptContext()
+	defer stop()
+	planned, err := planJobs(ctx, srcDir, destDir, *format, jobOptions{}, plan)
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = saveProbeCache(); err != nil {
+		console.println("couldn't save the probe cache:", err)
+	}
+	expected := make(map[string]bool, len(planned))
+	for _, j := range planned {
+		expected[j.destinationFile] = true
+	}
+	// outputs of sources removed after being verified aren't orphans, they're what replaced them
+	for _, entry := range state.Completed {
+		if entry.SourceDeleted {
+			expected[entry.Destination] = true
+		}
+	}
+
+	items, err := findCleanupItems(destDir, expected, *format)
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if pid, ok := activeRun(destDir); ok {
+		console.printf("a run (pid %d) is writing to the destination, the outputs it's working on are left alone\n", pid)
+	}
+
+	if *trashDays > 0 && !*dryRun {
+		expired, err := expireTrash(destDir, time.Duration(*trashDays)*24*time.Hour)
+		if err != nil {
+			console.println("couldn't empty the trash:", err)
+		}
+		for _, path := range expired {
+			printCleanup("emptied", path, fmt.Sprintf("older than %d days", *trashDays))
+		}
+	}
+
+	trashRun := newTrashRun(destDir)
+	removed := make(map[string]bool)
+	for _, item := range items {
+		trash := *useTrash && !item.partial
+		switch {
+		case *dryRun && trash:
+			printCleanup("would trash", item.path, item.reason)
+		case *dryRun:
+			printCleanup("would remove", item.path, item.reason)
+		case trash:
+			if err := moveToTrash(destDir, trashRun, item.path); err != nil {
+				console.println(err)
+				continue
+			}
+			printCleanup("trashed", item.path, item.reason)
+		default:
+			if err := safeRemoveAll(item.path); err != nil {
+				console.println(err)
+				continue
+			}
+			printCleanup("removed", item.path, item.reason)
+		}
+		removed[item.path] = true
+	}
+
+	directories, err := removeEmptyDirectories(destDir, removed, *allEmptyDirs, *dryRun)
+	if err != nil {
+		console.println(err)
+	}
+	for _, directory := range directories {
+		if *dryRun {
+			printCleanup("would remove", directory, "empty directory")
+		} else {
+			printCleanup("removed", directory, "empty directory")
+		}
+	}
+
+	// forget removed outputs, so the next run doesn't trust the state database about them
+	if !*dryRun && len(items) > 0 {
+		for source, entry := range state.Completed {
+			if removed[entry.Destination] {
+				delete(state.Completed, source)
+			}
+		}
+		if err = saveState(destDir, state); err != nil {
+			console.println("couldn't save the library's state:", err)
+		}
+	}
+
+	console.printf("%d files and %d empty directories cleaned\n", len(items), len(directories))
+	if _, err := destination.Stat(trashRun); err == nil {
+		console.printf("removed outputs were moved to %s, move them back to undo\n", trashRun)
+	}
+}
+
+// prints what clean did to a path and why, ie "trashed Artist/Album/01.m4a (orphaned, the source is gone)"
+func printCleanup(action string, path string, reason string) {
+	if console.json {
+		console.emit(consoleEvent{Event: "cleanup", Status: action, Destination: path, Message: reason})
+		return
+	}
+	console.printf("%s %s (%s)\n", action, path, reason)
+}
+
+// finds outputs in the destination the source library no longer accounts for, along with leftovers from interrupted runs
+func findCleanupItems(destDir string, expected map[string]bool, format audioFormat) ([]cleanupItem, error) {
+	var items []cleanupItem
+
+	// jobs and albums that were being staged when a run died, while a run is going they're the jobs it's running
+	partialRoots := []string{"work", "staging", "archives"}
+	if _, ok := activeRun(destDir); ok {
+		partialRoots = nil
+	}
+	for _, partialRoot := range partialRoots {
+		directory := filepath.Join(destDir, toolDirName, partialRoot)
+		entries, err := destination.List(directory)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			items = append(items, cleanupItem{path: filepath.Join(directory, entry.Name()), reason: "partial output from an interrupted run", partial: true})
+		}
+	}
+
+	err := walkDestination(destDir, func(curPath string, entry fs.DirEntry) error {
+		if entry.IsDir() {
+			// our own bookkeeping, handled above
+			if entry.Name() == toolDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		extension := filepath.Ext(entry.Name())
+		switch {
+		case expected[curPath] || !isAudioExtension(extension):
+			// wanted, or not ours to judge
+		case extension != format.fileExtension && !isLossyExtension(extension):
+			items = append(items, cleanupItem{path: curPath, reason: "doesn't match the " + format.name + " format"})
+		default:
+			items = append(items, cleanupItem{path: curPath, reason: "orphaned, the source is gone"})
+		}
+		return nil
+	})
+
+	return items, err
+}
+
+// removes directories under root that are empty once the removed paths are gone, deepest first. unless all is set
+// only the ones something was removed from go, a directory that was empty already could be anyone's.
+// root itself is never removed. returns the directories removed, or that would be when dryRun is set
+func removeEmptyDirectories(root string, removed map[string]bool, all bool, dryRun bool) ([]string, error) {
+	var directories []string
+	err := walkDestination(root, func(curPath string, entry fs.DirEntry) error {
+		if entry.IsDir() && entry.Name() == toolDirName {
+			return filepath.SkipDir
+		}
+		if entry.IsDir() && curPath != root {
+			directories = append(directories, curPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// deepest first, so a directory only holding empty directories goes too
+	sort.Slice(directories, func(i, j int) bool {
+		return strings.Count(directories[i], string(filepath.Separator)) > strings.Count(directories[j], string(filepath.Separator))
+	})
+
+	var emptied []string
+	for _, directory := range directories {
+		entries, err := destination.List(directory)
+		if err != nil {
+			continue
+		}
+
+		empty := true
+		for _, entry := range entries {
+			if !removed[filepath.Join(directory, entry.Name())] {
+				empty = false
+				break
+			}
+		}
+		if !empty || (len(entries) == 0 && !all) {
+			continue
+		}
+
+		if !dryRun {
+			if err := destination.Remove(directory); err != nil {
+				continue
+			}
+		}
+		removed[directory] = true
+		emptied = append(emptied, directory)
+	}
+
+	return emptied, nil
+}
+
+// creates a directory and any missing parents, returning the ones that didn't exist yet, deepest first
+func mkdirAllTracked(directory string) ([]string, error) {
+	var missing []string
+	for current := directory; ; current = filepath.Dir(current) {
+		if _, err := destination.Stat(current); err == nil {
+			break
+		}
+		missing = append(missing, current)
+		// reached the root of the filesystem
+		if filepath.Dir(current) == current {
+			break
+		}
+	}
+
+	// shallowest first, another worker placing a track of the same album can get to one first
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := destination.Mkdir(missing[i]); err != nil && !os.IsExist(err) {
+			return missing, err
+		}
+	}
+	return missing, nil
+}
+
+// takes back directories created by mkdirAllTracked, as long as nothing else has been put in them since
+func removeCreatedDirectories(directories []string) {
+	for _, directory := range directories {
+		// fails if the directory isn't empty, which also stops us removing its parents
+		if destination.Remove(directory) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package convert
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// what's done with the non-audio files next to sources, keyed by lowercased extension. anything not listed is ignored.
+// set from the config's [companions] table
+var companionPolicies = map[string]string{}
+
+// the extensions whose track paths can be rewritten to the outputs'
+var playlistExtensions = map[string]bool{
+	".m3u":  true,
+	".m3u8": true,
+}
+
+// how a playlist's entries are pointed at the outputs, filled in once the whole plan is made
+type playlistRewrite struct {
+	// the output each planned source ends up as
+	outputs map[string]string
+	// the folder the playlist is written to, its job's own destination is in the work directory until it's done
+	destinationDir string
+}
+
+// reads the [companions] table, which says what's done with each kind of non-audio file, ie
+//
+//	[companions]
+//	nfo = "copy"
+//	txt = "ignore"
+//	m3u8 = "playlist"
+//
+// copy copies them into the album's folder, playlist copies them with their tracks pointed at the outputs
+// and ignore leaves them behind, as happens to anything not listed
+func readCompanions(root configTable) (map[string]string, error) {
+	table, ok := root["companions"].(configTable)
+	if !ok {
+		if root["companions"] != nil {
+			return nil, fmt.Errorf("companions has to be a table")
+		}
+		return nil, nil
+	}
+
+	var keys []string
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	policies := make(map[string]string)
+	for _, key := range keys {
+		extension := normalizeExtension(key)
+		action, ok := table[key].(string)
+		switch {
+		case extension == "" || extension == ".":
+			return nil, fmt.Errorf("companions: %q isn't an extension", key)
+		case isAudioExtension(extension):
+			return nil, fmt.Errorf("companions: %s is audio, it's converted rather than copied", extension)
+		case !ok:
+			return nil, fmt.Errorf("companions: %s should be copy, playlist or ignore", key)
+		case action == "playlist" && !playlistExtensions[extension]:
+			return nil, fmt.Errorf("companions: %s files can't be rewritten as playlists, only .m3u and .m3u8 ones can", extension)
+		case action != "copy" && action != "playlist" && action != "ignore":
+			return nil, fmt.Errorf("companions: unknown action %s for %s, valid ones are copy, playlist and ignore", action, key)
+		}
+		policies[extension] = action
+	}
+	return policies, nil
+}
+
+// what's done with a non-audio file: copy, playlist or ignore. -rip-logs copies rip logs whatever the config says
+func companionAction(name string, ripLogs bool) string {
+	extension := strings.ToLower(filepath.Ext(name))
+	if ripLogs && ripLogExtensions[extension] {
+		return "copy"
+	}
+	if action, ok := companionPolicies[extension]; ok {
+		return action
+	}
+	return "ignore"
+}
+
+// points the planned playlists at the outputs of the jobs, once their destinations are final
+func planPlaylists(jobs []job) {
+	outputs := make(map[string]string)
+	for _, j := range jobs {
+		if !j.sidecar {
+			outputs[j.sourceFile] = j.destinationFile
+		}
+	}
+	for i := range jobs {
+		if jobs[i].playlist != nil {
+			jobs[i].playlist = &playlistRewrite{outputs: outputs, destinationDir: filepath.Dir(jobs[i].destinationFile)}
+		}
+	}
+}
+
+// writes a playlist job's output, with its tracks' paths rewritten to where the outputs went
+func writePlaylist(id int, j job, startTime time.Time) jobReport {
+	data, err := os.ReadFile(j.sourceFile)
+	if err != nil {
+		return jobReport{workerId: id, error: err, job: j}
+	}
+	if err = checkWritable(j.destinationFile); err != nil {
+		return jobReport{workerId: id, error: err, job: j}
+	}
+	rewritten := rewritePlaylist(string(data), filepath.Dir(j.sourceFile), j.playlist)
+	err = os.WriteFile(j.destinationFile, []byte(rewritten), 0644)
+	return jobReport{workerId: id, error: err, elaspedTime: time.Since(startTime), job: j}
+}
+
+// rewrites the track entries of an m3u playlist. entries of planned sources point at their outputs, relative ones
+// staying relative, and sources that were left out of the plan are dropped along with their #EXTINF line.
+// urls and anything else the plan doesn't know about are kept as they are
+func rewritePlaylist(data string, sourceDir string, rewrite *playlistRewrite) string {
+	newline := "\n"
+	if strings.Contains(data, "\r\n") {
+		newline = "\r\n"
+	}
+
+	var lines []string
+	var info string
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		entry := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(entry, "#EXTINF"):
+			info = line
+			continue
+		case entry == "" || strings.HasPrefix(entry, "#") || strings.Contains(entry, "://"):
+			lines = append(lines, line)
+			continue
+		}
+
+		// windows playlists separate folders with backslashes, they're read the same everywhere
+		backslashes := strings.Contains(entry, `\`) && !strings.Contains(entry, "/")
+		source := filepath.FromSlash(strings.ReplaceAll(entry, `\`, "/"))
+		absolute := filepath.IsAbs(source)
+		if !absolute {
+			source = filepath.Join(sourceDir, source)
+		}
+		source = filepath.Clean(source)
+
+		if output, ok := rewrite.outputs[source]; ok {
+			entry = output
+			if relative, err := filepath.Rel(rewrite.destinationDir, output); err == nil && !absolute {
+				entry = filepath.ToSlash(relative)
+				if backslashes {
+					entry = strings.ReplaceAll(entry, "/", `\`)
+				}
+			}
+		} else if _, err := os.Stat(source); err == nil && isAudioExtension(filepath.Ext(source)) {
+			// it's in the source library but not in the destination
+			info = ""
+			continue
+		} else {
+			entry = line
+		}
+
+		if info != "" {
+			lines = append(lines, info)
+			info = ""
+		}
+		lines = append(lines, entry)
+	}
+	if info != "" {
+		lines = append(lines, info)
+	}
+	return strings.Join(lines, newline)
+}
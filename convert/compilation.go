@@ -0,0 +1,67 @@
+package convert
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// folder names compilations get filed under, compared case insensitively
+var compilationFolderNames = []string{"various artists", "various", "va", "compilations", "compilation"}
+
+// what album artist compilations are given when their tags don't name one
+const compilationAlbumArtist = "Various Artists"
+
+// checks whether a source directory, relative to the library root, looks like it holds a compilation,
+// ie "Various Artists/Now 42" or "VA - Summer Hits"
+func isCompilationPath(relativeDir string) bool {
+	for _, component := range strings.Split(filepath.ToSlash(relativeDir), "/") {
+		component = strings.ToLower(strings.TrimSpace(component))
+		for _, name := range compilationFolderNames {
+			if component == name || strings.HasPrefix(component, name+" - ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checks whether a source's tags mark it as part of a compilation
+func isCompilationTagged(tags map[string]string) bool {
+	// itunes and id3 store the flag as cpil and TCMP, ffmpeg reads both as compilation
+	if value, ok := findTag(tags, "compilation"); ok && strings.TrimSpace(value) == "1" {
+		return true
+	}
+
+	for _, key := range []string{"album_artist", "albumartist", "album artist"} {
+		if value, ok := findTag(tags, key); ok && isCompilationArtist(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCompilationArtist(artist string) bool {
+	artist = strings.ToLower(strings.TrimSpace(artist))
+	return artist == "various artists" || artist == "various" || artist == "va"
+}
+
+// flags a compilation track as one in its output, so players group the album instead of splitting it up per artist
+func compilationMetadata(j job, tags map[string]string) map[string]string {
+	metadata := make(map[string]string)
+	if !j.compilation && !isCompilationTagged(tags) {
+		return metadata
+	}
+
+	metadata["compilation"] = "1"
+	hasAlbumArtist := false
+	for _, key := range []string{"album_artist", "albumartist", "album artist"} {
+		if value, ok := findTag(tags, key); ok && strings.TrimSpace(value) != "" {
+			hasAlbumArtist = true
+		}
+	}
+	if !hasAlbumArtist {
+		metadata["album_artist"] = compilationAlbumArtist
+	}
+
+	return metadata
+}
@@ -0,0 +1,480 @@
+package convert
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// settings read from the config file
+type config struct {
+	// tag rewrite rules, applied in order
+	rewrites []rewriteRule
+	// named sets of flag values, from [profile.<name>] tables, with what they inherit merged in
+	profiles map[string]configTable
+	// flag values every run starts from, from the [defaults] table
+	defaults configTable
+	// extra source extensions and whether they're lossy, with warnings about the ones that conflict
+	extensions        map[string]bool
+	extensionWarnings []string
+	// default bitrates by format name, from the [bitrate] table
+	bitrates map[string]int
+	// what's done with each kind of non-audio file, from the [companions] table
+	companions map[string]string
+	// what's done with audio sources, from [[rule]] tables, in order
+	rules []planRule
+}
+
+// where the config file is looked for when -config isn't given
+func defaultConfigPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "convert-muh-music", "config.toml")
+}
+
+// loads the config file, a missing file is only an error when it was asked for by name
+func loadConfig(configPath string) (*config, error) {
+	explicit := configPath != ""
+	if !explicit {
+		configPath = defaultConfigPath()
+	}
+
+	cfg := &config{}
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) && !explicit {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	root, err := parseConfig(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err)
+	}
+
+	if cfg.rewrites, err = readRewriteRules(root); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err)
+	}
+	if cfg.profiles, err = readProfiles(root); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err)
+	}
+	switch defaults := root["defaults"].(type) {
+	case nil:
+	case configTable:
+		cfg.defaults = defaults
+	default:
+		return nil, fmt.Errorf("%s: defaults has to be a table", configPath)
+	}
+	if cfg.extensions, cfg.extensionWarnings, err = readExtensions(root); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err)
+	}
+	if cfg.bitrates, err = readBitrates(root); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err)
+	}
+	if cfg.companions, err = readCompanions(root); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err)
+	}
+	if cfg.rules, err = readPlanRules(root); err != nil {
+		return nil, fmt.Errorf("%s: %s", configPath, err)
+	}
+
+	return cfg, nil
+}
+
+// a parsed config table, values are strings, int64s, float64s, bools, []interface{} and nested tables
+type configTable map[string]interface{}
+
+// parses the subset of toml the config needs: [tables], [[arrays of tables]], and key = value pairs
+// holding strings, numbers, booleans or arrays of those
+func parseConfig(data string) (configTable, error) {
+	root := configTable{}
+	current := root
+
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNumber := i + 1
+		line := strings.TrimSpace(stripConfigComment(lines[i]))
+		// arrays can be spread over several lines
+		for !strings.HasPrefix(line, "[") && !arrayClosed(line) {
+			if i+1 >= len(lines) {
+				return nil, fmt.Errorf("line %d: unterminated array", lineNumber)
+			}
+			i++
+			line += " " + strings.TrimSpace(stripConfigComment(lines[i]))
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[[") {
+			if !strings.HasSuffix(line, "]]") {
+				return nil, fmt.Errorf("line %d: malformed table header %s", lineNumber, line)
+			}
+			path := splitConfigKey(line[2 : len(line)-2])
+			parent, err := configTableAt(root, path[:len(path)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+			name := path[len(path)-1]
+			array, _ := parent[name].([]configTable)
+			if _, exists := parent[name]; exists && array == nil {
+				return nil, fmt.Errorf("line %d: %s isn't an array of tables", lineNumber, name)
+			}
+			current = configTable{}
+			parent[name] = append(array, current)
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed table header %s", lineNumber, line)
+			}
+			table, err := configTableAt(root, splitConfigKey(line[1:len(line)-1]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+			current = table
+			continue
+		}
+
+		equals := strings.Index(line, "=")
+		if equals < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key := unquoteConfigKey(strings.TrimSpace(line[:equals]))
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", lineNumber)
+		}
+		if _, exists := current[key]; exists {
+			return nil, fmt.Errorf("line %d: %s is set twice", lineNumber, key)
+		}
+		value, rest, err := parseConfigValue(strings.TrimSpace(line[equals+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" {
+			return nil, fmt.Errorf("line %d: unexpected %s after the value", lineNumber, rest)
+		}
+		current[key] = value
+	}
+
+	return root, nil
+}
+
+// walks to the table at path, creating missing tables on the way
+func configTableAt(root configTable, path []string) (configTable, error) {
+	table := root
+	for _, name := range path {
+		switch next := table[name].(type) {
+		case nil:
+			created := configTable{}
+			table[name] = created
+			table = created
+		case configTable:
+			table = next
+		case []configTable:
+			// headers under an array of tables refer to its latest entry
+			table = next[len(next)-1]
+		default:
+			return nil, fmt.Errorf("%s isn't a table", name)
+		}
+	}
+	return table, nil
+}
+
+func splitConfigKey(key string) []string {
+	var parts []string
+	for _, part := range strings.Split(key, ".") {
+		parts = append(parts, unquoteConfigKey(strings.TrimSpace(part)))
+	}
+	return parts
+}
+
+func unquoteConfigKey(key string) string {
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		return key[1 : len(key)-1]
+	}
+	return key
+}
+
+// drops a trailing # comment, leaving #s inside strings alone
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0 && line[i] == '\\' && quote == '"':
+			i++
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == 0 && line[i] == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// checks whether every [ opened outside of strings has been closed
+func arrayClosed(line string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0 && line[i] == '\\' && quote == '"':
+			i++
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == 0 && line[i] == '[':
+			depth++
+		case quote == 0 && line[i] == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// parses the value at the start of text, returning whatever follows it
+func parseConfigValue(text string) (interface{}, string, error) {
+	if text == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+
+	switch text[0] {
+	case '"':
+		var value strings.Builder
+		for i := 1; i < len(text); i++ {
+			switch text[i] {
+			case '"':
+				return value.String(), text[i+1:], nil
+			case '\\':
+				if i+1 >= len(text) {
+					return nil, "", fmt.Errorf("unterminated string")
+				}
+				i++
+				switch text[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case 't':
+					value.WriteByte('\t')
+				case '"', '\\':
+					value.WriteByte(text[i])
+				default:
+					return nil, "", fmt.Errorf("unknown escape \\%c", text[i])
+				}
+			default:
+				value.WriteByte(text[i])
+			}
+		}
+		return nil, "", fmt.Errorf("unterminated string")
+	case '\'':
+		end := strings.IndexByte(text[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return text[1 : end+1], text[end+2:], nil
+	case '[':
+		var values []interface{}
+		rest := strings.TrimSpace(text[1:])
+		for {
+			if strings.HasPrefix(rest, "]") {
+				return values, rest[1:], nil
+			}
+			value, after, err := parseConfigValue(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, value)
+			rest = strings.TrimSpace(after)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	}
+
+	// bare values run until a separator
+	end := strings.IndexAny(text, ",] \t")
+	if end < 0 {
+		end = len(text)
+	}
+	word, rest := text[:end], text[end:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	if number, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 10, 64); err == nil {
+		return number, rest, nil
+	}
+	if number, err := strconv.ParseFloat(strings.ReplaceAll(word, "_", ""), 64); err == nil {
+		return number, rest, nil
+	}
+
+	return nil, "", fmt.Errorf("can't make sense of the value %s, strings need quotes", word)
+}
+
+func readProfiles(root configTable) (map[string]configTable, error) {
+	profiles := make(map[string]configTable)
+
+	switch tables := root["profile"].(type) {
+	case nil:
+	case configTable:
+		for name, value := range tables {
+			profile, ok := value.(configTable)
+			if !ok {
+				return nil, fmt.Errorf("profile.%s should be a [profile.%s] table", name, name)
+			}
+			profiles[name] = profile
+		}
+	default:
+		return nil, fmt.Errorf("profiles go in [profile.<name>] tables")
+	}
+
+	resolved := make(map[string]configTable, len(profiles))
+	for name := range profiles {
+		profile, err := resolveProfile(profiles, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		resolved[name] = profile
+	}
+	return resolved, nil
+}
+
+// merges what a profile inherits, through inherits = "<name>", under its own settings
+func resolveProfile(profiles map[string]configTable, name string, chain []string) (configTable, error) {
+	for _, seen := range chain {
+		if seen == name {
+			return nil, fmt.Errorf("profile.%s inherits from itself through %s", name, strings.Join(append(chain, name), " > "))
+		}
+	}
+	profile := profiles[name]
+	parent, ok := profile["inherits"]
+	if !ok {
+		return profile, nil
+	}
+	parentName, ok := parent.(string)
+	if !ok {
+		return nil, fmt.Errorf("profile.%s: inherits should be the name of another profile", name)
+	}
+	if _, ok := profiles[parentName]; !ok {
+		return nil, fmt.Errorf("profile.%s inherits from %s, there's no profile by that name", name, parentName)
+	}
+
+	inherited, err := resolveProfile(profiles, parentName, append(chain, name))
+	if err != nil {
+		return nil, err
+	}
+	merged := make(configTable, len(inherited)+len(profile))
+	for key, value := range inherited {
+		merged[key] = value
+	}
+	for key, value := range profile {
+		if key != "inherits" {
+			merged[key] = value
+		}
+	}
+	return merged, nil
+}
+
+// sets every flag a profile has a value for, unless it was given on the command line.
+// profile keys are flag names, ie bitrate = 128 or blacklist = ["Ableton", "Logic"].
+// lenient skips settings the flag set doesn't have, for subcommands that only take some of convert's flags
+func applyProfile(flags *flag.FlagSet, profile configTable, lenient bool) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var keys []string
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == "config" || key == "profile" {
+			return fmt.Errorf("unknown setting %s", key)
+		}
+		if flags.Lookup(key) == nil {
+			if lenient {
+				continue
+			}
+			return fmt.Errorf("unknown setting %s", key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := flags.Set(key, configValueString(profile[key])); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+
+	return nil
+}
+
+// formats a config value the way it would be given as a flag, arrays become comma separated lists
+func configValueString(value interface{}) string {
+	if values, ok := value.([]interface{}); ok {
+		var items []string
+		for _, item := range values {
+			items = append(items, configValueString(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+func configString(table configTable, key string) (string, error) {
+	switch value := table[key].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	default:
+		return "", fmt.Errorf("%s should be a string", key)
+	}
+}
+
+func configStrings(table configTable, key string) ([]string, error) {
+	switch value := table[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s should be a list of strings", key)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("%s should be a list of strings", key)
+	}
+}
+
+func configBool(table configTable, key string) (bool, error) {
+	switch value := table[key].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return value, nil
+	default:
+		return false, fmt.Errorf("%s should be true or false", key)
+	}
+}
@@ -0,0 +1,200 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want configTable
+	}{
+		{"values", `
+format = "opus"
+bitrate = 128
+tempo = 1.25
+verbose = true
+size = 1_000
+`, configTable{"format": "opus", "bitrate": int64(128), "tempo": 1.25, "verbose": true, "size": int64(1000)}},
+		{"strings", `
+escaped = "a \"quoted\"\tword\\"
+literal = 'C:\Music\'
+`, configTable{"escaped": "a \"quoted\"\tword\\", "literal": `C:\Music\`}},
+		{"comments", `
+# a whole line
+format = "opus" # after a value
+title = "Track #1" # a # in a string isn't one
+literal = 'Side #2'
+`, configTable{"format": "opus", "title": "Track #1", "literal": "Side #2"}},
+		{"arrays", `
+blacklist = ["Ableton", "Logic"]
+empty = []
+nested = [[1, 2], ["a"]]
+`, configTable{"blacklist": []interface{}{"Ableton", "Logic"}, "empty": []interface{}(nil), "nested": []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{"a"}}}},
+		{"multi-line arrays", `
+blacklist = [
+	"Ableton", # a comment in it
+	"[Logic]",
+	"a # b",
+]
+after = 1
+`, configTable{"blacklist": []interface{}{"Ableton", "[Logic]", "a # b"}, "after": int64(1)}},
+		{"tables", `
+top = 1
+[profile.phone]
+bitrate = 96
+[profile."car stereo"]
+format = "mp3"
+`, configTable{"top": int64(1), "profile": configTable{
+			"phone":      configTable{"bitrate": int64(96)},
+			"car stereo": configTable{"format": "mp3"},
+		}}},
+		{"arrays of tables", `
+[[rule]]
+match = "*.wav"
+[rule.tags]
+genre = "Field Recording"
+[[rule]]
+match = "*.aiff"
+`, configTable{"rule": []configTable{
+			{"match": "*.wav", "tags": configTable{"genre": "Field Recording"}},
+			{"match": "*.aiff"},
+		}}},
+		{"windows line endings", "format = \"opus\"\r\n[defaults]\r\nworkers = 2\r\n",
+			configTable{"format": "opus", "defaults": configTable{"workers": int64(2)}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseConfig(test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"unterminated arrays", "blacklist = [\n\"a\",\n", "line 1: unterminated array"},
+		{"unterminated strings", `format = "opus`, "line 1: unterminated string"},
+		{"unknown escapes", `format = "\q"`, `line 1: unknown escape \q`},
+		{"bare strings", "format = opus", "line 1: can't make sense of the value opus, strings need quotes"},
+		{"keys set twice", "bitrate = 1\n\nbitrate = 2", "line 3: bitrate is set twice"},
+		{"lines without a value", "format", "line 1: expected key = value"},
+		{"missing keys", "= 1", "line 1: missing key"},
+		{"missing values", "format =", "line 1: missing value"},
+		{"junk after a value", `format = "opus" "mp3"`, `line 1: unexpected "mp3" after the value`},
+		{"arrays without commas", `blacklist = ["a" "b"]`, "line 1: expected , or ] in array"},
+		{"malformed headers", "[profile", "line 1: malformed table header [profile"},
+		{"malformed array headers", "[[rule]", "line 1: malformed table header [[rule]"},
+		{"tables under values", "profile = 1\n[profile.phone]", "line 2: profile isn't a table"},
+		{"arrays of tables over tables", "[rule]\n[[rule]]", "line 2: rule isn't an array of tables"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseConfig(test.text)
+			if err == nil || err.Error() != test.want {
+				t.Errorf("got %v, want %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestReadProfiles(t *testing.T) {
+	root, err := parseConfig(`
+[profile.base]
+format = "opus"
+bitrate = 128
+[profile.phone]
+inherits = "base"
+bitrate = 96
+[profile.watch]
+inherits = "phone"
+channels = 1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := readProfiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]configTable{
+		"base":  {"format": "opus", "bitrate": int64(128)},
+		"phone": {"format": "opus", "bitrate": int64(96)},
+		"watch": {"format": "opus", "bitrate": int64(96), "channels": int64(1)},
+	}
+	if !reflect.DeepEqual(profiles, want) {
+		t.Errorf("got %#v, want %#v", profiles, want)
+	}
+}
+
+func TestReadProfilesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"inheriting from itself", "[profile.a]\ninherits = \"a\"", "profile.a inherits from itself through a > a"},
+		{"inheritance cycles", "[profile.a]\ninherits = \"b\"\n[profile.b]\ninherits = \"c\"\n[profile.c]\ninherits = \"a\"", "inherits from itself through"},
+		{"missing parents", "[profile.a]\ninherits = \"b\"", "profile.a inherits from b, there's no profile by that name"},
+		{"parents that aren't names", "[profile.a]\ninherits = 1", "profile.a: inherits should be the name of another profile"},
+		{"profiles that aren't tables", "[profile]\na = 1", "profile.a should be a [profile.a] table"},
+		{"profile values", "profile = 1", "profiles go in [profile.<name>] tables"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := parseConfig(test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = readProfiles(root); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	dir := t.TempDir()
+	write := func(text string) string {
+		path := filepath.Join(dir, "config.toml")
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	cfg, err := loadConfig(write("[defaults]\nworkers = 2\nformat = \"opus\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (configTable{"workers": int64(2), "format": "opus"}); !reflect.DeepEqual(cfg.defaults, want) {
+		t.Errorf("got %#v, want %#v", cfg.defaults, want)
+	}
+
+	path := write("defaults = 1\n")
+	if _, err = loadConfig(path); err == nil || err.Error() != path+": defaults has to be a table" {
+		t.Errorf("got %v, want defaults to have to be a table", err)
+	}
+	// only a config asked for by name has to be there
+	if _, err = loadConfig(filepath.Join(dir, "missing.toml")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the config to be missing", err)
+	}
+}
@@ -0,0 +1,72 @@
+package convert
+
+import (
+	"fmt"
+	"strings"
+)
+
+type outputContainer struct {
+	// the ffmpeg muxer that writes the container
+	muxer string
+	// can the container carry cover art as an attached picture?
+	supportsArt bool
+	// the tag ffmpeg writes lyrics to the container from, empty if it can't write them
+	lyricsTag string
+	// can the container carry chapters?
+	supportsChapters bool
+	// does ffmpeg write tags it has no name for in the container, like REPLAYGAIN_TRACK_GAIN?
+	customTags bool
+}
+
+// containers outputs can be written to, keyed by file extension.
+// ffmpeg has no way of writing mp3 USLT frames, so mp3 lyrics only survive as .lrc sidecars.
+// mp4 only gets the tags itunes has atoms for, anything else is dropped
+var outputContainers = map[string]outputContainer{
+	".mp3":  {muxer: "mp3", supportsArt: true, supportsChapters: true, customTags: true},
+	".m4a":  {muxer: "ipod", supportsArt: true, lyricsTag: "lyrics", supportsChapters: true},
+	".m4b":  {muxer: "ipod", supportsArt: true, lyricsTag: "lyrics", supportsChapters: true},
+	".mp4":  {muxer: "mp4", supportsArt: true, lyricsTag: "lyrics", supportsChapters: true},
+	".aac":  {muxer: "adts"},
+	".ogg":  {muxer: "ogg", lyricsTag: "LYRICS", supportsChapters: true, customTags: true},
+	".oga":  {muxer: "ogg", lyricsTag: "LYRICS", supportsChapters: true, customTags: true},
+	".opus": {muxer: "opus", lyricsTag: "LYRICS", supportsChapters: true, customTags: true},
+	".mka":  {muxer: "matroska", supportsArt: true, lyricsTag: "LYRICS", supportsChapters: true, customTags: true},
+	".webm": {muxer: "webm", lyricsTag: "LYRICS", supportsChapters: true, customTags: true},
+	".caf":  {muxer: "caf"},
+	".flac": {muxer: "flac", supportsArt: true, lyricsTag: "LYRICS", customTags: true},
+	".aiff": {muxer: "aiff"},
+	".wav":  {muxer: "wav"},
+}
+
+// returns a copy of the format that's written under a different extension, in the container matching it
+func withExtension(format audioFormat, extension string) (audioFormat, error) {
+	extension = strings.ToLower(extension)
+	if !strings.HasPrefix(extension, ".") {
+		extension = "." + extension
+	}
+
+	container, ok := outputContainers[extension]
+	if !ok {
+		return format, fmt.Errorf("unknown output extension %s", extension)
+	}
+
+	supported := extension == format.fileExtension
+	for _, alternative := range format.extensions {
+		if extension == alternative {
+			supported = true
+		}
+	}
+	if !supported {
+		return format, fmt.Errorf("%s can't be written to %s files, it can be written to %s", format.name, extension, strings.Join(append([]string{format.fileExtension}, format.extensions...), ", "))
+	}
+
+	format.fileExtension = extension
+	format.muxer = container.muxer
+
+	// cover art has to be dropped for containers that can't hold it, or ffmpeg refuses to write them
+	if !container.supportsArt {
+		format = withoutArt(format)
+	}
+
+	return format, nil
+}
@@ -0,0 +1,388 @@
+// Package convert is convert-muh-music, the command line tool runs it through Main. Other Go programs run
+// conversions with Convert, which hands back their progress as structured events and their outcome as a Report.
+//
+// A conversion runs in the calling process, one at a time as the tool's run state is process wide, or in a
+// convert-muh-music executable of its own when Converter.Executable says where one is. Events come through a
+// callback, see WithProgress, or a channel, see WithEvents: each job is JobQueued, then JobStarted, JobProgress as it
+// encodes and JobDone, and the run ends with RunDone.
+//
+//	report, err := convert.Convert(ctx, convert.NewOptions("/music/flac", "/music/phone",
+//		convert.WithFormat("opus"),
+//		convert.WithBitrate(128),
+//		convert.WithProgress(func(event convert.Event) { log.Println(event.Status, event.Source) }),
+//	))
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options are the settings of a conversion. Anything left at its zero value takes the tool's default, or the
+// config's when it sets one.
+type Options struct {
+	// the source library and the destination it's converted into
+	Source      string
+	Destination string
+	// the format to transcode lossless sources to, ie "opus", see -list-formats
+	Format string
+	// the bitrate in kilobits to encode at
+	Bitrate int
+	// the number of concurrent workers
+	Workers int
+	// a [profile.<name>] section of the config to apply
+	Profile string
+	// further command line flags, ie []string{"-structure", "artist-album"}, applied after the ones above
+	Flags []string
+	// called for every event of the run as it happens
+	Progress func(Event)
+	// sent every event of the run as well, it's closed once the run is over. events wait for it to be read
+	Events chan<- Event
+	// called for particular kinds of events, after Progress
+	Hooks Hooks
+}
+
+// Hooks are called as things happen during a run, any of them can be left nil.
+type Hooks struct {
+	// a job's output was written, converted, copied or retagged
+	JobDone func(Event)
+	// a job failed, Event.Error says why
+	JobFailed func(Event)
+	// something about a job that didn't stop it, in Event.Error
+	Warning func(Event)
+	// the tool printed a message
+	Message func(Event)
+}
+
+// An Option changes one of the settings of a conversion.
+type Option func(*Options)
+
+// NewOptions returns the settings converting source into destination, with the options applied in order.
+func NewOptions(source string, destination string, options ...Option) Options {
+	settings := Options{Source: source, Destination: destination}
+	for _, option := range options {
+		option(&settings)
+	}
+	return settings
+}
+
+// WithFormat sets the format lossless sources are transcoded to.
+func WithFormat(format string) Option {
+	return func(o *Options) { o.Format = format }
+}
+
+// WithBitrate sets the bitrate in kilobits to encode at.
+func WithBitrate(bitrate int) Option {
+	return func(o *Options) { o.Bitrate = bitrate }
+}
+
+// WithWorkers sets the number of concurrent workers.
+func WithWorkers(workers int) Option {
+	return func(o *Options) { o.Workers = workers }
+}
+
+// WithProfile applies a profile of the config.
+func WithProfile(profile string) Option {
+	return func(o *Options) { o.Profile = profile }
+}
+
+// WithFlags adds command line flags of the tool's own.
+func WithFlags(flags ...string) Option {
+	return func(o *Options) { o.Flags = append(o.Flags, flags...) }
+}
+
+// WithProgress sets the callback every event of the run is passed to.
+func WithProgress(progress func(Event)) Option {
+	return func(o *Options) { o.Progress = progress }
+}
+
+// WithEvents sets the channel every event of the run is sent on, closed once the run is over.
+func WithEvents(events chan<- Event) Option {
+	return func(o *Options) { o.Events = events }
+}
+
+// WithHooks sets the callbacks for particular kinds of events.
+func WithHooks(hooks Hooks) Option {
+	return func(o *Options) { o.Hooks = hooks }
+}
+
+// An EventKind says what an Event is about.
+type EventKind string
+
+const (
+	// a job was planned and is waiting for a worker, every job of the run is queued before the first one starts
+	JobQueued EventKind = "queued"
+	// a worker started on a job
+	JobStarted EventKind = "started"
+	// an encode got further into its output, see Event.Position
+	JobProgress EventKind = "progress"
+	// a job is over, Event.Status says how it went
+	JobDone EventKind = "job"
+	// the run is over, Event.Data holds the Report Convert returns
+	RunDone EventKind = "summary"
+	// the tool printed something, in Event.Message
+	Message EventKind = "message"
+	// what the tool prints with -verbose
+	Debug EventKind = "debug"
+)
+
+// An Event is something that happened during a run, one line of the tool's -json output.
+type Event struct {
+	// one of the kinds above, or the kind of another report, like "timings"
+	Kind EventKind
+	Time time.Time
+	// for job events, the job's id. it's the same for the same source at the same settings in every run, so a
+	// track can be looked up in the library's history with "convert-muh-music history -job <id>"
+	ID string
+	// for JobDone: done, retag, warning, skipped, failed, protected, or for sources removed after verifying
+	// deleted, trashed or kept
+	Status      string
+	Source      string
+	Destination string
+	Elapsed     time.Duration
+	Error       string
+	// for failed jobs, what kind of failure Error is, to branch on rather than its wording: "destination-full",
+	// "source-unreadable", "timeout", "corrupt" or "encoder-failed", empty when it's none of them
+	ErrorKind string
+	// for JobProgress: how far into its output the encode is, and how long the output runs when that's known.
+	// only single encodes report progress, batched ones and the libav backend don't
+	Position time.Duration
+	Duration time.Duration
+	// for message and debug events
+	Message string
+	// for summary and other report events, as json
+	Data json.RawMessage
+}
+
+// A Report is how a run went, from its summary.
+type Report struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// the number of jobs planned, done by earlier runs, succeeded and failed
+	Planned     int `json:"planned"`
+	AlreadyDone int `json:"alreadyDone"`
+	Completed   int `json:"completed"`
+	Failed      int `json:"failed"`
+	// drm protected sources that were skipped
+	Protected int `json:"protected"`
+	// lossless outputs verified bit for bit against their sources
+	BitPerfect int `json:"bitPerfect"`
+	// jobs left for the next run because a budget ran out, and which one
+	Remaining  int    `json:"remaining"`
+	StopReason string `json:"stopReason"`
+	// the sources that failed, their jobs' ids in the same order, and how many failed for each cause
+	Failures      []string       `json:"failures"`
+	FailureIDs    []string       `json:"failureIds"`
+	FailureCauses map[string]int `json:"failureCauses"`
+}
+
+// ErrNoSummary is returned when the run ended before reporting its summary, usually because of bad settings,
+// the events before it say what went wrong.
+var ErrNoSummary = errors.New("the run ended without a summary")
+
+// A Converter runs conversions, in this process or with a particular convert-muh-music executable.
+type Converter struct {
+	// the path of an executable to run conversions in, ie a build with the libav backend. empty runs them in process
+	Executable string
+	// extra variables for the executable's environment, ie "NO_COLOR=1", on top of this process's
+	Env []string
+}
+
+// Convert runs a conversion in this process.
+func Convert(ctx context.Context, options Options) (Report, error) {
+	return (&Converter{}).Convert(ctx, options)
+}
+
+// Convert runs a conversion and waits for it to finish, calling the progress callback and hooks from the calling
+// goroutine as its events come in. Cancelling ctx interrupts the run the way ctrl-c does, so its progress is saved
+// and the next run picks up where it stopped. A run with failed jobs still returns its report without an error,
+// the report counts them.
+func (c *Converter) Convert(ctx context.Context, options Options) (Report, error) {
+	var report Report
+	if options.Events != nil {
+		defer close(options.Events)
+	}
+	if options.Source == "" || options.Destination == "" {
+		return report, errors.New("a conversion needs both a source and a destination")
+	}
+
+	if c.Executable == "" {
+		output, writer := io.Pipe()
+		exitCode := make(chan int, 1)
+		go func() {
+			exitCode <- runInProcess(ctx, options.args(), writer)
+			writer.Close()
+		}()
+		summarized, readErr := options.readEvents(output, &report)
+		code := <-exitCode
+		var runErr error
+		if code != 0 {
+			runErr = fmt.Errorf("exit status %d", code)
+		}
+		return runResult(ctx, report, summarized, readErr, runErr, "")
+	}
+
+	cmd := exec.Command(c.Executable, options.args()...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return report, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		return report, err
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// windows has no interrupt to send another process
+			if runtime.GOOS == "windows" || cmd.Process.Signal(os.Interrupt) != nil {
+				cmd.Process.Kill()
+			}
+		case <-finished:
+		}
+	}()
+
+	summarized, readErr := options.readEvents(stdout, &report)
+	waitErr := cmd.Wait()
+	return runResult(ctx, report, summarized, readErr, waitErr, strings.TrimSpace(stderr.String()))
+}
+
+// reads a run's -json output to its end, passing its events on as they come in. summarized is whether the run's
+// summary was among them, it's read into report
+func (o Options) readEvents(output io.Reader, report *Report) (summarized bool, err error) {
+	scanner := bufio.NewScanner(output)
+	// a summary with thousands of failures makes for a long line
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		event := parseEvent(scanner.Bytes())
+		if event.Kind == RunDone {
+			if err := json.Unmarshal(event.Data, report); err == nil {
+				summarized = true
+			}
+		}
+		o.dispatch(event)
+	}
+	// keep draining the output, so the run isn't stuck writing to a pipe nobody reads
+	io.Copy(io.Discard, output)
+	return summarized, scanner.Err()
+}
+
+// what Convert returns once a run is over. readErr is why its events couldn't be read to the end, runErr how it
+// ended and message what it printed besides its events
+func runResult(ctx context.Context, report Report, summarized bool, readErr error, runErr error, message string) (Report, error) {
+	switch {
+	case readErr != nil:
+		// events were lost, whatever the report says isn't the whole story
+		return report, fmt.Errorf("couldn't read the run's events: %w", readErr)
+	case ctx.Err() != nil && !summarized:
+		return report, ctx.Err()
+	case !summarized && runErr != nil && message != "":
+		return report, fmt.Errorf("%w: %s: %s", ErrNoSummary, runErr, message)
+	case !summarized && runErr != nil:
+		return report, fmt.Errorf("%w: %s", ErrNoSummary, runErr)
+	case !summarized:
+		return report, ErrNoSummary
+	}
+	return report, nil
+}
+
+// the command line of a conversion, the flags go before the directories where the tool's flag parsing looks for them
+func (o Options) args() []string {
+	args := []string{"-json"}
+	if o.Format != "" {
+		args = append(args, "-format", o.Format)
+	}
+	if o.Bitrate != 0 {
+		args = append(args, "-bitrate", strconv.Itoa(o.Bitrate))
+	}
+	if o.Workers != 0 {
+		args = append(args, "-workers", strconv.Itoa(o.Workers))
+	}
+	if o.Profile != "" {
+		args = append(args, "-profile", o.Profile)
+	}
+	args = append(args, o.Flags...)
+	return append(args, "--", o.Source, o.Destination)
+}
+
+// passes an event to the progress callback and the hook for its kind
+func (o Options) dispatch(event Event) {
+	if o.Progress != nil {
+		o.Progress(event)
+	}
+	if o.Events != nil {
+		o.Events <- event
+	}
+	var hook func(Event)
+	switch {
+	case event.Kind == JobDone && (event.Status == "done" || event.Status == "retag"):
+		hook = o.Hooks.JobDone
+	case event.Kind == JobDone && event.Status == "failed":
+		hook = o.Hooks.JobFailed
+	case event.Kind == JobDone && event.Status == "warning":
+		hook = o.Hooks.Warning
+	case event.Kind == Message:
+		hook = o.Hooks.Message
+	}
+	if hook != nil {
+		hook(event)
+	}
+}
+
+// reads a line of -json output. the few lines printed before the run gets to its flags come out as plain text,
+// they're passed on as messages
+func parseEvent(line []byte) Event {
+	var raw struct {
+		Event       string          `json:"event"`
+		Time        time.Time       `json:"time"`
+		ID          string          `json:"id"`
+		Status      string          `json:"status"`
+		Source      string          `json:"source"`
+		Destination string          `json:"destination"`
+		Elapsed     float64         `json:"elapsed"`
+		Error       string          `json:"error"`
+		ErrorKind   string          `json:"errorKind"`
+		Position    float64         `json:"position"`
+		Duration    float64         `json:"duration"`
+		Message     string          `json:"message"`
+		Data        json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(line, &raw); err != nil || raw.Event == "" {
+		return Event{Kind: Message, Time: time.Now(), Message: strings.TrimSpace(string(line))}
+	}
+	return Event{
+		Kind:        EventKind(raw.Event),
+		Time:        raw.Time,
+		ID:          raw.ID,
+		Status:      raw.Status,
+		Source:      raw.Source,
+		Destination: raw.Destination,
+		Elapsed:     seconds(raw.Elapsed),
+		Error:       raw.Error,
+		ErrorKind:   raw.ErrorKind,
+		Position:    seconds(raw.Position),
+		Duration:    seconds(raw.Duration),
+		Message:     raw.Message,
+		Data:        raw.Data,
+	}
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
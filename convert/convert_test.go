@@ -0,0 +1,58 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertInProcessBadSettings(t *testing.T) {
+	source, destination := filepath.Join(t.TempDir(), "missing"), t.TempDir()
+	for _, flags := range [][]string{{"-no-such-flag"}, {"-format", "nope"}, nil} {
+		// each run ends through exit, which mustn't end the test's process, and the next run starts over
+		_, err := Convert(context.Background(), NewOptions(source, destination, WithFlags(flags...)))
+		if !errors.Is(err, ErrNoSummary) {
+			t.Errorf("flags %q: got %v, want ErrNoSummary", flags, err)
+		}
+		if inProcessContext != nil {
+			t.Fatalf("flags %q: the run left its context behind", flags)
+		}
+	}
+}
+
+func TestReadEventsScannerError(t *testing.T) {
+	// a line longer than the scanner takes
+	output := strings.NewReader(`{"event":"message","message":"` + strings.Repeat("a", 65*1024*1024) + `"}` + "\n")
+	var report Report
+	summarized, err := (Options{}).readEvents(output, &report)
+	if err == nil || summarized {
+		t.Fatalf("got summarized %v and %v, want an error", summarized, err)
+	}
+	if _, err = runResult(context.Background(), report, true, err, nil, ""); err == nil || !strings.Contains(err.Error(), "couldn't read the run's events") {
+		t.Errorf("got %v, want the read error", err)
+	}
+}
+
+func TestReadEventsDrainsOutput(t *testing.T) {
+	output, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte(`{"event":"message","message":"hi"}` + "\n"))
+		writer.Close()
+	}()
+	var events []Event
+	options := Options{Progress: func(event Event) { events = append(events, event) }}
+	var report Report
+	summarized, err := options.readEvents(output, &report)
+	if err != nil || summarized {
+		t.Fatalf("got summarized %v and %v", summarized, err)
+	}
+	if len(events) != 1 {
+		t.Errorf("got %d events, want 1", len(events))
+	}
+	if _, err = runResult(context.Background(), report, summarized, nil, nil, ""); !errors.Is(err, ErrNoSummary) {
+		t.Errorf("got %v, want ErrNoSummary", err)
+	}
+}
@@ -0,0 +1,80 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// what became of a source once its output was verified
+type sourceRemoval struct {
+	j job
+	// where the source was moved to, empty when it was deleted
+	trashedTo string
+	error     error
+}
+
+// removes the sources of the jobs whose outputs verify, moving them under trashDir instead when it's set so they can be put back.
+// this is the one place sources are ever touched, and only when -delete-source-after-verify asks for it
+func removeVerifiedSources(ctx context.Context, jobs []job, srcDir string, trashDir string, workerCount int) []sourceRemoval {
+	removals := make([]sourceRemoval, len(jobs))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				// a cancelled run keeps the sources it hasn't got to
+				if err := ctx.Err(); err != nil {
+					removals[i] = sourceRemoval{j: jobs[i], error: err}
+					continue
+				}
+				removals[i] = removeVerifiedSource(jobs[i], srcDir, trashDir)
+			}
+		}()
+	}
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return removals
+}
+
+func removeVerifiedSource(j job, srcDir string, trashDir string) sourceRemoval {
+	removal := sourceRemoval{j: j}
+
+	if removal.error = verifyOutput(j); removal.error != nil {
+		return removal
+	}
+
+	if trashDir == "" {
+		removal.error = os.Remove(j.sourceFile)
+		return removal
+	}
+
+	relativePath, err := filepath.Rel(srcDir, j.sourceFile)
+	if err != nil {
+		removal.error = err
+		return removal
+	}
+	removal.trashedTo = filepath.Join(trashDir, relativePath)
+	removal.error = trashFile(j.sourceFile, removal.trashedTo)
+	return removal
+}
+
+// moves a source into the trash, never over something trashed before
+func trashFile(from string, to string) error {
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("%s is already in the trash", to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	return moveFile(from, to)
+}
@@ -0,0 +1,147 @@
+package convert
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where outputs go. what the run does to the destination library goes through one of these: checking which outputs
+// are there already, placing finished ones atomically and pruning what's left over, so it all works the same
+// wherever the library is
+type destinationBackend interface {
+	Stat(path string) (fs.FileInfo, error)
+	// creates or truncates a file, its folder has to exist
+	Create(path string) (io.WriteCloser, error)
+	// renames a file within the destination, replacing what's there. staged outputs outside it fail
+	// with an *os.LinkError and are copied in instead, see moveIntoPlace
+	Rename(from string, to string) error
+	// removes a file or an empty folder
+	Remove(path string) error
+	// lists a folder, sorted by name
+	List(dir string) ([]fs.DirEntry, error)
+	// creates a single folder, its parent has to exist
+	Mkdir(path string) error
+}
+
+// a destination on a filesystem the machine has mounted, a card, a usb drive or a network share
+type localDestination struct{}
+
+func (localDestination) Stat(path string) (fs.FileInfo, error) { return os.Stat(path) }
+
+func (localDestination) Create(path string) (io.WriteCloser, error) { return os.Create(path) }
+
+func (localDestination) Rename(from string, to string) error { return os.Rename(from, to) }
+
+func (localDestination) Remove(path string) error { return os.Remove(path) }
+
+func (localDestination) List(dir string) ([]fs.DirEntry, error) { return os.ReadDir(dir) }
+
+func (localDestination) Mkdir(path string) error { return os.Mkdir(path, os.ModePerm) }
+
+// the backend the run's destination is on
+var destination destinationBackend = localDestination{}
+
+// the kinds of destination people ask for that need a client this build doesn't have, keyed by url scheme
+var unsupportedDestinations = map[string]string{
+	"sftp": "sftp servers",
+	"ssh":  "sftp servers",
+	"s3":   "s3 buckets",
+	"mtp":  "mtp devices, like android phones",
+}
+
+// picks the backend for a destination given on the command line. only local paths have one so far, phones and
+// servers can be synced by mounting them, ie with sshfs, rclone mount or jmtpfs
+func selectDestination(destDir string) error {
+	scheme := ""
+	if i := strings.Index(destDir, "://"); i > 0 {
+		scheme = strings.ToLower(destDir[:i])
+	}
+	switch {
+	case scheme == "" || scheme == "file":
+		destination = localDestination{}
+		return nil
+	case unsupportedDestinations[scheme] != "":
+		return fmt.Errorf("%s can't be written to directly yet, mount it and give the mount point as the destination", unsupportedDestinations[scheme])
+	}
+	return fmt.Errorf("unknown destination %s, it has to be a directory", destDir)
+}
+
+// turns a file:// destination into its path
+func destinationPath(destDir string) string {
+	if strings.HasPrefix(strings.ToLower(destDir), "file://") {
+		return filepath.FromSlash(destDir[len("file://"):])
+	}
+	return destDir
+}
+
+// walks the destination under root like filepath.WalkDir, folders before what's in them. fn can return
+// fs.SkipDir to skip a folder
+func walkDestination(root string, fn func(path string, entry fs.DirEntry) error) error {
+	info, err := destination.Stat(root)
+	if err != nil {
+		return err
+	}
+	if err = fn(root, fs.FileInfoToDirEntry(info)); err != nil || !info.IsDir() {
+		if err == fs.SkipDir {
+			return nil
+		}
+		return err
+	}
+	return walkDestinationDir(root, fn)
+}
+
+func walkDestinationDir(dir string, fn func(path string, entry fs.DirEntry) error) error {
+	entries, err := destination.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		err := fn(path, entry)
+		if err == fs.SkipDir {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if err = walkDestinationDir(path, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removes a file or a folder with everything in it from the destination, a path that's already gone isn't an error.
+// links are removed rather than followed, as with os.RemoveAll
+func removeAllDestination(path string) error {
+	// files, links and empty folders
+	err := destination.Remove(path)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	if info, statErr := destination.Stat(path); statErr != nil || !info.IsDir() {
+		return err
+	}
+
+	entries, err := destination.List(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		if !entry.IsDir() {
+			err = destination.Remove(child)
+		} else {
+			err = removeAllDestination(child)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return destination.Remove(path)
+}
@@ -0,0 +1,219 @@
+package convert
+
+import (
+	"flag"
+	"path/filepath"
+	"sort"
+)
+
+// what a sync would do to an output
+const (
+	diffAdd     = "add"
+	diffReplace = "replace"
+	diffPrune   = "prune"
+)
+
+// a change to the destination the next sync would make
+type diffChange struct {
+	Action string `json:"action"`
+	// the source it comes from, empty for outputs being pruned
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination"`
+	Reason      string `json:"reason"`
+}
+
+// the symbols changes are listed with, the way terraform plan lists them
+var diffSymbols = map[string]string{diffAdd: "+", diffReplace: "~", diffPrune: "-"}
+
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	libraryFlags := addLibraryFlags(flags)
+	jsonOutput := flags.Bool("json", false, "print every change as a json event")
+	flags.Parse(args)
+	// set before the config is loaded so its warnings come out as events, and again after in case a profile sets it
+	console.json = *jsonOutput
+
+	cfg, err := libraryFlags.loadConfig(flags)
+	if err != nil {
+		console.println("couldn't load the config:", err)
+		exit(1)
+	}
+	console.json = *jsonOutput
+	loadProbeCache()
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		exit(2)
+	}
+
+	if err = selectSource(flags.Arg(0)); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	srcDir, err := filepath.Abs(sourcePath(flags.Arg(0)))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = selectDestination(flags.Arg(1)); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	destDir, err := filepath.Abs(destinationPath(flags.Arg(1)))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = checkLibraryPaths(srcDir, destDir); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	console.roots = []string{srcDir, destDir}
+
+	format, err := libraryFlags.format()
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	plan, err := libraryFlags.planOptions()
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	// art makes no difference to where outputs go
+	if err = overrideRuleFormats(cfg.rules, *libraryFlags.extension, false); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	plan.rules = cfg.rules
+
+	state, err := loadState(destDir)
+	if err != nil {
+		console.println("couldn't load the library's state:", err)
+		exit(1)
+	}
+	// the sync is compared against the sample the latest run took, as clean would
+	plan.sample = state.Sample
+
+	ctx, stop := interruptContext()
+	defer stop()
+	planned, err := planJobs(ctx, srcDir, destDir, *format, jobOptions{}, plan)
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = saveProbeCache(); err != nil {
+		console.println("couldn't save the probe cache:", err)
+	}
+
+	changes, unchanged := diffPlan(planned, state)
+	pruned, err := diffPrunes(destDir, planned, state, *format)
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	changes = append(changes, pruned...)
+	printDiff(changes, unchanged)
+}
+
+// sorts the plan into what a run would add or replace and how many outputs it would leave as they are, going by the
+// state database the way createJobsList does
+func diffPlan(planned []job, state *libraryState) ([]diffChange, int) {
+	var changes []diffChange
+	unchanged := 0
+	for _, j := range planned {
+		entry, ok := state.Completed[j.sourceFile]
+		if ok && entry.Destination == j.destinationFile {
+			if !sourceChanged(j.sourceFile, entry) {
+				unchanged++
+				continue
+			}
+			reason := "the source changed, it's converted again"
+			if j.encode && entry.AudioHash != "" {
+				if hash, err := audioHash(j.sourceFile); err == nil && hash == entry.AudioHash {
+					reason = "the source's tags changed, they're copied over"
+				}
+			}
+			changes = append(changes, diffChange{Action: diffReplace, Source: j.sourceFile, Destination: j.destinationFile, Reason: reason})
+			continue
+		}
+
+		// outputs made before the state database knew about them are adopted as they are
+		if destinationExists(j.destinationFile) {
+			unchanged++
+			continue
+		}
+		reason := "new"
+		switch {
+		case ok && destinationExists(entry.Destination):
+			// the old output is left for the prune
+			reason = "moved from " + console.relative(entry.Destination)
+		case j.sidecar:
+			reason = "new, copied along with its album"
+		case !j.encode:
+			reason = "new, copied as it is"
+		}
+		changes = append(changes, diffChange{Action: diffAdd, Source: j.sourceFile, Destination: j.destinationFile, Reason: reason})
+	}
+	return changes, unchanged
+}
+
+// what clean would remove once the plan is through: outputs nothing maps to any more and leftovers of interrupted runs
+func diffPrunes(destDir string, planned []job, state *libraryState, format audioFormat) ([]diffChange, error) {
+	expected := make(map[string]bool, len(planned))
+	for _, j := range planned {
+		expected[j.destinationFile] = true
+	}
+	for _, entry := range state.Completed {
+		if entry.SourceDeleted {
+			expected[entry.Destination] = true
+		}
+	}
+
+	items, err := findCleanupItems(destDir, expected, format)
+	if err != nil {
+		return nil, err
+	}
+	var changes []diffChange
+	for _, item := range items {
+		changes = append(changes, diffChange{Action: diffPrune, Destination: item.path, Reason: item.reason})
+	}
+	return changes, nil
+}
+
+// lists the changes by where they land in the destination, then how many there are of each
+func printDiff(changes []diffChange, unchanged int) {
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Destination < changes[j].Destination })
+
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Action]++
+		change := change
+		console.report("diff", change, func() {
+			console.printf("%s %s (%s)\n", diffSymbols[change.Action], console.relative(change.Destination), change.Reason)
+		})
+	}
+
+	data := struct {
+		Add       int `json:"add"`
+		Replace   int `json:"replace"`
+		Prune     int `json:"prune"`
+		Unchanged int `json:"unchanged"`
+	}{counts[diffAdd], counts[diffReplace], counts[diffPrune], unchanged}
+	console.report("summary", data, func() {
+		if len(changes) == 0 {
+			console.printf("no changes, all %s outputs are up to date\n", formatCount(unchanged))
+			return
+		}
+		console.printf("\n%s to add, %s to replace, %s to prune, %s unchanged\n", formatCount(data.Add), formatCount(data.Replace), formatCount(data.Prune), formatCount(data.Unchanged))
+	})
+}
+
+func destinationExists(path string) bool {
+	_, err := destination.Stat(path)
+	return err == nil
+}
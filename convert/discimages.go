@@ -0,0 +1,470 @@
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// read by -images without mounting them: iso9660 images of discs with audio files on them, and the bin+cue images
+// rippers make of audio cds, whose tracks are cut out of the bin as wavs
+func isDiscImageExtension(extension string) bool {
+	switch strings.ToLower(extension) {
+	case ".iso", ".cue":
+		return true
+	}
+	return false
+}
+
+const (
+	isoSectorSize = 2048
+	// a raw audio cd sector, 1/75th of a second of 16 bit stereo at 44.1 kHz
+	cdSectorSize       = 2352
+	cdSectorsPerSecond = 75
+)
+
+// a file in an iso image
+type isoFile struct {
+	name   string
+	extent uint32
+	size   uint32
+}
+
+// lists the audio files in an iso image by their path inside it, preferring the joliet names when the image has them,
+// the plain iso9660 ones are cut to 8.3 and upper case
+func listISO(imagePath string) ([]string, error) {
+	files, err := readISO(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, file := range files {
+		if isAudioExtension(filepath.Ext(file.name)) {
+			entries = append(entries, file.name)
+		}
+	}
+	return entries, nil
+}
+
+// extracts a single file of an iso image to target
+func extractISOEntry(imagePath string, entryName string, target string) error {
+	files, err := readISO(imagePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.name != entryName {
+			continue
+		}
+		in, err := os.Open(imagePath)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		return writeImageRange(in, int64(file.extent)*isoSectorSize, int64(file.size), nil, target, false)
+	}
+	return fmt.Errorf("%s is no longer in %s", entryName, imagePath)
+}
+
+// reads the directory tree of an iso image
+func readISO(imagePath string) ([]isoFile, error) {
+	in, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	// the volume descriptors start at the 16th sector, the primary one is always there and a joliet one often follows it
+	var root []byte
+	joliet := false
+	for sector := int64(16); ; sector++ {
+		descriptor := make([]byte, isoSectorSize)
+		if _, err := in.ReadAt(descriptor, sector*isoSectorSize); err != nil {
+			return nil, fmt.Errorf("not an iso image: %s", err)
+		}
+		if string(descriptor[1:6]) != "CD001" {
+			return nil, fmt.Errorf("not an iso image")
+		}
+		kind := descriptor[0]
+		if kind == 255 {
+			break
+		}
+		escapes := string(descriptor[88:91])
+		switch {
+		case kind == 1 && root == nil:
+			root = descriptor[156:190]
+		case kind == 2 && (escapes == "%/@" || escapes == "%/C" || escapes == "%/E"):
+			root, joliet = descriptor[156:190], true
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("%s has no primary volume descriptor", imagePath)
+	}
+
+	var files []isoFile
+	visited := make(map[uint32]bool)
+	var walk func(extent uint32, size uint32, dir string, depth int) error
+	walk = func(extent uint32, size uint32, dir string, depth int) error {
+		// a broken or malicious image can point a directory back at its parent
+		if visited[extent] || depth > 64 {
+			return nil
+		}
+		visited[extent] = true
+
+		data := make([]byte, size)
+		if _, err := in.ReadAt(data, int64(extent)*isoSectorSize); err != nil {
+			return err
+		}
+		for offset := 0; offset < len(data); {
+			length := int(data[offset])
+			// records don't cross sectors, the rest of this one is padding
+			if length == 0 {
+				offset = (offset/isoSectorSize + 1) * isoSectorSize
+				continue
+			}
+			if length < 34 || offset+length > len(data) {
+				return fmt.Errorf("broken directory record in %s", imagePath)
+			}
+			record := data[offset : offset+length]
+			offset += length
+
+			nameLength := int(record[32])
+			if 33+nameLength > len(record) {
+				return fmt.Errorf("broken directory record in %s", imagePath)
+			}
+			rawName := record[33 : 33+nameLength]
+			// the directory itself and its parent
+			if nameLength == 1 && rawName[0] <= 1 {
+				continue
+			}
+			name := isoName(rawName, joliet)
+			if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+				continue
+			}
+
+			childExtent := binary.LittleEndian.Uint32(record[2:6])
+			childSize := binary.LittleEndian.Uint32(record[10:14])
+			path := filepath.Join(dir, name)
+			if record[25]&0x02 != 0 {
+				if err := walk(childExtent, childSize, path, depth+1); err != nil {
+					return err
+				}
+			} else {
+				files = append(files, isoFile{name: path, extent: childExtent, size: childSize})
+			}
+		}
+		return nil
+	}
+
+	err = walk(binary.LittleEndian.Uint32(root[2:6]), binary.LittleEndian.Uint32(root[10:14]), "", 0)
+	return files, err
+}
+
+// the readable name of a directory record, joliet names are big endian ucs-2 and plain ones end in a ;1 version
+func isoName(raw []byte, joliet bool) string {
+	name := string(raw)
+	if joliet {
+		units := make([]uint16, len(raw)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(raw[i*2:])
+		}
+		name = string(utf16.Decode(units))
+	}
+	if i := strings.LastIndex(name, ";"); i != -1 {
+		name = name[:i]
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// a track of a cue sheet, pointing into one of its bin files
+type cueTrack struct {
+	number    int
+	title     string
+	performer string
+	file      string
+	// the position of its INDEX 01 in the file, in cd sectors
+	start int64
+	// motorola bins hold big endian samples
+	bigEndian bool
+}
+
+// reads the audio tracks of a cue sheet whose files are raw bin images, cue sheets of single wav or flac images
+// aren't read, those files are converted on their own
+func readCueSheet(cuePath string) (album string, albumArtist string, tracks []cueTrack, err error) {
+	data, err := os.ReadFile(cuePath)
+	if err != nil {
+		return "", "", nil, err
+	}
+	// a byte order mark would stick to the first command
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	var file string
+	var bigEndian, inTrack bool
+	var current *cueTrack
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		command, arguments := cueCommand(scanner.Text())
+		switch command {
+		case "FILE":
+			file, bigEndian = "", false
+			if len(arguments) >= 2 && (arguments[1] == "BINARY" || arguments[1] == "MOTOROLA") {
+				file = filepath.Join(filepath.Dir(cuePath), filepath.FromSlash(strings.ReplaceAll(arguments[0], `\`, "/")))
+				bigEndian = arguments[1] == "MOTOROLA"
+			}
+		case "TRACK":
+			current, inTrack = nil, true
+			if len(arguments) < 2 {
+				continue
+			}
+			number, _ := strconv.Atoi(arguments[0])
+			// data tracks of enhanced cds are left out
+			if file != "" && arguments[1] == "AUDIO" {
+				tracks = append(tracks, cueTrack{number: number, file: file, start: -1, bigEndian: bigEndian})
+				current = &tracks[len(tracks)-1]
+			}
+		case "TITLE", "PERFORMER":
+			if len(arguments) == 0 || (inTrack && current == nil) {
+				continue
+			}
+			switch {
+			case !inTrack && command == "TITLE":
+				album = arguments[0]
+			case !inTrack:
+				albumArtist = arguments[0]
+			case command == "TITLE":
+				current.title = arguments[0]
+			default:
+				current.performer = arguments[0]
+			}
+		case "INDEX":
+			if current != nil && len(arguments) >= 2 && arguments[0] == "01" {
+				if current.start, err = parseCueTime(arguments[1]); err != nil {
+					return "", "", nil, fmt.Errorf("track %d of %s: %s", current.number, cuePath, err)
+				}
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", "", nil, err
+	}
+
+	for _, track := range tracks {
+		if track.start < 0 {
+			return "", "", nil, fmt.Errorf("track %d of %s has no INDEX 01", track.number, cuePath)
+		}
+	}
+	return album, albumArtist, tracks, nil
+}
+
+// splits a line of a cue sheet into its command and arguments, quoted arguments can have spaces in them
+func cueCommand(line string) (string, []string) {
+	var fields []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		if line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end == -1 {
+				fields = append(fields, line[1:])
+				break
+			}
+			fields = append(fields, line[1:end+1])
+			line = strings.TrimSpace(line[end+2:])
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end == -1 {
+			fields = append(fields, line)
+			break
+		}
+		fields = append(fields, line[:end])
+		line = strings.TrimSpace(line[end:])
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(fields[0]), fields[1:]
+}
+
+// reads a cue sheet's mm:ss:ff position, ff being 1/75th of a second, as cd sectors
+func parseCueTime(value string) (int64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("%q isn't an mm:ss:ff time", value)
+	}
+	var numbers [3]int64
+	for i, part := range parts {
+		number, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || number < 0 {
+			return 0, fmt.Errorf("%q isn't an mm:ss:ff time", value)
+		}
+		numbers[i] = number
+	}
+	if numbers[1] >= 60 || numbers[2] >= cdSectorsPerSecond {
+		return 0, fmt.Errorf("%q isn't an mm:ss:ff time", value)
+	}
+	return (numbers[0]*60+numbers[1])*cdSectorsPerSecond + numbers[2], nil
+}
+
+// the name a track of a cue sheet is listed and extracted under, ie "03 Title.wav"
+func cueTrackName(track cueTrack) string {
+	title := tagFileName(track.title)
+	if title == "" {
+		title = fmt.Sprintf("Track %02d", track.number)
+	}
+	return fmt.Sprintf("%02d %s.wav", track.number, title)
+}
+
+// lists the audio tracks of a bin+cue image by the names they're extracted under
+func listCueSheet(cuePath string) ([]string, error) {
+	_, _, tracks, err := readCueSheet(cuePath)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, track := range tracks {
+		entries = append(entries, cueTrackName(track))
+	}
+	return entries, nil
+}
+
+// cuts a track out of a bin+cue image into a wav at target, tagged with the cue sheet's titles. pregaps stay with
+// the track before them, as cd players play them
+func extractCueTrack(cuePath string, entryName string, target string) error {
+	album, albumArtist, tracks, err := readCueSheet(cuePath)
+	if err != nil {
+		return err
+	}
+	for i, track := range tracks {
+		if cueTrackName(track) != entryName {
+			continue
+		}
+
+		in, err := os.Open(track.file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		}
+
+		start := track.start * cdSectorSize
+		end := info.Size()
+		if i+1 < len(tracks) && tracks[i+1].file == track.file {
+			end = tracks[i+1].start * cdSectorSize
+		}
+		if start >= end || end > info.Size() {
+			return fmt.Errorf("track %d of %s is out of %s", track.number, cuePath, track.file)
+		}
+
+		artist := track.performer
+		if artist == "" {
+			artist = albumArtist
+		}
+		header := wavHeader(end-start, []infoTag{{"INAM", track.title}, {"IART", artist}, {"IPRD", album}, {"ITRK", strconv.Itoa(track.number)}})
+		return writeImageRange(in, start, end-start, header, target, track.bigEndian)
+	}
+	return fmt.Errorf("%s is no longer in %s", entryName, cuePath)
+}
+
+// a tag of a wav's LIST INFO chunk, which ffmpeg reads as title, artist, album and track
+type infoTag struct {
+	id    string
+	value string
+}
+
+// the header of a 16 bit stereo 44.1 kHz wav holding dataSize bytes of samples
+func wavHeader(dataSize int64, tags []infoTag) []byte {
+	var info bytes.Buffer
+	info.WriteString("INFO")
+	for _, tag := range tags {
+		if tag.value == "" {
+			continue
+		}
+		value := append([]byte(tag.value), 0)
+		if len(value)%2 == 1 {
+			value = append(value, 0)
+		}
+		info.WriteString(tag.id)
+		binary.Write(&info, binary.LittleEndian, uint32(len(value)))
+		info.Write(value)
+	}
+
+	var header bytes.Buffer
+	chunks := 4 + 8 + 16 + 8 + dataSize
+	if info.Len() > 4 {
+		chunks += int64(8 + info.Len())
+	}
+	header.WriteString("RIFF")
+	binary.Write(&header, binary.LittleEndian, uint32(chunks))
+	header.WriteString("WAVEfmt ")
+	binary.Write(&header, binary.LittleEndian, []uint32{16})
+	// pcm, 2 channels, 44100 Hz, 176400 bytes a second, 4 bytes a frame, 16 bits
+	binary.Write(&header, binary.LittleEndian, []uint16{1, 2})
+	binary.Write(&header, binary.LittleEndian, []uint32{44100, 176400})
+	binary.Write(&header, binary.LittleEndian, []uint16{4, 16})
+	if info.Len() > 4 {
+		header.WriteString("LIST")
+		binary.Write(&header, binary.LittleEndian, uint32(info.Len()))
+		header.Write(info.Bytes())
+	}
+	header.WriteString("data")
+	binary.Write(&header, binary.LittleEndian, uint32(dataSize))
+	return header.Bytes()
+}
+
+// writes size bytes of an image from offset to target, after header. with swap the 16 bit samples have their bytes
+// swapped, for big endian bins
+func writeImageRange(in io.ReaderAt, offset int64, size int64, header []byte, target string, swap bool) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(header); err != nil {
+		out.Close()
+		return err
+	}
+
+	reader := io.NewSectionReader(in, offset, size)
+	if swap {
+		buffer := make([]byte, 64*cdSectorSize)
+		for {
+			n, readErr := io.ReadFull(reader, buffer)
+			for i := 0; i+1 < n; i += 2 {
+				buffer[i], buffer[i+1] = buffer[i+1], buffer[i]
+			}
+			if _, err = out.Write(buffer[:n]); err != nil {
+				break
+			}
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			} else if readErr != nil {
+				err = readErr
+				break
+			}
+		}
+	} else {
+		var copied int64
+		copied, err = io.Copy(out, reader)
+		if err == nil && copied != size {
+			err = fmt.Errorf("the image ends %d bytes early", size-copied)
+		}
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,114 @@
+package convert
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ffmpegEncoder struct {
+	name        string
+	description string
+}
+
+// prints the formats that can be transcoded to
+func printFormats() {
+	aliases := make(map[string][]string)
+	for alias, name := range formatAliases() {
+		aliases[name] = append(aliases[name], alias)
+	}
+
+	fmt.Printf("%-8s %-9s %-8s %-10s %-26s %s\n", "format", "type", "bitrate", "extension", "other extensions", "aliases")
+	for _, format := range audioFormats() {
+		kind := "lossless"
+		bitrate := "-"
+		if format.isLossy {
+			kind = "lossy"
+			bitrate = fmt.Sprintf("%dk", format.preferredBitrate)
+		}
+		sort.Strings(aliases[format.name])
+		line := fmt.Sprintf("%-8s %-9s %-8s %-10s %-26s %s", format.name, kind, bitrate, format.fileExtension, strings.Join(format.extensions, " "), strings.Join(aliases[format.name], " "))
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+}
+
+// prints the audio encoders the local ffmpeg has, along with the formats they're used for
+func printEncoders() error {
+	encoders, err := getFfmpegAudioEncoders()
+	if err != nil {
+		return err
+	}
+
+	// which formats each encoder serves, and whether it's the one they prefer.
+	// lossless formats have no encoder list, ffmpeg picks these for them
+	serves := map[string][]string{
+		"flac":      {"flac"},
+		"alac":      {"alac"},
+		"pcm_s16be": {"aiff"},
+		"pcm_s16le": {"wav"},
+	}
+	for _, format := range audioFormats() {
+		for i, encoder := range format.encoders {
+			name := format.name
+			if i == 0 {
+				name += " (preferred)"
+			}
+			serves[encoder] = append(serves[encoder], name)
+		}
+	}
+
+	for _, encoder := range encoders {
+		formats := "-"
+		if serves[encoder.name] != nil {
+			formats = strings.Join(serves[encoder.name], ", ")
+		}
+		fmt.Printf("%-20s %-28s %s\n", encoder.name, formats, encoder.description)
+	}
+
+	// point out what's missing, that's usually what people are looking for
+	available := make(map[string]bool)
+	for _, encoder := range encoders {
+		available[encoder.name] = true
+	}
+	var missing []string
+	for encoder := range serves {
+		if !available[encoder] {
+			missing = append(missing, encoder)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		fmt.Printf("\nnot available in this ffmpeg build: %s\n", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// lists the audio encoders ffmpeg was built with
+func getFfmpegAudioEncoders() ([]ffmpegEncoder, error) {
+	out, err := toolCommand(context.Background(), ffmpegPath, "-loglevel", "error", "-encoders").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var encoders []ffmpegEncoder
+	// the legend comes before a ------ line, the encoders after it
+	legend := true
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		words := strings.Fields(scanner.Text())
+		if legend {
+			legend = len(words) == 0 || !strings.HasPrefix(words[0], "---")
+			continue
+		}
+		// capabilities, name, then the description. the first capability is the media type
+		if len(words) < 2 || !strings.HasPrefix(words[0], "A") {
+			continue
+		}
+		encoders = append(encoders, ffmpegEncoder{name: words[1], description: strings.Join(words[2:], " ")})
+	}
+
+	return encoders, nil
+}
@@ -0,0 +1,108 @@
+package convert
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// matches the subfolders multi-disc albums split their discs into, ie CD1, Disc 2 or disk_3
+var discFolderPattern = regexp.MustCompile(`(?i)^(?:cd|dis[ck])[\s._-]*(\d+)$`)
+
+// the track number file names usually start with, ie "07 - Title.flac"
+var trackNumberPattern = regexp.MustCompile(`^(\d+)(.*)$`)
+
+// a track planned out of a disc subfolder, waiting for flattenDiscs to rename it
+type discTrack struct {
+	// index of the track's job in the plan
+	index int
+	disc  int
+}
+
+// checks whether a directory name is a disc subfolder, returning the disc's number
+func discNumber(directoryName string) (int, bool) {
+	match := discFolderPattern.FindStringSubmatch(directoryName)
+	if match == nil {
+		return 0, false
+	}
+	disc, err := strconv.Atoi(match[1])
+	return disc, err == nil
+}
+
+// renames tracks pulled out of disc subfolders so they can't collide and still sort in order.
+// prefix mode turns disc 2's "01 Title" into "2-01 Title", renumber mode carries on counting from the end of the previous disc
+func flattenDiscs(jobs []job, tracks []discTrack, mode string, windowsNames bool) {
+	// discs are grouped by the album folder they're flattened into
+	albums := make(map[string][]discTrack)
+	for _, track := range tracks {
+		directory := filepath.Dir(jobs[track.index].destinationFile)
+		albums[directory] = append(albums[directory], track)
+	}
+
+	for _, albumTracks := range albums {
+		// how many tracks each disc has, by its highest track number or by counting when the names aren't numbered
+		lengths := make(map[int]int)
+		counts := make(map[int]int)
+		for _, track := range albumTracks {
+			counts[track.disc]++
+			if number, _, ok := splitTrackNumber(filepath.Base(jobs[track.index].destinationFile)); ok && number > lengths[track.disc] {
+				lengths[track.disc] = number
+			}
+		}
+		var discs []int
+		for disc, count := range counts {
+			if count > lengths[disc] {
+				lengths[disc] = count
+			}
+			discs = append(discs, disc)
+		}
+		sort.Ints(discs)
+
+		offsets := make(map[int]int)
+		total := 0
+		for _, disc := range discs {
+			offsets[disc] = total
+			total += lengths[disc]
+		}
+		width := len(strconv.Itoa(total))
+		if width < 2 {
+			width = 2
+		}
+
+		for _, track := range albumTracks {
+			j := &jobs[track.index]
+			name := filepath.Base(j.destinationFile)
+			number, rest, numbered := splitTrackNumber(name)
+
+			switch {
+			case mode == "renumber" && numbered:
+				name = fmt.Sprintf("%0*d%s", width, offsets[track.disc]+number, rest)
+			case numbered:
+				name = fmt.Sprintf("%d-%02d%s", track.disc, number, rest)
+			default:
+				// nothing to renumber, the prefix at least keeps discs apart
+				name = fmt.Sprintf("%d-%s", track.disc, name)
+			}
+			if windowsNames {
+				name = windowsSafeName(name)
+			}
+			j.destinationFile = filepath.Join(filepath.Dir(j.destinationFile), name)
+		}
+	}
+}
+
+// splits the leading track number off a file name
+func splitTrackNumber(name string) (int, string, bool) {
+	match := trackNumberPattern.FindStringSubmatch(name)
+	if match == nil {
+		return 0, name, false
+	}
+
+	number, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, name, false
+	}
+	return number, match[2], true
+}
@@ -0,0 +1,209 @@
+package convert
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// hands queued work out to the workers, holding it back while the run is paused
+type dispatcher struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	// held back on top of any pause while the destination can't be reached, see watchDestination
+	unreachable bool
+	// cancelling it stops dispatching the way a budget running out does, and ends a pause
+	ctx context.Context
+
+	// stop starting jobs after this many have been started, 0 for no limit
+	maxJobs int
+	// stop starting jobs after this time, zero for no limit
+	deadline time.Time
+	// stop starting jobs once outputs would take up more than this many bytes, 0 for no limit
+	maxOutputBytes int64
+	// bytes written by finished jobs plus the estimated size of the ones still running, see reserveOutput
+	outputBytes int64
+	// the number of jobs started so far
+	started int
+	// why dispatching stopped early, if it did
+	stopReason string
+	// the quick and long lanes are dispatched at the same time, taking from one budget
+	budgetMutex sync.Mutex
+}
+
+func newDispatcher(ctx context.Context) *dispatcher {
+	d := &dispatcher{ctx: ctx}
+	d.cond = sync.NewCond(&d.mutex)
+	go func() {
+		<-ctx.Done()
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.cond.Broadcast()
+	}()
+	return d
+}
+
+func (d *dispatcher) pause() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.paused {
+		d.paused = true
+		console.println("paused, jobs already running will finish but no new jobs will be started")
+	}
+}
+
+func (d *dispatcher) resume() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.paused {
+		d.paused = false
+		console.println("resumed")
+		d.cond.Broadcast()
+	}
+}
+
+func (d *dispatcher) destinationLost(destDir string, reason string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.unreachable {
+		d.unreachable = true
+		console.printf("the destination %s can't be reached (%s), no new jobs will be started until it's back\n", destDir, reason)
+	}
+}
+
+func (d *dispatcher) destinationBack(destDir string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.unreachable {
+		d.unreachable = false
+		console.printf("the destination %s is back, carrying on\n", destDir)
+		d.cond.Broadcast()
+	}
+}
+
+// blocks for as long as the run is paused, or the destination is unreachable
+func (d *dispatcher) wait() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for (d.paused || d.unreachable) && d.ctx.Err() == nil {
+		d.cond.Wait()
+	}
+}
+
+// stops starting jobs for a reason of the run's own, ie every job failing the same way
+func (d *dispatcher) abort(reason string) {
+	d.budgetMutex.Lock()
+	defer d.budgetMutex.Unlock()
+	if d.stopReason == "" {
+		d.stopReason = reason
+	}
+}
+
+// checks whether the run's budget still allows starting another job
+func (d *dispatcher) withinBudget() bool {
+	if d.stopReason != "" {
+		return false
+	}
+
+	if d.ctx.Err() != nil {
+		d.stopReason = "interrupted"
+	} else if d.maxJobs != 0 && d.started >= d.maxJobs {
+		d.stopReason = "max-jobs"
+	} else if !d.deadline.IsZero() && time.Now().After(d.deadline) {
+		d.stopReason = "max-duration"
+	}
+
+	return d.stopReason == ""
+}
+
+// sets aside room in the output budget for jobs about to start, returning false once they wouldn't fit.
+// jobs carry their reservation, so it can be settled against what they actually wrote once they're done
+func (d *dispatcher) reserveOutput(jobs []job) bool {
+	if d.maxOutputBytes == 0 {
+		return true
+	}
+
+	var estimate int64
+	for i := range jobs {
+		jobs[i].estimatedBytes = estimateOutputSize(jobs[i])
+		estimate += jobs[i].estimatedBytes
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.outputBytes+estimate > d.maxOutputBytes {
+		d.stopReason = "max-output-bytes"
+		return false
+	}
+	d.outputBytes += estimate
+	return true
+}
+
+// swaps a finished job's reservation for the size of what it actually wrote
+func (d *dispatcher) settleOutput(j job, written int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.outputBytes += written - j.estimatedBytes
+}
+
+// checks the budget for jobs about to start and counts them as started if they're within it
+func (d *dispatcher) admit(jobs []job) bool {
+	d.budgetMutex.Lock()
+	defer d.budgetMutex.Unlock()
+
+	if !d.withinBudget() || !d.reserveOutput(jobs) {
+		return false
+	}
+	d.started += len(jobs)
+	return true
+}
+
+// sends jobs to the workers one at a time as they become free, then closes the channel.
+// once the budget runs out the remaining jobs are still sent, but deferred, so every job gets a report
+func (d *dispatcher) dispatchJobs(jobsList []job, jobs chan<- job) {
+	for i := range jobsList {
+		d.wait()
+		if !d.admit(jobsList[i : i+1]) {
+			jobsList[i].deferred = true
+		}
+		jobs <- jobsList[i]
+	}
+	close(jobs)
+}
+
+// like dispatchJobs, but for album batches. albums are never split by the budget
+func (d *dispatcher) dispatchAlbums(albumList []album, albums chan<- album) {
+	for _, a := range albumList {
+		d.wait()
+		if !d.admit(a.jobs) {
+			deferred := make([]job, len(a.jobs))
+			for i, j := range a.jobs {
+				j.deferred = true
+				deferred[i] = j
+			}
+			a.jobs = deferred
+		}
+		albums <- a
+	}
+	close(albums)
+}
+
+// like dispatchJobs, but for ffmpeg batches. the budget is checked per job, jobs past it are deferred within their batch
+func (d *dispatcher) dispatchBatches(batchList [][]job, batches chan<- []job) {
+	for _, batch := range batchList {
+		d.wait()
+		for i := range batch {
+			if !d.admit(batch[i : i+1]) {
+				batch[i].deferred = true
+			}
+		}
+		batches <- batch
+	}
+	close(batches)
+}
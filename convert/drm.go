@@ -0,0 +1,36 @@
+package convert
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// the extensions drm protected files come in: old itunes store purchases and windows media
+var drmExtensions = map[string]bool{
+	".m4p": true,
+	".wma": true,
+	".asf": true,
+}
+
+// checks whether a probed stream is drm protected, from its codec tag or what ffprobe warned about it.
+// fairplay streams are tagged drms, protected windows media gets a warning from the asf demuxer
+func isProtectedStream(codecTag string, warnings string) bool {
+	switch strings.ToLower(codecTag) {
+	case "drms", "drmi":
+		return true
+	}
+	return strings.Contains(strings.ToLower(warnings), "drm protected")
+}
+
+// whether a job's source is drm protected, which only files that can be are probed for
+func isProtectedSource(j job) bool {
+	if !drmExtensions[strings.ToLower(filepath.Ext(j.sourceFile))] {
+		return false
+	}
+
+	probe, err := probeSource(j.sourceFile)
+	if err != nil {
+		return false
+	}
+	return probe.protected
+}
@@ -0,0 +1,131 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the key an encode is cached under: the source's contents along with everything that decides what ffmpeg makes of
+// them, so a duplicate album or a second run at the same settings gets the exact same file back
+func encodeCacheKey(j job) (string, error) {
+	in, err := source.Open(j.sourceFile)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, in); err != nil {
+		return "", err
+	}
+
+	// the paths have nothing to do with what's written, only the arguments around them do
+	placeholder := j
+	placeholder.sourceFile = "source"
+	placeholder.destinationFile = "output" + filepath.Ext(j.destinationFile)
+	fmt.Fprintf(hash, "\x00%s\x00%s", encodingBackend(j), commandLine("ffmpeg", buildFfmpegArgs(j.format, placeholder, j.options)))
+	// applied after ffmpeg is done
+	fmt.Fprintf(hash, "\x00%t", carriesFlacBlocks(j))
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// the backend a job's encode runs on, see executeJob
+func encodingBackend(j job) string {
+	if j.remux || changesAudio(j.options) {
+		return "exec"
+	}
+	return selectedBackend
+}
+
+// where an encode is kept in the cache, spread over folders by the key's first byte
+func encodeCachePath(cacheDir string, key string, extension string) string {
+	return filepath.Join(cacheDir, key[:2], key+strings.ToLower(extension))
+}
+
+// checks whether the cache has a job's encode, its key has to be worked out already
+func isCachedEncode(j job) bool {
+	if j.cacheKey == "" {
+		return false
+	}
+	_, err := os.Stat(encodeCachePath(j.options.cacheDir, j.cacheKey, filepath.Ext(j.destinationFile)))
+	return err == nil
+}
+
+// copies a cached encode to the staged output, or links it with -cache-links, returning false when the cache doesn't have it.
+// a cache shared by several destinations, ie the phone's and the car's, fills each of them from the one encode
+func restoreCachedEncode(j job, stagedFile string) (bool, error) {
+	cached := encodeCachePath(j.options.cacheDir, j.cacheKey, filepath.Ext(j.destinationFile))
+	// the staged output is renamed into the destination, which keeps the link
+	if j.options.cacheLinks && os.Link(cached, stagedFile) == nil {
+		return true, nil
+	}
+
+	in, err := os.Open(cached)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(stagedFile)
+	if err != nil {
+		return false, err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return false, err
+	}
+	return true, out.Close()
+}
+
+// keeps a copy of a finished encode for the next job with the same key. it's written next to its place and renamed
+// into it, so a run that dies halfway never leaves a truncated file to be handed out. failing to cache isn't an error
+func storeCachedEncode(j job, stagedFile string) {
+	cached := encodeCachePath(j.options.cacheDir, j.cacheKey, filepath.Ext(j.destinationFile))
+	if _, err := os.Stat(cached); err == nil {
+		return
+	}
+
+	err := func() error {
+		if err := os.MkdirAll(filepath.Dir(cached), os.ModePerm); err != nil {
+			return err
+		}
+		// another run sharing the cache can get there first, whichever encode is kept they're the same
+		if j.options.cacheLinks {
+			if err := os.Link(stagedFile, cached); err == nil || os.IsExist(err) {
+				return nil
+			}
+		}
+		in, err := os.Open(stagedFile)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		partial := fmt.Sprintf("%s.%d.partial", cached, time.Now().UnixNano())
+		out, err := os.Create(partial)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(partial)
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		if err = out.Close(); err != nil {
+			return err
+		}
+		return os.Rename(partial, cached)
+	}()
+	if err != nil {
+		console.debugf("couldn't cache the encode of %s: %s\n", j.sourceFile, err)
+	}
+}
@@ -0,0 +1,69 @@
+package convert
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the variables ffmpeg, ffprobe and metaflac are run with: enough to find libraries and hardware, and none of ffmpeg's
+// own like FFREPORT or AV_LOG_FORCE_COLOR, which would change what it writes and where. builds installed outside the
+// system's library path, ie under /opt or a homebrew prefix, only start with LD_LIBRARY_PATH or DYLD_LIBRARY_PATH
+var toolEnvironment = []string{"PATH", "HOME", "TMPDIR", "TEMP", "TMP", "SYSTEMROOT", "SYSTEMDRIVE", "WINDIR", "DISPLAY", "XDG_RUNTIME_DIR", "LD_LIBRARY_PATH", "DYLD_LIBRARY_PATH"}
+
+// set whatever the caller's are. output read back, like astats levels, is parsed as written in the C locale,
+// a german one would write them with decimal commas. paths are bytes to ffmpeg either way
+var toolEnvironmentOverrides = []string{"LC_ALL=C", "AV_LOG_FORCE_NOCOLOR=1"}
+
+// hardware decoders are set up through variables of their own, ie LIBVA_DRIVER_NAME
+var toolEnvironmentPrefixes = []string{"LIBVA_", "VDPAU_", "CUDA_", "NVIDIA_"}
+
+// an exec.Cmd for one of the external tools, with a clean environment and the temp directory to run in,
+// so neither the caller's shell nor whatever directory it was started in can change what a job does
+func toolCommand(ctx context.Context, path string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Dir = os.TempDir()
+	cmd.Env = []string{}
+	for _, variable := range os.Environ() {
+		name := strings.ToUpper(strings.SplitN(variable, "=", 2)[0])
+		keep := false
+		for _, kept := range toolEnvironment {
+			keep = keep || name == kept
+		}
+		for _, prefix := range toolEnvironmentPrefixes {
+			keep = keep || strings.HasPrefix(name, prefix)
+		}
+		if keep {
+			cmd.Env = append(cmd.Env, variable)
+		}
+	}
+	cmd.Env = append(cmd.Env, toolEnvironmentOverrides...)
+	return cmd
+}
+
+// a command line as it would be typed into a shell, for logging. arguments with control characters in them,
+// ie file names with a newline, are go quoted so a command always takes up a single line
+func commandLine(path string, args []string) string {
+	quoted := []string{quoteArgument(path)}
+	for _, arg := range args {
+		quoted = append(quoted, quoteArgument(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// characters no shell does anything with
+const shellSafeCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=,+@%"
+
+func quoteArgument(arg string) string {
+	switch {
+	case arg == "":
+		return "''"
+	case strings.IndexFunc(arg, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0:
+		return strconv.Quote(arg)
+	case strings.Trim(arg, shellSafeCharacters) == "":
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
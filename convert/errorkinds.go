@@ -0,0 +1,115 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// the kinds of failure the run tells apart. errors are wrapped with them where they happen, see withKind, so the
+// summary, -json and whatever decides a failure is worth trying again find them with errors.Is instead of reading
+// the messages
+var (
+	errSourceUnreadable = errors.New("unreadable source")
+	errEncoderFailed    = errors.New("the encoder failed")
+	errDestinationFull  = errors.New("the destination is full")
+	errTimeout          = errors.New("timed out")
+	errCorrupt          = errors.New("corrupt audio")
+)
+
+// the names the kinds go by in -json output, the more telling ones first: a full destination makes ffmpeg fail too
+var errorKindNames = []struct {
+	kind error
+	name string
+}{
+	{errDestinationFull, "destination-full"},
+	{errSourceUnreadable, "source-unreadable"},
+	{errTimeout, "timeout"},
+	{errCorrupt, "corrupt"},
+	{errEncoderFailed, "encoder-failed"},
+}
+
+// an error of a known kind, which reads the same as the error it wraps
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+
+func (e *kindError) Unwrap() error { return e.err }
+
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+func withKind(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// an error writing into the destination, marked as a full destination when that's what it was
+func destinationError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return withKind(errDestinationFull, err)
+	}
+	return err
+}
+
+// ffmpeg, or the libav backend, giving up on an encode
+type encoderError struct {
+	// ffmpeg or libav
+	encoder  string
+	exitCode int
+	// what it complained about, see captureStderr
+	stderr []string
+}
+
+func (e *encoderError) Error() string {
+	message := fmt.Sprintf("%s: %s", e.encoder, strings.Join(e.stderr, "; "))
+	if e.exitCode > 0 {
+		message += fmt.Sprintf(", exit code: %d", e.exitCode)
+	}
+	return message
+}
+
+// ffmpeg only says in words why it failed, a source it can't make sense of and a full destination are told apart
+// from the encoder failing by what it said
+var (
+	unreadableSourcePattern = regexp.MustCompile(`(?i)invalid data found when processing input|could not find codec parameters|moov atom not found|error while decoding`)
+	noSpacePattern          = regexp.MustCompile(`(?i)no space left on device|disk quota exceeded|not enough space`)
+)
+
+func (e *encoderError) Is(target error) bool {
+	switch target {
+	case errEncoderFailed:
+		return true
+	case errSourceUnreadable:
+		return unreadableSourcePattern.MatchString(strings.Join(e.stderr, "\n"))
+	case errDestinationFull:
+		return noSpacePattern.MatchString(strings.Join(e.stderr, "\n"))
+	}
+	return false
+}
+
+// the exit code of a command that failed, 0 when it didn't get to exit
+func exitCodeOf(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return 0
+}
+
+// the name of an error's kind for -json, empty when it isn't one of the known kinds
+func errorKindName(err error) string {
+	for _, known := range errorKindNames {
+		if errors.Is(err, known.kind) {
+			return known.name
+		}
+	}
+	return ""
+}
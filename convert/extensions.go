@@ -0,0 +1,92 @@
+package convert
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the extensions planned as sources and whether each is lossy, keyed by the lowercased extension.
+// built from audioExtensions and extended by the config's [extensions] table
+var sourceExtensions = builtinSourceExtensions()
+
+// lowercases an extension and makes sure it starts with a dot, so .FLAC, flac and .flac are one entry
+func normalizeExtension(extension string) string {
+	extension = strings.ToLower(strings.TrimSpace(extension))
+	if extension != "" && !strings.HasPrefix(extension, ".") {
+		extension = "." + extension
+	}
+	return extension
+}
+
+func builtinSourceExtensions() map[string]bool {
+	// an extension is lossy when a lossy format writes it, m4a files are taken for aac rather than alac
+	lossy := make(map[string]bool)
+	for _, format := range audioFormats() {
+		if format.isLossy {
+			lossy[normalizeExtension(format.fileExtension)] = true
+		}
+	}
+
+	extensions := make(map[string]bool)
+	for _, extension := range audioExtensions() {
+		extension = normalizeExtension(extension)
+		extensions[extension] = lossy[extension]
+	}
+	return extensions
+}
+
+// reads the [extensions] table, which adds source extensions as lossy (copied) or lossless (encoded), ie
+//
+//	[extensions]
+//	lossy = [".mpc", ".wv"]
+//	lossless = [".dsf"]
+//
+// conflicts are warned about rather than refused: an extension listed as both is taken as lossy, so it's never reencoded
+func readExtensions(root configTable) (map[string]bool, []string, error) {
+	table, ok := root["extensions"].(configTable)
+	if !ok {
+		if root["extensions"] != nil {
+			return nil, nil, fmt.Errorf("extensions has to be a table")
+		}
+		return nil, nil, nil
+	}
+
+	extensions := make(map[string]bool)
+	var warnings []string
+	for _, kind := range []string{"lossless", "lossy"} {
+		values, err := configStrings(table, kind)
+		if err != nil {
+			return nil, nil, fmt.Errorf("extensions: %s", err)
+		}
+		for _, value := range values {
+			extension := normalizeExtension(value)
+			if extension == "" || extension == "." {
+				return nil, nil, fmt.Errorf("extensions: %q isn't an extension", value)
+			}
+
+			lossy := kind == "lossy"
+			if listedLossy, listed := extensions[extension]; listed && listedLossy != lossy {
+				warnings = append(warnings, fmt.Sprintf("%s is listed as both lossy and lossless, it'll be copied as lossy", extension))
+			} else if builtinLossy, builtin := sourceExtensions[extension]; builtin && builtinLossy != lossy {
+				warnings = append(warnings, fmt.Sprintf("%s is usually %s, the config makes it %s", extension, lossyName(builtinLossy), lossyName(lossy)))
+			}
+			extensions[extension] = lossy || extensions[extension]
+		}
+	}
+	for key := range table {
+		if key != "lossy" && key != "lossless" {
+			return nil, nil, fmt.Errorf("extensions: unknown key %s, valid ones are lossy and lossless", key)
+		}
+	}
+
+	sort.Strings(warnings)
+	return extensions, warnings, nil
+}
+
+func lossyName(lossy bool) string {
+	if lossy {
+		return "lossy"
+	}
+	return "lossless"
+}
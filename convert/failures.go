@@ -0,0 +1,81 @@
+package convert
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// once this many jobs have failed for the same reason, further ones are only counted for the summary
+const failureLinesPerCause = 3
+
+// causes that are worth a name of their own, matched against ffmpeg's and the os's error messages
+var failureCauses = []struct {
+	pattern *regexp.Regexp
+	cause   string
+}{
+	{regexp.MustCompile(`(?i)permission denied|access is denied|operation not permitted`), "permission denied"},
+	{regexp.MustCompile(`(?i)no space left on device|disk quota exceeded|not enough space`), "the destination is full"},
+	{regexp.MustCompile(`(?i)read-only file system`), "the destination is read-only"},
+	{regexp.MustCompile(`(?i)unknown encoder|encoder not found`), "missing encoder"},
+	{regexp.MustCompile(`(?i)invalid data found when processing input|could not find codec parameters|moov atom not found`), "unreadable source"},
+	{regexp.MustCompile(`(?i)no such file or directory|cannot find the (file|path)`), "file went missing"},
+	{regexp.MustCompile(`(?i)input/output error|stale (nfs )?file handle`), "i/o error"},
+	{regexp.MustCompile(`(?i)refusing to write`), "refused to write inside the source"},
+}
+
+// the parts of error messages that differ between otherwise identical failures
+var (
+	quotedPathPattern = regexp.MustCompile(`"[^"]*"|'[^']*'`)
+	pathPattern       = regexp.MustCompile(`(?:[A-Za-z]:)?[\\/][^\s:]*`)
+	numberPattern     = regexp.MustCompile(`\d+`)
+)
+
+// names why a job failed, so hundreds of jobs failing for the same reason can be told about once
+func failureCause(err error) string {
+	if errors.Is(err, os.ErrPermission) {
+		return "permission denied"
+	}
+	// the kinds that name themselves, the encoder failing is told apart further by what it said
+	for _, kind := range []error{errDestinationFull, errSourceUnreadable, errTimeout, errCorrupt} {
+		if errors.Is(err, kind) {
+			return kind.Error()
+		}
+	}
+
+	message := err.Error()
+	for _, known := range failureCauses {
+		if known.pattern.MatchString(message) {
+			return known.cause
+		}
+	}
+
+	// otherwise the message itself, without the paths and numbers that make every one unique
+	message = quotedPathPattern.ReplaceAllString(message, "…")
+	message = pathPattern.ReplaceAllString(message, "…")
+	message = numberPattern.ReplaceAllString(message, "N")
+	message = strings.Join(strings.Fields(message), " ")
+	return truncateBytes(message, 120)
+}
+
+// failures grouped by their cause, the most common first
+type failureGroup struct {
+	cause   string
+	sources []string
+}
+
+func groupFailures(causes map[string][]string) []failureGroup {
+	var groups []failureGroup
+	for cause, sources := range causes {
+		groups = append(groups, failureGroup{cause: cause, sources: sources})
+	}
+	sort.Slice(groups, func(a, b int) bool {
+		if len(groups[a].sources) != len(groups[b].sources) {
+			return len(groups[a].sources) > len(groups[b].sources)
+		}
+		return groups[a].cause < groups[b].cause
+	})
+	return groups
+}
@@ -0,0 +1,58 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// yt-dlp fetches url sources, from youtube, bandcamp and everything else it has an extractor for
+var ytDlpPath = "yt-dlp"
+
+// where downloads are saved in the temporary source library, laid out like a ripped album as Artist/Album/NN Title
+// from whatever the site says about them. single videos without an album go in Singles
+const downloadTemplate = "%(album_artist,artist,uploader|Unknown Artist)s/%(album,playlist_title|Singles)s/%(track_number,playlist_index&{:02d} |)s%(track,title)s.%(ext)s"
+
+// whether a source given on the command line is a link to download rather than a directory
+func isSourceURL(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://")
+}
+
+// downloads the best audio of a video, playlist or album page into a new temporary library, tagged with what the
+// site knows about it. the streams are kept as they are, the run's format decides what they end up as
+func fetchURLSource(ctx context.Context, link string) (string, error) {
+	if _, err := exec.LookPath(ytDlpPath); err != nil {
+		return "", fmt.Errorf("url sources need yt-dlp, which isn't installed")
+	}
+	dir, err := os.MkdirTemp("", "convert-muh-music-download-*")
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"--quiet", "--no-warnings", "--no-progress", "--yes-playlist", "--format", "bestaudio/best", "--extract-audio", "--embed-metadata", "--paths", dir, "--output", downloadTemplate}
+	if filepath.IsAbs(ffmpegPath) {
+		args = append(args, "--ffmpeg-location", ffmpegPath)
+	}
+	// yt-dlp isn't run with the tools' clean environment, downloads go through the user's proxies
+	out, err := exec.CommandContext(ctx, ytDlpPath, append(args, "--", link)...).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("yt-dlp couldn't download %s: %s", link, strings.TrimSpace(string(out)))
+	}
+
+	found := false
+	filepath.WalkDir(dir, func(curPath string, entry fs.DirEntry, err error) error {
+		found = found || (err == nil && !entry.IsDir() && isAudioExtension(filepath.Ext(curPath)))
+		return nil
+	})
+	if !found {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("yt-dlp didn't find any audio at %s", link)
+	}
+	return dir, nil
+}
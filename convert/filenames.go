@@ -0,0 +1,71 @@
+package convert
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// device names windows won't allow as file names, with or without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// renames a single path component windows can't create, ie con.flac becomes con_.flac
+func windowsSafeName(name string) string {
+	base := name
+	rest := ""
+	if dot := strings.Index(name, "."); dot != -1 {
+		base = name[:dot]
+		rest = name[dot:]
+	}
+
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = base + "_" + rest
+	}
+
+	// windows silently drops trailing dots and spaces, which makes the file unreachable under its real name
+	if trimmed := strings.TrimRight(name, ". "); trimmed != name {
+		name = trimmed + "_"
+	}
+
+	return name
+}
+
+// applies windowsSafeName to every component of a relative path
+func windowsSafePath(relativePath string) string {
+	var components []string
+	for _, component := range strings.Split(filepath.ToSlash(relativePath), "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		components = append(components, windowsSafeName(component))
+	}
+
+	return filepath.Join(components...)
+}
+
+// replaces the control characters in a path, ie a newline in a track name, which players and line based tools choke on,
+// along with the unicode ones that reorder text, see isHostileRune. bytes that aren't utf-8 go too, filesystems that
+// store names as utf-16, like a phone's exfat card, can't hold them. most filesystems take all of them, so sources
+// can have them, outputs never do
+func controlFreePath(p string) string {
+	return strings.Map(func(r rune) rune {
+		if isHostileRune(r) || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, p)
+}
+
+// turns a tag value into something every filesystem takes as a file name, ie "AC/DC" becomes "AC_DC"
+func tagFileName(value string) string {
+	return strings.Map(func(r rune) rune {
+		if isHostileRune(r) || r == utf8.RuneError || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(value))
+}
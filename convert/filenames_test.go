@@ -0,0 +1,117 @@
+package convert
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlFreePath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"plain paths", "Artist/Album/01 Track.flac", "Artist/Album/01 Track.flac"},
+		{"unicode paths", "Björk/Homogenic/01 Jóga.flac", "Björk/Homogenic/01 Jóga.flac"},
+		{"newlines", "Artist/Album\n(Live)/01\r\n.flac", "Artist/Album_(Live)/01__.flac"},
+		{"terminal escapes", "\x1b[31mArtist/01.flac", "_[31mArtist/01.flac"},
+		{"nul, del and tabs", "a\x00b\x7fc\td", "a_b_c_d"},
+		{"c1 controls", "a\u0085b\u009bc", "a_b_c"},
+		{"bidi overrides", "Artist/01 \u202egalf.flac", "Artist/01 _galf.flac"},
+		{"bidi isolates", "\u2066Artist\u2069/01.flac", "_Artist_/01.flac"},
+		{"bytes that aren't utf-8", "Caf\xe9/01\xff.flac", "Caf_/01_.flac"},
+		{"a cut off character", "Caf\xc3/01.flac", "Caf_/01.flac"},
+		// only characters that can't be shown are replaced, the separators are left alone
+		{"backslashes and escapes in names", `Artist\Album/01 \n.flac`, `Artist\Album/01 \n.flac`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := controlFreePath(test.path); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTagFileName(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Radiohead", "Radiohead"},
+		{"AC/DC", "AC_DC"},
+		{`What?: "Live" <at> *Home* | A\B`, `What__ _Live_ _at_ _Home_ _ A_B`},
+		{"  Sigur Rós  ", "Sigur Rós"},
+		{"Line\nBreak", "Line_Break"},
+		{"\x1b[2JClear", "_[2JClear"},
+		{"evil\u202egalf", "evil_galf"},
+		{"Caf\xe9", "Caf_"},
+		// nothing left once it's trimmed
+		{"\t\n", ""},
+	}
+	for _, test := range tests {
+		if got := tagFileName(test.value); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestWindowsSafePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"Artist/Album/01.flac", filepath.Join("Artist", "Album", "01.flac")},
+		{"CON/Album/con.flac", filepath.Join("CON_", "Album", "con_.flac")},
+		{"Artist/aux .flac/lpt1", filepath.Join("Artist", "aux _.flac", "lpt1_")},
+		{"Artist./Album /01.flac", filepath.Join("Artist_", "Album_", "01.flac")},
+		{"Artist/console.flac", filepath.Join("Artist", "console.flac")},
+		{"./Artist//01.flac", filepath.Join("Artist", "01.flac")},
+	}
+	for _, test := range tests {
+		if got := windowsSafePath(test.path); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+// quality and history print names that came from the library, none of them may get to the terminal as they are
+func TestReportsEscapeHostileNames(t *testing.T) {
+	saved := console
+	defer func() { console = saved }()
+	var out bytes.Buffer
+	console = &consoleOutput{writer: &out}
+
+	hostile := "Album\n\x1b[2J\u202e/01.mp3"
+	printQualityReport(qualityReport{file: hostile, bitrate: 320, cutoff: 16000, suspicious: true})
+
+	completed := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	state := &libraryState{Completed: map[string]stateEntry{
+		hostile: {Destination: "Out\r/01.opus", CompletedAt: completed, JobID: "abc123", Settings: "opus\x07"},
+	}}
+	printAlbumHistory(state, "album")
+	printJobHistory(state, []historyEntry{{
+		runRecord:  runRecord{StartedAt: completed},
+		Failures:   []string{hostile},
+		FailureIDs: []string{"abc123"},
+	}}, "abc")
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, names broke them up: %q", len(lines), out.String())
+	}
+	for _, line := range lines {
+		if strings.IndexFunc(line, isHostileRune) >= 0 {
+			t.Errorf("%q was printed unescaped", line)
+		}
+	}
+	for i, want := range []string{`Album\n\x1b[2J\u202e/01.mp3`, `Album\n\x1b[2J\u202e`, `Album\n\x1b[2J\u202e/01.mp3`, `Out\r/01.opus (opus\x07)`} {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("line %d is %q, want it to show %s", i, lines[i], want)
+		}
+	}
+}
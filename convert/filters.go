@@ -0,0 +1,64 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the ffmpeg -af filter chain a job's audio goes through, empty when it's left untouched.
+// the tempo change goes last, so filters like eq work on the audio as it was recorded
+func audioFilters(options jobOptions) string {
+	var filters []string
+	if options.filters != "" {
+		filters = append(filters, options.filters)
+	}
+	return strings.Join(append(filters, atempoFilters(options.tempo)...), ",")
+}
+
+// runs a filter chain over a moment of silence, so a typo fails the run before thousands of jobs fail with it
+func checkAudioFilters(filters string) error {
+	out, err := toolCommand(context.Background(), ffmpegPath, "-loglevel", "error", "-f", "lavfi", "-i", "anullsrc=r=44100:cl=stereo", "-t", "0.1", "-af", filters, "-f", "null", "-").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg doesn't take the filters %s: %s", filters, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// splits a tempo change into atempo steps, older ffmpeg builds only take factors between 0.5 and 2 at a time
+func atempoFilters(tempo float64) []string {
+	if tempo <= 0 || tempo == 1 {
+		return nil
+	}
+
+	var filters []string
+	for tempo > 2 {
+		filters = append(filters, "atempo=2")
+		tempo /= 2
+	}
+	for tempo < 0.5 {
+		filters = append(filters, "atempo=0.5")
+		tempo *= 2
+	}
+	return append(filters, "atempo="+strconv.FormatFloat(tempo, 'f', -1, 64))
+}
+
+// whether a job's audio comes out different from its source's, beyond being encoded
+func changesAudio(options jobOptions) bool {
+	return audioFilters(options) != "" || options.sampleRate != 0 || options.channels != 0
+}
+
+// whether an output carries its source's chapters, they'd point at the wrong times once the tempo changes
+func keepsChapters(format audioFormat, options jobOptions) bool {
+	return outputContainers[strings.ToLower(format.fileExtension)].supportsChapters && len(atempoFilters(options.tempo)) == 0
+}
+
+// how long a job's output runs for a source running duration, sped up spoken word is over sooner
+func outputDuration(options jobOptions, duration time.Duration) time.Duration {
+	if options.tempo <= 0 || options.tempo == 1 {
+		return duration
+	}
+	return time.Duration(float64(duration) / options.tempo)
+}
@@ -0,0 +1,150 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// fitting never picks a bitrate below this, past it the library should be trimmed rather than squeezed
+const minimumFitBitrate = 64
+
+// how the plan was fit into the destination's capacity
+type fitResult struct {
+	// the bitrate picked, in bitrate mode
+	bitrate int
+	// the jobs left out, in subset mode
+	dropped int
+	// the bytes the destination holds once the plan is done
+	estimatedSize int64
+}
+
+// the size of everything already in a library, leaving out our own bookkeeping
+func librarySize(destDir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(destDir, func(curPath string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && curPath == destDir {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == toolDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// probes the duration of every encode in the plan, jobs that can't be probed get 0
+func probeDurations(ctx context.Context, jobs []job, probeWorkers int) []time.Duration {
+	var encodes []job
+	for _, j := range jobs {
+		if j.encode && !j.retag && j.format.isLossy {
+			encodes = append(encodes, j)
+		}
+	}
+	prefetchProbes(ctx, jobSources(encodes), probeWorkers)
+
+	durations := make([]time.Duration, len(jobs))
+	for i, j := range jobs {
+		if j.encode && !j.retag && j.format.isLossy {
+			probe, _ := probeSource(j.sourceFile)
+			durations[i] = probe.duration
+		}
+	}
+	return durations
+}
+
+// the bytes a job adds to the destination at a bitrate, retags rewrite an output that's already counted
+func fitJobSize(j job, duration time.Duration, bitrate int) int64 {
+	if j.retag {
+		return 0
+	}
+	if j.encode && j.format.isLossy {
+		return int64(outputDuration(j.options, duration).Seconds() * float64(bitrate) * 1000 / 8)
+	}
+	info, err := os.Stat(j.sourceFile)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// picks the highest bitrate, up to maxBitrate, at which the plan fits in capacity along with what the destination already holds
+func fitBitrate(jobs []job, durations []time.Duration, existing int64, capacity int64, maxBitrate int) (fitResult, error) {
+	fixed := existing
+	var seconds float64
+	for i, j := range jobs {
+		if j.encode && j.format.isLossy && !j.retag {
+			seconds += outputDuration(j.options, durations[i]).Seconds()
+		} else {
+			fixed += fitJobSize(j, 0, 0)
+		}
+	}
+
+	if fixed > capacity {
+		return fitResult{}, fmt.Errorf("the copies and what's already in the destination take %s on their own", formatSize(fixed))
+	}
+	bitrate := maxBitrate
+	if seconds > 0 {
+		if fits := int(float64(capacity-fixed) * 8 / seconds / 1000); fits < bitrate {
+			bitrate = fits
+		}
+	}
+	if bitrate < minimumFitBitrate {
+		return fitResult{}, fmt.Errorf("the plan only fits at %dk, below the %dk minimum, try -fit-mode subset", bitrate, minimumFitBitrate)
+	}
+
+	return fitResult{bitrate: bitrate, estimatedSize: fixed + int64(seconds*float64(bitrate)*1000/8)}, nil
+}
+
+// keeps the jobs of the most recently modified sources that fit in capacity at their bitrate, dropping the rest
+func fitSubset(jobs []job, durations []time.Duration, existing int64, capacity int64) ([]job, fitResult) {
+	modTimes := make([]time.Time, len(jobs))
+	for i, j := range jobs {
+		if info, err := os.Stat(j.sourceFile); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	order := make([]int, len(jobs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return modTimes[order[a]].After(modTimes[order[b]])
+	})
+
+	keep := make([]bool, len(jobs))
+	result := fitResult{estimatedSize: existing}
+	for _, i := range order {
+		size := fitJobSize(jobs[i], durations[i], jobs[i].options.bitrate)
+		if result.estimatedSize+size > capacity {
+			result.dropped++
+			continue
+		}
+		keep[i] = true
+		result.estimatedSize += size
+	}
+
+	// the plan keeps its order, albums stay together for the workers
+	var kept []job
+	for i, j := range jobs {
+		if keep[i] {
+			kept = append(kept, j)
+		}
+	}
+	return kept, result
+}
@@ -0,0 +1,76 @@
+package convert
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// moves the outputs of folders holding more than maxFiles into A/, B/ style subfolders by the first letter of their
+// names, for devices whose firmware gives up on big folders. letters that are still too big are split into "A 2" and on.
+// sidecars stay where they are, with the album they go with
+func splitCrowdedFolders(jobs []job, maxFiles int) {
+	if maxFiles <= 0 {
+		return
+	}
+
+	folders := make(map[string][]int)
+	for i, j := range jobs {
+		if !j.sidecar {
+			dir := filepath.Dir(j.destinationFile)
+			folders[dir] = append(folders[dir], i)
+		}
+	}
+
+	for dir, indexes := range folders {
+		if len(indexes) <= maxFiles {
+			continue
+		}
+
+		buckets := make(map[string][]int)
+		for _, i := range indexes {
+			letter := fileLetter(filepath.Base(jobs[i].destinationFile))
+			buckets[letter] = append(buckets[letter], i)
+		}
+		for letter, bucket := range buckets {
+			sort.Slice(bucket, func(a, b int) bool {
+				return strings.ToLower(jobs[bucket[a]].destinationFile) < strings.ToLower(jobs[bucket[b]].destinationFile)
+			})
+			for n, i := range bucket {
+				folder := letter
+				if part := n/maxFiles + 1; part > 1 {
+					folder += " " + strconv.Itoa(part)
+				}
+				jobs[i].destinationFile = filepath.Join(dir, folder, filepath.Base(jobs[i].destinationFile))
+			}
+		}
+	}
+}
+
+// the folder a file is sorted into, looking past its track number, files named "01 Title" would all end up in 0-9
+func fileLetter(name string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if _, rest, ok := splitTrackNumber(name); ok && strings.TrimSpace(rest) != "" {
+		name = rest
+	}
+	return folderLetter(name)
+}
+
+// the folder a name is sorted into: its first letter, 0-9 for numbers and # for everything else
+func folderLetter(name string) string {
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r):
+			return string(unicode.ToUpper(r))
+		case unicode.IsDigit(r):
+			return "0-9"
+		}
+		// skip leading punctuation, ie "(What's the Story)" or "...And Justice for All"
+		if !unicode.IsPunct(r) && !unicode.IsSpace(r) {
+			break
+		}
+	}
+	return "#"
+}
@@ -0,0 +1,281 @@
+package convert
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// one finished run, as kept in the library's history
+type historyEntry struct {
+	runRecord
+	// the library the run converted
+	Source string `json:"source"`
+	// the config profile the run used, if any
+	Profile string `json:"profile,omitempty"`
+	// the format and bitrate the run encoded to
+	Format  string `json:"format"`
+	Bitrate int    `json:"bitrate,omitempty"`
+	Encoder string `json:"encoder,omitempty"`
+	// the sources that failed, their jobs' ids in the same order, and how many failed for each cause
+	Failures      []string       `json:"failures,omitempty"`
+	FailureIDs    []string       `json:"failureIds,omitempty"`
+	FailureCauses map[string]int `json:"failureCauses,omitempty"`
+	// warnings that came up too often to print every time, and how often
+	RepeatedWarnings map[string]int `json:"repeatedWarnings,omitempty"`
+}
+
+func historyFilePath(destDir string) string {
+	return filepath.Join(destDir, toolDirName, "history.jsonl")
+}
+
+// adds a run to the end of the library's history, one json object per line so it's never rewritten
+func appendHistory(destDir string, entry historyEntry) error {
+	historyPath := historyFilePath(destDir)
+	if err := os.MkdirAll(filepath.Dir(historyPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// reads the library's history, oldest run first
+func loadHistory(destDir string) ([]historyEntry, error) {
+	file, err := os.Open(historyFilePath(destDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(file)
+	// a run with thousands of failures makes for a long line
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry historyEntry
+		// a line cut short by a crash shouldn't hide every other run
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	last := flags.Int("last", 10, "the number of recent runs to show (0 for all of them)")
+	albumQuery := flags.String("album", "", "show when source directories matching this were last converted instead, ie \"Radiohead/OK Computer\"")
+	showFailures := flags.Bool("failures", false, "list the files each run failed on")
+	jobQuery := flags.String("job", "", "show what happened to the job with this id instead, or the start of it, ie as printed with -verbose")
+	jsonOutput := flags.Bool("json", false, "print every run as a json event")
+	flags.Parse(args)
+	console.json = *jsonOutput
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		exit(2)
+	}
+
+	destDir, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	if *jobQuery != "" {
+		state, err := loadState(destDir)
+		if err != nil {
+			console.println("couldn't load the library's state:", err)
+			exit(1)
+		}
+		entries, err := loadHistory(destDir)
+		if err != nil {
+			console.println("couldn't load the library's history:", err)
+			exit(1)
+		}
+		printJobHistory(state, entries, strings.ToLower(*jobQuery))
+		return
+	}
+	if *albumQuery != "" {
+		state, err := loadState(destDir)
+		if err != nil {
+			console.println("couldn't load the library's state:", err)
+			exit(1)
+		}
+		printAlbumHistory(state, *albumQuery)
+		return
+	}
+
+	entries, err := loadHistory(destDir)
+	if err != nil {
+		console.println("couldn't load the library's history:", err)
+		exit(1)
+	}
+	if len(entries) == 0 {
+		console.println("no runs have been recorded for this library yet")
+		return
+	}
+
+	shown := entries
+	if *last > 0 && len(shown) > *last {
+		shown = shown[len(shown)-*last:]
+	}
+	if console.json {
+		for _, entry := range shown {
+			console.emit(consoleEvent{Event: "run", Data: entry})
+		}
+		return
+	}
+
+	console.printf("%-25s %10s %-10s %10s %8s %10s\n", "started", "took", "format", "completed", "failed", "remaining")
+	for _, entry := range shown {
+		format := entry.Format
+		if entry.Bitrate != 0 {
+			format += fmt.Sprintf(" %dk", entry.Bitrate)
+		}
+		if entry.Profile != "" {
+			format = entry.Profile + ": " + format
+		}
+		stopped := ""
+		if entry.StopReason != "" {
+			stopped = " (stopped early, " + entry.StopReason + ")"
+		}
+		console.printf("%-25s %10s %-10s %10s %8s %10s%s\n", entry.StartedAt.Local().Format("2006-01-02 15:04 MST"), entry.FinishedAt.Sub(entry.StartedAt).Round(time.Second), format, formatCount(entry.Completed), formatCount(entry.Failed), formatCount(entry.Remaining), stopped)
+
+		if *showFailures {
+			for _, failure := range entry.Failures {
+				console.printf("    %s\n", failure)
+			}
+		}
+	}
+
+	// the average only counts runs that did something, a no-op sync says nothing about how long syncs take
+	var total time.Duration
+	var counted int
+	for _, entry := range entries {
+		if entry.Completed+entry.Failed > 0 {
+			total += entry.FinishedAt.Sub(entry.StartedAt)
+			counted++
+		}
+	}
+	if counted > 0 {
+		console.printf("\n%d runs recorded, runs that converted something took %s on average\n", len(entries), (total / time.Duration(counted)).Round(time.Second))
+	}
+}
+
+// prints the most recent completion of every source directory whose path contains query
+func printAlbumHistory(state *libraryState, query string) {
+	query = strings.ToLower(filepath.FromSlash(query))
+
+	latest := make(map[string]time.Time)
+	tracks := make(map[string]int)
+	for source, entry := range state.Completed {
+		directory := filepath.Dir(source)
+		if !strings.Contains(strings.ToLower(directory), query) {
+			continue
+		}
+		tracks[directory]++
+		if entry.CompletedAt.After(latest[directory]) {
+			latest[directory] = entry.CompletedAt
+		}
+	}
+
+	if len(latest) == 0 {
+		console.printf("no converted source directories match %s\n", query)
+		return
+	}
+
+	var directories []string
+	for directory := range latest {
+		directories = append(directories, directory)
+	}
+	sort.Strings(directories)
+
+	for _, directory := range directories {
+		data := struct {
+			Directory   string    `json:"directory"`
+			Tracks      int       `json:"tracks"`
+			CompletedAt time.Time `json:"completedAt"`
+		}{directory, tracks[directory], latest[directory]}
+		console.report("album", data, func() {
+			console.printf("%s  %4d tracks  %s\n", latest[directory].Local().Format("2006-01-02 15:04 MST"), tracks[directory], directory)
+		})
+	}
+}
+
+// prints the runs that failed the jobs whose id starts with query, and where their outputs are now. runs from before
+// jobs had ids and outputs that haven't been converted again since don't have one to go by
+func printJobHistory(state *libraryState, entries []historyEntry, query string) {
+	found := false
+	for _, entry := range entries {
+		for i, id := range entry.FailureIDs {
+			if !strings.HasPrefix(id, query) || i >= len(entry.Failures) {
+				continue
+			}
+			found = true
+			data := struct {
+				ID        string    `json:"id"`
+				Source    string    `json:"source"`
+				StartedAt time.Time `json:"startedAt"`
+			}{id, entry.Failures[i], entry.StartedAt}
+			console.report("failed", data, func() {
+				console.printf("%s  failed     %s  %s\n", entry.StartedAt.Local().Format("2006-01-02 15:04 MST"), id, entry.Failures[i])
+			})
+		}
+	}
+
+	var sources []string
+	for source, entry := range state.Completed {
+		if entry.JobID != "" && strings.HasPrefix(entry.JobID, query) {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		found = true
+		entry := state.Completed[source]
+		data := struct {
+			stateEntry
+			Source string `json:"source"`
+		}{entry, source}
+		console.report("completed", data, func() {
+			settings := ""
+			if entry.Settings != "" {
+				settings = " (" + entry.Settings + ")"
+			}
+			console.printf("%s  completed  %s  %s -> %s%s\n", entry.CompletedAt.Local().Format("2006-01-02 15:04 MST"), entry.JobID, source, entry.Destination, settings)
+		})
+	}
+
+	if !found {
+		console.printf("no job ids start with %s\n", query)
+	}
+}
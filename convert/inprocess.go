@@ -0,0 +1,74 @@
+package convert
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// how a command ends the program early, ie over bad settings. run in process through Convert it unwinds back to
+// runInProcess instead, the program isn't the tool's to end
+var exit = os.Exit
+
+// the exit code of a conversion run in process, see exit
+type inProcessExit int
+
+// the caller's context while a conversion runs in process. it interrupts the run the way ctrl-c does, the signals
+// belong to the program running it
+var inProcessContext context.Context
+
+// the run state is process wide, conversions run in process take turns
+var inProcessRuns sync.Mutex
+
+// runs the convert command in this process with its console writing to output, returning the exit code it ends with
+func runInProcess(ctx context.Context, args []string, output io.Writer) (code int) {
+	inProcessRuns.Lock()
+	defer inProcessRuns.Unlock()
+
+	resetRunState(output)
+	inProcessContext = ctx
+	exit = func(code int) {
+		panic(inProcessExit(code))
+	}
+	defer func() {
+		inProcessContext, exit = nil, os.Exit
+		if r := recover(); r != nil {
+			exitCode, ok := r.(inProcessExit)
+			if !ok {
+				panic(r)
+			}
+			code = int(exitCode)
+		}
+	}()
+
+	useDownloadedFfmpeg()
+	runConvert(args)
+	return 0
+}
+
+// puts back what an earlier run in the same process set up: its console, the backends and source protection it
+// selected and what its config added
+func resetRunState(output io.Writer) {
+	console = &consoleOutput{writer: output}
+	destination, source = localDestination{}, localSource{}
+	backend, selectedBackend = encodeBackends["exec"], "exec"
+	protectedRoots, protectedFiles = nil, make(map[string]bool)
+	sourceExtensions = builtinSourceExtensions()
+	companionPolicies = map[string]string{}
+	simulateRate = 0
+
+	folderArt.Lock()
+	folderArt.done = make(map[string]bool)
+	folderArt.Unlock()
+}
+
+// the context a command runs under, cancelled by ctrl-c or a service stop, or when run in process by the caller
+func interruptContext() (context.Context, context.CancelFunc) {
+	if inProcessContext != nil {
+		return context.WithCancel(inProcessContext)
+	}
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
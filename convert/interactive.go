@@ -0,0 +1,143 @@
+package convert
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many planned jobs are listed per page
+const reviewPageSize = 25
+
+// rough bytes per second of lossless sources, used to estimate durations without probing every file
+var losslessByteRates = map[string]float64{
+	".wav":  176400,
+	".aiff": 176400,
+	".cdda": 176400,
+}
+
+// flac, alac and ape all land somewhere around 880kbps for cd audio
+const compressedLosslessByteRate = 110000
+
+type planSummary struct {
+	encodes int
+	copies  int
+	// estimated size of everything the plan will write, in bytes
+	estimatedSize int64
+}
+
+func summarizePlan(jobs []job) planSummary {
+	var summary planSummary
+
+	for _, j := range jobs {
+		if j.encode {
+			summary.encodes++
+		} else {
+			summary.copies++
+		}
+		summary.estimatedSize += estimateOutputSize(j)
+	}
+
+	return summary
+}
+
+// roughly how many bytes a job's output takes, from the size of its source
+func estimateOutputSize(j job) int64 {
+	info, err := os.Stat(j.sourceFile)
+	if err != nil {
+		return 0
+	}
+
+	// lossless targets end up around the size of the source
+	if !j.encode || !j.format.isLossy || j.options.bitrate == 0 {
+		return info.Size()
+	}
+
+	byteRate, ok := losslessByteRates[strings.ToLower(filepath.Ext(j.sourceFile))]
+	if !ok {
+		byteRate = compressedLosslessByteRate
+	}
+	seconds := outputDuration(j.options, time.Duration(float64(info.Size())/byteRate*float64(time.Second))).Seconds()
+	return int64(seconds * float64(j.options.bitrate) * 1000 / 8)
+}
+
+// prints a summary of the plan and waits for the user to confirm it, returning whether they did
+func reviewPlan(jobs []job, in io.Reader) bool {
+	summary := summarizePlan(jobs)
+	console.printf("The plan has %s encodes and %s copies, writing roughly %s\n", formatCount(summary.encodes), formatCount(summary.copies), formatSize(summary.estimatedSize))
+
+	reader := bufio.NewReader(in)
+	for {
+		console.printf("Start the run? [y]es, [n]o, [l]ist planned jobs: ")
+		answer, err := reader.ReadString('\n')
+		if err != nil && answer == "" {
+			// stdin closed, don't take that as a yes
+			console.println()
+			return false
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		case "l", "list":
+			listPlan(jobs, reader)
+		}
+	}
+}
+
+// pages through the planned jobs, diff style
+func listPlan(jobs []job, reader *bufio.Reader) {
+	for i, j := range jobs {
+		action := "+ copy  "
+		if j.encode {
+			action = "+ encode"
+		}
+		console.printf("%s %s -> %s\n", action, j.sourceFile, j.destinationFile)
+
+		if (i+1)%reviewPageSize == 0 && i+1 < len(jobs) {
+			console.printf("-- %d of %d, enter for more, q to stop listing -- ", i+1, len(jobs))
+			answer, err := reader.ReadString('\n')
+			if err != nil || strings.ToLower(strings.TrimSpace(answer)) == "q" {
+				return
+			}
+		}
+	}
+}
+
+// reads a size like 500M, 1.5GB or 2000000, with the same decimal units formatSize prints
+func parseSize(text string) (int64, error) {
+	multipliers := map[string]float64{"": 1, "B": 1, "K": 1e3, "KB": 1e3, "M": 1e6, "MB": 1e6, "G": 1e9, "GB": 1e9, "T": 1e12, "TB": 1e12}
+
+	text = strings.ToUpper(strings.TrimSpace(text))
+	number := strings.TrimRight(text, "KMGTB")
+	multiplier, ok := multipliers[text[len(number):]]
+	value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if !ok || err != nil || value < 0 {
+		return 0, fmt.Errorf("%q isn't a size, sizes look like 500M or 1.5GB", text)
+	}
+
+	return int64(value * multiplier), nil
+}
+
+// formats a size in bytes with decimal units, ie 1.2GB
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
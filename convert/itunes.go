@@ -0,0 +1,139 @@
+package convert
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// how much a track is liked, from an itunes library or the track's own tags
+type trackStats struct {
+	// stars out of 5, 0 when unrated
+	rating float64
+	plays  int
+}
+
+// reads the ratings and play counts of an itunes Library.xml, keyed by the tracks' paths
+func readItunesLibrary(file string) (map[string]trackStats, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	decoder := xml.NewDecoder(in)
+	var root interface{}
+	for root == nil {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%s isn't an itunes library: %s", file, err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local != "plist" {
+			if root, err = decodePlistValue(decoder, start); err != nil {
+				return nil, fmt.Errorf("%s isn't an itunes library: %s", file, err)
+			}
+		}
+	}
+
+	library, _ := root.(map[string]interface{})
+	tracks, ok := library["Tracks"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s has no tracks", file)
+	}
+
+	stats := make(map[string]trackStats)
+	for _, value := range tracks {
+		track, _ := value.(map[string]interface{})
+		location, _ := track["Location"].(string)
+		path, err := itunesLocationPath(location)
+		if err != nil {
+			continue
+		}
+		rating, _ := track["Rating"].(int64)
+		plays, _ := track["Play Count"].(int64)
+		stats[path] = trackStats{rating: float64(rating) / 20, plays: int(plays)}
+	}
+
+	return stats, nil
+}
+
+// turns an itunes file:// location into a path, ie file://localhost/C:/Music/a.m4a or file:///Users/me/Music/a.m4a
+func itunesLocationPath(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("%s isn't a file", location)
+	}
+
+	path := u.Path
+	// windows drive letters come after a slash
+	if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.Clean(filepath.FromSlash(path)), nil
+}
+
+// decodes the plist element start opens: dicts become maps, arrays slices, integers int64 and everything else its text
+func decodePlistValue(decoder *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := make(map[string]interface{})
+		var key string
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch token := token.(type) {
+			case xml.StartElement:
+				if token.Name.Local == "key" {
+					if err = decoder.DecodeElement(&key, &token); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if dict[key], err = decodePlistValue(decoder, token); err != nil {
+					return nil, err
+				}
+			case xml.EndElement:
+				return dict, nil
+			}
+		}
+	case "array":
+		var array []interface{}
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch token := token.(type) {
+			case xml.StartElement:
+				value, err := decodePlistValue(decoder, token)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			case xml.EndElement:
+				return array, nil
+			}
+		}
+	case "true", "false":
+		return start.Name.Local == "true", decoder.Skip()
+	}
+
+	var text string
+	if err := decoder.DecodeElement(&text, &start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if start.Name.Local == "integer" {
+		return strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	}
+	return text, nil
+}
@@ -0,0 +1,39 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// splits the plan into a quick lane of copies, remuxes and tracks shorter than the threshold and a long lane of the rest,
+// so the destination fills up with whole albums instead of waiting behind hour long mixes. both keep their planned order
+func splitLanes(jobs []job, threshold time.Duration) ([]job, []job) {
+	var quick, long []job
+	for _, j := range jobs {
+		if !j.encode || j.remux || j.retag || estimateSourceDuration(j) < threshold {
+			quick = append(quick, j)
+		} else {
+			long = append(long, j)
+		}
+	}
+	return quick, long
+}
+
+// how long a source runs, from the probe cache when it has the file and from its size otherwise
+func estimateSourceDuration(j job) time.Duration {
+	if probe, ok := probes.lookup(j.sourceFile); ok && probe.duration > 0 {
+		return probe.duration
+	}
+
+	info, err := os.Stat(j.sourceFile)
+	if err != nil {
+		return 0
+	}
+	byteRate, ok := losslessByteRates[strings.ToLower(filepath.Ext(j.sourceFile))]
+	if !ok {
+		byteRate = compressedLosslessByteRate
+	}
+	return time.Duration(float64(info.Size()) / byteRate * float64(time.Second))
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package convert
+
+// paths aren't length limited outside windows
+func longPath(p string) string {
+	return p
+}
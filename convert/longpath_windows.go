@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package convert
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// extends an absolute path with \\?\ so tools we spawn aren't limited by MAX_PATH.
+// go's os package already does this for its own file operations, but ffmpeg gets the paths as is
+func longPath(p string) string {
+	if strings.HasPrefix(p, `\\?\`) || !filepath.IsAbs(p) {
+		return p
+	}
+
+	p = filepath.Clean(p)
+	// unc shares, \\nas\music
+	if strings.HasPrefix(p, `\\`) {
+		return `\\?\UNC\` + p[2:]
+	}
+
+	return `\\?\` + p
+}
@@ -0,0 +1,44 @@
+package convert
+
+import (
+	"strings"
+)
+
+// the codec ffprobe reports for the lossless formats a source can be remuxed into without reencoding.
+// wav and aiff are left out, they disagree on byte order so pcm is only copied when the container matches too
+var remuxableCodecs = map[string]string{
+	"flac": "flac",
+	"alac": "alac",
+}
+
+// the codec a lossless source holds, from its extension when that's unambiguous, otherwise by probing it.
+// sources that can't be probed, like tracks still inside an archive, get an empty codec
+func losslessSourceCodec(sourceFile string, extension string) string {
+	if strings.EqualFold(extension, ".flac") {
+		return "flac"
+	}
+
+	probe, err := probeSource(sourceFile)
+	if err != nil {
+		return ""
+	}
+	return probe.codec
+}
+
+// how a lossless source gets to a lossless format: encode, copy when it's already what the output would be,
+// or remux when only the container differs, ie alac in a .caf going to .m4a
+func losslessPlan(sourceFile string, extension string, format audioFormat) string {
+	sameContainer := strings.EqualFold(extension, format.fileExtension)
+	if sameContainer && (format.name == "wav" || format.name == "aiff") {
+		return "copy"
+	}
+
+	codec, ok := remuxableCodecs[format.name]
+	if !ok || losslessSourceCodec(sourceFile, extension) != codec {
+		return "encode"
+	}
+	if sameContainer {
+		return "copy"
+	}
+	return "remux"
+}
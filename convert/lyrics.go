@@ -0,0 +1,79 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the tags taggers store lyrics under. ffmpeg reads mp3 USLT frames as lyrics-<language>, ie lyrics-eng
+func isLyricsTag(key string) bool {
+	key = strings.ToLower(key)
+	return key == "lyrics" || key == "unsyncedlyrics" || strings.HasPrefix(key, "lyrics-")
+}
+
+// the .lrc file synced lyrics for a track sit in, next to it under the same name
+func lyricsSidecarPath(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".lrc"
+}
+
+// moves a source's lyrics to the tag the output container reads them from, preferring the .lrc sidecar when embedding those
+func lyricsMetadata(j job, container outputContainer, tags map[string]string) map[string]string {
+	var lyrics string
+	if j.options.lyricsSidecars == "embed" {
+		if data, err := os.ReadFile(lyricsSidecarPath(j.sourceFile)); err == nil {
+			lyrics = strings.TrimSpace(string(data))
+		}
+	}
+
+	metadata := make(map[string]string)
+	for key, value := range tags {
+		if !isLyricsTag(key) {
+			continue
+		}
+		if lyrics == "" {
+			lyrics = value
+		}
+		// blanked, or the lyrics would be carried over a second time under the source's name
+		if !strings.EqualFold(key, container.lyricsTag) {
+			metadata[key] = ""
+		}
+	}
+
+	if lyrics != "" {
+		metadata[container.lyricsTag] = lyrics
+	}
+
+	return metadata
+}
+
+// copies a source's .lrc sidecar next to the job's output, if it has one. output is where the output was written,
+// the destination or the album's staging folder
+func copyLyricsSidecar(j job, output string) error {
+	// converting in place, it's already there
+	if lyricsSidecarPath(j.sourceFile) == lyricsSidecarPath(j.destinationFile) {
+		return nil
+	}
+
+	in, err := os.Open(lyricsSidecarPath(j.sourceFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err = checkWritable(lyricsSidecarPath(output)); err != nil {
+		return err
+	}
+	out, err := os.Create(lyricsSidecarPath(output))
+	if err != nil {
+		return err
+	}
+	if _, err = copyWithStallTimeout(out, in, j.options.stallTimeout); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
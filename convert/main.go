@@ -0,0 +1,2118 @@
+package convert
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hidden directory in the destination library holding the tool's own bookkeeping
+const toolDirName = ".convert-muh-music"
+
+type job struct {
+	// The source audio file to be processed
+	sourceFile string
+	// The output file to produce
+	destinationFile string
+	// with -atomic-albums, where the output and the album's folder art are written until the whole album can be
+	// placed, see processAlbumAtomically. destinationFile is still where the output ends up
+	stagedFile   string
+	stagedArtDir string
+	// where the source is within the library, slash separated, see jobID
+	relativeSource string
+	// Should the file be encoded to another format, or just copied to the output path?
+	encode bool
+	// The format to be used in encodes
+	format audioFormat
+	//
+	options jobOptions
+	// set when the run's budget ran out before the job could start, it's left for the next run
+	deferred bool
+	// where the job is in the run's plan, see orderReports
+	plannedIndex int
+	// only the source's tags changed since the output was made, rewrite the output's tags instead of reencoding
+	retag bool
+	// the source already holds the target codec, only its container changes, see losslessPlan
+	remux bool
+	// the source's audio hash, if planning already worked it out
+	audioHash string
+	// tags to set on the output on top of the source's, as key=value
+	metadata []string
+	// whether addJobMetadata already worked metadata out, it probes the source and warns about what gets lost
+	metadataAdded bool
+	// the source sits in a compilation folder, see isCompilationPath
+	compilation bool
+	// the zip archive or disc image the source is extracted from, and its path inside it
+	archive      string
+	archiveEntry string
+	// the room set aside for the output in the run's output budget
+	estimatedBytes int64
+	// a file that goes with an album rather than a track, like a rip log, it's copied into the album's folder
+	sidecar bool
+	// the key the encode is cached under, see encodeCacheKey, empty until it's worked out
+	cacheKey string
+	// set for sidecars that are playlists, which are written with their entries pointed at the outputs
+	playlist *playlistRewrite
+}
+
+type jobReport struct {
+	// Exit code of the job's ffmpeg subprocess
+	exitCode int
+	// Id of the worker who completed the job
+	workerId int
+	// The job the report is regarding
+	job job
+	// The amount of time the job took to complete
+	elaspedTime time.Duration
+	// error
+	error error
+	// the job was never started, see job.deferred
+	deferred bool
+	// the job failed because of another job, ie a track in an atomic album, rather than its own fault
+	skipped bool
+	// the source is drm protected, it's skipped rather than counted as a failure
+	protected bool
+	// the source as it was processed
+	fingerprint sourceFingerprint
+	// the hash of the audio the source and output were both verified to decode to, when checked
+	pcmHash string
+	// the output came out of the encode cache rather than being encoded
+	cached bool
+	// the last lines ffmpeg wrote to stderr, see captureStderr
+	stderr []string
+}
+
+type jobOptions struct {
+	bitrate int
+	encoder string
+	// hardware decoder for video container sources, ie vaapi, empty to decode on the cpu
+	hwaccel string
+	// the device the hardware decoder runs on, empty for its default
+	hwaccelDevice string
+	// what to do with .lrc lyrics next to sources: ignore, copy or embed
+	lyricsSidecars string
+	// flag compilations as such in the outputs' tags
+	tagCompilations bool
+	// tag rewrite rules from the config
+	rewrites []rewriteRule
+	// check lossless outputs decode to exactly the same audio as their sources, see verifyBitPerfect
+	verifyLossless bool
+	// speed the audio up or down by this factor, 0 or 1 to leave it, see audioFilters
+	tempo float64
+	// an ffmpeg filter chain the audio goes through, ie highpass=f=30,dynaudnorm
+	filters string
+	// resample and remix outputs to these, 0 to keep the source's
+	sampleRate int
+	channels   int
+	// check flac rips against the crcs in the rip logs next to them, see verifyRip
+	verifyRips bool
+	// fail copies that can't write anything for this long, 0 to wait forever
+	stallTimeout time.Duration
+	// leave embedded art out of the outputs, with a folder.jpg per album instead, see writeFolderArt
+	stripArt bool
+	// write the embedded art of albums without a cover image to a cover.jpg next to them
+	extractArt bool
+	// where finished encodes are kept to be reused by jobs with the same source and settings, empty for nowhere
+	cacheDir string
+	// hardlink outputs and their cached encodes rather than copying them, where they're on the same filesystem
+	cacheLinks bool
+}
+
+type planOptions struct {
+	// directories that are skipped entirely
+	blacklistedDirectories []string
+	// lossy files flagged by the quality subcommand as likely upscales
+	suspiciousFiles map[string]bool
+	// what to do with suspicious files, copy, skip or encode
+	suspiciousAction string
+	// rename output paths windows can't create
+	windowsNames bool
+	// how compilations are handled: tag, skip or leave
+	compilations string
+	// how disc subfolders are flattened into their album: prefix, renumber, or empty to keep them
+	flattenDiscs string
+	// name outputs after their track number and title tags
+	numberTracks bool
+	// how the destination's folders are laid out: mirror, artist-album or flat, see restructureJobs
+	structure string
+	// groups artist folders of the artist-album structure under letter folders
+	artistBuckets artistBuckets
+	// plan the contents of zip archives as albums
+	archives bool
+	// plan the tracks of iso and bin+cue disc images as albums
+	images bool
+	// the longest output file or directory name and output path allowed, in bytes, 0 for no limit
+	maxNameLength int
+	maxPathLength int
+	// which names give way to the limits first, see shortenStrategies
+	shortenStrategy string
+	// how many files are probed at once when planning needs their tags
+	probeWorkers int
+	// leave out sources that aren't liked enough
+	selection selectionOptions
+	// only plan the albums of a sample of the library, which is updated with the albums picked
+	sample *librarySample
+	// outputs are written next to their sources instead of into a mirror, only encodes are planned
+	inPlace bool
+	// what to do with lossless sources already in the target's codec: copy (remuxing them when only the container differs) or encode
+	sameCodec string
+	// outputs go through audio filters, so every source is encoded, lossy ones and ones already in the target's codec too
+	filtered bool
+	// copy rip logs along with their albums
+	ripLogs bool
+	// leave out sources this small, short or long
+	candidates candidateFilter
+	// how many folder levels below the source are planned, 0 for all of them
+	maxDepth int
+	// split output folders with more files than this into letter subfolders, 0 for no limit
+	maxFolderFiles int
+	// jobs earlier runs completed, from the state database. outputs found during planning are added to it
+	completed map[string]stateEntry
+	// only reencode outputs made with other settings than the run's, see outdatedJobs
+	upgradeOutdated bool
+	// the config's rules for what's done with sources, tried before the built in ones, see planRule
+	rules []planRule
+}
+
+type audioFormat struct {
+	// name of the format
+	name string
+	// is the codec lossily compressed?
+	isLossy bool
+	// a list of encoders usable for the codec, with the lowest index being preferred for quality
+	encoders []string
+	// The preferred bitrate for a quality around equivalent to a 320k MP3
+	preferredBitrate int
+	// The file extension the format most commonly uses
+	fileExtension string
+	// any extra ffmpeg arguments the codec might want
+	ffmpegArguments []string
+	// other extensions the codec can be written under, see outputContainers
+	extensions []string
+	// the ffmpeg muxer to force, for when the extension alone doesn't pick the right container
+	muxer string
+}
+
+func audioFormats() []audioFormat {
+	return []audioFormat{
+		{name: "mp3", isLossy: true, encoders: []string{"libmp3lame", "libshine"}, preferredBitrate: 320, fileExtension: ".mp3", extensions: []string{".mka"}},
+		// m4a requires -c:v copy for encodes because reasons I guess detailing with it's container
+		{name: "aac", isLossy: true, encoders: []string{"libfdk_aac", "aac"}, preferredBitrate: 256, fileExtension: ".m4a", ffmpegArguments: []string{"-c:v", "copy"}, extensions: []string{".m4b", ".mp4", ".aac", ".mka"}},
+		// HE-AAC is only worth it at low bitrates, and only fdk can encode it
+		{name: "aac-he", isLossy: true, encoders: []string{"libfdk_aac"}, preferredBitrate: 64, fileExtension: ".m4a", ffmpegArguments: []string{"-c:v", "copy", "-profile:a", "aac_he"}, extensions: []string{".m4b", ".mp4", ".aac", ".mka"}},
+		{name: "vorbis", isLossy: true, encoders: []string{"libvorbis", "vorbis"}, preferredBitrate: 192, fileExtension: ".ogg", extensions: []string{".oga", ".mka", ".webm"}},
+		{name: "opus", isLossy: true, encoders: []string{"libopus"}, preferredBitrate: 128, fileExtension: ".opus", extensions: []string{".ogg", ".oga", ".mka", ".webm", ".caf"}},
+		// Lossless formats are in the list in case someone wanted to transcode to different one. No encoder preference or preferred bitrate for them, ffmpeg defaults will be fine
+		{name: "flac", isLossy: false, encoders: nil, preferredBitrate: 0, fileExtension: ".flac", extensions: []string{".oga", ".mka"}},
+		{name: "alac", isLossy: false, encoders: nil, preferredBitrate: 0, fileExtension: ".m4a", extensions: []string{".caf", ".mka"}},
+		{name: "aiff", isLossy: false, encoders: nil, preferredBitrate: 0, fileExtension: ".aiff"},
+		{name: "wav", isLossy: false, encoders: nil, preferredBitrate: 0, fileExtension: ".wav"},
+	}
+}
+
+func audioExtensions() []string {
+	return []string{
+		".mp3",
+		".m4a",
+		".ogg",
+		".opus",
+		".mp2",
+		".aac",
+		".flac",
+		".wav",
+		".alac",
+		".aiff",
+		".ape",
+		".webm",
+		".mp4",
+		".wma",
+		".m4p",
+		".cdda",
+	}
+}
+
+// other names people use for formats, usually the extension they know it by
+func formatAliases() map[string]string {
+	return map[string]string{
+		"ogg":    "vorbis",
+		"oga":    "vorbis",
+		"m4a":    "aac",
+		"mp4":    "aac",
+		"he-aac": "aac-he",
+		"heaac":  "aac-he",
+		"aac_he": "aac-he",
+		"aif":    "aiff",
+		"wave":   "wav",
+	}
+}
+
+func getAudioFormatFromName(name string) (*audioFormat, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := formatAliases()[name]; ok {
+		name = alias
+	}
+
+	for _, format := range audioFormats() {
+		if format.name == name {
+			return &format, nil
+		}
+	}
+
+	var names []string
+	for _, format := range audioFormats() {
+		names = append(names, format.name)
+	}
+	return nil, fmt.Errorf("unknown format %s, valid formats are %s (see -list-formats)", name, strings.Join(names, ", "))
+}
+
+func isAudioExtension(extension string) bool {
+	_, ok := sourceExtensions[normalizeExtension(extension)]
+	return ok
+}
+
+// containers sources with a video stream come in, as opposed to ones with just cover art
+func isVideoExtension(extension string) bool {
+	switch strings.ToLower(extension) {
+	case ".mp4", ".webm":
+		return true
+	}
+	return false
+}
+
+func isLossyExtension(extension string) bool {
+	return sourceExtensions[normalizeExtension(extension)]
+}
+
+func directoryIsBlacklisted(path string, blacklist []string) bool {
+	for _, blacklistedDirectory := range blacklist {
+		if strings.Contains(path, blacklistedDirectory) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splits a comma separated command line list, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func isEncoderAvailable(encoders []string, name string) bool {
+	for _, encoder := range encoders {
+		if name == encoder {
+			return true
+		}
+	}
+
+	return false
+}
+
+// plans a job for every source file in the library, whether or not its output already exists
+func planJobs(ctx context.Context, srcDir string, outDir string, format audioFormat, options jobOptions, plan planOptions) ([]job, error) {
+	var jobs []job
+
+	var discTracks []discTrack
+
+	rules := append(append([]planRule{}, plan.rules...), builtinPlanRules(format, plan)...)
+
+	// plans a single audio file, archive is set for files inside a zipped album
+	planFile := func(sourceFile string, relativeDir string, fileName string, archive string, archiveEntry string) {
+		extension := filepath.Ext(fileName)
+		name := strings.TrimSuffix(fileName, extension)
+
+		compilation := isCompilationPath(relativeDir)
+		relativeSource := filepath.ToSlash(filepath.Join(relativeDir, fileName))
+		// tracks of an archive are where they are in it, the folder they're planned in is only named after it
+		if archive != "" {
+			if relativeArchive, err := filepath.Rel(srcDir, archive); err == nil {
+				relativeSource = filepath.ToSlash(relativeArchive) + "/" + archiveEntry
+			}
+		}
+		action, rule := decideSource(rules, &plannedSource{file: sourceFile, relativePath: relativeSource, extension: strings.ToLower(extension), compilation: compilation})
+		if rule != nil && rule.configured {
+			console.debugf("%s: %s %s\n", rule.name, action, sourceFile)
+		}
+		if action == actionSkip {
+			return
+		}
+		encode := action == actionEncode || action == actionRemux
+		remux := action == actionRemux
+		jobFormat, jobOptions := format, options
+		if action == actionEncode {
+			jobFormat, jobOptions = rule.encodeSettings(format, options)
+		}
+		destinationName := fileName
+		if encode {
+			destinationName = name + jobFormat.fileExtension
+		}
+
+		// CD1 and CD2 are merged into the album folder above them, the names are sorted out once the whole album is planned
+		disc, isDisc := discNumber(filepath.Base(relativeDir))
+		if isDisc && plan.flattenDiscs != "" {
+			relativeDir = filepath.Dir(relativeDir)
+			discTracks = append(discTracks, discTrack{index: len(jobs), disc: disc})
+		}
+
+		relativeDir, destinationName = controlFreePath(relativeDir), controlFreePath(destinationName)
+		// tracks like con.flac can't be created on windows
+		if plan.windowsNames {
+			relativeDir = windowsSafePath(relativeDir)
+			destinationName = windowsSafeName(destinationName)
+		}
+
+		jobs = append(jobs, job{sourceFile: sourceFile, destinationFile: filepath.Join(outDir, relativeDir, destinationName), relativeSource: relativeSource, format: jobFormat, options: jobOptions, encode: encode, remux: remux, compilation: compilation, archive: archive, archiveEntry: archiveEntry})
+	}
+
+	var err error = source.Walk(srcDir, func(curPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		// where the file's directory lives relative to the library root, which is mirrored into the output library
+		relativeDir, err := filepath.Rel(srcDir, filepath.Dir(curPath))
+		if err != nil {
+			return err
+		}
+
+		// the tool's own files, which can sit inside the source when converting in place
+		if entry.IsDir() && entry.Name() == toolDirName {
+			return fs.SkipDir
+		}
+		if entry.IsDir() && plan.maxDepth > 0 && curPath != srcDir {
+			if relativePath, err := filepath.Rel(srcDir, curPath); err == nil && len(strings.Split(relativePath, string(filepath.Separator))) > plan.maxDepth {
+				return fs.SkipDir
+			}
+		}
+		if entry.IsDir() || directoryIsBlacklisted(relativeDir, plan.blacklistedDirectories) {
+			return nil
+		}
+
+		// zipped albums and disc images are planned as if they were a folder named after the archive, their tracks are
+		// extracted when their jobs run
+		if (plan.archives && isArchiveExtension(filepath.Ext(entry.Name()))) || (plan.images && isDiscImageExtension(filepath.Ext(entry.Name()))) {
+			entries, err := listArchive(curPath)
+			if err != nil {
+				console.printf("couldn't read %s: %s\n", curPath, err)
+				return nil
+			}
+			albumDir := filepath.Join(relativeDir, strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+			for _, archiveEntry := range entries {
+				extracted := filepath.Join(archiveExtractDir(outDir), albumDir, archiveEntry)
+				planFile(extracted, filepath.Join(albumDir, filepath.Dir(archiveEntry)), filepath.Base(archiveEntry), curPath, archiveEntry)
+			}
+			return nil
+		}
+
+		// is audio file
+		if isAudioExtension(filepath.Ext(entry.Name())) {
+			planFile(curPath, relativeDir, entry.Name(), "", "")
+		} else if action := companionAction(entry.Name(), plan.ripLogs); action != "ignore" {
+			destinationDir, name := controlFreePath(relativeDir), controlFreePath(entry.Name())
+			if plan.windowsNames {
+				destinationDir, name = windowsSafePath(destinationDir), windowsSafeName(name)
+			}
+			sidecar := job{sourceFile: curPath, destinationFile: filepath.Join(outDir, destinationDir, name), relativeSource: filepath.ToSlash(filepath.Join(relativeDir, entry.Name())), format: format, options: options, sidecar: true}
+			if action == "playlist" {
+				sidecar.playlist = &playlistRewrite{}
+			}
+			jobs = append(jobs, sidecar)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// everything from here on that reads tags reads them from the cache
+	if plan.numberTracks || plan.structure == "artist-album" || plan.candidates.needsDurations() || (plan.selection.active() && (plan.selection.itunes == nil || plan.selection.maxPerArtist > 0)) {
+		prefetchProbes(ctx, jobSources(jobs), plan.probeWorkers)
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if plan.candidates.active() {
+		jobs, discTracks = filterCandidates(jobs, discTracks, plan.candidates)
+	}
+
+	// numbered first, so flattened discs get renumbered by the tags' track numbers
+	if plan.numberTracks {
+		numberTrackNames(jobs, plan.windowsNames)
+	}
+	flattenDiscs(jobs, discTracks, plan.flattenDiscs, plan.windowsNames)
+	restructureJobs(jobs, outDir, plan.structure, plan.artistBuckets, plan.windowsNames)
+	jobs = dropLoneSidecars(jobs)
+	splitCrowdedFolders(jobs, plan.maxFolderFiles)
+	limitPathLengths(jobs, outDir, plan.maxNameLength, plan.maxPathLength, plan.shortenStrategy)
+
+	if plan.inPlace {
+		protectSources(jobs)
+		jobs = inPlaceJobs(jobs)
+	}
+	if plan.selection.active() {
+		jobs = selectJobs(jobs, srcDir, plan.selection)
+	}
+	if plan.sample != nil {
+		jobs = sampleAlbums(jobs, srcDir, plan.sample)
+	}
+	planPlaylists(jobs)
+
+	return jobs, nil
+}
+
+// drops the sidecars of folders without any audio to convert, scans or logs on their own would get a folder
+// made for them in the destination with nothing to play in it. playlists are kept, they usually have a folder of their own
+func dropLoneSidecars(jobs []job) []job {
+	withAudio := make(map[string]bool)
+	for _, j := range jobs {
+		if !j.sidecar {
+			withAudio[filepath.Dir(j.sourceFile)] = true
+		}
+	}
+
+	kept := jobs[:0]
+	for _, j := range jobs {
+		if j.sidecar && j.playlist == nil && !withAudio[filepath.Dir(j.sourceFile)] {
+			console.debugf("skipping %s, there's no audio next to it\n", j.sourceFile)
+			continue
+		}
+		kept = append(kept, j)
+	}
+	return kept
+}
+
+// plans the jobs needed to bring the output library up to date, along with how many sources already are
+func createJobsList(ctx context.Context, srcDir string, outDir string, format audioFormat, options jobOptions, plan planOptions) ([]job, int, error) {
+	var jobs []job
+	var alreadyDone int
+
+	planned, err := planJobs(ctx, srcDir, outDir, format, options, plan)
+	if err != nil {
+		return nil, 0, err
+	}
+	if plan.upgradeOutdated {
+		outdated, current, unknown := outdatedJobs(planned, plan.completed)
+		if unknown > 0 {
+			console.printf("%s outputs don't say what settings they were made with, they're left as they are\n", formatCount(unknown))
+		}
+		return outdated, current, nil
+	}
+
+	for _, newJob := range planned {
+		// the state database is trusted so resuming a big library doesn't stat every output
+		if entry, ok := plan.completed[newJob.sourceFile]; ok && entry.Destination == newJob.destinationFile {
+			if !sourceChanged(newJob.sourceFile, entry) {
+				alreadyDone++
+				continue
+			}
+
+			// edited since it was processed, if the audio is untouched only the tags need redoing
+			if newJob.encode && entry.AudioHash != "" {
+				if hash, err := audioHash(newJob.sourceFile); err == nil && hash == entry.AudioHash {
+					newJob.retag = true
+					newJob.audioHash = hash
+				}
+			}
+			jobs = append(jobs, newJob)
+			continue
+		}
+
+		// Ensure the output file doesn't exist
+		if _, err := destination.Stat(newJob.destinationFile); os.IsNotExist(err) {
+			jobs = append(jobs, newJob)
+		} else if err == nil && plan.completed != nil {
+			// produced before the state database knew about it
+			alreadyDone++
+			plan.completed[newJob.sourceFile] = stateEntry{Destination: newJob.destinationFile, CompletedAt: time.Now()}
+		}
+	}
+
+	return jobs, alreadyDone, nil
+}
+
+func buildFfmpegArgs(format audioFormat, job job, options jobOptions) []string {
+	// base arguments
+	args := []string{"-loglevel", "error", "-y"}
+	args = append(args, buildFfmpegInputArgs(job, options)...)
+
+	return append(args, buildFfmpegOutputArgs(format, job, options, 0)...)
+}
+
+// the arguments describing a job's input
+func buildFfmpegInputArgs(job job, options jobOptions) []string {
+	var args []string
+
+	// only worth it for concert rips and the like, where decoding the video would peg the cpu
+	if options.hwaccel != "" && isVideoExtension(filepath.Ext(job.sourceFile)) {
+		args = append(args, "-hwaccel", options.hwaccel)
+		if options.hwaccelDevice != "" {
+			args = append(args, "-hwaccel_device", options.hwaccelDevice)
+		}
+	}
+
+	return append(args, "-i", longPath(job.sourceFile))
+}
+
+// the arguments describing a job's output, taking metadata from the given input
+func buildFfmpegOutputArgs(format audioFormat, job job, options jobOptions, input int) []string {
+	var args []string
+
+	if job.remux {
+		// the audio is already what it should be, only the container changes
+		args = append(args, "-c:a", "copy")
+	} else {
+		// if the format specifies a bitrate
+		if options.bitrate != 0 {
+			args = append(args, "-b:a", fmt.Sprint(options.bitrate)+"k")
+		}
+
+		// -c:a
+		if options.encoder != "" {
+			args = append(args, "-c:a", options.encoder)
+		}
+
+		if filters := audioFilters(options); filters != "" {
+			args = append(args, "-af", filters)
+		}
+		if options.sampleRate != 0 {
+			args = append(args, "-ar", strconv.Itoa(options.sampleRate))
+		}
+		if options.channels != 0 {
+			args = append(args, "-ac", strconv.Itoa(options.channels))
+		}
+	}
+
+	// this is here right now necause the only format which specifies ffmpegArguments in AAC, which needs to be around -b:a
+	// positional arguments needs to be figured out
+	if format.ffmpegArguments != nil {
+		args = append(args, format.ffmpegArguments...)
+	}
+
+	// the extension was overridden, make sure the container matches it
+	if format.muxer != "" {
+		args = append(args, "-f", format.muxer)
+	}
+
+	// Audio metadata
+	for _, tag := range job.metadata {
+		args = append(args, "-metadata", tag)
+	}
+	args = append(args, settingsTagArgs(job)...)
+	// chapters have to be taken from the job's own input, ffmpeg otherwise takes them from the first input that has any
+	if keepsChapters(format, options) {
+		args = append(args, "-map_chapters", strconv.Itoa(input))
+	} else {
+		args = append(args, "-map_chapters", "-1")
+	}
+	args = append(args, "-map_metadata", strconv.Itoa(input), "-id3v2_version", "3", longPath(job.destinationFile))
+
+	return args
+}
+
+func getFfmpegEncoders() ([]string, error) {
+	out, err := toolCommand(context.Background(), ffmpegPath, "-loglevel", "error", "-encoders").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove first 10 lines of the command output, which only contain legend information for reading the encoder information
+	// if I could run tail or something this would be so much nicer but gotta suport le windows hur dur dur
+	var lines string
+	var scanner *bufio.Scanner
+	scanner = bufio.NewScanner(strings.NewReader(string(out)))
+	outLength := strings.Count(string(out), "\n")
+	for i := 1; i <= outLength; i++ {
+		scanner.Scan()
+		if i > 10 {
+			// make sure the last line has no newline attached
+			if i == outLength {
+				lines = lines + scanner.Text()
+			} else {
+				lines = lines + scanner.Text() + "\n"
+			}
+		}
+	}
+
+	var encoders []string
+	scanner = bufio.NewScanner(strings.NewReader(lines))
+
+	for scanner.Scan() {
+		words := strings.Fields(scanner.Text())
+		// just in case of error where data isn't as we expect
+		if len(words) > 1 {
+			// Append second word of string, the encoder
+			encoders = append(encoders, strings.Fields(scanner.Text())[1])
+		}
+	}
+	return encoders, nil
+}
+
+// the hardware decoding methods ffmpeg was built with
+func getFfmpegHwaccels() ([]string, error) {
+	out, err := toolCommand(context.Background(), ffmpegPath, "-hide_banner", "-hwaccels").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var hwaccels []string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// skip the "Hardware acceleration methods:" heading
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		hwaccels = append(hwaccels, line)
+	}
+
+	return hwaccels, scanner.Err()
+}
+
+// reads the duration of an audio file with ffprobe
+func getDuration(file string) (time.Duration, error) {
+	out, err := toolCommand(context.Background(), ffprobePath, "-loglevel", "error", "-show_entries", "format=duration", "-of", "json", longPath(file)).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	var probed struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err = json.Unmarshal(out, &probed); err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(probed.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe gave no duration for %s", file)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// worker goroutine, of which we'll run several
+// concurrent instances, these workers will receive
+// work on the jobs channel and send the corresponding
+// results on results.
+func worker(ctx context.Context, id int, jobs <-chan job, results chan<- jobReport, workDir string) {
+	for j := range jobs {
+		results <- processJob(ctx, id, j, workDir)
+	}
+}
+
+// runs a single job to completion, reporting how it went.
+// the output is written in workDir first and only moved into the destination once it's complete,
+// so failed jobs never leave half written files or empty directories behind
+func processJob(ctx context.Context, id int, j job, workDir string) jobReport {
+	// jobs handed out just as the run was cancelled are left for the next one
+	if j.deferred || ctx.Err() != nil {
+		return jobReport{workerId: id, job: j, deferred: true}
+	}
+
+	startTime := time.Now()
+	console.jobEvent("started", j)
+	if simulateRate > 0 {
+		return simulateJob(ctx, id, j, startTime)
+	}
+
+	if j.archive != "" {
+		if err := extractArchiveEntry(j.archive, j.archiveEntry, j.sourceFile); err != nil {
+			return jobReport{workerId: id, error: withKind(errSourceUnreadable, err), job: j}
+		}
+		defer os.Remove(j.sourceFile)
+	}
+
+	// ffmpeg can't decode these, and copies of them won't play anywhere else either
+	if isProtectedSource(j) {
+		return jobReport{workerId: id, error: fmt.Errorf("%s is drm protected", j.sourceFile), job: j, protected: true}
+	}
+	if j.options.verifyRips && !j.retag && strings.EqualFold(filepath.Ext(j.sourceFile), ".flac") {
+		if err := verifyRip(ctx, j.sourceFile); err != nil {
+			return jobReport{workerId: id, error: err, job: j}
+		}
+	}
+
+	if err := os.MkdirAll(workDir, os.ModePerm); err != nil {
+		return jobReport{workerId: id, error: err, job: j}
+	}
+	// not created with os.CreateTemp, its restrictive permissions would carry over to the library.
+	// the extension is kept so ffmpeg can pick the container
+	staged := j
+	staged.destinationFile = filepath.Join(workDir, fmt.Sprintf("job-%d-%d%s", id, startTime.UnixNano(), filepath.Ext(j.destinationFile)))
+	defer os.Remove(staged.destinationFile)
+
+	j = addJobMetadata(j)
+	staged.metadata = j.metadata
+
+	// the output could have gone missing since planning, in which case there's nothing to retag
+	if _, err := destination.Stat(j.destinationFile); j.retag && err != nil {
+		j.retag = false
+	}
+
+	// duplicated albums and reruns at the same settings don't need encoding again
+	cached := false
+	if j.options.cacheDir != "" && j.encode && !j.retag {
+		var err error
+		if j.cacheKey == "" {
+			if j.cacheKey, err = encodeCacheKey(j); err != nil {
+				console.debugf("couldn't work out the cache key of %s: %s\n", j.sourceFile, err)
+			}
+		}
+		if j.cacheKey != "" {
+			if cached, err = restoreCachedEncode(j, staged.destinationFile); err != nil {
+				console.debugf("couldn't use the cached encode of %s: %s\n", j.sourceFile, err)
+			}
+		}
+	}
+
+	var report jobReport
+	switch {
+	case cached:
+		console.debugf("worker %d took %s from the encode cache\n", id, j.sourceFile)
+		report = jobReport{workerId: id, elaspedTime: time.Since(startTime), cached: true}
+	case j.retag:
+		report = retagJob(ctx, id, j, staged.destinationFile, startTime)
+	default:
+		report = executeJob(ctx, id, staged, startTime)
+	}
+	report.job = j
+	if report.error != nil {
+		return report
+	}
+	// encodes leave the art out themselves, copies are written as they come
+	if j.options.stripArt && !j.encode && !j.retag && !j.sidecar {
+		if report.error = stripArtwork(ctx, staged.destinationFile); report.error != nil {
+			return report
+		}
+	}
+	report.fingerprint = fingerprintSource(j)
+
+	if !cached {
+		if report.error = carryFlacBlocks(ctx, j, staged.destinationFile); report.error != nil {
+			return report
+		}
+	}
+	if needsBitPerfectCheck(j) {
+		if report.pcmHash, report.error = verifyBitPerfect(ctx, j.sourceFile, staged.destinationFile); report.error != nil {
+			return report
+		}
+	}
+	if !cached && j.cacheKey != "" {
+		storeCachedEncode(j, staged.destinationFile)
+	}
+	output, artDir := j.destinationFile, filepath.Dir(j.destinationFile)
+	if j.stagedFile != "" {
+		output, artDir = j.stagedFile, j.stagedArtDir
+	}
+	report.error = placeOutput(staged.destinationFile, output, j.options.stallTimeout)
+	if report.error == nil && j.options.lyricsSidecars == "copy" {
+		report.error = copyLyricsSidecar(j, output)
+	}
+	if report.error == nil && (j.options.stripArt || j.options.extractArt) && !j.sidecar {
+		report.error = writeFolderArt(ctx, j, workDir, artDir)
+	}
+	return report
+}
+
+// moves a finished output from the work directory into the destination
+func placeOutput(stagedFile string, destinationFile string, stallTimeout time.Duration) error {
+	// Create output directory, now that there's something to put in it
+	createdDirectories, err := mkdirAllTracked(filepath.Dir(destinationFile))
+	if err != nil {
+		return destinationError(err)
+	}
+	if err = moveIntoPlace(stagedFile, destinationFile, stallTimeout); err != nil {
+		removeCreatedDirectories(createdDirectories)
+		return destinationError(err)
+	}
+
+	return nil
+}
+
+// does the actual copying or encoding of a job
+func executeJob(ctx context.Context, id int, j job, startTime time.Time) jobReport {
+	if j.playlist != nil {
+		return writePlaylist(id, j, startTime)
+	}
+	// Only a copy job
+	if !j.encode {
+		// Source file handle
+		fileHandleIn, err := source.Open(j.sourceFile)
+		if err != nil {
+			return jobReport{workerId: id, error: withKind(errSourceUnreadable, err), job: j}
+		}
+		defer fileHandleIn.Close()
+
+		// Output file handle
+		if err := checkWritable(j.destinationFile); err != nil {
+			return jobReport{workerId: id, error: err, job: j}
+		}
+		fileHandleOut, err := os.Create(j.destinationFile)
+		if err != nil {
+			return jobReport{workerId: id, error: destinationError(err), job: j}
+		}
+		defer fileHandleOut.Close()
+
+		_, err = copyWithStallTimeout(fileHandleOut, fileHandleIn, j.options.stallTimeout)
+		err = destinationError(err)
+
+		elaspedTime := time.Since(startTime)
+
+		return jobReport{exitCode: 0, workerId: id, error: err, elaspedTime: elaspedTime, job: j}
+	}
+
+	// the libav backend only transcodes, remuxes and filtered audio always go through ffmpeg
+	if j.remux || changesAudio(j.options) {
+		return execEncode(ctx, id, j, startTime)
+	}
+
+	return backend.encode(ctx, id, j, startTime)
+}
+
+// how much of a job's stderr is kept, the end of it is where ffmpeg says what went wrong
+const (
+	stderrTailBytes = 16 * 1024
+	stderrLineBytes = 4 * 1024
+)
+
+// reads a tool's stderr to the end, keeping its last lines up to stderrTailBytes. lines are cut at stderrLineBytes,
+// and bytes that aren't utf-8 are replaced, so a file name in some other encoding can't garble the message
+func captureStderr(stderr io.Reader) []string {
+	var lines []string
+	var size int
+	reader := bufio.NewReaderSize(stderr, stderrLineBytes)
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line := strings.TrimRight(string(chunk), "\r\n")
+		// the rest of a line too long for the buffer is skipped
+		for err == bufio.ErrBufferFull {
+			line = truncateBytes(line, stderrLineBytes) + "…"
+			_, err = reader.ReadSlice('\n')
+		}
+		if line = strings.ToValidUTF8(line, "\uFFFD"); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+			size += len(line)
+			for size > stderrTailBytes && len(lines) > 1 {
+				size -= len(lines[0])
+				lines = lines[1:]
+			}
+		}
+		if err != nil {
+			return lines
+		}
+	}
+}
+
+// encodes a job by running the ffmpeg executable
+func execEncode(ctx context.Context, id int, j job, startTime time.Time) jobReport {
+	var err error
+	var cmd *exec.Cmd
+	var errLogger io.ReadCloser
+	var exitCode int
+	var ffmpegArgs []string
+
+	// build the ffmpeg command to be run
+	ffmpegArgs = buildFfmpegArgs(j.format, j, j.options)
+	console.debugf("worker %d running job %s: %s\n", id, jobID(j), commandLine(ffmpegPath, ffmpegArgs))
+
+	// with -json, ffmpeg says how far it got on stdout for progress events
+	if console.json {
+		ffmpegArgs = append([]string{"-progress", "pipe:1", "-nostats"}, ffmpegArgs...)
+	}
+	cmd = toolCommand(ctx, ffmpegPath, ffmpegArgs...)
+
+	// pipe to capture ffmpeg error logging
+	errLogger, err = cmd.StderrPipe()
+
+	// Problem establishing stderr pipe
+	if err != nil {
+		return jobReport{workerId: id, error: err, job: j}
+	}
+	var progress io.ReadCloser
+	if console.json {
+		if progress, err = cmd.StdoutPipe(); err != nil {
+			return jobReport{workerId: id, error: err, job: j}
+		}
+	}
+
+	// Start ffmpeg process
+	if err = cmd.Start(); err != nil {
+		return jobReport{workerId: id, error: err, job: j}
+	}
+
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		if progress != nil {
+			reportProgress(progress, j)
+		}
+	}()
+
+	// Capture from process error logger
+	stderr := captureStderr(errLogger)
+
+	// both pipes have to be read to the end before waiting closes them
+	<-reported
+	cmd.Wait()
+	exitCode = cmd.ProcessState.ExitCode()
+
+	elaspedTime := time.Since(startTime)
+
+	if exitCode == 0 {
+		err = nil
+	} else {
+		err = fmt.Errorf("worker %d's execution failed: %w", id, &encoderError{encoder: "ffmpeg", exitCode: exitCode, stderr: stderr})
+	}
+
+	return jobReport{exitCode: exitCode, workerId: id, error: err, elaspedTime: elaspedTime, job: j, stderr: stderr}
+}
+
+// turns ffmpeg's -progress output into progress events, ie out_time_us=12345678, until it's done
+func reportProgress(progress io.Reader, j job) {
+	var duration time.Duration
+	if probe, err := probeSource(j.sourceFile); err == nil {
+		duration = outputDuration(j.options, probe.duration)
+	}
+
+	// older ffmpegs only have out_time_ms, which despite its name also counts microseconds. newer ones write both
+	timeKey := "out_time_ms"
+	scanner := bufio.NewScanner(progress)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[0] == "out_time_us" {
+			timeKey = parts[0]
+		}
+		if parts[0] != timeKey {
+			continue
+		}
+		if microseconds, err := strconv.ParseInt(parts[1], 10, 64); err == nil && microseconds >= 0 {
+			console.jobProgress(j, time.Duration(microseconds)*time.Microsecond, duration)
+		}
+	}
+}
+
+func selectEncoder(format *audioFormat, encoders []string) (string, error) {
+	// lossless formats lean on ffmpeg's defaults
+	if format.encoders == nil {
+		return "", nil
+	}
+
+	// settle for the highest quality encoder that is available
+	for i, encoder := range format.encoders {
+		if isEncoderAvailable(encoders, encoder) {
+			if i != 0 {
+				console.printf("The prefered, highest quality %s encoder, %s, wasn't found. Please build ffmpeg with support for %s for the highest quality encoding.\n", format.name, format.encoders[0], format.encoders[0])
+			}
+			return encoder, nil
+		}
+	}
+
+	return "", fmt.Errorf("an ffmpeg encoder for %s was not found! Please ensure your ffmpeg binary is built with a supported encoder (%v)", format.name, format.encoders)
+}
+
+// flags shared by every subcommand that maps a source library onto a destination library
+type libraryFlags struct {
+	formatName   *string
+	extension    *string
+	blacklist    *string
+	windowsNames *bool
+	compilations *string
+	flattenDiscs *string
+	numberTracks *bool
+	maxName      *int
+	maxPath      *int
+	shorten      *string
+	configPath   *string
+	profile      *string
+	archives     *bool
+	images       *bool
+	minRating    *float64
+	minPlays     *int
+	maxPerArtist *int
+	itunes       *string
+	probeWorkers *int
+	sameCodec    *string
+	structure    *string
+	buckets      *string
+	tempo        *float64
+	filters      *string
+	sampleRate   *int
+	channels     *int
+	ripLogs      *bool
+	minSize      *string
+	minDuration  *time.Duration
+	maxDuration  *time.Duration
+	maxDepth     *int
+	maxFolder    *int
+}
+
+func addLibraryFlags(flags *flag.FlagSet) libraryFlags {
+	return libraryFlags{
+		formatName:   flags.String("format", "aac", "the format to transcode lossless files to"),
+		extension:    flags.String("extension", "", "write transcoded files with this extension instead of the format's usual one, ie .ogg for opus"),
+		blacklist:    flags.String("blacklist", "PioneerDJ,Ableton,Logic", "comma separated list of directory names to skip"),
+		windowsNames: flags.Bool("windows-names", runtime.GOOS == "windows", "rename output files and folders windows can't create, like con.flac"),
+		flattenDiscs: flags.String("flatten-discs", "", "merge CD1/CD2 style disc folders into their album, prefixing tracks with the disc (prefix, ie 2-01) or numbering on from the previous disc (renumber)"),
+		structure:    flags.String("structure", "mirror", "how to lay out the destination: mirror the source's folders, rebuild Artist/Album folders from the tags (artist-album, reading the tags of every track while planning), or put every track in one folder (flat)"),
+		buckets:      flags.String("artist-buckets", "", "with -structure artist-album, group artists under a folder per first letter (letter) or per range of letters, ie A-F,G-M,N-S,T-Z, for car head units that can't jump through long lists"),
+		tempo:        flags.Float64("tempo", 1, "speed the audio up or down by this factor while encoding, ie 1.25 for spoken word, lossy sources get reencoded too (1 to leave it)"),
+		filters:      flags.String("filters", "", "an ffmpeg filter chain to run the audio through while encoding, ie highpass=f=30,dynaudnorm, lossy sources get reencoded too. profiles can give it as a list, filters = [\"highpass=f=30\", \"dynaudnorm\"]"),
+		sampleRate:   flags.Int("sample-rate", 0, "resample outputs to this many Hz, lossy sources get reencoded too (0 to keep the source's)"),
+		channels:     flags.Int("channels", 0, "remix outputs to this many channels, ie 1 for mono spoken word, lossy sources get reencoded too (0 to keep the source's)"),
+		ripLogs:      flags.Bool("rip-logs", false, "copy EAC and whipper .log and .accurip files along with their albums, and check flac rips against the CRCs in the logs before converting them"),
+		minSize:      flags.String("min-size", "", "leave out sources smaller than this, ie 100k, or 1 for empty files from failed downloads"),
+		minDuration:  flags.Duration("min-track-duration", 0, "leave out sources shorter than this, ie 30s for sound effects and hidden track stubs, reading the length of every track while planning (0 for no limit)"),
+		maxDuration:  flags.Duration("max-track-duration", 0, "leave out sources longer than this, ie 3h for livestream rips, reading the length of every track while planning (0 for no limit)"),
+		maxDepth:     flags.Int("max-depth", 0, "only go this many folder levels into the source, ie 2 for Artist/Album (0 for no limit)"),
+		maxFolder:    flags.Int("max-files-per-folder", 0, "split output folders holding more files than this into A, B, ... subfolders, for devices whose firmware can't cope, ie 1000 (0 for no limit)"),
+		numberTracks: flags.Bool("number-tracks", false, "name outputs like \"01 Title\" from their tags, reading the tags of every track while planning"),
+		configPath:   flags.String("config", "", "the config file to use (defaults to "+defaultConfigPath()+")"),
+		profile:      flags.String("profile", "", "apply the settings of a [profile.<name>] section of the config, flags given on the command line still win"),
+		archives:     flags.Bool("archives", false, "convert zipped albums, like bandcamp downloads, into a folder named after the archive"),
+		images:       flags.Bool("images", false, "convert the tracks of .iso disc images and .bin+.cue cd rips without mounting them, into a folder named after the image"),
+		minRating:    flags.Float64("min-rating", 0, "only take tracks rated at least this many stars out of 5, reading the tags of every track while planning (0 to take unrated ones too)"),
+		minPlays:     flags.Int("min-plays", 0, "only take tracks played at least this many times"),
+		maxPerArtist: flags.Int("max-tracks-per-artist", 0, "only take each artist's best rated, then most played, tracks (0 for no limit)"),
+		probeWorkers: flags.Int("probe-workers", defaultProbeWorkers, "the number of files probed at once while planning, raise it for libraries on network shares"),
+		itunes:       flags.String("itunes-library", "", "read ratings and play counts from this itunes Library.xml instead of the tracks' tags"),
+		maxName:      flags.Int("max-name-length", 255, "shorten output file and folder names longer than this many bytes, keeping track numbers and extensions (0 for no limit)"),
+		maxPath:      flags.Int("max-path-length", 0, "shorten output names so whole output paths stay under this many bytes, ie 4096 for some devices (0 for no limit)"),
+		shorten:      flags.String("shorten", "title", "how names over the length limits are shortened: cut the title first, cut the album folders first (album), or cut the title and end it with a hash of the whole name (hash), so long names that only differ at the end stay apart"),
+		sameCodec:    flags.String("same-codec", "copy", "what to do with lossless sources already in the target's codec, ie flac to flac: copy them, remuxing them when only the container differs, or encode them anyway"),
+		compilations: flags.String("compilations", "tag", "what to do with compilations, found by folders like Various Artists or by their tags: tag them as compilations, skip their folders or leave them be"),
+	}
+}
+
+// loads the config file and applies the chosen profile to the flags, which have to be parsed already
+func (l libraryFlags) loadConfig(flags *flag.FlagSet) (*config, error) {
+	cfg, err := loadConfig(*l.configPath)
+	if err != nil {
+		return nil, err
+	}
+	for extension, lossy := range cfg.extensions {
+		sourceExtensions[extension] = lossy
+	}
+	if cfg.companions != nil {
+		companionPolicies = cfg.companions
+	}
+	for _, warning := range cfg.extensionWarnings {
+		console.println("warning:", warning)
+	}
+
+	// clean takes the library flags but not the rest of convert's, settings it hasn't got are for convert
+	lenient := flags.Name() != "convert"
+	if *l.profile != "" {
+		profile, ok := cfg.profiles[*l.profile]
+		if !ok {
+			return nil, fmt.Errorf("the config has no profile named %s", *l.profile)
+		}
+		if err = applyProfile(flags, profile, lenient); err != nil {
+			return nil, fmt.Errorf("profile %s: %s", *l.profile, err)
+		}
+	}
+	// applied after the profile, whose settings count as given by then and win
+	if cfg.defaults != nil {
+		if err = applyProfile(flags, cfg.defaults, lenient); err != nil {
+			return nil, fmt.Errorf("defaults: %s", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// the format to transcode to, with any extension override applied
+func (l libraryFlags) format() (*audioFormat, error) {
+	format, err := getAudioFormatFromName(*l.formatName)
+	if err != nil || *l.extension == "" {
+		return format, err
+	}
+
+	overridden, err := withExtension(*format, *l.extension)
+	if err != nil {
+		return nil, err
+	}
+
+	return &overridden, nil
+}
+
+func (l libraryFlags) planOptions() (planOptions, error) {
+	switch *l.compilations {
+	case "tag", "skip", "leave":
+	default:
+		return planOptions{}, fmt.Errorf("unknown compilation handling %s, valid ones are tag, skip and leave", *l.compilations)
+	}
+	switch *l.flattenDiscs {
+	case "", "prefix", "renumber":
+	default:
+		return planOptions{}, fmt.Errorf("unknown disc flattening %s, valid ones are prefix and renumber", *l.flattenDiscs)
+	}
+	switch *l.structure {
+	case "mirror", "artist-album", "flat":
+	default:
+		return planOptions{}, fmt.Errorf("unknown structure %s, valid ones are mirror, artist-album and flat", *l.structure)
+	}
+	buckets, err := parseArtistBuckets(*l.buckets)
+	if err != nil {
+		return planOptions{}, err
+	}
+	if buckets.active() && *l.structure != "artist-album" {
+		return planOptions{}, fmt.Errorf("-artist-buckets needs -structure artist-album, the buckets are made from the album artist tags")
+	}
+	if *l.tempo <= 0 {
+		return planOptions{}, fmt.Errorf("-tempo has to be above 0")
+	}
+	if *l.sampleRate < 0 || *l.channels < 0 {
+		return planOptions{}, fmt.Errorf("-sample-rate and -channels can't be negative")
+	}
+	switch *l.sameCodec {
+	case "copy", "encode":
+	default:
+		return planOptions{}, fmt.Errorf("unknown same codec handling %s, valid ones are copy and encode", *l.sameCodec)
+	}
+
+	if !containsArg(shortenStrategies, *l.shorten) {
+		return planOptions{}, fmt.Errorf("unknown shortening strategy %s, valid ones are %s", *l.shorten, strings.Join(shortenStrategies, ", "))
+	}
+	if *l.maxDepth < 0 || *l.maxFolder < 0 {
+		return planOptions{}, fmt.Errorf("-max-depth and -max-files-per-folder can't be negative")
+	}
+	candidates := candidateFilter{minDuration: *l.minDuration, maxDuration: *l.maxDuration}
+	if *l.minSize != "" {
+		var err error
+		if candidates.minSize, err = parseSize(*l.minSize); err != nil {
+			return planOptions{}, fmt.Errorf("-min-size: %s", err)
+		}
+	}
+	if candidates.minDuration < 0 || candidates.maxDuration < 0 {
+		return planOptions{}, fmt.Errorf("-min-track-duration and -max-track-duration can't be negative")
+	}
+	if candidates.maxDuration > 0 && candidates.maxDuration < candidates.minDuration {
+		return planOptions{}, fmt.Errorf("-max-track-duration is shorter than -min-track-duration, nothing would be left")
+	}
+
+	selection := selectionOptions{minRating: *l.minRating, minPlays: *l.minPlays, maxPerArtist: *l.maxPerArtist}
+	if *l.itunes != "" {
+		var err error
+		if selection.itunes, err = readItunesLibrary(*l.itunes); err != nil {
+			return planOptions{}, err
+		}
+	}
+
+	return planOptions{blacklistedDirectories: splitList(*l.blacklist), windowsNames: *l.windowsNames, compilations: *l.compilations, flattenDiscs: *l.flattenDiscs, numberTracks: *l.numberTracks, structure: *l.structure, artistBuckets: buckets, filtered: *l.tempo != 1 || strings.TrimSpace(*l.filters) != "" || *l.sampleRate != 0 || *l.channels != 0, ripLogs: *l.ripLogs, candidates: candidates, maxDepth: *l.maxDepth, maxFolderFiles: *l.maxFolder, maxNameLength: *l.maxName, maxPathLength: *l.maxPath, shortenStrategy: *l.shorten, archives: *l.archives, images: *l.images, selection: selection, probeWorkers: *l.probeWorkers, sameCodec: *l.sameCodec}, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <source directory> <destination directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s [flags] <youtube, bandcamp or other yt-dlp link> <destination directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s -in-place [flags] <library directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s bench [flags] <source directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s quality [flags] <source directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s analyze [flags] <source directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s clean [flags] <source directory> <destination directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s diff [flags] <source directory> <destination directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s history [flags] <destination directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s recompress [flags] <library directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s state export|import <source directory> <destination directory> <file>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s rip [flags] <destination directory> [convert flags]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s podcasts [flags] <destination directory> <feed url>... [convert flags]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s service install [flags] <source directory> <destination directory> [convert flags]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s setup-ffmpeg [flags]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s gen-testlib [flags] <directory>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "\n%s\n\n", pauseHelp)
+}
+
+// Main runs the command line tool with the program's arguments, it's what the convert-muh-music executable does.
+func Main() {
+	// a static ffmpeg fetched by setup-ffmpeg beats whatever the distro ships
+	useDownloadedFfmpeg()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "setup-ffmpeg":
+			runSetupFfmpeg(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "quality":
+			runQuality(os.Args[2:])
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "clean":
+			runClean(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		case "recompress":
+			runRecompress(os.Args[2:])
+			return
+		case "service":
+			runService(os.Args[2:])
+			return
+		case "state":
+			runState(os.Args[2:])
+			return
+		case "rip":
+			runRip(os.Args[2:])
+			return
+		case "podcasts":
+			runPodcasts(os.Args[2:])
+			return
+		case "gen-testlib":
+			runGenTestlib(os.Args[2:])
+			return
+		}
+	}
+
+	runConvert(os.Args[1:])
+}
+
+func runConvert(args []string) {
+	var err error
+
+	// bad flags go through exit like the rest of the settings, so they don't end a program running the conversion in process
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	libraryFlags := addLibraryFlags(flags)
+	bitrate := flags.Int("bitrate", 0, "the bitrate in kilobits to encode at (0 uses the config's [bitrate] for the format, or else the format's preferred bitrate)")
+	// no real speed gains past the number of logical cpus
+	workerCount := flags.Int("workers", runtime.NumCPU(), "the number of concurrent workers")
+	suspiciousReport := flags.String("suspicious-report", "", "a report from the quality subcommand flagging upscaled lossy files")
+	suspiciousAction := flags.String("suspicious", "copy", "what to do with files flagged in the suspicious report: copy, skip or encode")
+	albumBatches := flags.Bool("album-batches", false, "have each worker finish a whole album before starting another")
+	atomicAlbums := flags.Bool("atomic-albums", false, "only place an album in the destination once all of its tracks succeeded (implies -album-batches)")
+	sampleSize := flags.String("sample", "", "only sync a random sample of whole albums taking up to this much, ie 16G, the same albums are kept on later runs")
+	reshuffle := flags.Bool("reshuffle", false, "pick a new -sample instead of keeping the albums picked before, run clean afterwards to remove the old ones")
+	fitCapacity := flags.String("fit", "", "fit the whole destination within this size, ie 64G for a card, see -fit-mode")
+	fitMode := flags.String("fit-mode", "bitrate", "how -fit makes the library fit: lower the bitrate as far as needed (bitrate), or leave out the least recently modified sources (subset)")
+	maxOutputBytes := flags.String("max-output-bytes", "", "stop starting new jobs once the run's outputs would take up more than this, ie 30G (empty for no limit)")
+	maxDuration := flags.Duration("max-duration", 0, "stop starting new jobs once the run has gone on this long, ie 2h (0 for no limit)")
+	removeEmptyDirs := flags.Bool("remove-empty-dirs", true, "remove empty directories from the destination after the run")
+	noColor := flags.Bool("no-color", false, "don't color the output, color is already off when not writing to a terminal")
+	verbose := flags.Bool("verbose", false, "print the ffmpeg commands being run")
+	listFormats := flags.Bool("list-formats", false, "print the formats that can be transcoded to and exit")
+	listEncoders := flags.Bool("list-encoders", false, "print the audio encoders available in ffmpeg and exit")
+	interactive := flags.Bool("interactive", false, "summarize the plan and wait for confirmation before starting")
+	rescan := flags.Bool("rescan", false, "check every output on disk instead of trusting the state database, for outputs removed by hand")
+	maxJobs := flags.Int("max-jobs", 0, "stop after starting this many jobs (0 for no limit)")
+	hwaccel := flags.String("hwaccel", "", "hardware decoder for video sources like concert rips, ie videotoolbox, vaapi or d3d11va (see ffmpeg -hwaccels)")
+	hwaccelDevice := flags.String("hwaccel-device", "", "the device the hardware decoder uses, ie /dev/dri/renderD128")
+	verifyLossless := flags.Bool("verify-lossless", false, "decode every lossless output and its source, failing the job unless their audio matches bit for bit")
+	lyricsSidecars := flags.String("lrc", "ignore", "what to do with .lrc lyrics files next to tracks: ignore, copy or embed them in the outputs")
+	quickLane := flags.Duration("quick-lane", 0, "start copies and tracks shorter than this, ie 15m, ahead of longer encodes like dj mixes (0 to keep the planned order)")
+	longWorkers := flags.Int("long-workers", 1, "with -quick-lane, the workers that only take the longer encodes, the rest join them once the quick jobs are done")
+	batchSize := flags.Int("batch-size", 1, "encode this many files per ffmpeg invocation, faster for libraries of short tracks (1 to disable)")
+	backendName := flags.String("backend", "exec", "how to encode: "+strings.Join(backendNames(), ", "))
+	deleteSources := flags.Bool("delete-source-after-verify", false, "remove each encoded source once its output decodes cleanly and carries its tags, for migrating a library")
+	sourceTrash := flags.String("source-trash", "", "move removed sources into this directory, keeping the library's layout, instead of deleting them")
+	showTimings := flags.Bool("timings", false, "print where the run's time went at the end: speed by kind of job and how busy each worker was")
+	jsonOutput := flags.Bool("json", false, "print every line as a json event, job results and the run's summary included, for scripts")
+	simulate := flags.String("simulate", "", "pretend to run the plan without ffmpeg or writing anything, each job taking as long as its source's size does at this rate per worker, ie 2G for 2GB a second, to try scheduling, progress and reports on a whole library")
+	ordered := flags.Bool("ordered", false, "report jobs in the order they were planned instead of as they finish, so the output of two runs diffs cleanly. jobs still run in parallel, the ones that finish early are held back")
+	tempDir := flags.String("temp-dir", "", "write outputs to this directory, ie on a fast local disk, and move them into the destination once they're finished (defaults to a directory in the destination)")
+	stripArt := flags.Bool("strip-art", false, "leave embedded cover art out of the outputs and put a single folder.jpg in each album instead, for players that slow down with it")
+	cacheDir := flags.String("cache-dir", "", "keep finished encodes in this directory and reuse them for sources with the same contents and settings, ie duplicated albums, or the phone and car profiles when they encode alike (set it in the config's [defaults] to share it)")
+	cacheLinks := flags.Bool("cache-links", false, "hardlink outputs to their encodes in -cache-dir instead of copying them where they're on the same filesystem, so destinations sharing a cache share the space too. tag edits made to an output in place show up in every copy")
+	abortAfter := flags.Int("abort-after", 10, "stop the run when this many jobs fail the same way before any succeeds, ie the destination is gone or the encoder is broken (0 to never stop)")
+	runSelfTest := flags.Bool("self-test", true, "encode and decode a second of test tone with the run's settings before starting, so a broken ffmpeg or encoder settings it refuses fail once rather than for every job")
+	upgradeOutdated := flags.Bool("upgrade-outdated", false, "only reencode outputs made with other settings than this run's, ie after raising a profile's bitrate, leaving new sources and everything else alone")
+	extractArt := flags.Bool("extract-art", false, "write the embedded cover art of albums without a cover image to a cover.jpg in their folder, for players that only read folder images")
+	stallTimeout := flags.Duration("stall-timeout", 2*time.Minute, "fail copies that can't write anything for this long, ie to a dropped network mount (0 to wait forever)")
+	inPlace := flags.Bool("in-place", false, "write outputs next to their sources in a single library instead of mirroring it, sources are never touched")
+	if err = flags.Parse(args); err == flag.ErrHelp {
+		exit(0)
+	} else if err != nil {
+		exit(2)
+	}
+	// set before the config is loaded so its warnings come out as events, and again after in case a profile sets it
+	console.json = *jsonOutput
+
+	cfg, err := libraryFlags.loadConfig(flags)
+	if err != nil {
+		console.println("couldn't load the config:", err)
+		exit(1)
+	}
+	console.json = *jsonOutput
+
+	// ctrl-c or a service stop cancels whatever is running, planning included, and the run winds down with its progress saved.
+	// a second one is left to kill the process
+	ctx, stop := interruptContext()
+	defer stop()
+	// closed before stop cancels ctx on the way out, so a run that finished isn't reported as interrupted
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-finished:
+			return
+		default:
+		}
+		stop()
+		console.println("interrupted, stopping the running jobs and saving progress, interrupt again to quit right away")
+	}()
+
+	if *interactive && *jsonOutput {
+		console.println("-interactive can't be used with -json")
+		exit(1)
+	}
+	loadProbeCache()
+
+	if *listFormats {
+		printFormats()
+		return
+	}
+	if *listEncoders {
+		if err = printEncoders(); err != nil {
+			console.println("couldn't list ffmpeg's encoders:", err)
+			exit(1)
+		}
+		return
+	}
+
+	if (*inPlace && flags.NArg() != 1) || (!*inPlace && flags.NArg() != 2) {
+		flags.Usage()
+		exit(2)
+	}
+
+	srcDir := flags.Arg(0)
+	destDir := flags.Arg(1)
+	if *inPlace {
+		destDir = srcDir
+	}
+	if err = selectDestination(destDir); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	destDir = destinationPath(destDir)
+	plan, err := libraryFlags.planOptions()
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	plan.inPlace = *inPlace
+	if *inPlace && plan.flattenDiscs != "" {
+		console.println("-flatten-discs can't be used in place, it would leave a copy of every disc in the album folder")
+		exit(1)
+	}
+	if *inPlace && plan.structure != "mirror" {
+		console.println("-structure can't be used in place, outputs are always written next to their sources")
+		exit(1)
+	}
+	plan.suspiciousAction = *suspiciousAction
+
+	switch *suspiciousAction {
+	case "copy", "skip", "encode":
+	default:
+		console.printf("unknown suspicious file action %s\n", *suspiciousAction)
+		exit(1)
+	}
+
+	if *suspiciousReport != "" {
+		plan.suspiciousFiles, err = readSuspiciousFiles(*suspiciousReport)
+		if err != nil {
+			console.println(err)
+			exit(1)
+		}
+	}
+
+	// links are downloaded into a library of their own, which is gone once they're converted
+	sourceURL := ""
+	if isSourceURL(srcDir) {
+		if *inPlace {
+			console.println("-in-place needs a library directory, not a link")
+			exit(1)
+		}
+		sourceURL = srcDir
+		console.printf("downloading %s\n", sourceURL)
+		if srcDir, err = fetchURLSource(ctx, sourceURL); err != nil {
+			console.println(err)
+			exit(1)
+		}
+		defer os.RemoveAll(srcDir)
+	} else {
+		if err = selectSource(srcDir); err != nil {
+			console.println(err)
+			exit(1)
+		}
+		srcDir = sourcePath(srcDir)
+	}
+
+	srcDir, err = filepath.Abs(srcDir)
+	if err != nil {
+		console.println(err)
+	}
+	destDir, err = filepath.Abs(destDir)
+	if err != nil {
+		console.println(err)
+	}
+	// in place there's no separate destination to keep apart, the sources themselves are protected once planned
+	if !*inPlace {
+		if err = checkLibraryPaths(srcDir, destDir); err != nil {
+			console.println(err)
+			exit(1)
+		}
+	}
+	if err = checkDestinationWritable(destDir); err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	if *sourceTrash != "" {
+		if !*deleteSources {
+			console.println("-source-trash only applies with -delete-source-after-verify")
+			exit(1)
+		}
+		if *sourceTrash, err = filepath.Abs(*sourceTrash); err != nil {
+			console.println(err)
+			exit(1)
+		}
+		// trashed sources would be picked up as sources, or cleaned away as orphans
+		if isWithin(*sourceTrash, srcDir) || isWithin(*sourceTrash, destDir) {
+			console.println("-source-trash has to be outside both the source and the destination")
+			exit(1)
+		}
+	}
+
+	console.color = console.color && !*noColor
+	console.verbose = *verbose
+	console.roots = []string{srcDir, destDir}
+
+	format, err := libraryFlags.format()
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if *stripArt {
+		stripped := withoutArt(*format)
+		format = &stripped
+	}
+
+	if err = selectBackend(*backendName); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if *simulate != "" {
+		if simulateRate, err = parseSize(*simulate); err != nil || simulateRate <= 0 {
+			console.println("-simulate takes how fast jobs go, ie 2G for 2GB a second")
+			exit(1)
+		}
+		if *deleteSources {
+			console.println("-delete-source-after-verify can't be simulated, there'd be no outputs to verify")
+			exit(1)
+		}
+		backend.encoders = simulatedEncoders
+	}
+	if *workerCount < 1 {
+		console.println("-workers has to be at least 1")
+		exit(1)
+	}
+	if *batchSize > 1 && *backendName != "exec" {
+		console.println("-batch-size only applies to the exec backend")
+		exit(1)
+	}
+	if *batchSize > 1 && (*albumBatches || *atomicAlbums) {
+		console.println("-batch-size can't be combined with -album-batches or -atomic-albums")
+		exit(1)
+	}
+	if *quickLane < 0 {
+		console.println("-quick-lane can't be negative")
+		exit(1)
+	}
+	if *quickLane > 0 && (*batchSize > 1 || *albumBatches || *atomicAlbums) {
+		console.println("-quick-lane hands out jobs one at a time, it can't be combined with -batch-size, -album-batches or -atomic-albums")
+		exit(1)
+	}
+	// a single worker has none to spare for the long lane, it works through the quick one first
+	if *quickLane > 0 && *workerCount == 1 {
+		*longWorkers = 0
+	}
+	if *quickLane > 0 && (*longWorkers < 0 || *longWorkers >= *workerCount) {
+		console.printf("-long-workers has to be between 0 and %d, leaving at least one worker for the quick lane\n", *workerCount-1)
+		exit(1)
+	}
+
+	encoders, err := backend.encoders()
+	if err != nil {
+		console.println("couldn't list ffmpeg's encoders:", err)
+		exit(1)
+	}
+
+	// Check if encoders for format are available
+	encoder, err := selectEncoder(format, encoders)
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	options := new(jobOptions)
+	if options.bitrate, err = resolveBitrate(*format, encoder, *bitrate, cfg.bitrates); err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	options.encoder = encoder
+	options.tagCompilations = plan.compilations == "tag"
+	options.rewrites = cfg.rewrites
+	options.verifyLossless = *verifyLossless
+	if *stallTimeout < 0 {
+		console.println("-stall-timeout can't be negative")
+		exit(1)
+	}
+	options.stallTimeout = *stallTimeout
+	options.stripArt = *stripArt
+	options.extractArt = *extractArt
+	if *cacheDir != "" {
+		if options.cacheDir, err = filepath.Abs(*cacheDir); err != nil {
+			console.println(err)
+			exit(1)
+		}
+		// cached encodes would be planned as sources, or cleaned away as orphans
+		if isWithin(options.cacheDir, srcDir) || isWithin(options.cacheDir, destDir) {
+			console.println("-cache-dir has to be outside both the source and the destination")
+			exit(1)
+		}
+	}
+	options.cacheLinks = *cacheLinks
+	options.tempo = *libraryFlags.tempo
+	options.filters = strings.TrimSpace(*libraryFlags.filters)
+	options.sampleRate = *libraryFlags.sampleRate
+	options.verifyRips = *libraryFlags.ripLogs
+	options.channels = *libraryFlags.channels
+	if err = checkEncoderSettings(encoder, *options); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = overrideRuleFormats(cfg.rules, *libraryFlags.extension, *stripArt); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = resolvePlanRules(cfg.rules, *format, *options, encoders, cfg.bitrates); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	plan.rules = cfg.rules
+	if options.filters != "" {
+		if err = checkAudioFilters(options.filters); err != nil {
+			console.println(err)
+			exit(1)
+		}
+	}
+
+	switch *lyricsSidecars {
+	case "ignore", "copy", "embed":
+		options.lyricsSidecars = *lyricsSidecars
+	default:
+		console.printf("unknown .lrc action %s\n", *lyricsSidecars)
+		exit(1)
+	}
+
+	if *hwaccel != "" {
+		hwaccels, err := getFfmpegHwaccels()
+		if err != nil {
+			console.println("couldn't list ffmpeg's hardware decoders:", err)
+			exit(1)
+		}
+		if *hwaccel != "auto" && !isEncoderAvailable(hwaccels, *hwaccel) {
+			console.printf("hardware decoder %s isn't available in your ffmpeg build, valid ones are %v\n", *hwaccel, hwaccels)
+			exit(1)
+		}
+		options.hwaccel = *hwaccel
+		options.hwaccelDevice = *hwaccelDevice
+	}
+
+	state, err := loadState(destDir)
+	if err != nil {
+		console.println("couldn't load the library's state:", err)
+		exit(1)
+	}
+	if *rescan {
+		state.Completed = make(map[string]stateEntry)
+	}
+	plan.completed = state.Completed
+	plan.upgradeOutdated = *upgradeOutdated
+	previousRun := state.LastRun
+
+	if *sampleSize != "" {
+		size, err := parseSize(*sampleSize)
+		if err != nil {
+			console.println("-sample:", err)
+			exit(1)
+		}
+		plan.sample = &librarySample{Size: size, reshuffle: *reshuffle}
+		// a bigger sample keeps what's there and adds to it, a smaller one keeps what still fits
+		if state.Sample != nil {
+			plan.sample.Albums = state.Sample.Albums
+		}
+	}
+	// clean goes by the sample of the latest run, and a run without one syncs everything
+	state.Sample = plan.sample
+
+	jobsList, alreadyDone, err := createJobsList(ctx, srcDir, destDir, *format, *options, plan)
+	if ctx.Err() != nil {
+		console.println("interrupted while planning, nothing was changed")
+		exit(1)
+	} else if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	// planning is where most probing happens, it shouldn't be lost if the run gets killed
+	if err = saveProbeCache(); err != nil {
+		console.println("couldn't save the probe cache:", err)
+	}
+
+	// a run that never recorded finishing was killed partway through
+	if !previousRun.StartedAt.IsZero() && previousRun.FinishedAt.IsZero() {
+		console.printf("The previous run started %s was interrupted\n", previousRun.StartedAt.Format(time.RFC1123))
+	} else if previousRun.StopReason != "" {
+		console.printf("The previous run stopped early (%s) with %s jobs left\n", previousRun.StopReason, formatCount(previousRun.Remaining))
+	}
+	if *fitCapacity != "" {
+		capacity, err := parseSize(*fitCapacity)
+		if err != nil {
+			console.println("-fit:", err)
+			exit(1)
+		}
+		existing, err := librarySize(destDir)
+		if err != nil {
+			console.println("couldn't measure the destination:", err)
+			exit(1)
+		}
+		durations := probeDurations(ctx, jobsList, plan.probeWorkers)
+
+		switch *fitMode {
+		case "bitrate":
+			if !format.isLossy {
+				console.printf("%s has no bitrate to lower, use -fit-mode subset\n", format.name)
+				exit(1)
+			}
+			fit, err := fitBitrate(jobsList, durations, existing, capacity, options.bitrate)
+			if err != nil {
+				console.printf("the plan doesn't fit in %s: %s\n", formatSize(capacity), err)
+				exit(1)
+			}
+			options.bitrate = fit.bitrate
+			for i := range jobsList {
+				jobsList[i].options.bitrate = fit.bitrate
+			}
+			console.printf("fitting %s: encoding at %dk, the destination will hold about %s\n", formatSize(capacity), fit.bitrate, formatSize(fit.estimatedSize))
+		case "subset":
+			var fit fitResult
+			jobsList, fit = fitSubset(jobsList, durations, existing, capacity)
+			console.printf("fitting %s: left out %s jobs, the destination will hold about %s\n", formatSize(capacity), formatCount(fit.dropped), formatSize(fit.estimatedSize))
+		default:
+			console.printf("unknown fit mode %s, valid ones are bitrate and subset\n", *fitMode)
+			exit(1)
+		}
+	}
+
+	// a simulated run doesn't need an ffmpeg that works
+	if *runSelfTest && simulateRate == 0 {
+		if err = selfTest(ctx, jobsList); err != nil {
+			console.println(err)
+			exit(1)
+		}
+	}
+
+	if alreadyDone > 0 {
+		console.printf("resumed: %s of %s jobs already done\n", formatCount(alreadyDone), formatCount(alreadyDone+len(jobsList)))
+	}
+
+	console.printf("%d jobs added to the job queue\n", len(jobsList))
+
+	if *interactive && len(jobsList) > 0 && !reviewPlan(jobsList, os.Stdin) {
+		console.println("Aborted, nothing was changed")
+		return
+	}
+	// clean leaves the outputs of a locked destination's running jobs alone, and a second run can't start on it
+	if simulateRate == 0 {
+		release, err := acquireRunLock(destDir)
+		if err != nil {
+			console.println(err)
+			exit(1)
+		}
+		defer release()
+	}
+
+	jobCount := len(jobsList)
+	// where outputs are written until they're complete
+	workDir := filepath.Join(destDir, toolDirName, "work")
+	if *tempDir != "" {
+		if *tempDir, err = filepath.Abs(*tempDir); err != nil {
+			console.println(err)
+			exit(1)
+		}
+		if isWithin(*tempDir, srcDir) && !isWithin(*tempDir, destDir) {
+			console.println("-temp-dir can't be inside the source library")
+			exit(1)
+		}
+		workDir = filepath.Join(*tempDir, "convert-muh-music-work")
+		if err = os.MkdirAll(workDir, os.ModePerm); err != nil {
+			console.println("couldn't create the temp directory:", err)
+			exit(1)
+		}
+	}
+	// channel to return results
+	results := make(chan jobReport)
+	// closes results once every worker is done, however many reports they sent
+	var workers sync.WaitGroup
+	workers.Add(*workerCount)
+
+	// record starting time
+	startTime := time.Now()
+
+	// paused and resumed by signals, or typed commands on windows, see handlePauseSignals
+	dispatch := newDispatcher(ctx)
+	dispatch.maxJobs = *maxJobs
+	if *maxDuration != 0 {
+		dispatch.deadline = startTime.Add(*maxDuration)
+	}
+	if *maxOutputBytes != "" {
+		if dispatch.maxOutputBytes, err = parseSize(*maxOutputBytes); err != nil {
+			console.println("-max-output-bytes:", err)
+			exit(1)
+		}
+	}
+	// run in process, the signals are the program's own
+	if inProcessContext == nil {
+		handlePauseSignals(dispatch)
+	}
+	// a simulation never writes the tool's directory the watch looks for, nor anything else it could lose
+	if simulateRate == 0 {
+		watchDestination(ctx, dispatch, destDir)
+	}
+
+	for i := range jobsList {
+		jobsList[i].plannedIndex = i
+		console.jobEvent("queued", jobsList[i])
+	}
+
+	if *albumBatches || *atomicAlbums {
+		var stagingRoot string
+		if *atomicAlbums {
+			stagingRoot = filepath.Join(destDir, toolDirName, "staging")
+		}
+
+		albumList := groupJobsByAlbum(jobsList)
+		// unbuffered so albums are only handed out as workers free up, which is what lets a run be paused
+		albums := make(chan album)
+
+		// start up worker goroutines, initially blocked
+		for w := 1; w <= *workerCount; w++ {
+			go func(w int) {
+				defer workers.Done()
+				albumWorker(ctx, w, albums, results, workDir, stagingRoot)
+			}(w)
+		}
+
+		// submit albums
+		go dispatch.dispatchAlbums(albumList, albums)
+	} else if *batchSize > 1 {
+		batchList := groupJobsInBatches(jobsList, *batchSize)
+		// unbuffered so batches are only handed out as workers free up, which is what lets a run be paused
+		batches := make(chan []job)
+
+		// start up worker goroutines, initially blocked
+		for w := 1; w <= *workerCount; w++ {
+			go func(w int) {
+				defer workers.Done()
+				batchWorker(ctx, w, batches, results, workDir)
+			}(w)
+		}
+
+		// submit batches
+		go dispatch.dispatchBatches(batchList, batches)
+	} else if *quickLane > 0 {
+		quickList, longList := splitLanes(jobsList, *quickLane)
+		console.debugf("%d jobs in the quick lane, %d in the long one\n", len(quickList), len(longList))
+		// unbuffered so jobs are only handed out as workers free up, which is what lets a run be paused
+		quickJobs, longJobs := make(chan job), make(chan job)
+
+		for w := 1; w <= *workerCount; w++ {
+			go func(w int) {
+				defer workers.Done()
+				if w > *longWorkers {
+					worker(ctx, w, quickJobs, results, workDir)
+				}
+				worker(ctx, w, longJobs, results, workDir)
+			}(w)
+		}
+
+		go dispatch.dispatchJobs(quickList, quickJobs)
+		go dispatch.dispatchJobs(longList, longJobs)
+	} else {
+		// unbuffered so jobs are only handed out as workers free up, which is what lets a run be paused
+		jobs := make(chan job)
+
+		// start up worker goroutines, initially blocked
+		for w := 1; w <= *workerCount; w++ {
+			go func(w int) {
+				defer workers.Done()
+				worker(ctx, w, jobs, results, workDir)
+			}(w)
+		}
+
+		// submit jobs
+		go dispatch.dispatchJobs(jobsList, jobs)
+	}
+
+	// a simulated run leaves the state as it was, none of its jobs did anything
+	saveRunState := func() error {
+		if simulateRate > 0 {
+			return nil
+		}
+		return saveState(destDir, state)
+	}
+	// recorded up front so a run that gets killed can be told apart from one that finished
+	run := runRecord{StartedAt: startTime, Planned: jobCount, AlreadyDone: alreadyDone}
+	state.LastRun = run
+	if err = saveRunState(); err != nil {
+		console.println("couldn't save the library's state:", err)
+	}
+	lastSave := time.Now()
+	var failures, failureIDs []string
+	// the failed sources by why they failed
+	failuresByCause := make(map[string][]string)
+	// the cause every job has failed with so far, until one succeeds or fails some other way, see -abort-after
+	firstCause, breakerArmed := "", *abortAfter > 0
+	timings := newRunTimings()
+	// outputs whose sources go once they're verified
+	var verifyQueue []job
+
+	// collect resulting job reports
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	reports := (<-chan jobReport)(results)
+	if *ordered {
+		reports = orderReports(results)
+	}
+	for jobReport := range reports {
+		var written int64
+		if info, err := destination.Stat(jobReport.job.destinationFile); err == nil && !jobReport.deferred && jobReport.error == nil {
+			written = info.Size()
+		}
+		dispatch.settleOutput(jobReport.job, written)
+		timings.add(jobReport)
+		// jobs interrupted partway didn't fail, the next run picks them up
+		if jobReport.deferred || (jobReport.error != nil && ctx.Err() != nil) {
+			run.Remaining++
+			console.debugf("left %s for the next run\n", console.relative(jobReport.job.sourceFile))
+		} else if jobReport.protected {
+			run.Protected++
+			console.job("protected", 0, jobReport.job, "", nil)
+		} else if jobReport.error != nil {
+			run.Failed++
+			failures = append(failures, jobReport.job.sourceFile)
+			failureIDs = append(failureIDs, jobID(jobReport.job))
+			status := "failed"
+			if jobReport.skipped {
+				status = "skipped"
+			}
+			cause := failureCause(jobReport.error)
+			if jobReport.skipped {
+				cause = "skipped with the rest of a failed album"
+			}
+			failuresByCause[cause] = append(failuresByCause[cause], jobReport.job.sourceFile)
+			// a destination that's gone or an encoder that's broken fails every job the same way, there's no use in going on
+			if breakerArmed && !jobReport.skipped {
+				if firstCause == "" {
+					firstCause = cause
+				}
+				if cause != firstCause {
+					breakerArmed = false
+				} else if len(failuresByCause[cause]) >= *abortAfter {
+					breakerArmed = false
+					dispatch.abort("failing")
+					console.printf("the first %d jobs all failed with %s, stopping the run. the latest one failed with:\n%s\n", *abortAfter, cause, jobReport.error)
+				}
+			}
+			// the same failure over and over is summarized at the end instead
+			if count := len(failuresByCause[cause]); count <= failureLinesPerCause || console.json {
+				console.job(status, jobReport.elaspedTime, jobReport.job, "", jobReport.error)
+			} else if count == failureLinesPerCause+1 {
+				console.printf("more jobs are failing with %s, they're counted in the summary at the end\n", cause)
+			}
+		} else {
+			run.Completed++
+			breakerArmed = false
+			// what ffmpeg complained about without failing, ie a few corrupt frames in the source
+			for _, line := range jobReport.stderr {
+				console.warning(jobReport.job, errors.New(line))
+			}
+			if jobReport.pcmHash != "" {
+				run.BitPerfect++
+			}
+			fingerprint := jobReport.fingerprint
+			// a retag leaves the audio, and the settings it was encoded with, as they were
+			settings := settingsFingerprint(jobReport.job)
+			if jobReport.job.retag {
+				settings = state.Completed[jobReport.job.sourceFile].Settings
+			}
+			state.Completed[jobReport.job.sourceFile] = stateEntry{Destination: jobReport.job.destinationFile, CompletedAt: time.Now(), SourceSize: fingerprint.size, SourceModTime: fingerprint.modTime, AudioHash: fingerprint.audioHash, PCMHash: jobReport.pcmHash, Settings: settings, JobID: jobID(jobReport.job)}
+			if *deleteSources && jobReport.job.encode && jobReport.job.archive == "" {
+				verifyQueue = append(verifyQueue, jobReport.job)
+			}
+			status := "done"
+			if jobReport.job.retag {
+				status = "retag"
+			}
+			console.job(status, jobReport.elaspedTime, jobReport.job, jobReport.job.destinationFile, nil)
+		}
+
+		// persist progress every so often, a reboot mid run shouldn't lose hours of work
+		if time.Since(lastSave) > stateSaveInterval {
+			state.LastRun = run
+			if err = saveRunState(); err != nil {
+				console.println("couldn't save the library's state:", err)
+			}
+			lastSave = time.Now()
+		}
+	}
+
+	if len(verifyQueue) > 0 {
+		console.printf("verifying %d outputs before removing their sources\n", len(verifyQueue))
+		for _, removal := range removeVerifiedSources(ctx, verifyQueue, srcDir, *sourceTrash, *workerCount) {
+			source := removal.j.sourceFile
+			switch {
+			case removal.error != nil:
+				console.job("kept", 0, removal.j, "", removal.error)
+			case removal.trashedTo != "":
+				console.job("trashed", 0, removal.j, removal.trashedTo, nil)
+			default:
+				console.job("deleted", 0, removal.j, "", nil)
+			}
+			if removal.error == nil {
+				entry := state.Completed[source]
+				entry.SourceDeleted = true
+				state.Completed[source] = entry
+			}
+		}
+	}
+
+	// every job reports exactly once, a job that didn't still counts against the run
+	if missing := jobCount - run.Completed - run.Failed - run.Remaining - run.Protected; missing > 0 {
+		console.printf("%d jobs never reported back, counting them as failed\n", missing)
+		run.Failed += missing
+	}
+
+	run.FinishedAt = time.Now()
+	run.StopReason = dispatch.stopReason
+	if ctx.Err() != nil {
+		run.StopReason = "interrupted"
+	}
+	state.LastRun = run
+	if err = saveRunState(); err != nil {
+		console.println("couldn't save the library's state:", err)
+	}
+	if err = saveProbeCache(); err != nil {
+		console.println("couldn't save the probe cache:", err)
+	}
+	historySource := srcDir
+	if sourceURL != "" {
+		historySource = sourceURL
+	}
+	summary := historyEntry{runRecord: run, Source: historySource, Profile: *libraryFlags.profile, Format: format.name, Bitrate: options.bitrate, Encoder: options.encoder, Failures: failures, FailureIDs: failureIDs}
+	if repeated := console.repeatedWarnings(); len(repeated) > 0 {
+		summary.RepeatedWarnings = repeated
+	}
+	failureGroups := groupFailures(failuresByCause)
+	for _, group := range failureGroups {
+		if summary.FailureCauses == nil {
+			summary.FailureCauses = make(map[string]int)
+		}
+		summary.FailureCauses[group.cause] = len(group.sources)
+	}
+	if simulateRate > 0 {
+		console.println("simulated, nothing was changed")
+	} else if err = appendHistory(destDir, summary); err != nil {
+		console.println("couldn't record the run in the library's history:", err)
+	}
+
+	// tracks are removed as their jobs finish, this takes the folders they were extracted to
+	os.RemoveAll(archiveExtractDir(destDir))
+
+	// blacklisted or failed albums shouldn't leave skeletons behind in the mirror, in place the empty directories are the user's own
+	if *removeEmptyDirs && !*inPlace && simulateRate == 0 {
+		if _, err = removeEmptyDirectories(destDir, make(map[string]bool), true, false); err != nil {
+			console.println("couldn't remove empty directories:", err)
+		}
+	}
+
+	elaspedTime := time.Since(startTime)
+	if *showTimings {
+		console.report("timings", timings.data(elaspedTime, *workerCount), func() {
+			timings.print(elaspedTime, *workerCount)
+		})
+	}
+	console.report("summary", summary, func() {
+		if len(failureGroups) > 0 {
+			console.printf("%s jobs failed:\n", formatCount(run.Failed))
+			for _, group := range failureGroups {
+				console.printf("  %8s  %s, ie %s\n", formatCount(len(group.sources)), group.cause, console.relative(group.sources[0]))
+			}
+		}
+		if len(summary.RepeatedWarnings) > 0 {
+			var kinds []string
+			for kind := range summary.RepeatedWarnings {
+				kinds = append(kinds, kind)
+			}
+			sort.Slice(kinds, func(a, b int) bool { return summary.RepeatedWarnings[kinds[a]] > summary.RepeatedWarnings[kinds[b]] })
+			for _, kind := range kinds {
+				console.printf("warning %s: message repeated %s times\n", kind, formatCount(summary.RepeatedWarnings[kind]))
+			}
+		}
+		if alreadyDone > 0 {
+			console.printf("%s jobs were already done by earlier runs\n", formatCount(alreadyDone))
+		}
+		if run.Protected > 0 {
+			console.printf("%s sources are drm protected and were skipped\n", formatCount(run.Protected))
+		}
+		if run.BitPerfect > 0 {
+			console.printf("%s lossless outputs were verified bit for bit against their sources\n", formatCount(run.BitPerfect))
+		}
+		if run.Remaining > 0 {
+			console.printf("Stopped early (%s) after %s, %d jobs are left for the next run\n", run.StopReason, elaspedTime, run.Remaining)
+		} else {
+			console.printf("All files processed in %s\n", elaspedTime)
+		}
+	})
+}
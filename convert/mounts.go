@@ -0,0 +1,104 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// how often the destination is checked on while jobs run, and how long a check may take before it counts as gone
+const (
+	destinationCheckInterval = 5 * time.Second
+	destinationCheckTimeout  = 10 * time.Second
+)
+
+// checks on the destination for as long as the run goes, holding back new jobs while it's unreachable, ie a dropped
+// smb or nfs mount. the tool's directory is what's checked, an unmounted mount point is still there but empty
+func watchDestination(ctx context.Context, d *dispatcher, destDir string) {
+	marker := filepath.Join(destDir, toolDirName)
+	go func() {
+		ticker := time.NewTicker(destinationCheckInterval)
+		defer ticker.Stop()
+
+		// a stat on a hard nfs mount can hang for good, only one is ever left waiting
+		var pending chan error
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if pending == nil {
+				pending = make(chan error, 1)
+				go func(result chan<- error) {
+					_, err := destination.Stat(marker)
+					result <- err
+				}(pending)
+			}
+			select {
+			case err := <-pending:
+				pending = nil
+				if err != nil {
+					d.destinationLost(destDir, err.Error())
+				} else {
+					d.destinationBack(destDir)
+				}
+			case <-time.After(destinationCheckTimeout):
+				d.destinationLost(destDir, "it isn't responding")
+			}
+		}
+	}()
+}
+
+// counts every write to a channel, for copies watched for stalls
+type progressWriter struct {
+	w        io.Writer
+	progress chan<- struct{}
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	select {
+	case p.progress <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+// io.Copy, but giving up once nothing has been written for the timeout, 0 waits forever.
+// a write stuck on a dead mount can't be interrupted, it's left behind to fail whenever the mount does
+func copyWithStallTimeout(dst io.Writer, src io.Reader, timeout time.Duration) (int64, error) {
+	if timeout == 0 {
+		return io.Copy(dst, src)
+	}
+
+	type copyResult struct {
+		written int64
+		err     error
+	}
+	progress := make(chan struct{}, 1)
+	done := make(chan copyResult, 1)
+	go func() {
+		written, err := io.Copy(progressWriter{w: dst, progress: progress}, src)
+		done <- copyResult{written: written, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case result := <-done:
+			return result.written, result.err
+		case <-progress:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+		case <-timer.C:
+			return 0, withKind(errTimeout, fmt.Errorf("the copy stalled, nothing could be written for %s", timeout))
+		}
+	}
+}
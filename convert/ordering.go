@@ -0,0 +1,43 @@
+package convert
+
+import "sort"
+
+// passes reports on in the order their jobs were planned in rather than the order they finish in, holding back the
+// ones that finish early until the jobs planned before them have reported. the workers carry on meanwhile, it's only
+// the printing and recording of their results that waits, -abort-after included
+func orderReports(results <-chan jobReport) <-chan jobReport {
+	ordered := make(chan jobReport)
+	go func() {
+		defer close(ordered)
+		held := make(map[int]jobReport)
+		next := 0
+		for report := range results {
+			// a second report for the same place isn't held back, it would take the first one's place
+			if _, taken := held[report.job.plannedIndex]; taken || report.job.plannedIndex < next {
+				ordered <- report
+				continue
+			}
+			held[report.job.plannedIndex] = report
+			for {
+				report, ok := held[next]
+				if !ok {
+					break
+				}
+				delete(held, next)
+				ordered <- report
+				next++
+			}
+		}
+
+		// the jobs that never reported leave gaps, the rest is let out in order once the workers are done
+		var indexes []int
+		for index := range held {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		for _, index := range indexes {
+			ordered <- held[index]
+		}
+	}()
+	return ordered
+}
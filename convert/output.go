@@ -0,0 +1,308 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// the color each job status is printed in
+var statusColors = map[string]string{
+	"done":      colorGreen,
+	"retag":     colorGreen,
+	"deleted":   colorGreen,
+	"trashed":   colorGreen,
+	"kept":      colorYellow,
+	"protected": colorYellow,
+	"warning":   colorYellow,
+	"skipped":   colorYellow,
+	"failed":    colorRed,
+}
+
+// the run's console output, status lines are aligned and colored when going to a terminal
+type consoleOutput struct {
+	writer io.Writer
+	// print statuses in color
+	color bool
+	// print the ffmpeg commands being run and other noise
+	verbose bool
+	// paths under these are shown relative to them
+	roots []string
+	// print every line as a json event instead, for scripts wrapping the tool
+	json bool
+	// workers print concurrently, keep their lines whole
+	mutex sync.Mutex
+	// how many times each kind of warning came up, see warning
+	warnings     map[string]int
+	warningMutex sync.Mutex
+}
+
+// how many times the same kind of warning is printed before the rest are only counted for the summary
+const warningLinesPerKind = 3
+
+var console = &consoleOutput{writer: os.Stdout, color: isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""}
+
+// checks whether a file is an interactive terminal, rather than a pipe or a regular file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// a line of -json output
+type consoleEvent struct {
+	// queued, started, progress, job, message, debug or summary
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// job events, with the job's id, see jobID
+	ID          string  `json:"id,omitempty"`
+	Status      string  `json:"status,omitempty"`
+	Source      string  `json:"source,omitempty"`
+	Destination string  `json:"destination,omitempty"`
+	Elapsed     float64 `json:"elapsed,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	// what kind of failure the error is, see errorKindNames
+	ErrorKind string `json:"errorKind,omitempty"`
+	// progress events: how far into its output an encode is and how long the output runs, in seconds,
+	// duration is left out when the source's length isn't known
+	Position float64 `json:"position,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	// message events
+	Message string `json:"message,omitempty"`
+	// the run summary, or whatever else a command reports as a whole
+	Data interface{} `json:"data,omitempty"`
+}
+
+func (c *consoleOutput) emit(event consoleEvent) {
+	event.Time = time.Now()
+	data, err := json.Marshal(event)
+	if err != nil {
+		data, _ = json.Marshal(consoleEvent{Event: "message", Time: event.Time, Message: err.Error()})
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(c.writer, "%s\n", data)
+}
+
+// prints how a job went: a status line, or a job event with -json. destination and err are optional
+func (c *consoleOutput) job(status string, elapsed time.Duration, j job, destination string, err error) {
+	source := j.sourceFile
+	if c.json {
+		event := consoleEvent{Event: "job", ID: jobID(j), Status: status, Source: source, Destination: destination, Elapsed: elapsed.Seconds()}
+		if err != nil {
+			event.Error, event.ErrorKind = err.Error(), errorKindName(err)
+		}
+		c.emit(event)
+		return
+	}
+
+	message := c.relative(source)
+	if destination != "" {
+		message += " -> " + c.relative(destination)
+	}
+	if err != nil {
+		message += ": " + c.relativeText(err.Error())
+	}
+	// the id is how the job's found again in the history and the state, see history -job
+	if id := jobID(j); c.verbose && id != "" {
+		message += " [" + id + "]"
+	}
+	c.jobStatus(status, elapsed, message)
+}
+
+// tells -json wrappers a job was queued or started, the status lines only say how jobs ended
+func (c *consoleOutput) jobEvent(event string, j job) {
+	if c.json {
+		c.emit(consoleEvent{Event: event, ID: jobID(j), Source: j.sourceFile, Destination: j.destinationFile})
+	}
+}
+
+// tells -json wrappers how far an encode has got
+func (c *consoleOutput) jobProgress(j job, position time.Duration, duration time.Duration) {
+	if c.json {
+		c.emit(consoleEvent{Event: "progress", ID: jobID(j), Source: j.sourceFile, Position: position.Seconds(), Duration: duration.Seconds()})
+	}
+}
+
+// prints a warning about a job. the same warning for track after track, ie an encoder's complaint about every file,
+// is shown a few times and then only counted, warnings are told apart the way failures are, see failureCause
+func (c *consoleOutput) warning(j job, err error) {
+	kind := failureCause(err)
+	c.warningMutex.Lock()
+	if c.warnings == nil {
+		c.warnings = make(map[string]int)
+	}
+	c.warnings[kind]++
+	count := c.warnings[kind]
+	c.warningMutex.Unlock()
+
+	if count <= warningLinesPerKind || c.json {
+		c.job("warning", 0, j, "", err)
+	} else if count == warningLinesPerKind+1 {
+		c.printf("the same warning keeps coming up (%s), it's counted in the summary at the end\n", kind)
+	}
+}
+
+// the warnings that came up more often than they were printed, by kind
+func (c *consoleOutput) repeatedWarnings() map[string]int {
+	c.warningMutex.Lock()
+	defer c.warningMutex.Unlock()
+
+	repeated := make(map[string]int)
+	for kind, count := range c.warnings {
+		if count > warningLinesPerKind {
+			repeated[kind] = count
+		}
+	}
+	return repeated
+}
+
+// prints a line of output, a message event with -json
+func (c *consoleOutput) printf(format string, args ...interface{}) {
+	if c.json {
+		c.emit(consoleEvent{Event: "message", Message: strings.TrimSpace(fmt.Sprintf(format, args...))})
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(c.writer, format, escapeArgs(args)...)
+}
+
+func (c *consoleOutput) println(args ...interface{}) {
+	c.printf("%s\n", strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+// reports something as a whole, like a run's summary, printing text the usual way or data as an event with -json
+func (c *consoleOutput) report(event string, data interface{}, text func()) {
+	if c.json {
+		c.emit(consoleEvent{Event: event, Data: data})
+		return
+	}
+	text()
+}
+
+// prints an aligned status line for a job, ie "done       3.2s  Artist/Album/01.flac -> Artist/Album/01.opus"
+func (c *consoleOutput) jobStatus(status string, elapsed time.Duration, message string) {
+	shownStatus := fmt.Sprintf("%-7s", status)
+	if c.color && statusColors[status] != "" {
+		shownStatus = statusColors[status] + shownStatus + colorReset
+	}
+
+	shownElapsed := "-"
+	if elapsed > 0 {
+		shownElapsed = fmt.Sprintf("%.1fs", elapsed.Seconds())
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(c.writer, "%s %8s  %s\n", shownStatus, shownElapsed, escapeControl(message))
+}
+
+// prints only when verbose output was asked for
+func (c *consoleOutput) debugf(format string, args ...interface{}) {
+	if !c.verbose {
+		return
+	}
+	if c.json {
+		c.emit(consoleEvent{Event: "debug", Message: strings.TrimSpace(fmt.Sprintf(format, args...))})
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(c.writer, format, escapeArgs(args)...)
+}
+
+// shows a path relative to the library it's in, full absolute paths make lines unreadably long
+func (c *consoleOutput) relative(p string) string {
+	for _, root := range c.roots {
+		if relativePath, err := filepath.Rel(root, p); err == nil && !strings.HasPrefix(relativePath, "..") {
+			return relativePath
+		}
+	}
+
+	return p
+}
+
+// shortens any library paths inside a message, for errors that embed them
+func (c *consoleOutput) relativeText(text string) string {
+	for _, root := range c.roots {
+		text = strings.ReplaceAll(text, root+string(filepath.Separator), "")
+	}
+
+	return text
+}
+
+// escapes control characters, and the unicode ones that reorder text, so a file name with a newline or an escape
+// sequence in it can't break a line of output in two or pass for something else. bytes that aren't utf-8 are escaped
+// too, a lone 0x9b is an escape sequence to some terminals. once anything is escaped backslashes are doubled, so a
+// name with a \n in it isn't mistaken for one with a newline. json output is escaped already
+func escapeControl(text string) string {
+	if utf8.ValidString(text) && strings.IndexFunc(text, isHostileRune) < 0 {
+		return text
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&escaped, `\x%02x`, text[i])
+		case r == '\\':
+			escaped.WriteString(`\\`)
+		case r == '\n':
+			escaped.WriteString(`\n`)
+		case r == '\r':
+			escaped.WriteString(`\r`)
+		case r == '\t':
+			escaped.WriteString(`\t`)
+		case isHostileRune(r) && r < 0x100:
+			fmt.Fprintf(&escaped, `\x%02x`, r)
+		case isHostileRune(r):
+			fmt.Fprintf(&escaped, `\u%04x`, r)
+		default:
+			escaped.WriteRune(r)
+		}
+		i += size
+	}
+	return escaped.String()
+}
+
+func isHostileRune(r rune) bool {
+	return unicode.IsControl(r) || (r >= 0x202a && r <= 0x202e) || (r >= 0x2066 && r <= 0x2069)
+}
+
+// escapes the strings and errors among printf style arguments, the format's own newlines are meant
+func escapeArgs(args []interface{}) []interface{} {
+	escaped := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch value := arg.(type) {
+		case string:
+			escaped[i] = escapeControl(value)
+		case error:
+			escaped[i] = escapeControl(value.Error())
+		default:
+			escaped[i] = arg
+		}
+	}
+	return escaped
+}
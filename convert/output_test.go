@@ -0,0 +1,134 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEscapeControl(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain names", "Artist/Album/01 Track.flac", "Artist/Album/01 Track.flac"},
+		{"unicode names", "Björk/日本語/01 Café.flac", "Björk/日本語/01 Café.flac"},
+		{"windows paths", `C:\Music\Artist\01.flac`, `C:\Music\Artist\01.flac`},
+		{"joiners and marks", "👩\u200d🎤/e\u0301", "👩\u200d🎤/e\u0301"},
+		{"newlines", "01 First\n02 Second.flac", `01 First\n02 Second.flac`},
+		{"carriage returns and tabs", "a\rb\tc", `a\rb\tc`},
+		{"terminal escapes", "\x1b[2J\x1b[31mred.flac", `\x1b[2J\x1b[31mred.flac`},
+		{"nul and del", "a\x00b\x7f", `a\x00b\x7f`},
+		{"c1 controls", "a\u009b31mb\u0085", `a\x9b31mb\x85`},
+		{"bidi overrides", "evil\u202egalf.exe", `evil\u202egalf.exe`},
+		{"every bidi override", "\u202a\u202b\u202c\u202d\u202e", `\u202a\u202b\u202c\u202d\u202e`},
+		{"bidi isolates", "\u2066a\u2067b\u2068c\u2069", `\u2066a\u2067b\u2068c\u2069`},
+		{"bytes that aren't utf-8", "caf\xe9.flac", `caf\xe9.flac`},
+		{"a lone csi byte", "a\x9b2Jb", `a\x9b2Jb`},
+		{"a cut off character", "01 Caf\xc3", `01 Caf\xc3`},
+		{"an escape that's part of the name", `01 \n.flac`, `01 \n.flac`},
+		{"an escape that's part of the name next to a newline", "01 \\n\n.flac", `01 \\n\n.flac`},
+		{"backslashes next to a control", "C:\\Music\\\x1b.flac", `C:\\Music\\\x1b.flac`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := escapeControl(test.text); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// whatever goes in, what comes out is a single line of printable text
+func TestEscapeControlIsPrintable(t *testing.T) {
+	for _, text := range []string{"a\nb", "\x1b]0;title\x07", "\xff\xfe", "\u202e\u2066", "\\\x00\\", strings.Repeat("\x9b", 3)} {
+		escaped := escapeControl(text)
+		for _, r := range escaped {
+			if r < 0x20 || r == 0x7f || isHostileRune(r) || r == 0xfffd {
+				t.Errorf("%q escaped to %q, which still has %U", text, escaped, r)
+			}
+		}
+		if escapeControl(escaped) != escaped {
+			t.Errorf("%q escaped to %q, which gets escaped again", text, escaped)
+		}
+	}
+}
+
+func TestIsHostileRune(t *testing.T) {
+	tests := []struct {
+		r       rune
+		hostile bool
+	}{
+		{'a', false},
+		{' ', false},
+		{'\\', false},
+		{'é', false},
+		{'\u200d', false},
+		// the replacement character is a character, the invalid bytes behind it are escaped on their own
+		{'\ufffd', false},
+		{'\n', true},
+		{'\x1b', true},
+		{'\x7f', true},
+		{'\u0080', true},
+		{'\u009f', true},
+		{'\u00a0', false},
+		{'\u2029', false},
+		{'\u202a', true},
+		{'\u202e', true},
+		{'\u202f', false},
+		{'\u2065', false},
+		{'\u2066', true},
+		{'\u2069', true},
+		{'\u206a', false},
+	}
+	for _, test := range tests {
+		if got := isHostileRune(test.r); got != test.hostile {
+			t.Errorf("%U: got %v, want %v", test.r, got, test.hostile)
+		}
+	}
+}
+
+func TestConsoleEscapesNames(t *testing.T) {
+	var out bytes.Buffer
+	c := &consoleOutput{writer: &out}
+
+	c.printf("couldn't read %s: %s\n", "Album\n01.flac", errorString("bad\x1b[0m"))
+	c.job("done", 0, job{sourceFile: "Album/01\u202e.flac"}, "Album/01\r.m4a", nil)
+	c.println("cue", "a\tb")
+
+	want := []string{
+		`couldn't read Album\n01.flac: bad\x1b[0m`,
+		`done           -  Album/01\u202e.flac -> Album/01\r.m4a`,
+		`cue a\tb`,
+	}
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestConsoleJSONKeepsNames(t *testing.T) {
+	var out bytes.Buffer
+	c := &consoleOutput{writer: &out, json: true}
+
+	name := "Album\n01 \u202e\x1b.flac"
+	c.job("done", 0, job{sourceFile: name}, "", nil)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("the event took %d lines: %q", len(lines), out.String())
+	}
+	var event consoleEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Source != name {
+		t.Errorf("got %q, want %q", event.Source, name)
+	}
+}
+
+type errorString string
+
+func (e errorString) Error() string { return string(e) }
@@ -0,0 +1,230 @@
+package convert
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// shortened names are never cut below this many bytes, on top of the parts that are preserved
+const minimumShortenedLength = 16
+
+// how names are shortened: title cuts file names before their folders, album cuts the folders first, keeping titles
+// whole as long as possible, and hash cuts like title but ends every shortened name with a hash of the whole name,
+// so names that only differ past the cut, like the movements of a long classical work, stay apart
+var shortenStrategies = []string{"title", "album", "hash"}
+
+// the length of the " #1a2b3c4d" the hash strategy ends shortened names with
+const hashSuffixLength = 10
+
+// the track number at the start of a file name, along with its separator, ie "01 - " or "2-03 "
+var trackPrefixPattern = regexp.MustCompile(`^\d+(?:-\d+)?[\s._-]*`)
+
+// cuts s down to at most n bytes without splitting a character, n below 0 is taken as 0
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	if n < 0 {
+		n = 0
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	// a trailing dot or space would get dropped by windows anyway
+	return strings.TrimRight(s[:n], " .")
+}
+
+// splits a file name into the parts shortening keeps, its track number and extension, and the title in between
+func splitFileName(name string) (string, string, string) {
+	extension := filepath.Ext(name)
+	base := strings.TrimSuffix(name, extension)
+	prefix := trackPrefixPattern.FindString(base)
+	return prefix, base[len(prefix):], extension
+}
+
+// cuts a name down to limit bytes, ending it with a hash of the whole name when asked to
+func shortenName(name string, limit int, hashed bool) string {
+	if len(name) <= limit {
+		return name
+	}
+	if !hashed {
+		return truncateBytes(name, limit)
+	}
+	sum := sha1.Sum([]byte(name))
+	return truncateBytes(name, limit-hashSuffixLength) + " #" + hex.EncodeToString(sum[:4])
+}
+
+// shortens a file name to limit bytes by cutting down its title
+func shortenFileName(name string, limit int, hashed bool) string {
+	if len(name) <= limit {
+		return name
+	}
+
+	prefix, title, extension := splitFileName(name)
+	room := limit - len(prefix) - len(extension)
+	if room < 1 {
+		// the number and extension leave no room for a title, the number goes as the title says more about the track
+		return truncateBytes(title, minimumShortenedLength) + extension
+	}
+	// the hash is of the whole name, two titles that only differ in their track number still get different ones
+	if hashed && room > hashSuffixLength {
+		sum := sha1.Sum([]byte(name))
+		return prefix + truncateBytes(title, room-hashSuffixLength) + " #" + hex.EncodeToString(sum[:4]) + extension
+	}
+	return prefix + truncateBytes(title, room) + extension
+}
+
+// shortens a path component, file names keep their track number and extension
+func shortenComponent(component string, limit int, isFile bool, strategy string) string {
+	if isFile {
+		return shortenFileName(component, limit, strategy == "hash")
+	}
+	return shortenName(component, limit, strategy == "hash")
+}
+
+// how short a path component can get, keeping a file name's track number and extension
+func minimumComponentLength(component string, isFile bool, strategy string) int {
+	minimum := minimumShortenedLength
+	if strategy == "hash" {
+		minimum += hashSuffixLength
+	}
+	if isFile {
+		prefix, _, extension := splitFileName(component)
+		minimum += len(prefix) + len(extension)
+	}
+	if len(component) < minimum {
+		return len(component)
+	}
+	return minimum
+}
+
+// keeps output names under maxName bytes and whole output paths under maxPath bytes, either 0 for no limit.
+// which names give way first depends on the strategy, see shortenStrategies, and every track of an album lands
+// in the same shortened directory. names that end up the same, ignoring case, are numbered apart
+func limitPathLengths(jobs []job, outDir string, maxName int, maxPath int, strategy string) {
+	if maxName <= 0 && maxPath <= 0 {
+		return
+	}
+
+	// shortened directories, relative to outDir, by their original path and, lowercased, the other way around
+	shortened := make(map[string]string)
+	originals := make(map[string]string)
+	// every output's planned name is taken, so a shortened name can't land on one that didn't need shortening
+	taken := make(map[string]bool)
+	for _, j := range jobs {
+		taken[strings.ToLower(j.destinationFile)] = true
+	}
+
+	for i := range jobs {
+		relativePath, err := filepath.Rel(outDir, jobs[i].destinationFile)
+		if err != nil {
+			continue
+		}
+		components := strings.Split(relativePath, string(filepath.Separator))
+		last := len(components) - 1
+
+		// directories seen before keep the name they were given
+		known := make([]bool, len(components))
+		for k := 0; k < last; k++ {
+			if short, ok := shortened[filepath.Join(components[:k+1]...)]; ok {
+				components[k] = filepath.Base(short)
+				known[k] = true
+			} else if maxName > 0 {
+				components[k] = shortenComponent(components[k], maxName, false, strategy)
+			}
+		}
+		if maxName > 0 {
+			components[last] = shortenComponent(components[last], maxName, true, strategy)
+		}
+
+		if maxPath > 0 {
+			// outDir and the separators between components
+			excess := len(outDir) + len(components) - maxPath
+			for _, component := range components {
+				excess += len(component)
+			}
+			for _, k := range shorteningOrder(last, strategy) {
+				if excess <= 0 {
+					break
+				}
+				if known[k] {
+					continue
+				}
+				cut := len(components[k]) - minimumComponentLength(components[k], k == last, strategy)
+				if cut > excess {
+					cut = excess
+				}
+				if cut <= 0 {
+					continue
+				}
+				before := len(components[k])
+				components[k] = shortenComponent(components[k], before-cut, k == last, strategy)
+				excess -= before - len(components[k])
+			}
+			if excess > 0 {
+				console.debugf("%s is still %d bytes over the path length limit\n", jobs[i].destinationFile, excess)
+			}
+		}
+
+		// two long album names can be cut down to the same thing, which would merge them. folders that fit keep
+		// their names, they're only recorded so shortened ones can't land on them
+		originalComponents := strings.Split(relativePath, string(filepath.Separator))
+		for k := 0; k < last; k++ {
+			original := filepath.Join(originalComponents[:k+1]...)
+			if known[k] {
+				continue
+			}
+			short := filepath.Join(append(shortenedParents(shortened, originalComponents[:k]), components[k])...)
+			cut := components[k]
+			for n := 2; cut != originalComponents[k] && originals[strings.ToLower(short)] != "" && originals[strings.ToLower(short)] != original; n++ {
+				number := fmt.Sprintf("~%d", n)
+				components[k] = truncateBytes(cut, len(cut)-len(number)) + number
+				short = filepath.Join(append(shortenedParents(shortened, originalComponents[:k]), components[k])...)
+			}
+			shortened[original] = short
+			if originals[strings.ToLower(short)] == "" {
+				originals[strings.ToLower(short)] = original
+			}
+		}
+
+		destinationFile := filepath.Join(outDir, filepath.Join(components...))
+		if destinationFile == jobs[i].destinationFile {
+			continue
+		}
+		prefix, title, extension := splitFileName(components[last])
+		for n := 2; taken[strings.ToLower(destinationFile)]; n++ {
+			number := fmt.Sprintf("~%d", n)
+			destinationFile = filepath.Join(outDir, filepath.Join(components[:last]...), prefix+truncateBytes(title, len(title)-len(number))+number+extension)
+		}
+		taken[strings.ToLower(destinationFile)] = true
+		jobs[i].destinationFile = destinationFile
+	}
+}
+
+// the order path components are cut down in, file name first unless the strategy cuts the album folders first
+func shorteningOrder(last int, strategy string) []int {
+	var order []int
+	if strategy != "album" {
+		order = append(order, last)
+	}
+	for k := last - 1; k >= 0; k-- {
+		order = append(order, k)
+	}
+	if strategy == "album" {
+		order = append(order, last)
+	}
+	return order
+}
+
+// the shortened form of a directory's parents
+func shortenedParents(shortened map[string]string, originalParents []string) []string {
+	if len(originalParents) == 0 {
+		return nil
+	}
+	return strings.Split(shortened[filepath.Join(originalParents...)], string(filepath.Separator))
+}
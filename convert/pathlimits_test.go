@@ -0,0 +1,126 @@
+package convert
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateBytes(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"Homogenic", 20, "Homogenic"},
+		{"Homogenic", 4, "Homo"},
+		{"Homogenic", -1, ""},
+		// é takes two bytes, a cut through it leaves it out
+		{"Café Tacvba", 4, "Caf"},
+		{"Café Tacvba", 5, "Café"},
+		{"日本語", 4, "日"},
+		{"日本語", 6, "日本"},
+		// windows drops a trailing dot or space
+		{"Mr. Bungle", 4, "Mr"},
+		{"Live at. ", 8, "Live at"},
+	}
+	for _, test := range tests {
+		if got := truncateBytes(test.s, test.n); got != test.want {
+			t.Errorf("truncateBytes(%q, %d): got %q, want %q", test.s, test.n, got, test.want)
+		}
+	}
+}
+
+// the hash the hash strategy ends a shortened name with
+func nameHash(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return hex.EncodeToString(sum[:4])
+}
+
+func TestShortenFileName(t *testing.T) {
+	long := "01 - " + strings.Repeat("Movement ", 10) + ".flac"
+	tests := []struct {
+		name   string
+		file   string
+		limit  int
+		hashed bool
+		want   string
+	}{
+		{"short names", "01 - Intro.flac", 64, false, "01 - Intro.flac"},
+		{"the title is cut", long, 24, false, "01 - Movement Movem.flac"},
+		{"multibyte titles at the limit", "02 - 日本語の曲名.opus", 20, false, "02 - 日本語.opus"},
+		{"disc and track numbers are kept", "2-03 Something Long.mp3", 14, false, "2-03 Somet.mp3"},
+		{"hashed", long, 40, true, "01 - Movement Movement Mo #" + nameHash(long) + ".flac"},
+		{"no room for a title", "01 - Title.flac", 6, false, "Title.flac"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := shortenFileName(test.file, test.limit, test.hashed)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("%q was cut through a character", got)
+			}
+			if len(test.file) > test.limit && len(got) > test.limit && test.limit > 10 {
+				t.Errorf("%q is %d bytes, over the limit of %d", got, len(got), test.limit)
+			}
+		})
+	}
+}
+
+func TestLimitPathLengths(t *testing.T) {
+	outDir := filepath.FromSlash("/out")
+	path := func(p string) string { return filepath.Join(outDir, filepath.FromSlash(p)) }
+	plan := func(paths ...string) []job {
+		var jobs []job
+		for _, p := range paths {
+			jobs = append(jobs, job{destinationFile: path(p)})
+		}
+		return jobs
+	}
+	long := strings.Repeat("x", 40)
+
+	tests := []struct {
+		name     string
+		jobs     []job
+		maxName  int
+		maxPath  int
+		strategy string
+		want     []string
+	}{
+		{"nothing over the limits", plan("Artist/Album/01 - Intro.flac"), 64, 255, "title",
+			[]string{"Artist/Album/01 - Intro.flac"}},
+		{"long folders are cut once for every track", plan("Artist/"+long+"/01 - a.flac", "Artist/"+long+"/02 - b.flac"), 20, 0, "title",
+			[]string{"Artist/" + long[:20] + "/01 - a.flac", "Artist/" + long[:20] + "/02 - b.flac"}},
+		{"multibyte folders are cut on a character", plan("Artist/" + strings.Repeat("é", 15) + "/01 - a.flac"), 21, 0, "title",
+			[]string{"Artist/" + strings.Repeat("é", 10) + "/01 - a.flac"}},
+		{"folders cut to the same name are numbered apart", plan("Artist/"+long+" One/01 - a.flac", "Artist/"+long+" Two/01 - a.flac"), 20, 0, "title",
+			[]string{"Artist/" + long[:20] + "/01 - a.flac", "Artist/" + long[:18] + "~2/01 - a.flac"}},
+		{"files cut to the same name are numbered apart", plan("Album/01 - "+long+" (Live).flac", "Album/01 - "+long+" (Demo).flac"), 30, 0, "title",
+			[]string{"Album/01 - " + long[:20] + ".flac", "Album/01 - " + long[:18] + "~2.flac"}},
+		{"numbering ignores case", plan("Album/"+strings.ToUpper(long)+".flac", "Album/"+long+"X.flac"), 20, 0, "title",
+			[]string{"Album/" + strings.ToUpper(long)[:15] + ".flac", "Album/" + long[:13] + "~2.flac"}},
+		{"shortened names don't take names that fit", plan("Album/"+long+".flac", "Album/"+long[:15]+".flac"), 20, 0, "title",
+			[]string{"Album/" + long[:13] + "~2.flac", "Album/" + long[:15] + ".flac"}},
+		{"the title strategy cuts titles first", plan(long + "/01 - " + long + ".flac"), 0, len(outDir) + 70, "title",
+			[]string{long + "/01 - " + long[:18] + ".flac"}},
+		{"the album strategy cuts folders first", plan(long + "/01 - " + long + ".flac"), 0, len(outDir) + 70, "album",
+			[]string{long[:18] + "/01 - " + long + ".flac"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limitPathLengths(test.jobs, outDir, test.maxName, test.maxPath, test.strategy)
+			for i, j := range test.jobs {
+				if want := path(test.want[i]); j.destinationFile != want {
+					t.Errorf("job %d: got %s, want %s", i, j.destinationFile, want)
+				}
+			}
+		})
+	}
+}
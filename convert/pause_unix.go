@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package convert
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// how a run is paused, for the usage text
+const pauseHelp = "pause a run by sending it SIGUSR1, ie kill -USR1 <pid>, and resume it with SIGUSR2"
+
+// SIGUSR1 pauses dispatching new jobs, SIGUSR2 resumes it
+func handlePauseSignals(d *dispatcher) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				d.pause()
+			} else {
+				d.resume()
+			}
+		}
+	}()
+}
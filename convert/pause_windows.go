@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package convert
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// how a run is paused, for the usage text
+const pauseHelp = "pause a run in a console by typing p and enter, and resume it with r and enter"
+
+// windows has no user signals to pause with, a run in a console takes p and r typed on its input instead
+func handlePauseSignals(d *dispatcher) {
+	if !isTerminal(os.Stdin) {
+		return
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+			case "p", "pause":
+				d.pause()
+			case "r", "resume":
+				d.resume()
+			}
+		}
+	}()
+}
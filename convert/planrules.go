@@ -0,0 +1,386 @@
+package convert
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the actions a rule can take on a source. remux is only taken by the built in rules, it needs a source already
+// in the target's codec
+const (
+	actionEncode = "encode"
+	actionCopy   = "copy"
+	actionRemux  = "remux"
+	actionSkip   = "skip"
+)
+
+// a rule deciding what's done with an audio source. the config's come from [[rule]] tables, ie
+//
+//	[[rule]]
+//	path = "Audiobooks"
+//	action = "encode"
+//	format = "opus"
+//	bitrate = 48
+//
+//	[[rule]]
+//	codec = "mp3"
+//	max-bitrate = 128
+//	action = "skip"
+//
+// the first rule a source matches decides what happens to it. the config's rules are tried in order before the
+// built in ones, which do what the flags say, see builtinPlanRules
+type planRule struct {
+	// what the rule is called in -verbose output
+	name string
+	// the rule's action for a source, or "" when it doesn't apply to it
+	decide func(source *plannedSource) string
+	// the format and bitrate sources the rule encodes are encoded at instead of the run's, nil and 0 for the run's.
+	// the encoder is picked once the available ones are known, see resolvePlanRules
+	format  *audioFormat
+	bitrate int
+	encoder string
+	// whether it comes from the config
+	configured bool
+}
+
+// what a rule gets to look at about a source. the probe is only run when a rule asks about tags, codecs or bitrates
+type plannedSource struct {
+	file string
+	// where the source is within the library, with forward slashes
+	relativePath string
+	// lowercased, with the dot
+	extension   string
+	compilation bool
+
+	probed   bool
+	probe    sourceProbe
+	probeErr error
+}
+
+// the source's probe, ok is false when it can't be probed, like tracks still inside an archive
+func (s *plannedSource) readProbe() (sourceProbe, bool) {
+	if !s.probed {
+		s.probe, s.probeErr = probeSource(s.file)
+		s.probed = true
+	}
+	return s.probe, s.probeErr == nil
+}
+
+// the action for a source and the rule that decided it. the built in rules end with one that encodes everything,
+// so with them there's always a rule
+func decideSource(rules []planRule, source *plannedSource) (string, *planRule) {
+	for i := range rules {
+		if action := rules[i].decide(source); action != "" {
+			return action, &rules[i]
+		}
+	}
+	return actionEncode, nil
+}
+
+// what the flags make of a source, in order
+func builtinPlanRules(format audioFormat, plan planOptions) []planRule {
+	return []planRule{
+		{name: "suspicious files", decide: func(source *plannedSource) string {
+			// fake upscales aren't worth a place in the library, unless they're reencoded as they have nothing left to lose
+			switch {
+			case !plan.suspiciousFiles[source.file]:
+				return ""
+			case plan.suspiciousAction == "skip":
+				return actionSkip
+			case plan.suspiciousAction == "encode":
+				return actionEncode
+			}
+			return ""
+		}},
+		{name: "compilations", decide: func(source *plannedSource) string {
+			if source.compilation && plan.compilations == "skip" {
+				return actionSkip
+			}
+			return ""
+		}},
+		{name: "audio filters", decide: func(source *plannedSource) string {
+			if plan.filtered {
+				return actionEncode
+			}
+			return ""
+		}},
+		// don't reencode lossy files
+		{name: "lossy sources", decide: func(source *plannedSource) string {
+			if isLossyExtension(source.extension) {
+				return actionCopy
+			}
+			return ""
+		}},
+		// lossless sources already in the target's codec don't need reencoding
+		{name: "same codec", decide: func(source *plannedSource) string {
+			if format.isLossy || plan.sameCodec != "copy" {
+				return ""
+			}
+			return losslessPlan(source.file, source.extension, format)
+		}},
+		{name: "everything else", decide: func(source *plannedSource) string {
+			return actionEncode
+		}},
+	}
+}
+
+func readPlanRules(root configTable) ([]planRule, error) {
+	var rules []planRule
+
+	switch tables := root["rule"].(type) {
+	case nil:
+		return nil, nil
+	case []configTable:
+		for i, table := range tables {
+			rule, err := readPlanRule(table)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+			rule.name = fmt.Sprintf("rule %d", i+1)
+			rules = append(rules, rule)
+		}
+	default:
+		return nil, fmt.Errorf("rules go in [[rule]] tables")
+	}
+
+	return rules, nil
+}
+
+// reads a [[rule]] table. every condition it has has to hold for the rule to apply, lists hold when any of their
+// values does
+func readPlanRule(table configTable) (planRule, error) {
+	rule := planRule{configured: true}
+
+	known := map[string]bool{"extension": true, "codec": true, "path": true, "tag": true, "value": true, "lossy": true, "min-bitrate": true, "max-bitrate": true, "action": true, "format": true, "bitrate": true}
+	for key := range table {
+		if !known[key] {
+			return rule, fmt.Errorf("unknown setting %s", key)
+		}
+	}
+
+	extensions, err := configStrings(table, "extension")
+	if err != nil {
+		return rule, err
+	}
+	for i := range extensions {
+		extensions[i] = normalizeExtension(extensions[i])
+	}
+	codecs, err := configStrings(table, "codec")
+	if err != nil {
+		return rule, err
+	}
+	paths, err := configStrings(table, "path")
+	if err != nil {
+		return rule, err
+	}
+	for i, pattern := range paths {
+		paths[i] = strings.Trim(filepath.ToSlash(pattern), "/")
+		if _, err := path.Match(paths[i], ""); err != nil || paths[i] == "" {
+			return rule, fmt.Errorf("path %q isn't a pattern of folders or files in the library", pattern)
+		}
+	}
+	tag, err := configString(table, "tag")
+	if err != nil {
+		return rule, err
+	}
+	values, err := configStrings(table, "value")
+	if err != nil {
+		return rule, err
+	}
+	if len(values) > 0 && tag == "" {
+		return rule, fmt.Errorf("value needs the tag it's the value of")
+	}
+	var lossy *bool
+	if _, ok := table["lossy"]; ok {
+		value, err := configBool(table, "lossy")
+		if err != nil {
+			return rule, err
+		}
+		lossy = &value
+	}
+	minBitrate, err := configKilobits(table, "min-bitrate")
+	if err != nil {
+		return rule, err
+	}
+	maxBitrate, err := configKilobits(table, "max-bitrate")
+	if err != nil {
+		return rule, err
+	}
+
+	action, err := configString(table, "action")
+	if err != nil {
+		return rule, err
+	}
+	switch action {
+	case actionEncode, actionCopy, actionSkip:
+	case "":
+		return rule, fmt.Errorf("action is required, it's encode, copy or skip")
+	default:
+		return rule, fmt.Errorf("unknown action %s, it's encode, copy or skip", action)
+	}
+	formatName, err := configString(table, "format")
+	if err != nil {
+		return rule, err
+	}
+	if formatName != "" {
+		if rule.format, err = getAudioFormatFromName(formatName); err != nil {
+			return rule, err
+		}
+	}
+	if rule.bitrate, err = configKilobits(table, "bitrate"); err != nil {
+		return rule, err
+	}
+	if (rule.format != nil || rule.bitrate != 0) && action != actionEncode {
+		return rule, fmt.Errorf("format and bitrate are only for rules that encode")
+	}
+	if rule.format != nil && !rule.format.isLossy && rule.bitrate != 0 {
+		return rule, fmt.Errorf("%s is lossless, it has no bitrate to set", rule.format.name)
+	}
+
+	rule.decide = func(source *plannedSource) string {
+		if len(extensions) > 0 && !anyEqualFold(extensions, source.extension) {
+			return ""
+		}
+		if len(paths) > 0 && !matchesLibraryPath(paths, source.relativePath) {
+			return ""
+		}
+		if lossy != nil && isLossyExtension(source.extension) != *lossy {
+			return ""
+		}
+		if len(codecs) == 0 && tag == "" && minBitrate == 0 && maxBitrate == 0 {
+			return action
+		}
+
+		probe, ok := source.readProbe()
+		if !ok {
+			return ""
+		}
+		if len(codecs) > 0 && !anyEqualFold(codecs, probe.codec) {
+			return ""
+		}
+		if tag != "" {
+			value, found := findTag(probe.tags, tag)
+			if !found || (len(values) > 0 && !anyEqualFold(values, strings.TrimSpace(value))) {
+				return ""
+			}
+		}
+		// sources whose bitrate isn't known don't match either bound
+		if (minBitrate != 0 || maxBitrate != 0) && probe.bitrate == 0 {
+			return ""
+		}
+		if (minBitrate != 0 && probe.bitrate < minBitrate) || (maxBitrate != 0 && probe.bitrate > maxBitrate) {
+			return ""
+		}
+		return action
+	}
+	return rule, nil
+}
+
+// applies -extension and -strip-art to the formats of the rules that encode to a format of their own, the way they're
+// applied to the run's. a rule's format that can't be written under the extension is an error rather than written
+// under its own, the outputs would end up under names no run planned
+func overrideRuleFormats(rules []planRule, extension string, stripArt bool) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.format == nil {
+			continue
+		}
+
+		ruleFormat := *rule.format
+		if extension != "" {
+			var err error
+			if ruleFormat, err = withExtension(ruleFormat, extension); err != nil {
+				return fmt.Errorf("%s: %s", rule.name, err)
+			}
+		}
+		if stripArt {
+			ruleFormat = withoutArt(ruleFormat)
+		}
+		rule.format = &ruleFormat
+	}
+	return nil
+}
+
+// picks the encoders of the rules that encode at settings of their own and works out their bitrates, the way the run's
+// own are. rules that only change the bitrate keep the run's format and encoder
+func resolvePlanRules(rules []planRule, format audioFormat, options jobOptions, encoders []string, configured map[string]int) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.format == nil && rule.bitrate == 0 {
+			continue
+		}
+
+		ruleFormat, encoder := format, options.encoder
+		if rule.format != nil {
+			ruleFormat = *rule.format
+			var err error
+			if encoder, err = selectEncoder(&ruleFormat, encoders); err != nil {
+				return fmt.Errorf("%s: %s", rule.name, err)
+			}
+		}
+		bitrate, err := resolveBitrate(ruleFormat, encoder, rule.bitrate, configured)
+		if err != nil {
+			return fmt.Errorf("%s: %s", rule.name, err)
+		}
+
+		ruleOptions := options
+		ruleOptions.encoder, ruleOptions.bitrate = encoder, bitrate
+		if err = checkEncoderSettings(encoder, ruleOptions); err != nil {
+			return fmt.Errorf("%s: %s", rule.name, err)
+		}
+		rule.encoder, rule.bitrate = encoder, bitrate
+	}
+	return nil
+}
+
+// the format and options a source a rule encodes is encoded with
+func (rule *planRule) encodeSettings(format audioFormat, options jobOptions) (audioFormat, jobOptions) {
+	if rule == nil || (rule.format == nil && rule.bitrate == 0) {
+		return format, options
+	}
+	if rule.format != nil {
+		format = *rule.format
+	}
+	options.encoder, options.bitrate = rule.encoder, rule.bitrate
+	return format, options
+}
+
+// whether a path within the library is, or is inside, something matching one of the patterns.
+// "Audiobooks" matches everything in the Audiobooks folder, "*/Live *" every artist's live albums
+func matchesLibraryPath(patterns []string, relativePath string) bool {
+	parts := strings.Split(relativePath, "/")
+	for _, pattern := range patterns {
+		depth := len(strings.Split(pattern, "/"))
+		if depth > len(parts) {
+			continue
+		}
+		if matched, _ := path.Match(pattern, strings.Join(parts[:depth], "/")); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func anyEqualFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// reads a bitrate in kilobits, 0 when it isn't set
+func configKilobits(table configTable, key string) (int, error) {
+	switch value := table[key].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		if value > 0 {
+			return int(value), nil
+		}
+	}
+	return 0, fmt.Errorf("%s should be a number of kilobits, ie 192", key)
+}
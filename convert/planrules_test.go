@@ -0,0 +1,286 @@
+package convert
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustFormat(t *testing.T, name string) audioFormat {
+	t.Helper()
+	format, err := getAudioFormatFromName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *format
+}
+
+// reads the [[rule]] tables of a config
+func mustPlanRules(t *testing.T, text string) []planRule {
+	t.Helper()
+	root, err := parseConfig(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := readPlanRules(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestBuiltinPlanRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		plan   planOptions
+		source plannedSource
+		action string
+		rule   string
+	}{
+		{"suspicious files are skipped before anything else", "aac", planOptions{suspiciousFiles: map[string]bool{"a.flac": true}, suspiciousAction: "skip", compilations: "skip"}, plannedSource{file: "a.flac", extension: ".flac", compilation: true}, actionSkip, "suspicious files"},
+		{"suspicious lossy files are encoded rather than copied", "aac", planOptions{suspiciousFiles: map[string]bool{"a.mp3": true}, suspiciousAction: "encode"}, plannedSource{file: "a.mp3", extension: ".mp3"}, actionEncode, "suspicious files"},
+		{"suspicious files left to copy fall through", "aac", planOptions{suspiciousFiles: map[string]bool{"a.mp3": true}, suspiciousAction: "copy"}, plannedSource{file: "a.mp3", extension: ".mp3"}, actionCopy, "lossy sources"},
+		{"compilations are skipped before filters", "aac", planOptions{compilations: "skip", filtered: true}, plannedSource{file: "a.flac", extension: ".flac", compilation: true}, actionSkip, "compilations"},
+		{"tagged compilations are converted", "aac", planOptions{compilations: "tag"}, plannedSource{file: "a.flac", extension: ".flac", compilation: true}, actionEncode, "everything else"},
+		{"filters reencode lossy sources", "aac", planOptions{filtered: true}, plannedSource{file: "a.mp3", extension: ".mp3"}, actionEncode, "audio filters"},
+		{"lossy sources are copied", "aac", planOptions{}, plannedSource{file: "a.mp3", extension: ".mp3"}, actionCopy, "lossy sources"},
+		{"lossy sources are copied before the same codec", "wav", planOptions{sameCodec: "copy"}, plannedSource{file: "a.mp3", extension: ".mp3"}, actionCopy, "lossy sources"},
+		{"sources in the target's codec are copied", "wav", planOptions{sameCodec: "copy"}, plannedSource{file: "a.wav", extension: ".wav"}, actionCopy, "same codec"},
+		{"sources in the target's codec can be reencoded", "wav", planOptions{sameCodec: "encode"}, plannedSource{file: "a.wav", extension: ".wav"}, actionEncode, "everything else"},
+		{"the same codec doesn't apply to lossy targets", "aac", planOptions{sameCodec: "copy"}, plannedSource{file: "a.flac", extension: ".flac"}, actionEncode, "everything else"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := test.source
+			action, rule := decideSource(builtinPlanRules(mustFormat(t, test.format), test.plan), &source)
+			if rule == nil {
+				t.Fatalf("no rule decided, want %s", test.rule)
+			}
+			if action != test.action || rule.name != test.rule {
+				t.Errorf("got %s by %q, want %s by %q", action, rule.name, test.action, test.rule)
+			}
+		})
+	}
+}
+
+func TestConfiguredRulesComeFirst(t *testing.T) {
+	configured := mustPlanRules(t, `
+[[rule]]
+path = "Audiobooks"
+action = "encode"
+format = "opus"
+bitrate = 48
+
+[[rule]]
+extension = "mp3"
+action = "skip"
+
+[[rule]]
+extension = "mp3"
+action = "copy"
+`)
+	rules := append(append([]planRule{}, configured...), builtinPlanRules(mustFormat(t, "aac"), planOptions{})...)
+
+	tests := []struct {
+		source plannedSource
+		action string
+		rule   string
+	}{
+		// the earliest matching rule wins, even before the built in lossy copy
+		{plannedSource{file: "a.mp3", relativePath: "Audiobooks/Book/01.mp3", extension: ".mp3"}, actionEncode, "rule 1"},
+		{plannedSource{file: "b.mp3", relativePath: "Artist/Album/01.mp3", extension: ".mp3"}, actionSkip, "rule 2"},
+		{plannedSource{file: "c.flac", relativePath: "Artist/Album/01.flac", extension: ".flac"}, actionEncode, "everything else"},
+	}
+	for _, test := range tests {
+		source := test.source
+		action, rule := decideSource(rules, &source)
+		if rule == nil || action != test.action || rule.name != test.rule {
+			t.Errorf("%s: got %s by %v, want %s by %q", test.source.relativePath, action, rule, test.action, test.rule)
+		}
+	}
+}
+
+func TestReadPlanRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		source plannedSource
+		// "" when the rule shouldn't apply
+		action string
+	}{
+		{"path matches inside the folder", `path = "Audiobooks"` + "\naction = \"skip\"", plannedSource{relativePath: "Audiobooks/Book/01.flac", extension: ".flac"}, actionSkip},
+		{"path doesn't match a prefix of a name", `path = "Audio"` + "\naction = \"skip\"", plannedSource{relativePath: "Audiobooks/Book/01.flac", extension: ".flac"}, ""},
+		{"path patterns match a level", `path = "*/Live *"` + "\naction = \"skip\"", plannedSource{relativePath: "Artist/Live at Home/01.flac", extension: ".flac"}, actionSkip},
+		{"extensions match without the dot", `extension = ["FLAC", "wav"]` + "\naction = \"copy\"", plannedSource{relativePath: "a.flac", extension: ".flac"}, actionCopy},
+		{"lossy matches lossy sources", "lossy = true\naction = \"copy\"", plannedSource{relativePath: "a.flac", extension: ".flac"}, ""},
+		{"codec goes by the probe", `codec = "mp3"` + "\naction = \"skip\"", plannedSource{relativePath: "a.mka", extension: ".mka", probed: true, probe: sourceProbe{codec: "MP3"}}, actionSkip},
+		{"max bitrate holds at the bound", "max-bitrate = 128\naction = \"skip\"", plannedSource{relativePath: "a.mp3", extension: ".mp3", probed: true, probe: sourceProbe{bitrate: 128}}, actionSkip},
+		{"max bitrate", "max-bitrate = 128\naction = \"skip\"", plannedSource{relativePath: "a.mp3", extension: ".mp3", probed: true, probe: sourceProbe{bitrate: 320}}, ""},
+		{"unknown bitrates match no bound", "min-bitrate = 128\naction = \"skip\"", plannedSource{relativePath: "a.mp3", extension: ".mp3", probed: true, probe: sourceProbe{}}, ""},
+		{"tags match any value", `tag = "genre"` + "\nvalue = [\"Podcast\", \"Audiobook\"]\naction = \"skip\"", plannedSource{relativePath: "a.mp3", extension: ".mp3", probed: true, probe: sourceProbe{tags: map[string]string{"GENRE": " audiobook "}}}, actionSkip},
+		{"tags without values only have to be there", `tag = "compilation"` + "\naction = \"skip\"", plannedSource{relativePath: "a.mp3", extension: ".mp3", probed: true, probe: sourceProbe{tags: map[string]string{"artist": "someone"}}}, ""},
+		{"every condition has to hold", `extension = "mp3"` + "\npath = \"Podcasts\"\naction = \"skip\"", plannedSource{relativePath: "Music/a.mp3", extension: ".mp3"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := mustPlanRules(t, "[[rule]]\n"+test.config+"\n")
+			if len(rules) != 1 {
+				t.Fatalf("read %d rules, want 1", len(rules))
+			}
+			source := test.source
+			if action := rules[0].decide(&source); action != test.action {
+				t.Errorf("got %q, want %q", action, test.action)
+			}
+		})
+	}
+}
+
+func TestReadPlanRuleErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		error  string
+	}{
+		{"unknown settings", "action = \"skip\"\nname = \"x\"", "unknown setting name"},
+		{"no action", `extension = "mp3"`, "action is required"},
+		{"unknown action", `action = "remux"`, "unknown action remux"},
+		{"format for a copy", "action = \"copy\"\nformat = \"opus\"", "only for rules that encode"},
+		{"bitrate for a lossless format", "action = \"encode\"\nformat = \"flac\"\nbitrate = 128", "flac is lossless"},
+		{"unknown format", "action = \"encode\"\nformat = \"nope\"", "nope"},
+		{"value without a tag", "action = \"skip\"\nvalue = \"x\"", "value needs the tag"},
+		{"empty path", "action = \"skip\"\npath = \"/\"", "isn't a pattern"},
+		{"bad path pattern", "action = \"skip\"\npath = \"[\"", "isn't a pattern"},
+		{"bitrate that isn't a number", "action = \"encode\"\nbitrate = \"high\"", "bitrate should be a number"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := parseConfig("[[rule]]\n" + test.config + "\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = readPlanRules(root)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %v, want an error with %q", err, test.error)
+			}
+			if err != nil && !strings.HasPrefix(err.Error(), "rule 1: ") {
+				t.Errorf("%q doesn't say which rule it's about", err)
+			}
+		})
+	}
+}
+
+func TestResolvePlanRules(t *testing.T) {
+	runFormat := mustFormat(t, "aac")
+	runOptions := jobOptions{encoder: "aac", bitrate: 256}
+	encoders := []string{"aac", "libopus", "libmp3lame"}
+
+	tests := []struct {
+		name       string
+		config     string
+		configured map[string]int
+		format     string
+		encoder    string
+		bitrate    int
+	}{
+		{"a rule's format gets its own encoder and preferred bitrate", "format = \"opus\"", nil, "opus", "libopus", 128},
+		{"a rule's format goes by the config's bitrate", "format = \"opus\"", map[string]int{"opus": 96}, "opus", "libopus", 96},
+		{"a rule's bitrate wins over the config's", "format = \"opus\"\nbitrate = 48", map[string]int{"opus": 96}, "opus", "libopus", 48},
+		{"a bitrate alone keeps the run's format and encoder", "bitrate = 128", nil, "aac", "aac", 128},
+		{"rules without settings encode like the run", "", nil, "aac", "aac", 256},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := mustPlanRules(t, "[[rule]]\naction = \"encode\"\n"+test.config+"\n")
+			if err := resolvePlanRules(rules, runFormat, runOptions, encoders, test.configured); err != nil {
+				t.Fatal(err)
+			}
+			format, options := rules[0].encodeSettings(runFormat, runOptions)
+			if format.name != test.format || options.encoder != test.encoder || options.bitrate != test.bitrate {
+				t.Errorf("got %s with %s at %dk, want %s with %s at %dk", format.name, options.encoder, options.bitrate, test.format, test.encoder, test.bitrate)
+			}
+		})
+	}
+
+	t.Run("sources no rule decided encode like the run", func(t *testing.T) {
+		var rule *planRule
+		format, options := rule.encodeSettings(runFormat, runOptions)
+		if format.name != "aac" || options.encoder != "aac" || options.bitrate != 256 {
+			t.Errorf("got %s with %+v", format.name, options)
+		}
+	})
+}
+
+func TestResolvePlanRulesErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		encoders []string
+		error    string
+	}{
+		{"bitrates out of the encoder's range", "format = \"opus\"\nbitrate = 600", []string{"libopus"}, "rule 1: libopus takes bitrates from 6k to 510k"},
+		{"formats without an encoder", "format = \"opus\"", []string{"aac"}, "rule 1: an ffmpeg encoder for opus was not found"},
+		{"a bitrate alone is checked against the run's encoder", "bitrate = 600", []string{"aac"}, "rule 1: aac takes bitrates from 8k to 512k"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := mustPlanRules(t, "[[rule]]\naction = \"encode\"\n"+test.config+"\n")
+			err := resolvePlanRules(rules, mustFormat(t, "aac"), jobOptions{encoder: "aac", bitrate: 256}, test.encoders, nil)
+			if err == nil || !strings.HasPrefix(err.Error(), test.error) {
+				t.Errorf("got %v, want an error starting with %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestOverrideRuleFormats(t *testing.T) {
+	tests := []struct {
+		name      string
+		extension string
+		stripArt  bool
+		// the rule's format's extension, and whether ffmpeg is told to leave video streams out
+		want   string
+		noArt  bool
+		errors bool
+	}{
+		{"nothing to override", "", false, ".opus", false, false},
+		{"the run's extension", ".mka", false, ".mka", false, false},
+		{"extensions without the dot, in a container that can't hold art", "ogg", false, ".ogg", true, false},
+		{"stripped art", "", true, ".opus", true, false},
+		{"both", ".ogg", true, ".ogg", true, false},
+		{"extensions the rule's format can't be written to", ".m4a", false, "", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := mustPlanRules(t, "[[rule]]\naction = \"encode\"\nformat = \"opus\"\n\n[[rule]]\naction = \"encode\"\nbitrate = 96\n")
+			err := overrideRuleFormats(rules, test.extension, test.stripArt)
+			if test.errors {
+				if err == nil || !strings.HasPrefix(err.Error(), "rule 1: ") {
+					t.Errorf("got %v, want an error about rule 1", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			format := rules[0].format
+			if format.fileExtension != test.want || containsArg(format.ffmpegArguments, "-vn") != test.noArt {
+				t.Errorf("got %s with %v", format.fileExtension, format.ffmpegArguments)
+			}
+			// a rule that only sets a bitrate takes the run's format, which the flags were applied to already
+			if rules[1].format != nil {
+				t.Errorf("the bitrate rule got a format of its own, %s", rules[1].format.name)
+			}
+		})
+	}
+
+	// the formats are copies, the next run's rule gets the one it asked for
+	if format := mustFormat(t, "opus"); format.fileExtension != ".opus" || containsArg(format.ffmpegArguments, "-vn") {
+		t.Errorf("the opus format was changed to %s with %v", format.fileExtension, format.ffmpegArguments)
+	}
+}
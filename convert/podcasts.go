@@ -0,0 +1,340 @@
+package convert
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// what podcasts are converted with unless the convert flags say otherwise: mono opus at a bitrate that's plenty for
+// speech. remixing to mono has the lossy episodes reencoded rather than copied, and opus keeps their chapters
+var spokenWordFlags = []string{"-format", "opus", "-bitrate", "32", "-channels", "1"}
+
+// the audio types feeds give their enclosures, for links that don't end in an extension
+var enclosureExtensions = map[string]string{
+	"audio/mpeg":  ".mp3",
+	"audio/mp3":   ".mp3",
+	"audio/mp4":   ".m4a",
+	"audio/x-m4a": ".m4a",
+	"audio/aac":   ".aac",
+	"audio/ogg":   ".ogg",
+	"audio/opus":  ".opus",
+}
+
+// the parts of an rss feed that say what its episodes are and where to get them
+type podcastFeed struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Items []struct {
+			Title     string `xml:"title"`
+			GUID      string `xml:"guid"`
+			PubDate   string `xml:"pubDate"`
+			Enclosure struct {
+				URL  string `xml:"url,attr"`
+				Type string `xml:"type,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// an episode to download, newest first as feeds list them
+type podcastEpisode struct {
+	feed  string
+	guid  string
+	link  string
+	show  string
+	name  string
+	title string
+}
+
+func podcastStatePath(destDir string) string {
+	return filepath.Join(destDir, toolDirName, "podcasts.json")
+}
+
+// mirrors podcast feeds into the destination: downloads the episodes that haven't been converted yet and converts them
+// into <folder>/<show>/ with the spoken word settings, or whatever convert flags are given after the feeds
+func runPodcasts(args []string) {
+	flags := flag.NewFlagSet("podcasts", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	folder := flags.String("folder", "Podcasts", "the folder of the destination the shows are filed under")
+	latest := flags.Int("latest", 0, "only download the newest this many episodes of each feed not converted yet (0 for all of them)")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		exit(2)
+	}
+	if *latest < 0 {
+		console.println("-latest can't be negative")
+		exit(1)
+	}
+	if *folder == "" || filepath.IsAbs(*folder) || strings.Contains(*folder, "..") {
+		console.println("-folder has to be a folder inside the destination")
+		exit(1)
+	}
+
+	destDir, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	// the feeds come first, the convert flags after them
+	var feeds, convertFlags []string
+	for i, arg := range flags.Args()[1:] {
+		if !isSourceURL(arg) {
+			convertFlags = flags.Args()[1+i:]
+			break
+		}
+		feeds = append(feeds, arg)
+	}
+	if len(feeds) == 0 {
+		flags.Usage()
+		exit(2)
+	}
+
+	converted, err := loadPodcastState(destDir)
+	if err != nil {
+		console.println("couldn't read the podcasts already converted:", err)
+		exit(1)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	var episodes []podcastEpisode
+	for _, feed := range feeds {
+		found, err := readPodcastFeed(ctx, feed)
+		if err != nil {
+			console.printf("couldn't read %s: %s\n", feed, err)
+			continue
+		}
+		var fresh []podcastEpisode
+		for _, episode := range found {
+			if !converted[feed][episode.guid] && (*latest == 0 || len(fresh) < *latest) {
+				fresh = append(fresh, episode)
+			}
+		}
+		if len(fresh) > 0 {
+			console.printf("%s has %d new episodes\n", fresh[0].show, len(fresh))
+		}
+		episodes = append(episodes, fresh...)
+	}
+	if len(episodes) == 0 {
+		console.println("no new episodes")
+		return
+	}
+
+	libraryDir, err := os.MkdirTemp("", "convert-muh-music-podcasts-*")
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	defer os.RemoveAll(libraryDir)
+
+	var downloaded []podcastEpisode
+	for _, episode := range episodes {
+		file := filepath.Join(libraryDir, *folder, episode.show, episode.name)
+		if err := downloadEpisode(ctx, episode.link, file); err != nil {
+			console.printf("couldn't download %s: %s\n", episode.title, err)
+			continue
+		}
+		downloaded = append(downloaded, episode)
+	}
+	if len(downloaded) == 0 {
+		exit(1)
+	}
+
+	// the convert flags go before the directories, where its flag parsing looks for them
+	runConvert(append(append(append([]string{}, spokenWordFlags...), convertFlags...), libraryDir, destDir))
+
+	// episodes whose jobs failed are downloaded again next time
+	for _, episode := range downloaded {
+		base := strings.TrimSuffix(episode.name, filepath.Ext(episode.name))
+		if matches, _ := filepath.Glob(filepath.Join(destDir, *folder, episode.show, globEscape(base)+".*")); len(matches) == 0 {
+			continue
+		}
+		if converted[episode.feed] == nil {
+			converted[episode.feed] = make(map[string]bool)
+		}
+		converted[episode.feed][episode.guid] = true
+	}
+	if err = savePodcastState(destDir, converted); err != nil {
+		console.println("couldn't save the podcasts converted:", err)
+		exit(1)
+	}
+}
+
+// reads a feed's episodes, leaving out the ones without any audio
+func readPodcastFeed(ctx context.Context, feed string) ([]podcastEpisode, error) {
+	response, err := podcastGet(ctx, feed)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var parsed podcastFeed
+	decoder := xml.NewDecoder(response.Body)
+	// feeds that say they're latin-1 are nearly always utf-8 anyway
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) { return input, nil }
+	if err = decoder.Decode(&parsed); err != nil {
+		return nil, err
+	}
+
+	show := tagFileName(parsed.Channel.Title)
+	if show == "" {
+		show = tagFileName(feedHost(feed))
+	}
+	var episodes []podcastEpisode
+	for _, item := range parsed.Channel.Items {
+		link := strings.TrimSpace(item.Enclosure.URL)
+		if link == "" {
+			continue
+		}
+		guid := strings.TrimSpace(item.GUID)
+		if guid == "" {
+			guid = link
+		}
+		episodes = append(episodes, podcastEpisode{feed: feed, guid: guid, link: link, show: show, name: episodeFileName(item.Title, item.PubDate, link, item.Enclosure.Type), title: item.Title})
+	}
+	return episodes, nil
+}
+
+// the name an episode is saved under, its date first so a show's folder sorts oldest to newest, ie "2024-03-01 Title.mp3"
+func episodeFileName(title string, pubDate string, link string, mimeType string) string {
+	extension := ".mp3"
+	if parsed, err := url.Parse(link); err == nil && isAudioExtension(path.Ext(parsed.Path)) {
+		extension = strings.ToLower(path.Ext(parsed.Path))
+	} else if known, ok := enclosureExtensions[strings.ToLower(strings.TrimSpace(mimeType))]; ok {
+		extension = known
+	}
+
+	name := tagFileName(title)
+	if name == "" {
+		name = "Episode"
+	}
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", "2 Jan 2006 15:04:05 -0700"} {
+		if published, err := time.Parse(layout, strings.TrimSpace(pubDate)); err == nil {
+			name = published.Format("2006-01-02") + " " + name
+			break
+		}
+	}
+	return name + extension
+}
+
+func feedHost(feed string) string {
+	if parsed, err := url.Parse(feed); err == nil {
+		return parsed.Host
+	}
+	return feed
+}
+
+// hides glob patterns in a name that's matched literally
+func globEscape(name string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(name)
+}
+
+// some hosts turn away requests that don't look like they come from a podcast app
+func podcastGet(ctx context.Context, link string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", "convert-muh-music")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("%s returned %s", link, response.Status)
+	}
+	return response, nil
+}
+
+// downloads an episode next to file and renames it into place once it's all there
+func downloadEpisode(ctx context.Context, link string, file string) error {
+	response, err := podcastGet(ctx, link)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if err = os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	partial := file + ".partial"
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+	if _, err = io.Copy(out, response.Body); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, file)
+}
+
+// the episodes of each feed already converted into the destination, by guid
+func loadPodcastState(destDir string) (map[string]map[string]bool, error) {
+	converted := make(map[string]map[string]bool)
+	data, err := os.ReadFile(podcastStatePath(destDir))
+	if os.IsNotExist(err) {
+		return converted, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved map[string][]string
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for feed, guids := range saved {
+		converted[feed] = make(map[string]bool)
+		for _, guid := range guids {
+			converted[feed][guid] = true
+		}
+	}
+	return converted, nil
+}
+
+func savePodcastState(destDir string, converted map[string]map[string]bool) error {
+	saved := make(map[string][]string)
+	for feed, guids := range converted {
+		for guid := range guids {
+			saved[feed] = append(saved[feed], guid)
+		}
+		sort.Strings(saved[feed])
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	statePath := podcastStatePath(destDir)
+	if err = os.MkdirAll(filepath.Dir(statePath), os.ModePerm); err != nil {
+		return err
+	}
+	partial := statePath + ".partial"
+	if err = os.WriteFile(partial, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(partial, statePath)
+}
@@ -0,0 +1,143 @@
+package convert
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ffprobe results of earlier runs, so planning a big library again doesn't probe every file again
+type probeCache struct {
+	mutex   sync.Mutex
+	entries map[string]probeCacheEntry
+	// whether anything was probed since the cache was loaded
+	dirty bool
+}
+
+type probeCacheEntry struct {
+	// the file's size and modification time when it was probed, a change to either and it's probed again
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+
+	Tags       map[string]string `json:"tags,omitempty"`
+	Chapters   int               `json:"chapters,omitempty"`
+	Duration   time.Duration     `json:"duration"`
+	Bitrate    int               `json:"bitrate,omitempty"`
+	Codec      string            `json:"codec,omitempty"`
+	Channels   int               `json:"channels,omitempty"`
+	SampleRate int               `json:"sampleRate,omitempty"`
+	Art        bool              `json:"art,omitempty"`
+	Protected  bool              `json:"protected,omitempty"`
+}
+
+var probes = &probeCache{entries: make(map[string]probeCacheEntry)}
+
+// the cache is shared by every destination, sources are what's probed
+func probeCachePath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "convert-muh-music", "probes.json")
+}
+
+// loads the probe cache, a missing or unreadable cache just means probing everything
+func loadProbeCache() {
+	path := probeCachePath()
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	entries := make(map[string]probeCacheEntry)
+	if err = json.Unmarshal(data, &entries); err != nil {
+		console.debugf("ignoring the probe cache, it's unreadable: %s\n", err)
+		return
+	}
+
+	probes.mutex.Lock()
+	defer probes.mutex.Unlock()
+	probes.entries = entries
+}
+
+// writes the probe cache back if anything was probed
+func saveProbeCache() error {
+	path := probeCachePath()
+	probes.mutex.Lock()
+	defer probes.mutex.Unlock()
+	if path == "" || !probes.dirty {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(probes.entries)
+	if err != nil {
+		return err
+	}
+
+	// written aside and renamed over, a run killed halfway shouldn't leave half a cache
+	tempPath := path + ".tmp"
+	if err = os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	probes.dirty = false
+	return nil
+}
+
+// the cached probe of a file, as long as it hasn't changed since
+func (c *probeCache) lookup(file string) (sourceProbe, bool) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return sourceProbe{}, false
+	}
+
+	c.mutex.Lock()
+	entry, ok := c.entries[file]
+	c.mutex.Unlock()
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return sourceProbe{}, false
+	}
+	// audio always has a sample rate, entries without one are from before sample rates and art were cached
+	if entry.Codec != "" && entry.SampleRate == 0 {
+		return sourceProbe{}, false
+	}
+
+	// a copy, callers are free to change the tags they get
+	tags := make(map[string]string, len(entry.Tags))
+	for key, value := range entry.Tags {
+		tags[key] = value
+	}
+	// entries from before bitrates were cached get one from the file's size
+	bitrate := entry.Bitrate
+	if bitrate == 0 && entry.Duration > 0 {
+		bitrate = int(float64(entry.Size*8) / 1000 / entry.Duration.Seconds())
+	}
+	return sourceProbe{tags: tags, chapters: entry.Chapters, duration: entry.Duration, bitrate: bitrate, codec: entry.Codec, channels: entry.Channels, sampleRate: entry.SampleRate, art: entry.Art, protected: entry.Protected}, true
+}
+
+func (c *probeCache) store(file string, probe sourceProbe) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+
+	tags := make(map[string]string, len(probe.tags))
+	for key, value := range probe.tags {
+		tags[key] = value
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[file] = probeCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Tags: tags, Chapters: probe.chapters, Duration: probe.duration, Bitrate: probe.bitrate, Codec: probe.codec, Channels: probe.channels, SampleRate: probe.sampleRate, Art: probe.art, Protected: probe.protected}
+	c.dirty = true
+}
@@ -0,0 +1,51 @@
+package convert
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// probing is mostly waiting on the disk, over a network share even more so, so it runs wider than encoding
+var defaultProbeWorkers = runtime.NumCPU() * 2
+
+// probes files ahead of the steps that need them, through a pool of its own that's separate from the encoders.
+// ffprobe only takes one input, so every file is still its own call, the results land in the probe cache
+func prefetchProbes(ctx context.Context, files []string, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				// failures are reported by whatever needed the probe, when it tries again
+				probeSource(file)
+			}
+		}()
+	}
+	for _, file := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- file
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// the source files of jobs, for prefetchProbes
+func jobSources(jobs []job) []string {
+	files := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		if j.sidecar {
+			continue
+		}
+		files = append(files, j.sourceFile)
+	}
+	return files
+}
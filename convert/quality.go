@@ -0,0 +1,287 @@
+package convert
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the frequencies we check for content above, in hz
+var cutoffBands = []int{15000, 16000, 17000, 18000, 19000, 20000}
+
+// how far below the full band level a high passed band can be before we consider it empty
+const cutoffThreshold = -60.0
+
+// matches the overall rms level astats prints when it's torn down, along with which instance printed it
+var astatsRmsPattern = regexp.MustCompile(`\[Parsed_astats_(\d+) @ [^\]]*\] RMS level dB: (-?[0-9.]+|-inf)`)
+
+type qualityReport struct {
+	// the analyzed lossy file
+	file string
+	// the bitrate the file claims, in kilobits
+	bitrate int
+	// the highest band that still had content, 0 if there was nothing above the lowest band
+	cutoff int
+	// does the cutoff look too low for the claimed bitrate?
+	suspicious bool
+}
+
+func runQuality(args []string) {
+	flags := flag.NewFlagSet("quality", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	reportPath := flags.String("report", "", "write a report file which can be passed to -suspicious-report during conversion")
+	jsonOutput := flags.Bool("json", false, "print every analyzed file as a json event")
+	flags.Parse(args)
+	console.json = *jsonOutput
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		exit(2)
+	}
+
+	if err := selectSource(flags.Arg(0)); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	srcDir, err := filepath.Abs(sourcePath(flags.Arg(0)))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	var files []string
+	err = source.Walk(srcDir, func(curPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// only lossy files can be fake upscales
+		if !entry.IsDir() && isLossyExtension(filepath.Ext(entry.Name())) {
+			files = append(files, curPath)
+		}
+		return nil
+	})
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	var reports []qualityReport
+	var suspiciousCount int
+	for _, file := range files {
+		report, err := analyzeQuality(file)
+		if err != nil {
+			console.printf("couldn't analyze %s: %s\n", file, err)
+			continue
+		}
+		reports = append(reports, report)
+
+		if report.suspicious {
+			suspiciousCount++
+		}
+		printQualityReport(report)
+	}
+
+	console.printf("%d of %d lossy files look like upscales\n", suspiciousCount, len(reports))
+
+	if *reportPath != "" {
+		if err = writeQualityReport(*reportPath, reports); err != nil {
+			console.println(err)
+			exit(1)
+		}
+	}
+}
+
+// prints what the analysis found about a file, only suspicious ones get a line unless it's -json
+func printQualityReport(report qualityReport) {
+	data := struct {
+		File       string `json:"file"`
+		Bitrate    int    `json:"bitrate"`
+		Cutoff     int    `json:"cutoff"`
+		Suspicious bool   `json:"suspicious"`
+	}{report.file, report.bitrate, report.cutoff, report.suspicious}
+	console.report("quality", data, func() {
+		if report.suspicious {
+			console.printf("suspicious: %s claims %dk but has nothing above %s\n", report.file, report.bitrate, formatCutoff(report.cutoff))
+		}
+	})
+}
+
+// measures how much content a lossy file has above each cutoff band, to find where its encoder low passed it
+func analyzeQuality(file string) (qualityReport, error) {
+	report := qualityReport{file: file}
+
+	out, err := toolCommand(context.Background(), ffprobePath, "-loglevel", "error", "-select_streams", "a:0", "-show_entries", "stream=bit_rate:format=bit_rate", "-of", "json", longPath(file)).Output()
+	if err != nil {
+		return report, err
+	}
+	var probed struct {
+		Format struct {
+			BitRate string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			BitRate string `json:"bit_rate"`
+		} `json:"streams"`
+	}
+	if err = json.Unmarshal(out, &probed); err != nil {
+		return report, err
+	}
+	// the stream bitrate is preferred, but some containers only report it for the whole file
+	bitrates := []string{probed.Format.BitRate}
+	if len(probed.Streams) > 0 {
+		bitrates = append([]string{probed.Streams[0].BitRate}, bitrates...)
+	}
+	for _, value := range bitrates {
+		if bitrate, err := strconv.Atoi(value); err == nil {
+			report.bitrate = bitrate / 1000
+			break
+		}
+	}
+
+	// downmix to mono, then split into the full signal plus one steeply high passed copy per band
+	graph := fmt.Sprintf("[0:a]aformat=channel_layouts=mono,asplit=%d[full]", len(cutoffBands)+1)
+	for i := range cutoffBands {
+		graph += fmt.Sprintf("[b%d]", i)
+	}
+	graph += ";[full]astats=measure_perchannel=none:measure_overall=RMS_level[ofull]"
+	for i, band := range cutoffBands {
+		highpass := fmt.Sprintf("highpass=f=%d", band)
+		graph += fmt.Sprintf(";[b%d]%s,%s,%s,astats=measure_perchannel=none:measure_overall=RMS_level[o%d]", i, highpass, highpass, highpass, i)
+	}
+
+	args := []string{"-hide_banner", "-nostats", "-i", longPath(file), "-filter_complex", graph, "-map", "[ofull]", "-f", "null", "-"}
+	for i := range cutoffBands {
+		args = append(args, "-map", fmt.Sprintf("[o%d]", i), "-f", "null", "-")
+	}
+
+	out, err = toolCommand(context.Background(), ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		return report, fmt.Errorf("ffmpeg: %s", strings.TrimSpace(string(out)))
+	}
+
+	// filter instances are numbered in graph order, so sorting by instance gives full band first then each band
+	levels := make(map[int]float64)
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		match := astatsRmsPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		instance, _ := strconv.Atoi(match[1])
+		level, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			// -inf, complete silence
+			level = -200
+		}
+		levels[instance] = level
+	}
+	if len(levels) != len(cutoffBands)+1 {
+		return report, fmt.Errorf("expected %d measurements from ffmpeg, got %d", len(cutoffBands)+1, len(levels))
+	}
+
+	var instances []int
+	for instance := range levels {
+		instances = append(instances, instance)
+	}
+	sort.Ints(instances)
+
+	fullLevel := levels[instances[0]]
+	for i, band := range cutoffBands {
+		if levels[instances[i+1]]-fullLevel > cutoffThreshold {
+			report.cutoff = band
+		}
+	}
+
+	report.suspicious = report.cutoff < expectedCutoff(report.bitrate)
+
+	return report, nil
+}
+
+// the lowest cutoff a real encode at the given bitrate would be expected to have
+func expectedCutoff(bitrate int) int {
+	switch {
+	case bitrate >= 256:
+		return 19000
+	case bitrate >= 192:
+		return 18000
+	case bitrate >= 160:
+		return 17000
+	case bitrate >= 128:
+		return 16000
+	default:
+		// low bitrate files are expected to be low passed hard, nothing to flag
+		return 0
+	}
+}
+
+func formatCutoff(cutoff int) string {
+	if cutoff == 0 {
+		return fmt.Sprintf("%dkHz", cutoffBands[0]/1000)
+	}
+	return fmt.Sprintf("%dkHz", cutoff/1000)
+}
+
+// writes one tab separated line per file, the path is last so tabs in file names can't break parsing.
+// paths with a newline or other control character in them, or that start with a quote, are written go quoted
+func writeQualityReport(reportPath string, reports []qualityReport) error {
+	file, err := os.Create(reportPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, report := range reports {
+		verdict := "ok"
+		if report.suspicious {
+			verdict = "suspicious"
+		}
+		path := report.file
+		if strings.HasPrefix(path, `"`) || strings.IndexFunc(path, isHostileRune) >= 0 {
+			path = strconv.Quote(path)
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%s\n", verdict, report.bitrate, report.cutoff, path)
+	}
+
+	return writer.Flush()
+}
+
+// reads the files flagged as suspicious from a report written by the quality subcommand
+func readSuspiciousFiles(reportPath string) (map[string]bool, error) {
+	file, err := os.Open(reportPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	suspicious := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		path := fields[3]
+		if strings.HasPrefix(path, `"`) {
+			if path, err = strconv.Unquote(path); err != nil {
+				return nil, fmt.Errorf("%s: can't read the path %s", reportPath, fields[3])
+			}
+		}
+		if fields[0] == "suspicious" {
+			suspicious[path] = true
+		}
+	}
+
+	return suspicious, scanner.Err()
+}
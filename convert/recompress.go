@@ -0,0 +1,253 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how a flac came out of being recompressed
+type recompressResult struct {
+	file string
+	// the replacement was moved over the original
+	replaced bool
+	// the original had no md5 of its audio, which the replacement has
+	fixedMD5 bool
+	// the sizes before and after, after is 0 when nothing was encoded
+	before  int64
+	after   int64
+	err     error
+	elapsed time.Duration
+}
+
+// reencodes the flacs of a library at a chosen compression level, only replacing them once the audio is verified unchanged
+func runRecompress(args []string) {
+	flags := flag.NewFlagSet("recompress", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	compressionLevel := flags.Int("compression-level", 8, "the flac compression level to reencode at, from 0 to 12")
+	fixMD5 := flags.Bool("fix-md5", false, "also replace flacs missing the md5 of their audio when recompressing doesn't make them smaller")
+	workerCount := flags.Int("workers", runtime.NumCPU(), "the number of flacs recompressed at once")
+	jsonOutput := flags.Bool("json", false, "print every recompressed file as a json event")
+	flags.Parse(args)
+	console.json = *jsonOutput
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		exit(2)
+	}
+	if *compressionLevel < 0 || *compressionLevel > 12 {
+		fmt.Println("-compression-level has to be between 0 and 12")
+		exit(1)
+	}
+	if *workerCount < 1 {
+		fmt.Println("-workers has to be at least 1")
+		exit(1)
+	}
+
+	libraryDir, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	console.roots = []string{libraryDir}
+	if err = checkDestinationWritable(libraryDir); err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+
+	var files []string
+	err = filepath.WalkDir(libraryDir, func(curPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == toolDirName {
+			return fs.SkipDir
+		}
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".flac") {
+			files = append(files, curPath)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	queue := make(chan string)
+	results := make(chan recompressResult)
+	var workers sync.WaitGroup
+	for i := 0; i < *workerCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for file := range queue {
+				results <- recompressFlac(ctx, file, *compressionLevel, *fixMD5)
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for _, file := range files {
+			if ctx.Err() != nil {
+				return
+			}
+			queue <- file
+		}
+	}()
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var replaced, fixed, failed int
+	var saved int64
+	for result := range results {
+		status, message := "kept", "not any smaller"
+		switch {
+		case result.err != nil && ctx.Err() != nil:
+			// cut short by the interrupt, the original is untouched
+			continue
+		case result.err != nil:
+			failed++
+			status, message = "failed", console.relativeText(result.err.Error())
+		case result.replaced:
+			replaced++
+			saved += result.before - result.after
+			if result.fixedMD5 {
+				fixed++
+			}
+			status, message = "done", formatSize(result.before)+" -> "+formatSize(result.after)
+		}
+
+		data := struct {
+			File   string `json:"file"`
+			Status string `json:"status"`
+			Before int64  `json:"before"`
+			After  int64  `json:"after,omitempty"`
+			Error  string `json:"error,omitempty"`
+		}{File: result.file, Status: status, Before: result.before, After: result.after}
+		if result.err != nil {
+			data.Error = result.err.Error()
+		}
+		console.report("recompress", data, func() {
+			console.jobStatus(status, result.elapsed, console.relative(result.file)+": "+message)
+		})
+	}
+
+	data := struct {
+		Files     int   `json:"files"`
+		Replaced  int   `json:"replaced"`
+		FixedMD5  int   `json:"fixedMD5"`
+		Failed    int   `json:"failed"`
+		SavedSize int64 `json:"savedSize"`
+	}{len(files), replaced, fixed, failed, saved}
+	console.report("summary", data, func() {
+		fmt.Printf("recompressed %s of %s flacs, saving %s", formatCount(replaced), formatCount(len(files)), formatSize(saved))
+		if fixed > 0 {
+			fmt.Printf(", %s of them were missing their md5", formatCount(fixed))
+		}
+		fmt.Println()
+		if failed > 0 {
+			fmt.Printf("%s flacs couldn't be recompressed and were left as they were\n", formatCount(failed))
+		}
+	})
+	if ctx.Err() != nil {
+		fmt.Println("interrupted, the flacs not recompressed yet were left as they were")
+	}
+	if failed > 0 || ctx.Err() != nil {
+		exit(1)
+	}
+}
+
+// reencodes a flac next to itself and moves it over the original if its audio decodes the same and it's worth keeping
+func recompressFlac(ctx context.Context, file string, compressionLevel int, fixMD5 bool) recompressResult {
+	startTime := time.Now()
+	result := recompressResult{file: file}
+	fail := func(err error) recompressResult {
+		result.err = err
+		result.elapsed = time.Since(startTime)
+		return result
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return fail(err)
+	}
+	result.before = info.Size()
+	// unreadable streaminfo is as good as missing, ffmpeg writes a fresh one
+	missingMD5, err := flacMissingMD5(file)
+	if err != nil {
+		missingMD5 = true
+	}
+
+	// next to the original, so replacing it is a rename on the same filesystem
+	tempFile := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".recompress")
+	defer os.Remove(tempFile)
+	// cover art and tags are carried over as they are, only the audio is reencoded
+	out, err := toolCommand(ctx, ffmpegPath, "-loglevel", "error", "-y", "-i", longPath(file), "-map", "0", "-map_metadata", "0", "-c", "copy", "-c:a", "flac", "-compression_level", strconv.Itoa(compressionLevel), "-f", "flac", longPath(tempFile)).CombinedOutput()
+	if err != nil {
+		return fail(fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out))))
+	}
+
+	tempInfo, err := os.Stat(tempFile)
+	if err != nil {
+		return fail(err)
+	}
+	result.after = tempInfo.Size()
+	result.fixedMD5 = missingMD5
+	if result.after >= result.before && !(fixMD5 && missingMD5) {
+		result.elapsed = time.Since(startTime)
+		return result
+	}
+
+	// the original is only ever replaced by something that decodes to exactly the same samples
+	if _, err = verifyBitPerfect(ctx, file, tempFile); err != nil {
+		return fail(err)
+	}
+
+	if err = os.Chmod(tempFile, info.Mode().Perm()); err != nil {
+		return fail(err)
+	}
+	if err = os.Rename(tempFile, file); err != nil {
+		return fail(err)
+	}
+	result.replaced = true
+	result.elapsed = time.Since(startTime)
+	return result
+}
+
+// checks whether a flac's streaminfo block leaves the md5 of its audio unset, as some rippers do
+func flacMissingMD5(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// the "fLaC" marker, the streaminfo block's header, then the 34 bytes of streaminfo with the md5 last
+	header := make([]byte, 4+4+34)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return false, err
+	}
+	if string(header[:4]) != "fLaC" || header[4]&0x7f != 0 {
+		return false, fmt.Errorf("%s doesn't start with a flac streaminfo block", file)
+	}
+
+	return bytes.Equal(header[26:42], make([]byte, 16)), nil
+}
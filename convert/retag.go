@@ -0,0 +1,97 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// what a source looked like when it was processed, so later runs can tell when it changes
+type sourceFingerprint struct {
+	size    int64
+	modTime time.Time
+	// md5 of the source's audio packets, empty for copies, which are cheap to redo anyway
+	audioHash string
+}
+
+func fingerprintSource(j job) sourceFingerprint {
+	var fingerprint sourceFingerprint
+
+	info, err := os.Stat(j.sourceFile)
+	if err != nil {
+		return fingerprint
+	}
+	fingerprint.size = info.Size()
+	fingerprint.modTime = info.ModTime()
+
+	if j.encode {
+		fingerprint.audioHash = j.audioHash
+		if fingerprint.audioHash == "" {
+			// a failed hash only costs the next edit a full reencode
+			fingerprint.audioHash, _ = audioHash(j.sourceFile)
+		}
+	}
+
+	return fingerprint
+}
+
+// hashes the audio packets of a file without decoding them, tag edits don't change it
+func audioHash(file string) (string, error) {
+	out, err := toolCommand(context.Background(), ffmpegPath, "-loglevel", "error", "-i", longPath(file), "-map", "0:a:0", "-c", "copy", "-f", "hash", "-hash", "md5", "-").Output()
+	if err != nil {
+		return "", err
+	}
+
+	return parseHash(out)
+}
+
+// reads the md5 ffmpeg's hash muxer printed
+func parseHash(out []byte) (string, error) {
+	hash := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(hash, "MD5=") {
+		return "", fmt.Errorf("unexpected hash output from ffmpeg: %s", hash)
+	}
+	return strings.TrimPrefix(hash, "MD5="), nil
+}
+
+// checks whether a source was modified since it was processed
+func sourceChanged(sourceFile string, entry stateEntry) bool {
+	// processed before sources were fingerprinted, there's nothing to compare against
+	if entry.SourceModTime.IsZero() {
+		return false
+	}
+
+	info, err := os.Stat(sourceFile)
+	if err != nil {
+		return false
+	}
+
+	return info.Size() != entry.SourceSize || !info.ModTime().Equal(entry.SourceModTime)
+}
+
+// rewrites the tags of a job's existing output from its source, remuxing the output's streams as they are
+func retagJob(ctx context.Context, id int, j job, stagedFile string, startTime time.Time) jobReport {
+	args := []string{"-loglevel", "error", "-y", "-i", longPath(j.sourceFile), "-i", longPath(j.destinationFile), "-map", "1", "-map_metadata", "0", "-map_chapters", "0", "-c", "copy"}
+	for _, tag := range j.metadata {
+		args = append(args, "-metadata", tag)
+	}
+	// the tags come from the source, the output's settings fingerprint would go missing with its old tags
+	if fingerprint, err := readSettingsTag(j.destinationFile); err == nil && fingerprint != "" {
+		args = append(args, "-metadata", settingsTag+"="+fingerprint)
+	}
+	if j.format.muxer != "" {
+		args = append(args, "-f", j.format.muxer)
+	}
+	args = append(args, "-id3v2_version", "3", longPath(stagedFile))
+
+	console.debugf("worker %d running job %s: %s\n", id, jobID(j), commandLine(ffmpegPath, args))
+	out, err := toolCommand(ctx, ffmpegPath, args...).CombinedOutput()
+	elaspedTime := time.Since(startTime)
+	if err != nil {
+		return jobReport{workerId: id, error: fmt.Errorf("worker %d's retag failed: ffmpeg: %s", id, strings.TrimSpace(string(out))), elaspedTime: elaspedTime, job: j}
+	}
+
+	return jobReport{workerId: id, elaspedTime: elaspedTime, job: j}
+}
@@ -0,0 +1,140 @@
+package convert
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// a rule cleaning up a tag on its way into the output library, from a [[rewrite]] table in the config, ie
+//
+//	[[rewrite]]
+//	tag = "genre"
+//	from = "Hip-Hop/Rap"
+//	to = "Hip-Hop"
+type rewriteRule struct {
+	// the tag the rule applies to, ie artist or genre
+	tag string
+	// the whole value to replace, compared case insensitively
+	from string
+	// a regular expression to replace matches of instead, the replacement can use $1 and friends
+	pattern *regexp.Regexp
+	// what from or pattern is replaced with
+	to string
+	// capitalize the first letter of every word
+	titleCase bool
+}
+
+func readRewriteRules(root configTable) ([]rewriteRule, error) {
+	var rules []rewriteRule
+
+	switch tables := root["rewrite"].(type) {
+	case nil:
+		return nil, nil
+	case []configTable:
+		for i, table := range tables {
+			rule, err := readRewriteRule(table)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: %s", i+1, err)
+			}
+			rules = append(rules, rule)
+		}
+	default:
+		return nil, fmt.Errorf("rewrite rules go in [[rewrite]] tables")
+	}
+
+	return rules, nil
+}
+
+func readRewriteRule(table configTable) (rewriteRule, error) {
+	var rule rewriteRule
+	var err error
+
+	if rule.tag, err = configString(table, "tag"); err != nil {
+		return rule, err
+	}
+	if rule.tag == "" {
+		return rule, fmt.Errorf("tag is required")
+	}
+	if rule.from, err = configString(table, "from"); err != nil {
+		return rule, err
+	}
+	pattern, err := configString(table, "pattern")
+	if err != nil {
+		return rule, err
+	}
+	if pattern != "" {
+		if rule.pattern, err = regexp.Compile(pattern); err != nil {
+			return rule, err
+		}
+	}
+	if rule.to, err = configString(table, "to"); err != nil {
+		return rule, err
+	}
+	if rule.titleCase, err = configBool(table, "titlecase"); err != nil {
+		return rule, err
+	}
+
+	if rule.from == "" && rule.pattern == nil && !rule.titleCase {
+		return rule, fmt.Errorf("needs from, pattern or titlecase")
+	}
+	if rule.from != "" && rule.pattern != nil {
+		return rule, fmt.Errorf("from and pattern can't be used together")
+	}
+
+	return rule, nil
+}
+
+// applies the rules to a source's tags, returning the tags that changed
+func rewriteMetadata(tags map[string]string, rules []rewriteRule) map[string]string {
+	changed := make(map[string]string)
+
+	for _, rule := range rules {
+		value, ok := changed[rule.tag]
+		if !ok {
+			if value, ok = findTag(tags, rule.tag); !ok {
+				continue
+			}
+		}
+
+		rewritten := value
+		if rule.titleCase {
+			rewritten = titleCase(rewritten)
+		}
+		if rule.from != "" && strings.EqualFold(rewritten, rule.from) {
+			rewritten = rule.to
+		}
+		if rule.pattern != nil {
+			rewritten = rule.pattern.ReplaceAllString(rewritten, rule.to)
+		}
+
+		changed[rule.tag] = rewritten
+	}
+
+	// rules that ended up back where they started have nothing to override
+	for key, value := range changed {
+		if original, _ := findTag(tags, key); original == value {
+			delete(changed, key)
+		}
+	}
+
+	return changed
+}
+
+// capitalizes the first letter of every word, leaving the rest alone so AC/DC stays AC/DC
+func titleCase(value string) string {
+	var result strings.Builder
+	startOfWord := true
+	for len(value) > 0 {
+		r, size := utf8.DecodeRuneInString(value)
+		value = value[size:]
+		if startOfWord {
+			r = unicode.ToUpper(r)
+		}
+		result.WriteRune(r)
+		startOfWord = unicode.IsSpace(r) || r == '-' || r == '(' || r == '/'
+	}
+	return result.String()
+}
@@ -0,0 +1,360 @@
+package convert
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cdparanoia reads the disc, ffmpeg compresses its wavs into tagged flacs
+var cdparanoiaPath = "cdparanoia"
+
+// musicbrainz turns away clients that don't say who they are
+const musicBrainzUserAgent = "convert-muh-music ( https://github.com/Trigex/convert-muh-music )"
+
+// a track of cdparanoia's table of contents, ie "  1.    16503 [03:40.03]        0 [00:00.00]    no   no  2"
+var tocTrackPattern = regexp.MustCompile(`^\s*(\d+)\.\s+(\d+)\s+\[[^\]]*\]\s+(\d+)\s+\[`)
+
+// the audio tracks of a disc, positions are in sectors from the start of the first track
+type cdTOC struct {
+	numbers []int
+	starts  []int
+	leadOut int
+}
+
+// what musicbrainz knows of a disc, or the blanks left when it knows nothing
+type discRelease struct {
+	id     string
+	title  string
+	artist string
+	date   string
+	disc   int
+	discs  int
+	titles map[int]string
+	// track artists, for the compilations and features whose tracks differ from the album's artist
+	artists map[int]string
+}
+
+// rips the cd in the drive into tagged flacs, then converts them like any other source into the destination
+func runRip(args []string) {
+	flags := flag.NewFlagSet("rip", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	device := flags.String("device", "", "the cd drive to rip from, ie /dev/sr0 (empty lets cdparanoia find it)")
+	ripsDir := flags.String("rips", "", "keep the flac rips in this library, under Artist/Album, instead of removing them once converted")
+	lookup := flags.Bool("musicbrainz", true, "look the disc up on musicbrainz by its disc id to tag the rips")
+	releaseID := flags.String("release", "", "the musicbrainz release to tag the rips with, when the disc id matches several")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		exit(2)
+	}
+	if _, err := exec.LookPath(cdparanoiaPath); err != nil {
+		console.println("ripping needs cdparanoia, which isn't installed")
+		exit(1)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	toc, err := readCDTOC(ctx, *device)
+	if err != nil {
+		console.println("couldn't read the disc:", err)
+		exit(1)
+	}
+	discID := musicBrainzDiscID(toc)
+	console.printf("disc %s has %d audio tracks\n", discID, len(toc.numbers))
+
+	release := discRelease{disc: 1, discs: 1}
+	if *lookup {
+		if release, err = lookupDisc(ctx, discID, *releaseID); err != nil {
+			console.println(err)
+			exit(1)
+		}
+	}
+	if release.title == "" && *lookup {
+		console.printf("musicbrainz doesn't know the disc, it can be added at https://musicbrainz.org/cdtoc/attach?id=%s&tracks=%d&toc=%s\n", discID, len(toc.numbers), url.QueryEscape(musicBrainzTOC(toc)))
+	} else if release.title != "" {
+		console.printf("ripping %s - %s\n", release.artist, release.title)
+	}
+
+	libraryDir := *ripsDir
+	if libraryDir == "" {
+		if libraryDir, err = os.MkdirTemp("", "convert-muh-music-rip-*"); err != nil {
+			console.println(err)
+			exit(1)
+		}
+		defer os.RemoveAll(libraryDir)
+	}
+	if libraryDir, err = filepath.Abs(libraryDir); err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	albumDir := filepath.Join(libraryDir, ripAlbumPath(release, discID))
+	if entries, _ := os.ReadDir(albumDir); len(entries) > 0 {
+		console.printf("%s already has a rip in it\n", albumDir)
+		exit(1)
+	}
+	if err = os.MkdirAll(albumDir, os.ModePerm); err != nil {
+		console.println(err)
+		exit(1)
+	}
+
+	for i, number := range toc.numbers {
+		startTime := time.Now()
+		flac := filepath.Join(albumDir, ripTrackName(release, number))
+		if err = ripTrack(ctx, *device, number, flac, ripTags(release, discID, number, len(toc.numbers))); err != nil {
+			console.printf("couldn't rip track %d: %s\n", number, err)
+			exit(1)
+		}
+		console.printf("ripped track %d of %d in %s\n", i+1, len(toc.numbers), time.Since(startTime).Round(time.Second))
+	}
+
+	// the convert flags go before the directories, where its flag parsing looks for them
+	runConvert(append(flags.Args()[1:], libraryDir, flags.Arg(0)))
+}
+
+// reads the audio tracks of the disc in the drive from cdparanoia's table of contents
+func readCDTOC(ctx context.Context, device string) (cdTOC, error) {
+	var toc cdTOC
+	out, err := toolCommand(ctx, cdparanoiaPath, append(deviceArgs(device), "-Q")...).CombinedOutput()
+	if err != nil {
+		return toc, fmt.Errorf("cdparanoia: %s", lastOutputLine(out))
+	}
+
+	var lengths []int
+	for _, line := range strings.Split(string(out), "\n") {
+		match := tocTrackPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		number, _ := strconv.Atoi(match[1])
+		length, _ := strconv.Atoi(match[2])
+		start, _ := strconv.Atoi(match[3])
+		toc.numbers = append(toc.numbers, number)
+		toc.starts = append(toc.starts, start)
+		lengths = append(lengths, length)
+	}
+	if len(toc.numbers) == 0 {
+		return toc, fmt.Errorf("it has no audio tracks")
+	}
+	// cdparanoia only lists audio, the lead out of an enhanced cd's data session doesn't count
+	last := len(toc.numbers) - 1
+	toc.leadOut = toc.starts[last] + lengths[last]
+	return toc, nil
+}
+
+func deviceArgs(device string) []string {
+	if device == "" {
+		return nil
+	}
+	return []string{"-d", device}
+}
+
+// the last line a tool printed, usually what went wrong
+func lastOutputLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// the disc's musicbrainz toc: first and last track, then the lead out and each track's offset, all counting the
+// two second lead in
+func musicBrainzTOC(toc cdTOC) string {
+	parts := []string{strconv.Itoa(toc.numbers[0]), strconv.Itoa(toc.numbers[len(toc.numbers)-1]), strconv.Itoa(toc.leadOut + 150)}
+	for _, start := range toc.starts {
+		parts = append(parts, strconv.Itoa(start+150))
+	}
+	return strings.Join(parts, "+")
+}
+
+// works out the musicbrainz disc id of a disc, see https://musicbrainz.org/doc/Disc_ID_Calculation
+func musicBrainzDiscID(toc cdTOC) string {
+	offsets := make(map[int]int)
+	for i, number := range toc.numbers {
+		offsets[number] = toc.starts[i] + 150
+	}
+
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%02X%02X%08X", toc.numbers[0], toc.numbers[len(toc.numbers)-1], toc.leadOut+150)
+	for number := 1; number <= 99; number++ {
+		fmt.Fprintf(hash, "%08X", offsets[number])
+	}
+	return strings.NewReplacer("+", ".", "/", "_", "=", "-").Replace(base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+}
+
+type musicBrainzCredit []struct {
+	Name       string `json:"name"`
+	JoinPhrase string `json:"joinphrase"`
+}
+
+func (credit musicBrainzCredit) String() string {
+	var name strings.Builder
+	for _, part := range credit {
+		name.WriteString(part.Name + part.JoinPhrase)
+	}
+	return name.String()
+}
+
+// the parts of musicbrainz's answer to a disc id lookup that go into tags
+type musicBrainzDisc struct {
+	Releases []struct {
+		ID           string            `json:"id"`
+		Title        string            `json:"title"`
+		Date         string            `json:"date"`
+		ArtistCredit musicBrainzCredit `json:"artist-credit"`
+		Media        []struct {
+			Position int `json:"position"`
+			Discs    []struct {
+				ID string `json:"id"`
+			} `json:"discs"`
+			Tracks []struct {
+				Position     int               `json:"position"`
+				Title        string            `json:"title"`
+				ArtistCredit musicBrainzCredit `json:"artist-credit"`
+			} `json:"tracks"`
+		} `json:"media"`
+	} `json:"releases"`
+}
+
+// looks a disc up on musicbrainz. a disc it doesn't know isn't an error, the rips are just left untagged, but one that
+// matches several releases has to have one of them picked with -release
+func lookupDisc(ctx context.Context, discID string, releaseID string) (discRelease, error) {
+	release := discRelease{disc: 1, discs: 1}
+	request, err := http.NewRequestWithContext(ctx, "GET", "https://musicbrainz.org/ws/2/discid/"+url.PathEscape(discID)+"?inc=artist-credits+recordings&fmt=json", nil)
+	if err != nil {
+		return release, err
+	}
+	request.Header.Set("User-Agent", musicBrainzUserAgent)
+	response, err := (&http.Client{Timeout: time.Minute}).Do(request)
+	if err != nil {
+		return release, fmt.Errorf("couldn't look the disc up on musicbrainz: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return release, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return release, fmt.Errorf("couldn't look the disc up on musicbrainz, it returned %s", response.Status)
+	}
+
+	var disc musicBrainzDisc
+	if err = json.NewDecoder(response.Body).Decode(&disc); err != nil {
+		return release, fmt.Errorf("couldn't read musicbrainz's answer: %s", err)
+	}
+
+	matches := disc.Releases[:0]
+	for _, candidate := range disc.Releases {
+		if releaseID == "" || candidate.ID == releaseID {
+			matches = append(matches, candidate)
+		}
+	}
+	switch {
+	case len(matches) == 0 && releaseID != "":
+		return release, fmt.Errorf("the disc isn't part of release %s", releaseID)
+	case len(matches) == 0:
+		return release, nil
+	case len(matches) > 1:
+		var choices []string
+		for _, candidate := range matches {
+			choices = append(choices, fmt.Sprintf("  %s  %s - %s (%s)", candidate.ID, candidate.ArtistCredit, candidate.Title, candidate.Date))
+		}
+		return release, fmt.Errorf("the disc is part of several releases, pick one with -release:\n%s", strings.Join(choices, "\n"))
+	}
+
+	match := matches[0]
+	release = discRelease{id: match.ID, title: match.Title, artist: match.ArtistCredit.String(), date: match.Date, disc: 1, discs: len(match.Media), titles: make(map[int]string), artists: make(map[int]string)}
+	for _, medium := range match.Media {
+		found := false
+		for _, candidate := range medium.Discs {
+			found = found || candidate.ID == discID
+		}
+		if !found {
+			continue
+		}
+		release.disc = medium.Position
+		for _, track := range medium.Tracks {
+			release.titles[track.Position] = track.Title
+			release.artists[track.Position] = track.ArtistCredit.String()
+		}
+		break
+	}
+	return release, nil
+}
+
+// where a disc is ripped to in the rips library, Artist/Album with a Disc N folder for the discs of a set.
+// discs musicbrainz doesn't know go under their disc id
+func ripAlbumPath(release discRelease, discID string) string {
+	if release.title == "" {
+		return filepath.Join("Unknown Artist", discID)
+	}
+	album := filepath.Join(tagFileName(release.artist), tagFileName(release.title))
+	if release.discs > 1 {
+		album = filepath.Join(album, fmt.Sprintf("Disc %d", release.disc))
+	}
+	return album
+}
+
+// the name a track is ripped to, ie "03 Title.flac"
+func ripTrackName(release discRelease, number int) string {
+	title := tagFileName(release.titles[number])
+	if title == "" {
+		title = fmt.Sprintf("Track %02d", number)
+	}
+	return fmt.Sprintf("%02d %s.flac", number, title)
+}
+
+// the tags a ripped track is written with, blank ones are left out
+func ripTags(release discRelease, discID string, number int, total int) []string {
+	tags := [][2]string{
+		{"title", release.titles[number]},
+		{"artist", release.artists[number]},
+		{"album", release.title},
+		{"album_artist", release.artist},
+		{"date", release.date},
+		{"track", fmt.Sprintf("%d/%d", number, total)},
+		{"disc", fmt.Sprintf("%d/%d", release.disc, release.discs)},
+		{"MUSICBRAINZ_DISCID", discID},
+		{"MUSICBRAINZ_ALBUMID", release.id},
+	}
+	var args []string
+	for _, tag := range tags {
+		if tag[1] != "" {
+			args = append(args, "-metadata", tag[0]+"="+tag[1])
+		}
+	}
+	return args
+}
+
+// rips a track through cdparanoia's error correction into a wav next to flac, then compresses and tags it
+func ripTrack(ctx context.Context, device string, number int, flac string, tags []string) error {
+	wav := strings.TrimSuffix(flac, filepath.Ext(flac)) + ".wav"
+	defer os.Remove(wav)
+
+	args := append(deviceArgs(device), "--quiet", "--output-wav", "--", strconv.Itoa(number), wav)
+	if out, err := toolCommand(ctx, cdparanoiaPath, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("cdparanoia: %s", lastOutputLine(out))
+	}
+
+	args = append([]string{"-loglevel", "error", "-y", "-i", longPath(wav), "-c:a", "flac"}, tags...)
+	if out, err := toolCommand(ctx, ffmpegPath, append(args, longPath(flac))...).CombinedOutput(); err != nil {
+		os.Remove(flac)
+		return fmt.Errorf("ffmpeg: %s", lastOutputLine(out))
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package convert
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// the verification files rippers leave next to an album, copied along with it when asked to
+var ripLogExtensions = map[string]bool{
+	".log":     true,
+	".accurip": true,
+}
+
+// a cd sector holds 588 stereo samples, accuraterip leaves out the first and last 5 sectors of a disc
+const (
+	samplesPerSector      = 588
+	accurateRipSkipFrames = 5 * samplesPerSector
+)
+
+// what a rip log says about one of its tracks
+type loggedTrack struct {
+	number int
+	// the file name the ripper wrote the track to, without its extension, empty if the log doesn't say
+	name string
+	// crc32 of the track's audio as ripped, uppercase hex
+	copyCRC string
+	// accuraterip checksums the log vouches for, v1 or v2
+	accurateRip []string
+}
+
+type ripLog struct {
+	path   string
+	tracks []loggedTrack
+}
+
+var (
+	// eac's "Track  1", whipper's "  1:" under Tracks
+	eacTrackPattern     = regexp.MustCompile(`^Track\s+(\d+)$`)
+	whipperTrackPattern = regexp.MustCompile(`^(\d+):$`)
+	logFilenamePattern  = regexp.MustCompile(`^Filename:?\s+(.+)$`)
+	copyCRCPattern      = regexp.MustCompile(`^Copy CRC:?\s+([0-9A-Fa-f]{8})$`)
+	// eac's "Accurately ripped (confidence 12)  [9A3C1F2E]  (AR v2)", whipper's "Local CRC: 9A3C1F2E" under AccurateRip v1 and v2
+	eacAccurateRipPattern = regexp.MustCompile(`^Accurately ripped.*\[([0-9A-Fa-f]{8})\]`)
+	localCRCPattern       = regexp.MustCompile(`^Local CRC:?\s+([0-9A-Fa-f]{8})$`)
+)
+
+// reads an eac or whipper log, eac writes them in utf-16
+func readRipLog(path string) (ripLog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ripLog{}, err
+	}
+	text := string(data)
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+		units := make([]uint16, (len(data)-2)/2)
+		for i := range units {
+			units[i] = binary.LittleEndian.Uint16(data[2+i*2:])
+		}
+		text = string(utf16.Decode(units))
+	}
+
+	log := ripLog{path: path}
+	var current *loggedTrack
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if match := eacTrackPattern.FindStringSubmatch(line); match != nil {
+			current = log.addTrack(match[1])
+		} else if match := whipperTrackPattern.FindStringSubmatch(line); match != nil {
+			current = log.addTrack(match[1])
+		} else if current == nil {
+			continue
+		} else if match := logFilenamePattern.FindStringSubmatch(line); match != nil {
+			// windows paths, whichever system the log is read on
+			name := match[1][strings.LastIndexAny(match[1], `\/`)+1:]
+			current.name = strings.TrimSuffix(name, filepath.Ext(name))
+		} else if match := copyCRCPattern.FindStringSubmatch(line); match != nil {
+			current.copyCRC = strings.ToUpper(match[1])
+		} else if match := eacAccurateRipPattern.FindStringSubmatch(line); match != nil {
+			current.accurateRip = append(current.accurateRip, strings.ToUpper(match[1]))
+		} else if match := localCRCPattern.FindStringSubmatch(line); match != nil {
+			current.accurateRip = append(current.accurateRip, strings.ToUpper(match[1]))
+		}
+	}
+	return log, scanner.Err()
+}
+
+func (l *ripLog) addTrack(number string) *loggedTrack {
+	n, _ := strconv.Atoi(number)
+	l.tracks = append(l.tracks, loggedTrack{number: n})
+	return &l.tracks[len(l.tracks)-1]
+}
+
+// the logged track a file was ripped to, by the name the log gives it or else by its track number
+func (l ripLog) track(file string) (loggedTrack, bool) {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	for _, t := range l.tracks {
+		if t.name != "" && strings.EqualFold(t.name, name) {
+			return t, true
+		}
+	}
+	if number, _, ok := splitTrackNumber(name); ok {
+		for _, t := range l.tracks {
+			if t.number == number {
+				return t, true
+			}
+		}
+	}
+	return loggedTrack{}, false
+}
+
+// the highest track number in the log, accuraterip treats the disc's last track differently
+func (l ripLog) lastTrack() int {
+	last := 0
+	for _, t := range l.tracks {
+		if t.number > last {
+			last = t.number
+		}
+	}
+	return last
+}
+
+// checks a flac against the rip logs in its folder, tracks no log mentions pass as there's nothing to check them against
+func verifyRip(ctx context.Context, sourceFile string) error {
+	logs, _ := filepath.Glob(filepath.Join(filepath.Dir(sourceFile), "*.log"))
+	for _, logPath := range logs {
+		log, err := readRipLog(logPath)
+		if err != nil {
+			continue
+		}
+		logged, ok := log.track(sourceFile)
+		if !ok || (logged.copyCRC == "" && len(logged.accurateRip) == 0) {
+			continue
+		}
+
+		checksums, err := ripChecksums(ctx, sourceFile, logged.number == 1, logged.number == log.lastTrack())
+		if err != nil {
+			return withKind(errSourceUnreadable, fmt.Errorf("couldn't decode %s to check it against %s: %s", sourceFile, filepath.Base(logPath), err))
+		}
+		if logged.copyCRC != "" && checksums.copyCRC != logged.copyCRC {
+			return withKind(errCorrupt, fmt.Errorf("%s doesn't match its rip log %s, its crc is %s but the log has %s", sourceFile, filepath.Base(logPath), checksums.copyCRC, logged.copyCRC))
+		}
+		if len(logged.accurateRip) > 0 && !containsString(logged.accurateRip, checksums.accurateRipV1) && !containsString(logged.accurateRip, checksums.accurateRipV2) {
+			return withKind(errCorrupt, fmt.Errorf("%s doesn't match the accuraterip checksums in its rip log %s", sourceFile, filepath.Base(logPath)))
+		}
+		return nil
+	}
+	return nil
+}
+
+// the checksums rippers log for a track: eac and whipper's copy crc, and both versions of accuraterip's
+type ripTrackChecksums struct {
+	copyCRC       string
+	accurateRipV1 string
+	accurateRipV2 string
+}
+
+// decodes a track to 16 bit stereo and works out its rip checksums as the audio streams in
+func ripChecksums(ctx context.Context, file string, firstTrack bool, lastTrack bool) (ripTrackChecksums, error) {
+	cmd := toolCommand(ctx, ffmpegPath, "-loglevel", "error", "-i", longPath(file), "-map", "0:a:0", "-f", "s16le", "-c:a", "pcm_s16le", "-ac", "2", "-")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return ripTrackChecksums{}, err
+	}
+	if err = cmd.Start(); err != nil {
+		return ripTrackChecksums{}, err
+	}
+
+	// accuraterip multiplies every stereo sample, as one little endian 32 bit word, by its position in the track.
+	// the last track's final sectors only turn out to be the final ones at the end, so their share is kept aside to take back out
+	crc := crc32.NewIEEE()
+	reader := bufio.NewReader(io.TeeReader(out, crc))
+	var v1, v2 uint32
+	var tailV1, tailV2 [accurateRipSkipFrames]uint32
+	sample := make([]byte, 4)
+	position := 0
+	for {
+		if _, err = io.ReadFull(reader, sample); err != nil {
+			break
+		}
+		position++
+		if firstTrack && position < accurateRipSkipFrames {
+			continue
+		}
+		value := binary.LittleEndian.Uint32(sample)
+		product := uint64(value) * uint64(position)
+		shareV1, shareV2 := uint32(product), uint32(product)+uint32(product>>32)
+		v1 += shareV1
+		v2 += shareV2
+		tailV1[position%accurateRipSkipFrames] = shareV1
+		tailV2[position%accurateRipSkipFrames] = shareV2
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		cmd.Wait()
+		return ripTrackChecksums{}, err
+	}
+	if err = cmd.Wait(); err != nil {
+		return ripTrackChecksums{}, err
+	}
+	if lastTrack {
+		for i := range tailV1 {
+			v1 -= tailV1[i]
+			v2 -= tailV2[i]
+		}
+	}
+
+	return ripTrackChecksums{
+		copyCRC:       fmt.Sprintf("%08X", crc.Sum32()),
+		accurateRipV1: fmt.Sprintf("%08X", v1),
+		accurateRipV2: fmt.Sprintf("%08X", v2),
+	}, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package convert
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the lock a run holds on its destination while it writes to it, holding the pid of the run's process. clean leaves
+// the work in progress of a locked destination alone
+func runLockPath(destDir string) string {
+	return filepath.Join(destDir, toolDirName, "run.lock")
+}
+
+// locks the destination for a run, failing if another run holds it. returns a function releasing it
+func acquireRunLock(destDir string) (func(), error) {
+	lockPath := runLockPath(destDir)
+	if err := os.MkdirAll(filepath.Dir(lockPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		// only one of two runs starting together gets to create it
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) || attempt >= runLockAttempts {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(lockPath)
+		if os.IsNotExist(err) {
+			// released in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			// the run that created it hasn't written its pid yet
+			time.Sleep(runLockWait)
+			continue
+		}
+		if pid, ok := activeRun(destDir); ok {
+			return nil, fmt.Errorf("another run (pid %d) is writing to %s", pid, destDir)
+		}
+		// left behind by a run that was killed
+		if err = os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// how many times acquireRunLock tries for the lock, and how long it waits for a new lock's pid to be written
+const (
+	runLockAttempts = 20
+	runLockWait     = 50 * time.Millisecond
+)
+
+// the pid of the run writing to a destination, if there is one. the lock of a run that was killed is left behind,
+// it only counts while its process is still around
+func activeRun(destDir string) (int, bool) {
+	data, err := os.ReadFile(runLockPath(destDir))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return 0, false
+	}
+	return pid, processRunning(pid)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package convert
+
+import "syscall"
+
+// signal 0 only checks the process is there, a process of another user can't be signalled but still exists
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
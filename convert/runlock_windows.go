@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package convert
+
+import "os"
+
+// finding a process opens a handle to it on windows, which fails once it has exited
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
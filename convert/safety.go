@@ -0,0 +1,197 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the source libraries of the run, nothing is ever written or removed inside them
+var protectedRoots []string
+
+// the source files of an in place run, which shares its directory with them
+var protectedFiles = make(map[string]bool)
+
+// resolves symlinks in as much of a path as exists, so a link can't sneak the destination into the source
+func resolvePath(p string) string {
+	p = filepath.Clean(p)
+	var missing []string
+	for current := p; ; current = filepath.Dir(current) {
+		if resolved, err := filepath.EvalSymlinks(current); err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...)
+		}
+		if filepath.Dir(current) == current {
+			return p
+		}
+		missing = append([]string{filepath.Base(current)}, missing...)
+	}
+}
+
+// checks whether path is root or somewhere below it
+func isWithin(path string, root string) bool {
+	relativePath, err := filepath.Rel(resolvePath(root), resolvePath(path))
+	if err != nil {
+		return false
+	}
+	return relativePath == "." || (relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)))
+}
+
+// refuses to go on when the source and destination libraries overlap, converting into the source would
+// pick up its own outputs as sources, and cleaning would count the source as orphans
+func checkLibraryPaths(srcDir string, destDir string) error {
+	switch {
+	case isWithin(destDir, srcDir) && isWithin(srcDir, destDir):
+		return fmt.Errorf("the source and destination are the same directory, %s", srcDir)
+	case isWithin(destDir, srcDir):
+		return fmt.Errorf("the destination %s is inside the source %s", destDir, srcDir)
+	case isWithin(srcDir, destDir):
+		return fmt.Errorf("the source %s is inside the destination %s", srcDir, destDir)
+	}
+
+	protectedRoots = append(protectedRoots, srcDir)
+	return nil
+}
+
+// guards every write and removal in the destination, none of them may touch the source library
+func checkWritable(path string) error {
+	if protectedFiles[filepath.Clean(path)] || protectedFiles[resolvePath(path)] {
+		return fmt.Errorf("refusing to write to %s, it's a source file", path)
+	}
+	for _, root := range protectedRoots {
+		if isWithin(path, root) {
+			return fmt.Errorf("refusing to write to %s, it's inside the source library %s", path, root)
+		}
+	}
+	return nil
+}
+
+// writes and removes a file in the destination, and in the tool's own directory in it, before any job is planned.
+// a read-only mount or a directory owned by someone else otherwise fails every job with an error of its own
+func checkDestinationWritable(destDir string) error {
+	// a destination that doesn't exist yet is created, which its nearest existing parent has to allow
+	dir := destDir
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("the destination %s isn't a directory", dir)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) || filepath.Dir(dir) == dir {
+			return fmt.Errorf("can't get at the destination %s: %s", destDir, err)
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	dirs := []string{dir}
+	if info, err := os.Stat(filepath.Join(destDir, toolDirName)); err == nil && info.IsDir() {
+		dirs = append(dirs, filepath.Join(destDir, toolDirName))
+	}
+	for _, dir := range dirs {
+		file, err := os.CreateTemp(dir, ".write-test-*")
+		if err == nil {
+			_, err = file.Write([]byte{0})
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if removeErr := os.Remove(file.Name()); err == nil {
+				err = removeErr
+			}
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, syscall.EROFS):
+			return fmt.Errorf("the destination %s is on a read-only filesystem, remount it read-write first", dir)
+		case errors.Is(err, os.ErrPermission):
+			return fmt.Errorf("you don't have permission to write to %s, the destination has to be writable", dir)
+		default:
+			return fmt.Errorf("couldn't write a test file to the destination %s: %s", dir, err)
+		}
+	}
+	return nil
+}
+
+// protects every planned source of an in place run, along with its lyrics
+func protectSources(jobs []job) {
+	for _, j := range jobs {
+		for _, file := range []string{j.sourceFile, lyricsSidecarPath(j.sourceFile)} {
+			protectedFiles[filepath.Clean(file)] = true
+			protectedFiles[resolvePath(file)] = true
+		}
+	}
+}
+
+// keeps the jobs that can run in place: encodes, whose output won't land on a source.
+// copies would only duplicate the file, and encoding flac to flac would overwrite it
+func inPlaceJobs(jobs []job) []job {
+	var kept []job
+	for _, j := range jobs {
+		if !j.encode {
+			continue
+		}
+		if protectedFiles[filepath.Clean(j.destinationFile)] || protectedFiles[resolvePath(j.destinationFile)] {
+			console.debugf("skipping %s, its output would overwrite a source\n", j.sourceFile)
+			continue
+		}
+		kept = append(kept, j)
+	}
+	return kept
+}
+
+// renames a file in the destination, as long as the target is outside the source library
+func safeRename(from string, to string) error {
+	if err := checkWritable(to); err != nil {
+		return err
+	}
+	return destination.Rename(from, to)
+}
+
+// safeRename, copying instead when the file is on another filesystem, ie staged in -temp-dir. the copy is
+// renamed into place once complete, so the destination never has half an output in it
+func moveIntoPlace(from string, to string, stallTimeout time.Duration) error {
+	err := safeRename(from, to)
+	var linkErr *os.LinkError
+	if err == nil || !errors.As(err, &linkErr) {
+		return err
+	}
+
+	// renames across devices fail differently on every platform, for other failures the copy fails too
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	partial := filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".partial")
+	if err = checkWritable(partial); err != nil {
+		return err
+	}
+	out, err := destination.Create(partial)
+	if err != nil {
+		return err
+	}
+	_, err = copyWithStallTimeout(out, in, stallTimeout)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = safeRename(partial, to)
+	}
+	if err != nil {
+		destination.Remove(partial)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// removes a path in the destination with everything in it, as long as it's outside the source library
+func safeRemoveAll(path string) error {
+	if err := checkWritable(path); err != nil {
+		return err
+	}
+	return removeAllDestination(path)
+}
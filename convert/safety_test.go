@@ -0,0 +1,304 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gives the test protected roots and files of its own, the checks go by globals a run sets up once
+func resetProtection(t *testing.T) {
+	roots, files := protectedRoots, protectedFiles
+	protectedRoots, protectedFiles = nil, make(map[string]bool)
+	t.Cleanup(func() {
+		protectedRoots, protectedFiles = roots, files
+	})
+}
+
+func mkdirs(t *testing.T, dirs ...string) {
+	t.Helper()
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func symlink(t *testing.T, target string, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("can't create symlinks here:", err)
+	}
+}
+
+func TestCheckLibraryPaths(t *testing.T) {
+	root := t.TempDir()
+	music := filepath.Join(root, "Music")
+	mkdirs(t, filepath.Join(music, "Artist"), filepath.Join(root, "Music Test"), filepath.Join(root, "Phone"))
+
+	tests := []struct {
+		name string
+		src  string
+		dest string
+		// "" when the paths are fine
+		error string
+	}{
+		{"separate libraries", music, filepath.Join(root, "Phone"), ""},
+		{"a destination named like the source", music, filepath.Join(root, "Music Test"), ""},
+		{"a destination that doesn't exist yet", music, filepath.Join(root, "Phone", "new", "library"), ""},
+		{"the same directory", music, music, "are the same directory"},
+		{"the same directory written differently", music, filepath.Join(root, "Phone", "..", "Music") + string(filepath.Separator), "are the same directory"},
+		{"a destination inside the source", music, filepath.Join(music, "Artist", "converted"), "is inside the source"},
+		{"a source inside the destination", filepath.Join(music, "Artist"), music, "is inside the destination"},
+		{"a source inside a destination to be made", filepath.Join(root, "Phone", "new", "Music"), filepath.Join(root, "Phone", "new"), "is inside the destination"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetProtection(t)
+			err := checkLibraryPaths(test.src, test.dest)
+			switch {
+			case test.error == "" && err != nil:
+				t.Errorf("got %s, want no error", err)
+			case test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)):
+				t.Errorf("got %v, want an error with %q", err, test.error)
+			}
+			// only a run that goes ahead protects its source
+			if (err == nil) != (len(protectedRoots) == 1) {
+				t.Errorf("protected %v after %v", protectedRoots, err)
+			}
+		})
+	}
+}
+
+func TestCheckLibraryPathsThroughSymlinks(t *testing.T) {
+	root := t.TempDir()
+	music := filepath.Join(root, "Music")
+	mkdirs(t, filepath.Join(music, "Artist"), filepath.Join(root, "Phone"))
+	symlink(t, music, filepath.Join(root, "Phone", "linked"))
+	symlink(t, filepath.Join(root, "Phone"), filepath.Join(music, "Artist", "phone"))
+
+	tests := []struct {
+		name  string
+		src   string
+		dest  string
+		error string
+	}{
+		{"a destination linked into the source", music, filepath.Join(root, "Phone", "linked", "converted"), "is inside the source"},
+		{"a link to the source as the destination", music, filepath.Join(root, "Phone", "linked"), "are the same directory"},
+		{"a source reached through the destination", filepath.Join(music, "Artist", "phone"), filepath.Join(root, "Phone"), "are the same directory"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetProtection(t)
+			if err := checkLibraryPaths(test.src, test.dest); err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("got %v, want an error with %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	resetProtection(t)
+	root := t.TempDir()
+	music := filepath.Join(root, "Music")
+	phone := filepath.Join(root, "Phone")
+	mkdirs(t, filepath.Join(music, "Artist", "Album"), phone, filepath.Join(root, "Music Test"))
+	if err := checkLibraryPaths(music, phone); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		writable bool
+	}{
+		{"an output in the destination", filepath.Join(phone, "Artist", "Album", "01.m4a"), true},
+		{"the tool's own directory", filepath.Join(phone, toolDirName, "work", "job-1.m4a"), true},
+		{"a library named like the source", filepath.Join(root, "Music Test", "01.m4a"), true},
+		{"a source file", filepath.Join(music, "Artist", "Album", "01.flac"), false},
+		{"the source itself", music, false},
+		{"a path that climbs into the source", filepath.Join(phone, "..", "Music", "01.m4a"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := checkWritable(test.path); (err == nil) != test.writable {
+				t.Errorf("got %v, want writable %v", err, test.writable)
+			}
+		})
+	}
+
+	t.Run("a link in the destination to the source", func(t *testing.T) {
+		symlink(t, filepath.Join(music, "Artist"), filepath.Join(phone, "Artist"))
+		if err := checkWritable(filepath.Join(phone, "Artist", "Album", "01.m4a")); err == nil {
+			t.Error("wrote through a link into the source")
+		}
+	})
+
+	t.Run("renames and removals are checked too", func(t *testing.T) {
+		source := filepath.Join(music, "Artist", "Album", "01.flac")
+		if err := os.WriteFile(source, []byte("audio"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		staged := filepath.Join(phone, "staged.flac")
+		if err := os.WriteFile(staged, []byte("output"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := safeRename(staged, source); err == nil {
+			t.Error("renamed over a source")
+		}
+		if err := safeRemoveAll(filepath.Join(music, "Artist")); err == nil {
+			t.Error("removed part of the source")
+		}
+		if data, err := os.ReadFile(source); err != nil || string(data) != "audio" {
+			t.Errorf("the source was changed: %q, %v", data, err)
+		}
+	})
+}
+
+func TestInPlaceJobs(t *testing.T) {
+	resetProtection(t)
+	album := filepath.Join(t.TempDir(), "Artist", "Album")
+	mkdirs(t, album)
+	source := func(name string) string { return filepath.Join(album, name) }
+
+	jobs := []job{
+		{sourceFile: source("01.flac"), destinationFile: source("01.opus"), encode: true},
+		// flac to flac would overwrite the source
+		{sourceFile: source("02.flac"), destinationFile: source("02.flac"), encode: true},
+		// copies would only duplicate the source
+		{sourceFile: source("03.mp3"), destinationFile: source("03 copy.mp3")},
+		// 04.wav's output lands on another job's source
+		{sourceFile: source("04.wav"), destinationFile: source("05.m4a"), encode: true},
+		{sourceFile: source("05.m4a"), destinationFile: source("05.opus"), encode: true},
+		// written differently, it's still the source
+		{sourceFile: source("06.flac"), destinationFile: filepath.Join(album, "..", "Album", "06.flac"), encode: true},
+	}
+	protectSources(jobs)
+
+	var kept []string
+	for _, j := range inPlaceJobs(jobs) {
+		kept = append(kept, filepath.Base(j.sourceFile))
+	}
+	if strings.Join(kept, " ") != "01.flac 05.m4a" {
+		t.Errorf("kept %v, want 01.flac and 05.m4a", kept)
+	}
+
+	tests := []struct {
+		path     string
+		writable bool
+	}{
+		{source("01.opus"), true},
+		{source("01.flac"), false},
+		// lyrics are protected along with their source
+		{source("01.lrc"), false},
+		{source("05.m4a"), false},
+		// anything not planned as a source is the run's to write
+		{source("cover.jpg"), true},
+	}
+	for _, test := range tests {
+		if err := checkWritable(test.path); (err == nil) != test.writable {
+			t.Errorf("%s: got %v, want writable %v", filepath.Base(test.path), err, test.writable)
+		}
+	}
+}
+
+func TestCheckDestinationWritable(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "library.txt")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		dest  string
+		error string
+	}{
+		{"an existing destination", root, ""},
+		{"a destination to be made", filepath.Join(root, "new", "library"), ""},
+		{"a file", file, "isn't a directory"},
+		{"a destination under a file", filepath.Join(file, "library"), "can't get at the destination"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkDestinationWritable(test.dest)
+			switch {
+			case test.error == "" && err != nil:
+				t.Errorf("got %s, want no error", err)
+			case test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)):
+				t.Errorf("got %v, want an error with %q", err, test.error)
+			}
+		})
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("test files were left behind, %d entries", len(entries))
+	}
+
+	t.Run("a destination without write permission", func(t *testing.T) {
+		if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+			t.Skip("permissions don't keep this user out")
+		}
+		locked := filepath.Join(root, "locked")
+		mkdirs(t, locked)
+		if err := os.Chmod(locked, 0555); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(locked, 0755)
+		for _, dest := range []string{locked, filepath.Join(locked, "new")} {
+			if err := checkDestinationWritable(dest); err == nil || !strings.Contains(err.Error(), "permission") {
+				t.Errorf("%s: got %v, want a permission error", dest, err)
+			}
+		}
+	})
+
+	t.Run("a tool directory without write permission", func(t *testing.T) {
+		if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+			t.Skip("permissions don't keep this user out")
+		}
+		dest := filepath.Join(root, "library")
+		mkdirs(t, filepath.Join(dest, toolDirName))
+		if err := os.Chmod(filepath.Join(dest, toolDirName), 0555); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(filepath.Join(dest, toolDirName), 0755)
+		if err := checkDestinationWritable(dest); err == nil || !strings.Contains(err.Error(), toolDirName) {
+			t.Errorf("got %v, want an error about %s", err, toolDirName)
+		}
+	})
+}
+
+func TestRunLock(t *testing.T) {
+	destDir := t.TempDir()
+	lockPath := runLockPath(destDir)
+	if err := os.MkdirAll(filepath.Dir(lockPath), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock of a process that's still around is left alone, the test's parent is one
+	if err := os.WriteFile(lockPath, []byte(strconv.Itoa(os.Getppid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireRunLock(destDir); err == nil || !strings.Contains(err.Error(), "another run") {
+		t.Fatalf("got %v, want the other run's lock to be kept", err)
+	}
+
+	// one left behind by a run that was killed is taken over
+	if err := os.WriteFile(lockPath, []byte("not a pid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	release, err := acquireRunLock(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(lockPath); strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("the lock holds %q, want this process's pid", data)
+	}
+	release()
+	if _, err = os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("the lock is still there after it was released: %v", err)
+	}
+}
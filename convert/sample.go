@@ -0,0 +1,86 @@
+package convert
+
+import (
+	"math/rand"
+	"path/filepath"
+	"time"
+)
+
+// a randomly picked set of whole albums that fits a small device, kept in the state so later runs sync the same albums
+type librarySample struct {
+	// the most the sample's outputs may take up, in bytes
+	Size int64 `json:"size"`
+	// the source directories of the albums in the sample, relative to the source library, in the order they were picked
+	Albums []string `json:"albums"`
+	// pick every album anew instead of keeping the ones picked before
+	reshuffle bool
+}
+
+// keeps only the jobs of the sampled albums, picking albums at random until the sample is full.
+// albums picked before stay in the sample as long as they still fit, unless it's being reshuffled
+func sampleAlbums(jobs []job, srcDir string, sample *librarySample) []job {
+	sizes := make(map[string]int64)
+	var albums []string
+	for _, j := range jobs {
+		album := sampleAlbumOf(j, srcDir)
+		if _, ok := sizes[album]; !ok {
+			albums = append(albums, album)
+		}
+		sizes[album] += estimateOutputSize(j)
+	}
+
+	var candidates []string
+	picked := make(map[string]bool)
+	if !sample.reshuffle {
+		for _, album := range sample.Albums {
+			// albums gone from the source drop out
+			if _, ok := sizes[album]; ok {
+				candidates = append(candidates, album)
+				picked[album] = true
+			}
+		}
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random.Shuffle(len(albums), func(a, b int) {
+		albums[a], albums[b] = albums[b], albums[a]
+	})
+	for _, album := range albums {
+		if !picked[album] {
+			candidates = append(candidates, album)
+		}
+	}
+
+	// albums too big for what's left are passed over for smaller ones
+	var total int64
+	chosen := make(map[string]bool)
+	sample.Albums = nil
+	for _, album := range candidates {
+		if total+sizes[album] > sample.Size {
+			continue
+		}
+		total += sizes[album]
+		chosen[album] = true
+		sample.Albums = append(sample.Albums, album)
+	}
+
+	var sampled []job
+	for _, j := range jobs {
+		if chosen[sampleAlbumOf(j, srcDir)] {
+			sampled = append(sampled, j)
+		}
+	}
+	return sampled
+}
+
+// the album a job belongs to, the source directory it's in. tracks of zipped albums go by their archive
+func sampleAlbumOf(j job, srcDir string) string {
+	source := j.sourceFile
+	if j.archive != "" {
+		source = j.archive
+	}
+	album, err := filepath.Rel(srcDir, filepath.Dir(source))
+	if err != nil {
+		return filepath.Dir(source)
+	}
+	return filepath.ToSlash(album)
+}
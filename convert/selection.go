@@ -0,0 +1,148 @@
+package convert
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// which sources make it into the library, by how much they're liked
+type selectionOptions struct {
+	// the fewest stars out of 5 a track needs, 0 to keep unrated tracks
+	minRating float64
+	// the fewest plays a track needs
+	minPlays int
+	// keep only this many of each artist's best liked tracks, 0 for no limit
+	maxPerArtist int
+	// ratings and play counts from an itunes library, otherwise they're read from the tags
+	itunes map[string]trackStats
+}
+
+func (s selectionOptions) active() bool {
+	return s.minRating > 0 || s.minPlays > 0 || s.maxPerArtist > 0
+}
+
+// reads a rating tag as stars out of 5. taggers write 1 to 5, 0 to 100, or 0 to 1 for FMPS_RATING
+func parseRating(key string, value string) float64 {
+	rating, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || rating < 0 {
+		return 0
+	}
+
+	switch {
+	case strings.HasPrefix(strings.ToLower(key), "fmps"):
+		return rating * 5
+	case rating > 5:
+		return rating / 20
+	}
+	return rating
+}
+
+// how much a source is liked, along with the artist it's counted under for maxPerArtist
+func sourceStats(j job, srcDir string, selection selectionOptions) (trackStats, string) {
+	var stats trackStats
+	var tags map[string]string
+	// the itunes library has everything but the artist
+	if selection.itunes == nil || selection.maxPerArtist > 0 {
+		probe, err := probeSource(j.sourceFile)
+		if err != nil {
+			console.debugf("couldn't read the tags of %s: %s\n", j.sourceFile, err)
+		}
+		tags = probe.tags
+	}
+
+	if itunesStats, ok := selection.itunes[filepath.Clean(j.sourceFile)]; ok {
+		stats = itunesStats
+	} else if selection.itunes == nil {
+		// ffprobe doesn't read id3 POPM frames, the TXXX ratings most taggers also write do show up
+		for _, key := range []string{"rating", "fmps_rating"} {
+			if value, ok := findTag(tags, key); ok {
+				stats.rating = parseRating(key, value)
+				break
+			}
+		}
+		for _, key := range []string{"play_count", "playcount", "fmps_playcount"} {
+			if value, ok := findTag(tags, key); ok {
+				plays, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				stats.plays = int(plays)
+				break
+			}
+		}
+	}
+
+	artist, _ := findTag(tags, "album_artist")
+	if value, ok := findTag(tags, "artist"); ok && value != "" {
+		artist = value
+	}
+	if artist == "" {
+		// untagged, the top folder of the library is usually the artist
+		if relativePath, err := filepath.Rel(srcDir, j.sourceFile); err == nil {
+			artist = strings.Split(relativePath, string(filepath.Separator))[0]
+		}
+	}
+
+	return stats, strings.ToLower(artist)
+}
+
+// drops the planned jobs whose sources aren't liked enough, and all but the best liked tracks of each artist
+func selectJobs(jobs []job, srcDir string, selection selectionOptions) []job {
+	type candidate struct {
+		index int
+		stats trackStats
+	}
+	artists := make(map[string][]candidate)
+	var order []string
+
+	for i, j := range jobs {
+		if j.sidecar {
+			continue
+		}
+		stats, artist := sourceStats(j, srcDir, selection)
+		if stats.rating < selection.minRating || stats.plays < selection.minPlays {
+			continue
+		}
+		if artists[artist] == nil {
+			order = append(order, artist)
+		}
+		artists[artist] = append(artists[artist], candidate{index: i, stats: stats})
+	}
+
+	keep := make([]bool, len(jobs))
+	for _, artist := range order {
+		candidates := artists[artist]
+		if selection.maxPerArtist > 0 && len(candidates) > selection.maxPerArtist {
+			sort.SliceStable(candidates, func(a, b int) bool {
+				if candidates[a].stats.rating != candidates[b].stats.rating {
+					return candidates[a].stats.rating > candidates[b].stats.rating
+				}
+				return candidates[a].stats.plays > candidates[b].stats.plays
+			})
+			candidates = candidates[:selection.maxPerArtist]
+		}
+		for _, c := range candidates {
+			keep[c.index] = true
+		}
+	}
+
+	// rip logs go wherever one of their album's tracks does
+	selectedDirs := make(map[string]bool)
+	for i, j := range jobs {
+		if keep[i] {
+			selectedDirs[filepath.Dir(j.sourceFile)] = true
+		}
+	}
+	for i, j := range jobs {
+		if j.sidecar && selectedDirs[filepath.Dir(j.sourceFile)] {
+			keep[i] = true
+		}
+	}
+
+	var selected []job
+	for i, j := range jobs {
+		if keep[i] {
+			selected = append(selected, j)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,55 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// encodes a second of generated tone the way the run's encodes will go and checks it decodes again, so a broken ffmpeg
+// build or an argument combination the encoder refuses fails once up front rather than for every job
+func selfTest(ctx context.Context, jobs []job) error {
+	var sample *job
+	for i := range jobs {
+		if jobs[i].encode && !jobs[i].remux && !jobs[i].retag {
+			sample = &jobs[i]
+			break
+		}
+	}
+	// nothing is encoded, or only containers change
+	if sample == nil {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "convert-muh-music-self-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tone := filepath.Join(dir, "tone.wav")
+	out, err := toolCommand(ctx, ffmpegPath, "-loglevel", "error", "-f", "lavfi", "-i", "sine=frequency=440:sample_rate=44100:duration=1", "-ac", "2", tone).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg couldn't generate a test tone: %s", strings.TrimSpace(string(out)))
+	}
+
+	test := *sample
+	test.sourceFile = tone
+	test.destinationFile = filepath.Join(dir, "test"+filepath.Ext(sample.destinationFile))
+	test.metadata, test.metadataAdded, test.archive, test.archiveEntry, test.cacheKey = nil, false, "", "", ""
+	if report := executeJob(ctx, 0, test, time.Now()); report.error != nil {
+		return fmt.Errorf("encoding a test tone failed, every job would: %s", report.error)
+	}
+
+	if out, err = toolCommand(ctx, ffmpegPath, "-loglevel", "error", "-i", test.destinationFile, "-f", "null", "-").CombinedOutput(); err != nil {
+		return fmt.Errorf("the test tone was encoded but doesn't decode again: %s", strings.TrimSpace(string(out)))
+	}
+	// a tempo change makes it shorter or longer, but never next to nothing
+	if duration, err := getDuration(test.destinationFile); err != nil || duration < 250*time.Millisecond {
+		return fmt.Errorf("the test tone was encoded but came out %s long", duration)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a scheduled sync the service subcommand sets up
+type serviceSpec struct {
+	name string
+	// the command line the scheduler runs, the executable first
+	command  []string
+	interval time.Duration
+}
+
+func runService(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "install":
+			runServiceInstall(args[1:])
+			return
+		case "run":
+			runServiceRun(args[1:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "usage: %s service install [flags] <source directory> <destination directory> [convert flags]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s service run [flags] -- [convert flags] <source directory> <destination directory>\n", filepath.Base(os.Args[0]))
+	exit(2)
+}
+
+func runServiceInstall(args []string) {
+	flags := flag.NewFlagSet("service install", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	name := flags.String("name", "convert-muh-music", "the name of the unit or agent, to keep several syncs apart")
+	profile := flags.String("profile", "", "the config profile the sync runs with")
+	configPath := flags.String("config", "", "the config file the sync reads (defaults to "+defaultConfigPath()+")")
+	interval := flags.Duration("interval", time.Hour, "how long to wait between syncs")
+	printOnly := flags.Bool("print", false, "print the files instead of installing them")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		exit(2)
+	}
+	if *interval < time.Minute {
+		console.println("-interval has to be at least a minute")
+		exit(1)
+	}
+	if *name == "" || strings.ContainsAny(*name, `/\ `) {
+		console.println("-name can't be empty or have slashes or spaces in it")
+		exit(1)
+	}
+
+	// the profile is checked now, not at 3am when the first sync runs
+	if *profile != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			console.println("couldn't load the config:", err)
+			exit(1)
+		}
+		if _, ok := cfg.profiles[*profile]; !ok {
+			console.println("the config has no profile named", *profile)
+			exit(1)
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		console.println("couldn't find the path of this executable:", err)
+		exit(1)
+	}
+	// a windows service runs as LocalSystem, which would look for a config of its own
+	if *configPath == "" && runtime.GOOS == "windows" {
+		if _, err := os.Stat(defaultConfigPath()); err == nil {
+			*configPath = defaultConfigPath()
+		}
+	}
+	command := []string{executable}
+	if *configPath != "" {
+		path, err := filepath.Abs(*configPath)
+		if err != nil {
+			console.println(err)
+			exit(1)
+		}
+		command = append(command, "-config", path)
+	}
+	if *profile != "" {
+		command = append(command, "-profile", *profile)
+	}
+	// the convert flags go before the directories, where its flag parsing looks for them
+	command = append(command, flags.Args()[2:]...)
+	for _, dir := range flags.Args()[:2] {
+		path, err := filepath.Abs(dir)
+		if err != nil {
+			console.println(err)
+			exit(1)
+		}
+		command = append(command, path)
+	}
+
+	spec := serviceSpec{name: *name, command: command, interval: *interval}
+	switch runtime.GOOS {
+	case "linux":
+		err = installSystemdService(spec, *printOnly)
+	case "darwin":
+		err = installLaunchdAgent(spec, *printOnly)
+	case "windows":
+		err = installWindowsService(spec, *printOnly)
+	default:
+		err = fmt.Errorf("service install doesn't support %s", runtime.GOOS)
+	}
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+}
+
+// writes a user service and the timer that runs it, then enables the timer
+func installSystemdService(spec serviceSpec, printOnly bool) error {
+	var quoted []string
+	for _, arg := range spec.command {
+		quoted = append(quoted, systemdQuote(arg))
+	}
+
+	unit := fmt.Sprintf(`[Unit]
+Description=convert-muh-music sync (%s)
+
+[Service]
+Type=oneshot
+ExecStart=%s
+Nice=10
+IOSchedulingClass=idle
+`, spec.name, strings.Join(quoted, " "))
+	timer := fmt.Sprintf(`[Unit]
+Description=run convert-muh-music sync (%s) every %s
+
+[Timer]
+OnBootSec=5min
+OnUnitInactiveSec=%ds
+
+[Install]
+WantedBy=timers.target
+`, spec.name, spec.interval, int(spec.interval.Seconds()))
+
+	if printOnly {
+		fmt.Printf("# %s.service\n%s\n# %s.timer\n%s", spec.name, unit, spec.name, timer)
+		return nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	unitDir := filepath.Join(configDir, "systemd", "user")
+	if err = os.MkdirAll(unitDir, 0755); err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(unitDir, spec.name+".service"), []byte(unit), 0644); err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(unitDir, spec.name+".timer"), []byte(timer), 0644); err != nil {
+		return err
+	}
+	console.println("wrote", filepath.Join(unitDir, spec.name+".service"), "and", spec.name+".timer")
+
+	enable := [][]string{{"--user", "daemon-reload"}, {"--user", "enable", "--now", spec.name + ".timer"}}
+	for _, args := range enable {
+		if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("couldn't enable the timer, run systemctl %s yourself: %s", strings.Join(enable[1], " "), strings.TrimSpace(string(out)))
+		}
+	}
+	console.println("enabled", spec.name+".timer, it runs every", spec.interval)
+	return nil
+}
+
+// quotes an argument for ExecStart, where % and $ mean something to systemd itself
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// writes a launch agent that runs the sync at login and every interval after, then loads it
+func installLaunchdAgent(spec serviceSpec, printOnly bool) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	label := "com.github.trigex." + spec.name
+	logPath := filepath.Join(home, "Library", "Logs", "convert-muh-music", spec.name+".log")
+
+	var arguments bytes.Buffer
+	for _, arg := range spec.command {
+		arguments.WriteString("\t\t<string>")
+		xml.EscapeText(&arguments, []byte(arg))
+		arguments.WriteString("</string>\n")
+	}
+	var escapedLog bytes.Buffer
+	xml.EscapeText(&escapedLog, []byte(logPath))
+
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>StartInterval</key>
+	<integer>%s</integer>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>LowPriorityIO</key>
+	<true/>
+	<key>Nice</key>
+	<integer>10</integer>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, label, arguments.String(), strconv.Itoa(int(spec.interval.Seconds())), escapedLog.String(), escapedLog.String())
+
+	if printOnly {
+		fmt.Print(plist)
+		return nil
+	}
+
+	agentDir := filepath.Join(home, "Library", "LaunchAgents")
+	if err = os.MkdirAll(agentDir, 0755); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return err
+	}
+	plistPath := filepath.Join(agentDir, label+".plist")
+	if err = os.WriteFile(plistPath, []byte(plist), 0644); err != nil {
+		return err
+	}
+	console.println("wrote", plistPath)
+
+	// a reinstall replaces the agent that's loaded, unloading one that isn't fails harmlessly
+	exec.Command("launchctl", "unload", plistPath).Run()
+	if out, err := exec.Command("launchctl", "load", "-w", plistPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't load the agent, run launchctl load -w %s yourself: %s", plistPath, strings.TrimSpace(string(out)))
+	}
+	console.println("loaded", label+", it runs every", spec.interval, "and logs to", logPath)
+	return nil
+}
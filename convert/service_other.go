@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package convert
+
+import (
+	"fmt"
+)
+
+// systemd and launchd run the sync themselves, there's no service for it to run inside
+func runServiceRun(args []string) {
+	console.println("service run is for windows services, use service install to set up a scheduled sync")
+	exit(1)
+}
+
+func installWindowsService(spec serviceSpec, printOnly bool) error {
+	return fmt.Errorf("windows services can only be installed on windows")
+}
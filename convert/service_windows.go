@@ -0,0 +1,249 @@
+//go:build windows
+// +build windows
+
+package convert
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW         = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                 = advapi32.NewProc("ReportEventW")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped        = 1
+	serviceStopPending    = 3
+	serviceRunning        = 4
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	// what StartServiceCtrlDispatcher fails with when it's run from a console instead of by the service manager
+	errorFailedServiceControllerConnect = 1063
+	errorCallNotImplemented             = 120
+
+	eventError       = 1
+	eventWarning     = 2
+	eventInformation = 4
+)
+
+// SERVICE_STATUS
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// SERVICE_TABLE_ENTRYW
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// the running service: the sync it repeats and the handles it reports through
+type windowsService struct {
+	name     *uint16
+	interval time.Duration
+	command  []string
+	status   uintptr
+	events   uintptr
+	cancel   context.CancelFunc
+}
+
+// runs the sync every interval as a windows service, until the service manager stops it.
+// started from a console instead, it runs the same loop in the foreground until ctrl+c
+func runServiceRun(args []string) {
+	flags := flag.NewFlagSet("service run", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	name := flags.String("name", "convert-muh-music", "the name the service is installed under")
+	interval := flags.Duration("interval", time.Hour, "how long to wait between syncs")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		exit(2)
+	}
+
+	serviceName, err := syscall.UTF16PtrFromString(*name)
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	service := &windowsService{name: serviceName, interval: *interval, command: flags.Args()}
+	// without an event source the sync's results only go to the console, which a service hasn't got
+	service.events, _, _ = procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(serviceName)))
+
+	table := []serviceTableEntry{{name: serviceName, proc: syscall.NewCallback(service.main)}, {}}
+	if ok, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); ok == 0 {
+		if errno, isErrno := err.(syscall.Errno); !isErrno || errno != errorFailedServiceControllerConnect {
+			console.println("couldn't start the service:", err)
+			exit(1)
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		console.println("not started by the service manager, syncing every", *interval, "until ctrl+c")
+		service.syncLoop(ctx)
+	}
+}
+
+// ServiceMain, called by the service manager on a thread of its own
+func (s *windowsService) main(argc uint32, argv uintptr) uintptr {
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+
+	s.status, _, _ = procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(s.name)), syscall.NewCallback(s.control), 0)
+	if s.status == 0 {
+		return 0
+	}
+	s.setStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown)
+	s.syncLoop(ctx)
+	s.setStatus(serviceStopped, 0)
+	return 0
+}
+
+// the service control handler, stopping cancels the sync that's running
+func (s *windowsService) control(control uint32, eventType uint32, eventData uintptr, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		s.setStatus(serviceStopPending, 0)
+		s.cancel()
+		return 0
+	case serviceControlInterrogate:
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+func (s *windowsService) setStatus(state uint32, accepted uint32) {
+	status := serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state, controlsAccepted: accepted}
+	if state == serviceStopPending {
+		// killing ffmpeg and the sync takes a moment
+		status.waitHint = 10000
+	}
+	procSetServiceStatus.Call(s.status, uintptr(unsafe.Pointer(&status)))
+}
+
+// runs the sync, waits out the interval and starts over. a sync that's stopped halfway is picked up by the next one
+func (s *windowsService) syncLoop(ctx context.Context) {
+	executable, err := os.Executable()
+	if err != nil {
+		s.log(eventError, "couldn't find the path of this executable: "+err.Error())
+		return
+	}
+
+	for {
+		started := time.Now()
+		out, err := exec.CommandContext(ctx, executable, s.command...).CombinedOutput()
+		if ctx.Err() != nil {
+			s.log(eventWarning, "the sync was stopped before it finished")
+			return
+		}
+		if err != nil {
+			s.log(eventError, fmt.Sprintf("the sync failed after %s: %s\n\n%s", time.Since(started).Round(time.Second), err, lastLines(string(out), 40)))
+		} else {
+			s.log(eventInformation, fmt.Sprintf("the sync finished in %s\n\n%s", time.Since(started).Round(time.Second), lastLines(string(out), 40)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// writes to the application event log, and to the console for foreground runs
+func (s *windowsService) log(eventType uint16, message string) {
+	if s.status == 0 {
+		console.println(message)
+	}
+	if s.events == 0 {
+		return
+	}
+	text, err := syscall.UTF16PtrFromString(strings.ReplaceAll(message, "\x00", ""))
+	if err != nil {
+		return
+	}
+	// event 1 of EventCreate.exe, the message file the source is registered with, is the text as is
+	procReportEventW.Call(s.events, uintptr(eventType), 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&text)), 0)
+}
+
+// the end of a sync's output, the summary is what's worth keeping, and event log messages are capped at 32k characters
+func lastLines(text string, count int) string {
+	lines := strings.Split(strings.TrimRight(text, "\r\n"), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	text = strings.Join(lines, "\n")
+	if len(text) > 30000 {
+		text = text[len(text)-30000:]
+	}
+	return text
+}
+
+// registers a service that starts with windows and runs service run, and the event log source it reports through
+func installWindowsService(spec serviceSpec, printOnly bool) error {
+	binPath := []string{syscall.EscapeArg(spec.command[0]), "service", "run", "-name", spec.name, "-interval", spec.interval.String(), "--"}
+	for _, arg := range spec.command[1:] {
+		binPath = append(binPath, syscall.EscapeArg(arg))
+	}
+
+	eventSource := `HKLM\SYSTEM\CurrentControlSet\Services\EventLog\Application\` + spec.name
+	commands := [][]string{
+		{"sc.exe", "create", spec.name, "binPath=", strings.Join(binPath, " "), "start=", "delayed-auto", "DisplayName=", "convert-muh-music sync (" + spec.name + ")"},
+		{"sc.exe", "description", spec.name, "Converts " + spec.command[len(spec.command)-2] + " into " + spec.command[len(spec.command)-1] + " every " + spec.interval.String()},
+		{"reg.exe", "add", eventSource, "/v", "EventMessageFile", "/t", "REG_EXPAND_SZ", "/d", `%SystemRoot%\System32\EventCreate.exe`, "/f"},
+		{"reg.exe", "add", eventSource, "/v", "TypesSupported", "/t", "REG_DWORD", "/d", "7", "/f"},
+		{"sc.exe", "start", spec.name},
+	}
+
+	if printOnly {
+		for _, command := range commands {
+			var quoted []string
+			for _, arg := range command {
+				quoted = append(quoted, syscall.EscapeArg(arg))
+			}
+			fmt.Println(strings.Join(quoted, " "))
+		}
+		return nil
+	}
+
+	for _, command := range commands {
+		if out, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %s failed, installing a service needs an administrator prompt: %s", command[0], command[1], strings.TrimSpace(string(out)))
+		}
+	}
+	console.println("installed and started the", spec.name, "service, it syncs every", spec.interval, "and reports to the application event log")
+	// LocalSystem has no mapped drives and a config dir of its own
+	console.println("it runs as LocalSystem, to reach network drives run it as your user with: sc.exe config", spec.name, `obj= .\<user> password= <password>`)
+	return nil
+}
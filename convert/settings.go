@@ -0,0 +1,116 @@
+package convert
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the private tag outputs carry their settings fingerprint in, ie CMM_SETTINGS=opus/libopus/128k/v1
+const settingsTag = "CMM_SETTINGS"
+
+// bumped when what goes into a fingerprint changes, so outputs made by older versions can be told apart
+const settingsFingerprintVersion = 1
+
+// sums up the settings that decide what an encode's audio turns out like: the format, encoder and bitrate, along with
+// any resampling, remixing, tempo change or filters. tags and art aren't part of it, a retag takes care of those.
+// copies have no settings, they're the source as it is
+func settingsFingerprint(j job) string {
+	if !j.encode {
+		return ""
+	}
+	if j.remux {
+		return fmt.Sprintf("%s/copy/v%d", j.format.name, settingsFingerprintVersion)
+	}
+
+	parts := []string{j.format.name, j.options.encoder}
+	if j.options.bitrate != 0 {
+		parts = append(parts, strconv.Itoa(j.options.bitrate)+"k")
+	}
+	if j.options.sampleRate != 0 {
+		parts = append(parts, strconv.Itoa(j.options.sampleRate)+"hz")
+	}
+	if j.options.channels != 0 {
+		parts = append(parts, strconv.Itoa(j.options.channels)+"ch")
+	}
+	if j.options.tempo != 0 && j.options.tempo != 1 {
+		parts = append(parts, "tempo"+strconv.FormatFloat(j.options.tempo, 'g', -1, 64))
+	}
+	// filter chains can be long, and have slashes of their own
+	if j.options.filters != "" {
+		sum := sha1.Sum([]byte(j.options.filters))
+		parts = append(parts, "filters-"+hex.EncodeToString(sum[:4]))
+	}
+	parts = append(parts, "v"+strconv.Itoa(settingsFingerprintVersion))
+	return strings.Join(parts, "/")
+}
+
+// a job's id, the same for the same source at the same settings whichever run or machine it's on, so a track can be
+// followed through the logs, the history and the state database. made from where the source is within the library
+// and its settings fingerprint, empty for jobs that aren't made from a source, like generated playlists
+func jobID(j job) string {
+	if j.relativeSource == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(j.relativeSource + "\x00" + settingsFingerprint(j)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// the arguments tagging an encode with its settings fingerprint, for the containers that can hold a tag of our own.
+// the rest, and outputs of the libav backend, are only fingerprinted in the state database
+func settingsTagArgs(j job) []string {
+	fingerprint := settingsFingerprint(j)
+	if fingerprint == "" || !outputContainers[strings.ToLower(j.format.fileExtension)].customTags {
+		return nil
+	}
+	return []string{"-metadata", settingsTag + "=" + fingerprint}
+}
+
+// reads the settings fingerprint an output was tagged with, empty when it hasn't got one
+func readSettingsTag(file string) (string, error) {
+	probe, err := runProbe(file)
+	if err != nil {
+		return "", err
+	}
+	fingerprint, _ := findTag(probe.tags, settingsTag)
+	return fingerprint, nil
+}
+
+// the planned encodes whose outputs were made with other settings than the run's, ie a lower bitrate before a profile
+// was bumped. sources without an output yet and outputs made with the same settings are left alone, as are outputs
+// that don't say what they were made with, counted in unknown. current counts the ones already up to date
+func outdatedJobs(planned []job, completed map[string]stateEntry) (outdated []job, current int, unknown int) {
+	for _, j := range planned {
+		if !j.encode || j.sidecar {
+			continue
+		}
+		if _, err := destination.Stat(j.destinationFile); err != nil {
+			continue
+		}
+
+		recorded := ""
+		if entry, ok := completed[j.sourceFile]; ok && entry.Destination == j.destinationFile {
+			recorded = entry.Settings
+		}
+		// made before the state database kept settings, or by a run with another database
+		if recorded == "" {
+			var err error
+			if recorded, err = readSettingsTag(j.destinationFile); err != nil {
+				console.debugf("couldn't read the settings of %s: %s\n", j.destinationFile, err)
+			}
+		}
+
+		switch settings := settingsFingerprint(j); {
+		case recorded == "":
+			unknown++
+		case recorded == settings:
+			current++
+		default:
+			console.debugf("%s was made with %s, the run encodes with %s\n", j.destinationFile, recorded, settings)
+			outdated = append(outdated, j)
+		}
+	}
+	return outdated, current, unknown
+}
@@ -0,0 +1,298 @@
+package convert
+
+import (
+	"archive/zip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// the ffmpeg and ffprobe binaries to run, a downloaded static build replaces these when there is one
+var ffmpegPath = "ffmpeg"
+var ffprobePath = "ffprobe"
+
+// a known-good static ffmpeg build for a platform
+type ffmpegBuild struct {
+	// archives to download, macOS builds ship ffmpeg and ffprobe separately
+	urls []string
+}
+
+var ffmpegBuilds = map[string]ffmpegBuild{
+	"linux/amd64":   {urls: []string{"https://johnvansickle.com/ffmpeg/releases/ffmpeg-release-amd64-static.tar.xz"}},
+	"linux/arm64":   {urls: []string{"https://johnvansickle.com/ffmpeg/releases/ffmpeg-release-arm64-static.tar.xz"}},
+	"windows/amd64": {urls: []string{"https://github.com/BtbN/FFmpeg-Builds/releases/download/latest/ffmpeg-master-latest-win64-gpl.zip"}},
+	// intel only, apple silicon runs it through rosetta
+	"darwin/amd64": {urls: []string{"https://evermeet.cx/ffmpeg/getrelease/ffmpeg/zip", "https://evermeet.cx/ffmpeg/getrelease/ffprobe/zip"}},
+	"darwin/arm64": {urls: []string{"https://evermeet.cx/ffmpeg/getrelease/ffmpeg/zip", "https://evermeet.cx/ffmpeg/getrelease/ffprobe/zip"}},
+}
+
+// where the tool keeps data that isn't tied to a particular library
+func dataDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(configDir, "convert-muh-music"), nil
+	default:
+		if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+			return filepath.Join(dataHome, "convert-muh-music"), nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, ".local", "share", "convert-muh-music"), nil
+	}
+}
+
+func executableName(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// switches to a downloaded ffmpeg if setup-ffmpeg has been run
+func useDownloadedFfmpeg() {
+	directory, err := dataDir()
+	if err != nil {
+		return
+	}
+
+	ffmpeg := filepath.Join(directory, "ffmpeg", executableName("ffmpeg"))
+	ffprobe := filepath.Join(directory, "ffmpeg", executableName("ffprobe"))
+	if _, err := os.Stat(ffmpeg); err != nil {
+		return
+	}
+	if _, err := os.Stat(ffprobe); err != nil {
+		return
+	}
+
+	ffmpegPath = ffmpeg
+	ffprobePath = ffprobe
+}
+
+func runSetupFfmpeg(args []string) {
+	flags := flag.NewFlagSet("setup-ffmpeg", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	remove := flags.Bool("remove", false, "remove the downloaded ffmpeg and go back to the one on your PATH")
+	jsonOutput := flags.Bool("json", false, "print what was installed or removed as a json event, and every other line as one too")
+	flags.Parse(args)
+	console.json = *jsonOutput
+
+	directory, err := dataDir()
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	ffmpegDir := filepath.Join(directory, "ffmpeg")
+
+	if *remove {
+		if err = os.RemoveAll(ffmpegDir); err != nil {
+			console.println(err)
+			exit(1)
+		}
+		data := struct {
+			Removed string `json:"removed"`
+		}{ffmpegDir}
+		console.report("ffmpeg", data, func() {
+			console.println("removed", ffmpegDir)
+		})
+		return
+	}
+
+	build, ok := ffmpegBuilds[runtime.GOOS+"/"+runtime.GOARCH]
+	if !ok {
+		console.printf("there's no known static ffmpeg build for %s/%s, please install ffmpeg yourself\n", runtime.GOOS, runtime.GOARCH)
+		exit(1)
+	}
+
+	tempDir, err := os.MkdirTemp("", "convert-muh-music-ffmpeg")
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, url := range build.urls {
+		console.println("downloading", url)
+		if err = downloadAndExtract(url, tempDir); err != nil {
+			console.println("download failed:", err)
+			exit(1)
+		}
+	}
+
+	if err = os.MkdirAll(ffmpegDir, os.ModePerm); err != nil {
+		console.println(err)
+		exit(1)
+	}
+	// archives nest the binaries differently, go find them
+	for _, name := range []string{executableName("ffmpeg"), executableName("ffprobe")} {
+		found, err := findFile(tempDir, name)
+		if err != nil {
+			console.printf("%s wasn't in the downloaded build\n", name)
+			exit(1)
+		}
+		if err = moveFile(found, filepath.Join(ffmpegDir, name)); err != nil {
+			console.println(err)
+			exit(1)
+		}
+		os.Chmod(filepath.Join(ffmpegDir, name), 0755)
+	}
+
+	useDownloadedFfmpeg()
+	out, err := toolCommand(context.Background(), ffmpegPath, "-hide_banner", "-version").Output()
+	if err != nil {
+		console.println("the downloaded ffmpeg doesn't run:", err)
+		exit(1)
+	}
+	data := struct {
+		Installed string `json:"installed"`
+		FFprobe   string `json:"ffprobe"`
+		Version   string `json:"version"`
+	}{ffmpegPath, ffprobePath, strings.SplitN(string(out), "\n", 2)[0]}
+	console.report("ffmpeg", data, func() {
+		console.printf("installed %s\n%s\n", data.Installed, data.Version)
+	})
+	// static gpl builds can't legally include it
+	console.println("note: static builds don't include libfdk_aac, aac encodes will use ffmpeg's native encoder")
+}
+
+func downloadAndExtract(url string, destination string) error {
+	response, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+
+	archive, err := os.CreateTemp(destination, "download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	if _, err = io.Copy(archive, response.Body); err != nil {
+		archive.Close()
+		return err
+	}
+	archive.Close()
+
+	if strings.HasSuffix(url, ".tar.xz") {
+		// there's no xz in the standard library, but every system these builds are for has tar
+		out, err := exec.Command("tar", "-xJf", archive.Name(), "-C", destination).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("tar: %s", strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	return extractZip(archive.Name(), destination)
+}
+
+func extractZip(archivePath string, destination string) error {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		target := filepath.Join(destination, file.Name)
+		// refuse entries that would escape the destination
+		if !strings.HasPrefix(target, filepath.Clean(destination)+string(filepath.Separator)) {
+			return fmt.Errorf("bad path in archive: %s", file.Name)
+		}
+		if file.FileInfo().IsDir() {
+			if err = os.MkdirAll(target, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		if err = extractZipFile(file, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(file *zip.File, target string) error {
+	in, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.Mode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// finds a file by name anywhere under root
+func findFile(root string, name string) (string, error) {
+	var found string
+	err := filepath.Walk(root, func(curPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if found == "" && !info.IsDir() && info.Name() == name {
+			found = curPath
+		}
+		return nil
+	})
+	if err == nil && found == "" {
+		err = os.ErrNotExist
+	}
+
+	return found, err
+}
+
+// renames a file, falling back to copying when the temp directory is on another filesystem
+func moveFile(from string, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(from)
+}
@@ -0,0 +1,63 @@
+package convert
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// how fast jobs go with -simulate, in bytes of source a second per worker, 0 when they're run for real
+var simulateRate int64
+
+// the bitrate simulated encodes pretend their sources play at, cd audio, for the durations of their progress events
+const simulatedBitrate = 1411 * 1000
+
+// how many progress events a simulated encode sends
+const simulatedProgressSteps = 10
+
+// the encoders -simulate claims to have, every one a format can use, so any format can be simulated without ffmpeg
+func simulatedEncoders() ([]string, error) {
+	var encoders []string
+	for _, format := range audioFormats() {
+		encoders = append(encoders, format.encoders...)
+	}
+	return encoders, nil
+}
+
+// stands in for a job with -simulate: it takes as long as its source's size does at the simulated rate, reporting
+// progress along the way the way an encode would, and succeeds without running anything or writing a thing.
+// tracks still inside an archive and other sources that can't be measured go by as if they were empty
+func simulateJob(ctx context.Context, id int, j job, startTime time.Time) jobReport {
+	var size int64
+	if info, err := os.Stat(j.sourceFile); err == nil {
+		size = info.Size()
+	}
+	took := time.Duration(float64(size) / float64(simulateRate) * float64(time.Second))
+	duration := time.Duration(float64(size*8) / simulatedBitrate * float64(time.Second))
+
+	if !j.encode || j.retag {
+		if err := sleepContext(ctx, took); err != nil {
+			return jobReport{workerId: id, job: j, deferred: true}
+		}
+		return jobReport{workerId: id, elaspedTime: time.Since(startTime), job: j}
+	}
+	for step := 1; step <= simulatedProgressSteps; step++ {
+		if err := sleepContext(ctx, took/simulatedProgressSteps); err != nil {
+			return jobReport{workerId: id, job: j, deferred: true}
+		}
+		console.jobProgress(j, duration*time.Duration(step)/simulatedProgressSteps, duration)
+	}
+	return jobReport{workerId: id, elaspedTime: time.Since(startTime), job: j}
+}
+
+// waits, unless the run is cancelled first
+func sleepContext(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,199 @@
+package convert
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the converted set of a state database, with paths relative to the libraries so another machine can take it in
+// with its own. sources are keyed and destinations stored slash separated, whichever system they came from
+type exportedState struct {
+	ExportedAt time.Time             `json:"exportedAt"`
+	Completed  map[string]stateEntry `json:"completed"`
+}
+
+func runState(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			runStateExport(args[1:])
+			return
+		case "import":
+			runStateImport(args[1:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "usage: %s state export <source directory> <destination directory> <file>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s state import <source directory> <destination directory> <file>\n", filepath.Base(os.Args[0]))
+	exit(2)
+}
+
+// the source and destination libraries and the export file a state subcommand was given
+func stateArgs(name string, args []string) (string, string, string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	jsonOutput := flags.Bool("json", false, "print how the "+strings.TrimPrefix(name, "state ")+" went as a json event, and every other line as one too")
+	flags.Parse(args)
+	console.json = *jsonOutput
+
+	if flags.NArg() != 3 {
+		flags.Usage()
+		exit(2)
+	}
+	srcDir, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	destDir, err := filepath.Abs(flags.Arg(1))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	return srcDir, destDir, flags.Arg(2)
+}
+
+func runStateExport(args []string) {
+	srcDir, destDir, file := stateArgs("state export", args)
+
+	state, err := loadState(destDir)
+	if err != nil {
+		console.println("couldn't load the library's state:", err)
+		exit(1)
+	}
+
+	exported := exportedState{ExportedAt: time.Now(), Completed: make(map[string]stateEntry)}
+	for source, entry := range state.Completed {
+		// entries of other source libraries converted into the same destination aren't this one's to hand out
+		relativeSource, err := filepath.Rel(srcDir, source)
+		if err != nil || !isWithin(source, srcDir) {
+			continue
+		}
+		relativeDestination, err := filepath.Rel(destDir, entry.Destination)
+		if err != nil || !isWithin(entry.Destination, destDir) {
+			continue
+		}
+		entry.Destination = filepath.ToSlash(relativeDestination)
+		exported.Completed[filepath.ToSlash(relativeSource)] = entry
+	}
+
+	data, err := json.MarshalIndent(exported, "", "\t")
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	if err = os.WriteFile(file, data, 0644); err != nil {
+		console.println("couldn't write the export:", err)
+		exit(1)
+	}
+	summary := struct {
+		File    string `json:"file"`
+		Sources int    `json:"sources"`
+	}{file, len(exported.Completed)}
+	console.report("export", summary, func() {
+		console.printf("exported %s converted sources to %s\n", formatCount(len(exported.Completed)), file)
+	})
+}
+
+// merges another machine's export into the state database, for the sources this machine has the same files for.
+// source modification times differ from one copy of a library to the next, the sizes have to match
+func runStateImport(args []string) {
+	srcDir, destDir, file := stateArgs("state import", args)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		console.println("couldn't read the export:", err)
+		exit(1)
+	}
+	var exported exportedState
+	if err = json.Unmarshal(data, &exported); err != nil {
+		console.println("couldn't read the export:", err)
+		exit(1)
+	}
+
+	// a run going keeps the state in memory and saves over the import when it's done, and one starting now would
+	// miss it
+	release, err := acquireRunLock(destDir)
+	if err != nil {
+		console.printf("%s, import once it's finished\n", err)
+		exit(1)
+	}
+	defer release()
+
+	state, err := loadState(destDir)
+	if err != nil {
+		console.println("couldn't load the library's state:", err)
+		exit(1)
+	}
+
+	var sources []string
+	for source := range exported.Completed {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	var imported, missing, differing, newer int
+	for _, relativeSource := range sources {
+		entry := exported.Completed[relativeSource]
+		source := filepath.Join(srcDir, filepath.FromSlash(relativeSource))
+		destination := filepath.Join(destDir, filepath.FromSlash(entry.Destination))
+		// an export edited by hand could point anywhere
+		if !isWithin(source, srcDir) || !isWithin(destination, destDir) {
+			missing++
+			continue
+		}
+
+		info, err := os.Stat(source)
+		if err != nil {
+			missing++
+			continue
+		}
+		if entry.SourceSize != 0 && info.Size() != entry.SourceSize {
+			differing++
+			continue
+		}
+		if local, ok := state.Completed[source]; ok && local.CompletedAt.After(entry.CompletedAt) {
+			newer++
+			continue
+		}
+
+		entry.Destination = destination
+		if !entry.SourceModTime.IsZero() {
+			entry.SourceModTime = info.ModTime()
+		}
+		state.Completed[source] = entry
+		imported++
+	}
+
+	if err = saveState(destDir, state); err != nil {
+		console.println("couldn't save the library's state:", err)
+		exit(1)
+	}
+	summary := struct {
+		Imported  int `json:"imported"`
+		Missing   int `json:"missing"`
+		Differing int `json:"differing"`
+		Newer     int `json:"newer"`
+	}{imported, missing, differing, newer}
+	console.report("import", summary, func() {
+		console.printf("imported %s converted sources\n", formatCount(imported))
+		if missing > 0 {
+			console.printf("skipped %s that aren't in %s\n", formatCount(missing), srcDir)
+		}
+		if differing > 0 {
+			console.printf("skipped %s whose source here isn't the same size, they'll be converted again\n", formatCount(differing))
+		}
+		if newer > 0 {
+			console.printf("kept %s this library converted more recently\n", formatCount(newer))
+		}
+	})
+}
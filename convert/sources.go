@@ -0,0 +1,68 @@
+package convert
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where the library being converted comes from. planning walks it, copies and the encode cache read sources
+// through it and tags are probed with it, so the planner doesn't care what the library is kept on. ffmpeg opens
+// the sources it encodes itself, so a backend's paths have to be ones it can read
+type sourceBackend interface {
+	// walks the library under root like filepath.WalkDir, fn can return fs.SkipDir to skip a folder
+	Walk(root string, fn fs.WalkDirFunc) error
+	Open(path string) (io.ReadCloser, error)
+	// reads a source's tags, chapters and audio stream, probeSource caches what it says
+	Probe(path string) (sourceProbe, error)
+}
+
+// a library on a filesystem the machine has mounted
+type localSource struct{}
+
+func (localSource) Walk(root string, fn fs.WalkDirFunc) error { return filepath.WalkDir(root, fn) }
+
+func (localSource) Open(path string) (io.ReadCloser, error) { return os.Open(path) }
+
+func (localSource) Probe(path string) (sourceProbe, error) { return runProbe(path) }
+
+// the backend the run's sources are on
+var source sourceBackend = localSource{}
+
+// the kinds of source people ask for that need a client this build doesn't have, keyed by url scheme. links to
+// pages and albums are downloaded instead, see fetchURLSource
+var unsupportedSources = map[string]string{
+	"sftp": "sftp servers",
+	"ssh":  "sftp servers",
+	"smb":  "smb shares",
+	"s3":   "s3 buckets",
+	"mtp":  "mtp devices, like android phones",
+}
+
+// picks the backend for a source library given on the command line. only local paths have one so far, shares and
+// servers can be converted from by mounting them
+func selectSource(srcDir string) error {
+	scheme := ""
+	if i := strings.Index(srcDir, "://"); i > 0 {
+		scheme = strings.ToLower(srcDir[:i])
+	}
+	switch {
+	case scheme == "" || scheme == "file":
+		source = localSource{}
+		return nil
+	case unsupportedSources[scheme] != "":
+		return fmt.Errorf("%s can't be read from directly yet, mount it and give the mount point as the source", unsupportedSources[scheme])
+	}
+	return fmt.Errorf("unknown source %s, it has to be a directory or a link to download", srcDir)
+}
+
+// turns a file:// source into its path
+func sourcePath(srcDir string) string {
+	if strings.HasPrefix(strings.ToLower(srcDir), "file://") {
+		return filepath.FromSlash(srcDir[len("file://"):])
+	}
+	return srcDir
+}
@@ -0,0 +1,122 @@
+package convert
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// how often a running conversion persists its progress
+const stateSaveInterval = 30 * time.Second
+
+// the state database, kept in the destination library so later runs know what earlier runs did
+type libraryState struct {
+	// successfully processed jobs, keyed by source file
+	Completed map[string]stateEntry `json:"completed"`
+	// how the most recent run went
+	LastRun runRecord `json:"lastRun"`
+	// the albums the latest run sampled, if it only synced a sample
+	Sample *librarySample `json:"sample,omitempty"`
+}
+
+type stateEntry struct {
+	// the output the source was processed to
+	Destination string `json:"destination"`
+	// when the job completed
+	CompletedAt time.Time `json:"completedAt"`
+	// the source's size and modification time when it was processed, to notice it being edited
+	SourceSize    int64     `json:"sourceSize,omitempty"`
+	SourceModTime time.Time `json:"sourceModTime"`
+	// see sourceFingerprint
+	AudioHash string `json:"audioHash,omitempty"`
+	// md5 of the decoded audio the source and output were verified to share, see verifyBitPerfect
+	PCMHash string `json:"pcmHash,omitempty"`
+	// the source was removed after its output was verified, the output is all that's left of it
+	SourceDeleted bool `json:"sourceDeleted,omitempty"`
+	// what the output was encoded with, see settingsFingerprint
+	Settings string `json:"settings,omitempty"`
+	// the job that made the output, see jobID
+	JobID string `json:"jobId,omitempty"`
+}
+
+type runRecord struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// the number of jobs the run planned
+	Planned int `json:"planned"`
+	// the number of sources earlier runs had already taken care of
+	AlreadyDone int `json:"alreadyDone"`
+	// the number of jobs that succeeded
+	Completed int `json:"completed"`
+	// the number of jobs that failed
+	Failed int `json:"failed"`
+	// the number of jobs skipped because their source is drm protected
+	Protected int `json:"protected,omitempty"`
+	// the number of completed jobs whose output was verified bit for bit against its source
+	BitPerfect int `json:"bitPerfect,omitempty"`
+	// the number of jobs left for the next run because a budget ran out
+	Remaining int `json:"remaining"`
+	// why the run stopped before working through its whole plan, if it did
+	StopReason string `json:"stopReason,omitempty"`
+}
+
+func stateFilePath(destDir string) string {
+	return filepath.Join(destDir, toolDirName, "state.json")
+}
+
+// loads the state database of a destination library, a library without one gets an empty state
+func loadState(destDir string) (*libraryState, error) {
+	state := &libraryState{Completed: make(map[string]stateEntry)}
+
+	data, err := os.ReadFile(stateFilePath(destDir))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Completed == nil {
+		state.Completed = make(map[string]stateEntry)
+	}
+
+	return state, nil
+}
+
+// writes the state database, going through a temporary file so a crash can't leave it half written
+func saveState(destDir string, state *libraryState) error {
+	statePath := stateFilePath(destDir)
+	if err := os.MkdirAll(filepath.Dir(statePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tempPath := statePath + ".tmp"
+	if err = os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, statePath)
+}
+
+// formats a count with thousands separators, ie 48,002
+func formatCount(count int) string {
+	digits := strconv.Itoa(count)
+	if count < 0 {
+		return "-" + formatCount(-count)
+	}
+
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+
+	return digits
+}
@@ -0,0 +1,162 @@
+package convert
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// rebuilds the folders of planned outputs: mirror keeps the source tree, artist-album rebuilds Artist/Album from the tags
+// and flat puts everything straight into the destination, for players that ignore folders
+func restructureJobs(jobs []job, outDir string, structure string, buckets artistBuckets, windowsNames bool) {
+	if structure == "mirror" || structure == "" {
+		return
+	}
+
+	for i := range jobs {
+		if jobs[i].sidecar {
+			continue
+		}
+		dir := outDir
+		if structure == "artist-album" {
+			probe, err := probeSource(jobs[i].sourceFile)
+			if err != nil {
+				// tracks of zipped albums can't be read until they're extracted, they keep their mirrored folder
+				console.debugf("couldn't read the tags of %s, keeping its folder: %s\n", jobs[i].sourceFile, err)
+				continue
+			}
+			artist, album := tagFolders(probe.tags)
+			if windowsNames {
+				artist, album = windowsSafeName(artist), windowsSafeName(album)
+			}
+			dir = filepath.Join(outDir, buckets.folder(artist), artist, album)
+		}
+		jobs[i].destinationFile = filepath.Join(dir, filepath.Base(jobs[i].destinationFile))
+	}
+
+	// files that go with an album follow its first track, wherever that went
+	albumDirs := make(map[string]string)
+	for _, j := range jobs {
+		if _, ok := albumDirs[filepath.Dir(j.sourceFile)]; !ok && !j.sidecar {
+			albumDirs[filepath.Dir(j.sourceFile)] = filepath.Dir(j.destinationFile)
+		}
+	}
+	for i := range jobs {
+		if dir, ok := albumDirs[filepath.Dir(jobs[i].sourceFile)]; ok && jobs[i].sidecar {
+			jobs[i].destinationFile = filepath.Join(dir, filepath.Base(jobs[i].destinationFile))
+		}
+	}
+
+	dedupeDestinations(jobs)
+}
+
+// groups artist folders under folders of their own, for car head units and other players that can only scroll through
+// a list from the top: by first letter, or by ranges of letters like A-F. no ranges and no letters means no grouping
+type artistBuckets struct {
+	letters bool
+	ranges  [][2]rune
+}
+
+// reads "letter" or a comma separated list of ranges, ie "A-F,G-M,N-S,T-Z"
+func parseArtistBuckets(value string) (artistBuckets, error) {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "":
+		return artistBuckets{}, nil
+	case "letter":
+		return artistBuckets{letters: true}, nil
+	}
+
+	var buckets artistBuckets
+	for _, part := range splitList(value) {
+		bounds := []rune(strings.ToUpper(part))
+		if len(bounds) == 1 {
+			bounds = []rune{bounds[0], '-', bounds[0]}
+		}
+		if len(bounds) != 3 || (bounds[1] != '-' && bounds[1] != '–') || bounds[0] < 'A' || bounds[2] > 'Z' || bounds[0] > bounds[2] {
+			return artistBuckets{}, fmt.Errorf("unknown artist bucket %s, buckets are letter ranges like A-F", part)
+		}
+		for _, taken := range buckets.ranges {
+			if bounds[0] <= taken[1] && bounds[2] >= taken[0] {
+				return artistBuckets{}, fmt.Errorf("artist bucket %s overlaps %c-%c", part, taken[0], taken[1])
+			}
+		}
+		buckets.ranges = append(buckets.ranges, [2]rune{bounds[0], bounds[2]})
+	}
+	return buckets, nil
+}
+
+func (b artistBuckets) active() bool {
+	return b.letters || len(b.ranges) > 0
+}
+
+// the folder an artist goes in, "" when there's no grouping. artists starting with a number go in 0-9, and those whose
+// letter no range covers, ie accented ones, in #
+func (b artistBuckets) folder(artist string) string {
+	if !b.active() {
+		return ""
+	}
+	letter := folderLetter(artist)
+	if b.letters || letter == "0-9" || letter == "#" {
+		return letter
+	}
+	for _, bucket := range b.ranges {
+		if r := []rune(letter)[0]; r >= bucket[0] && r <= bucket[1] {
+			if bucket[0] == bucket[1] {
+				return string(bucket[0])
+			}
+			return string(bucket[0]) + "-" + string(bucket[1])
+		}
+	}
+	return "#"
+}
+
+// the artist and album folder names for a track, the album artist wins so compilations stay together
+func tagFolders(tags map[string]string) (string, string) {
+	artist := ""
+	for _, key := range []string{"album_artist", "albumartist", "artist"} {
+		if value, ok := findTag(tags, key); ok && tagFileName(value) != "" {
+			artist = tagFileName(value)
+			break
+		}
+	}
+	album, _ := findTag(tags, "album")
+	album = tagFileName(album)
+
+	// folders named . or .. would escape the destination
+	if strings.Trim(artist, ".") == "" {
+		artist = "Unknown Artist"
+	}
+	if strings.Trim(album, ".") == "" {
+		album = "Unknown Album"
+	}
+	return artist, album
+}
+
+// numbers outputs that ended up under the same name, ie "Intro (2).mp3", in planned order so reruns agree
+func dedupeDestinations(jobs []job) {
+	taken := make(map[string]bool, len(jobs))
+	for _, j := range jobs {
+		taken[strings.ToLower(j.destinationFile)] = false
+	}
+
+	for i := range jobs {
+		destination := jobs[i].destinationFile
+		if claimed := taken[strings.ToLower(destination)]; !claimed {
+			taken[strings.ToLower(destination)] = true
+			continue
+		}
+
+		extension := filepath.Ext(destination)
+		base := strings.TrimSuffix(destination, extension)
+		for n := 2; ; n++ {
+			candidate := base + " (" + strconv.Itoa(n) + ")" + extension
+			if _, exists := taken[strings.ToLower(candidate)]; !exists {
+				taken[strings.ToLower(candidate)] = true
+				jobs[i].destinationFile = candidate
+				break
+			}
+		}
+	}
+}
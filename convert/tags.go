@@ -0,0 +1,195 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what ffprobe tells us about a source
+type sourceProbe struct {
+	tags map[string]string
+	// the number of chapters the source has
+	chapters int
+	duration time.Duration
+	// the overall bitrate in kilobits, 0 when ffprobe doesn't know it
+	bitrate int
+	// the codec, channel count and sample rate of the first audio stream
+	codec      string
+	channels   int
+	sampleRate int
+	// the source has cover art embedded in it
+	art bool
+	// the source is drm protected, see isProtectedStream
+	protected bool
+}
+
+// reads a file's tags, chapters and audio stream with ffprobe, or from the probe cache when the file hasn't changed since
+func probeSource(file string) (sourceProbe, error) {
+	if probe, ok := probes.lookup(file); ok {
+		return probe, nil
+	}
+
+	probe, err := source.Probe(file)
+	if err != nil {
+		return probe, err
+	}
+	probes.store(file, probe)
+	return probe, nil
+}
+
+// runs ffprobe on a file. most containers keep tags on the file, ogg keeps them on the audio stream,
+// so both are merged with the file's tags winning
+func runProbe(file string) (sourceProbe, error) {
+	probe := sourceProbe{tags: make(map[string]string)}
+
+	// warnings are kept apart from the json, they're how protected windows media gives itself away
+	var warnings bytes.Buffer
+	cmd := toolCommand(context.Background(), ffprobePath, "-loglevel", "warning", "-show_entries", "format=duration,bit_rate:format_tags:stream=codec_type,codec_name,codec_tag_string,channels,sample_rate:stream_disposition=attached_pic:stream_tags:chapter=id", "-of", "json", longPath(file))
+	cmd.Stderr = &warnings
+	out, err := cmd.Output()
+	if err != nil {
+		return probe, err
+	}
+
+	var probed struct {
+		Format struct {
+			Duration string            `json:"duration"`
+			BitRate  string            `json:"bit_rate"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType   string            `json:"codec_type"`
+			CodecName   string            `json:"codec_name"`
+			CodecTag    string            `json:"codec_tag_string"`
+			Channels    int               `json:"channels"`
+			SampleRate  string            `json:"sample_rate"`
+			Disposition map[string]int    `json:"disposition"`
+			Tags        map[string]string `json:"tags"`
+		} `json:"streams"`
+		Chapters []struct{} `json:"chapters"`
+	}
+	if err = json.Unmarshal(out, &probed); err != nil {
+		return probe, err
+	}
+
+	audio := false
+	for _, stream := range probed.Streams {
+		// embedded cover art is a video stream of a single picture
+		if stream.CodecType == "video" && stream.Disposition["attached_pic"] == 1 {
+			probe.art = true
+		}
+		if stream.CodecType != "audio" || audio {
+			continue
+		}
+		audio = true
+		for key, value := range stream.Tags {
+			probe.tags[key] = value
+		}
+		probe.codec = stream.CodecName
+		probe.channels = stream.Channels
+		probe.sampleRate, _ = strconv.Atoi(stream.SampleRate)
+		probe.protected = isProtectedStream(stream.CodecTag, warnings.String())
+	}
+	for key, value := range probed.Format.Tags {
+		probe.tags[key] = value
+	}
+	probe.chapters = len(probed.Chapters)
+	if seconds, err := strconv.ParseFloat(probed.Format.Duration, 64); err == nil {
+		probe.duration = time.Duration(seconds * float64(time.Second))
+	}
+	if bitsPerSecond, err := strconv.Atoi(probed.Format.BitRate); err == nil {
+		probe.bitrate = bitsPerSecond / 1000
+	}
+
+	return probe, nil
+}
+
+// looks a tag up regardless of how the tagger capitalized it
+func findTag(tags map[string]string, key string) (string, bool) {
+	for name, value := range tags {
+		if strings.EqualFold(name, key) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// works out the tags a job's output needs on top of the ones ffmpeg copies over by itself
+func addJobMetadata(j job) job {
+	if !j.encode || j.metadataAdded {
+		return j
+	}
+	j.metadataAdded = true
+
+	container := outputContainers[strings.ToLower(j.format.fileExtension)]
+	// nothing to move around, and no chapters or archival tags that could get lost
+	if container.lyricsTag == "" && keepsChapters(j.format, j.options) && (j.format.isLossy || container.customTags) && !j.options.tagCompilations && len(j.options.rewrites) == 0 {
+		return j
+	}
+
+	probe, err := probeSource(j.sourceFile)
+	if err != nil {
+		// ffmpeg will still copy whatever tags it can read
+		console.debugf("couldn't read the tags of %s: %s\n", j.sourceFile, err)
+	}
+
+	// a flac's cuesheet shows up as chapters, see carryFlacBlocks
+	if probe.chapters > 0 && !container.supportsChapters && !carriesFlacBlocks(j) {
+		console.warning(j, fmt.Errorf("%d chapters, %s files can't hold them", probe.chapters, j.format.fileExtension))
+	} else if probe.chapters > 0 && !keepsChapters(j.format, j.options) {
+		console.warning(j, fmt.Errorf("%d chapters, dropped since the tempo changes", probe.chapters))
+	}
+	// lossless outputs are usually archival copies, losing their replaygain or cuesheet shouldn't go unnoticed
+	if !j.format.isLossy && !container.customTags {
+		var dropped []string
+		for key := range probe.tags {
+			if isArchivalTag(key) {
+				dropped = append(dropped, key)
+			}
+		}
+		if len(dropped) > 0 {
+			sort.Strings(dropped)
+			console.warning(j, fmt.Errorf("%s, %s files can't hold them", strings.Join(dropped, ", "), j.format.fileExtension))
+		}
+	}
+
+	metadata := rewriteMetadata(probe.tags, j.options.rewrites)
+	if j.options.tagCompilations {
+		for key, value := range compilationMetadata(j, probe.tags) {
+			metadata[key] = value
+		}
+	}
+	if container.lyricsTag != "" {
+		for key, value := range lyricsMetadata(j, container, probe.tags) {
+			metadata[key] = value
+		}
+	}
+
+	// length tags, ie id3 TLEN, would still give the source's duration
+	if len(atempoFilters(j.options.tempo)) > 0 {
+		for key := range probe.tags {
+			if strings.EqualFold(key, "TLEN") || strings.EqualFold(key, "length") {
+				metadata[key] = ""
+			}
+		}
+	}
+
+	j.metadata = nil
+	var keys []string
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	// sorted so the ffmpeg command is the same from run to run
+	sort.Strings(keys)
+	for _, key := range keys {
+		j.metadata = append(j.metadata, key+"="+metadata[key])
+	}
+
+	return j
+}
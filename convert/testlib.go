@@ -0,0 +1,370 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// an album of the library gen-testlib writes
+type testAlbum struct {
+	// the album's folder inside the library, with forward slashes
+	folder string
+	artist string
+	title  string
+	// the tracks of compilations have artists of their own
+	compilation bool
+	tracks      []testTrack
+	// a cover, a playlist and a text file next to the tracks, for what's copied along with them
+	extras bool
+	// names windows won't create
+	unixOnly bool
+}
+
+type testTrack struct {
+	// where the track goes inside its album's folder without its extension, with forward slashes
+	file   string
+	title  string
+	artist string
+	number int
+	disc   int
+}
+
+// the albums every library gen-testlib writes has, on top of one album per format, see testFormatAlbum
+var testAlbums = []testAlbum{
+	{folder: "Sígur Tónar/Ágætis Prófun", artist: "Sígur Tónar", title: "Ágætis Prófun", tracks: []testTrack{
+		{file: "01 - Svefn-g-englar", title: "Svefn-g-englar", number: 1},
+		{file: "02 - Ný batterí", title: "Ný batterí", number: 2},
+		{file: "03 - 東京の音", title: "東京の音", number: 3},
+		// a decomposed é, which some filesystems and devices turn into the composed one
+		{file: "04 - Cafe\u0301 Ölfus", title: "Cafe\u0301 Ölfus", number: 4},
+	}},
+	{folder: "Test Tones/Double Album", artist: "Test Tones", title: "Double Album", extras: true, tracks: []testTrack{
+		{file: "CD1/01 - First Side", title: "First Side", number: 1, disc: 1},
+		{file: "CD1/02 - Second Side", title: "Second Side", number: 2, disc: 1},
+		{file: "CD2/01 - Third Side", title: "Third Side", number: 1, disc: 2},
+		{file: "CD2/02 - Fourth Side", title: "Fourth Side", number: 2, disc: 2},
+	}},
+	{folder: "Various Artists/Tone Compilation", artist: "Various Artists", title: "Tone Compilation", compilation: true, tracks: []testTrack{
+		{file: "01 - The Sines - Pure", title: "Pure", artist: "The Sines", number: 1},
+		{file: "02 - Hertz & The Harmonics - Overtone", title: "Overtone", artist: "Hertz & The Harmonics", number: 2},
+		{file: "03 - DJ Nyquist - Aliased", title: "Aliased", artist: "DJ Nyquist", number: 3},
+	}},
+	{folder: "Edge Cases/Strange Names", artist: "Edge Cases", title: "Strange Names", unixOnly: true, tracks: []testTrack{
+		{file: "CON", title: "CON", number: 1},
+		{file: "What Is This?", title: "What Is This?", number: 2},
+		{file: "-03 Starts With A Dash", title: "Starts With A Dash", number: 3},
+		{file: "  04 Leading Spaces", title: "Leading Spaces", number: 4},
+		{file: "05 Trailing Dot.", title: "Trailing Dot.", number: 5},
+		{file: `06 "Quotes", *Stars* & <Brackets>`, title: `"Quotes", *Stars* & <Brackets>`, number: 6},
+		{file: "07 - " + testLongTitle, title: testLongTitle, number: 7},
+	}},
+}
+
+// long enough to run into the limits devices put on names and paths, short enough for every filesystem
+const testLongTitle = "A Title Long Enough To Run Into The Limits Some Players And Cards Put On File Names And Paths, " +
+	"Which Is Exactly Why It Is Here, Dragging On Well Past The Point Of Reason Until It Ends"
+
+// the album of a bin+cue image of a whole cd, for -images
+var testDiscImage = testAlbum{folder: "Test Tones/Disc Image", artist: "Test Tones", title: "Disc Image", tracks: []testTrack{
+	{title: "Lead In", number: 1},
+	{title: "Middle", number: 2},
+	{title: "Run Out", number: 3},
+}}
+
+// the album of tones in one of the formats
+func testFormatAlbum(format audioFormat) testAlbum {
+	album := testAlbum{folder: "Test Tones/Sine Waves (" + format.name + ")", artist: "Test Tones", title: "Sine Waves (" + format.name + ")", extras: true}
+	for i, note := range []string{"A", "C Sharp", "E"} {
+		album.tracks = append(album.tracks, testTrack{file: fmt.Sprintf("%02d - %s", i+1, note), title: note, number: i + 1})
+	}
+	return album
+}
+
+func runGenTestlib(args []string) {
+	flags := flag.NewFlagSet("gen-testlib", flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	formatNames := flags.String("formats", "flac,mp3,opus,aac,vorbis,alac,wav", "comma separated formats to encode the tones to, every one gets an album of its own and the other albums take turns. every format but wav needs ffmpeg")
+	seconds := flags.Int("seconds", 3, "how long every track is")
+	jsonOutput := flags.Bool("json", false, "print every album written as a json event, and every other line as one too")
+	flags.Parse(args)
+	console.json = *jsonOutput
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		exit(2)
+	}
+	if *seconds <= 0 {
+		console.println("-seconds has to be at least 1")
+		exit(1)
+	}
+
+	var formats []audioFormat
+	for _, name := range splitList(*formatNames) {
+		format, err := getAudioFormatFromName(name)
+		if err != nil {
+			console.println(err)
+			exit(1)
+		}
+		formats = append(formats, *format)
+	}
+	if len(formats) == 0 {
+		console.println("-formats needs at least one format")
+		exit(1)
+	}
+
+	libDir, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	// never mix fixtures into someone's actual music
+	if entries, err := os.ReadDir(libDir); err == nil && len(entries) > 0 {
+		console.printf("%s isn't empty, give gen-testlib a new or empty directory\n", libDir)
+		exit(1)
+	}
+
+	// the encoders are only needed for what isn't written as wav
+	encoders := map[string]string{}
+	needsFfmpeg := false
+	for _, format := range formats {
+		needsFfmpeg = needsFfmpeg || format.name != "wav"
+	}
+	if needsFfmpeg {
+		available, err := getFfmpegEncoders()
+		if err != nil {
+			console.printf("gen-testlib needs ffmpeg for every format but wav, couldn't run it: %s\n", err)
+			exit(1)
+		}
+		for i := range formats {
+			if encoders[formats[i].name], err = selectEncoder(&formats[i], available); err != nil {
+				console.println(err)
+				exit(1)
+			}
+		}
+	}
+
+	tempDir, err := os.MkdirTemp("", "cmm-testlib-")
+	if err != nil {
+		console.println(err)
+		exit(1)
+	}
+	defer os.RemoveAll(tempDir)
+
+	generator := testlibGenerator{libDir: libDir, tempDir: tempDir, frames: *seconds * 44100, encoders: encoders}
+	var albums []testAlbum
+	for _, format := range formats {
+		albums = append(albums, testFormatAlbum(format))
+	}
+	albums = append(albums, testAlbums...)
+	written := 0
+	for i, album := range albums {
+		if album.unixOnly && runtime.GOOS == "windows" {
+			continue
+		}
+		// the format albums come first, one each, the rest of them take turns
+		format := formats[i%len(formats)]
+		if err = generator.writeAlbum(album, format); err != nil {
+			console.printf("couldn't write %s: %s\n", album.folder, err)
+			os.RemoveAll(tempDir)
+			exit(1)
+		}
+		printTestAlbum(album.folder, format.name)
+		written++
+	}
+	if err = generator.writeDiscImage(testDiscImage); err != nil {
+		console.printf("couldn't write %s: %s\n", testDiscImage.folder, err)
+		os.RemoveAll(tempDir)
+		exit(1)
+	}
+	printTestAlbum(testDiscImage.folder, "bin+cue image")
+	written++
+
+	data := struct {
+		Directory string `json:"directory"`
+		Albums    int    `json:"albums"`
+	}{libDir, written}
+	console.report("testlib", data, func() {
+		console.printf("wrote %d albums of test tones to %s\n", written, libDir)
+	})
+}
+
+// tells what album gen-testlib wrote, and in what
+func printTestAlbum(folder string, format string) {
+	data := struct {
+		Folder string `json:"folder"`
+		Format string `json:"format"`
+	}{folder, format}
+	console.report("album", data, func() {
+		console.printf("wrote %s as %s\n", folder, format)
+	})
+}
+
+type testlibGenerator struct {
+	libDir  string
+	tempDir string
+	// how long every track is, in 44.1 kHz sample frames
+	frames int
+	// the encoder of every format, by name, "" for ffmpeg's default
+	encoders map[string]string
+	// how many tracks have been written so far, every one gets a tone of its own
+	tones int
+}
+
+func (g *testlibGenerator) writeAlbum(album testAlbum, format audioFormat) error {
+	albumDir := filepath.Join(g.libDir, filepath.FromSlash(album.folder))
+	var playlist strings.Builder
+	for _, track := range album.tracks {
+		out := filepath.Join(albumDir, filepath.FromSlash(track.file)+format.fileExtension)
+		if err := os.MkdirAll(filepath.Dir(out), os.ModePerm); err != nil {
+			return err
+		}
+		if err := g.writeTrack(album, track, format, out); err != nil {
+			return fmt.Errorf("%s: %s", track.file, err)
+		}
+		playlist.WriteString(track.file + format.fileExtension + "\n")
+	}
+	if !album.extras {
+		return nil
+	}
+
+	if err := writeTestCover(filepath.Join(albumDir, "folder.jpg")); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(albumDir, "playlist.m3u"), []byte(playlist.String()), 0644); err != nil {
+		return err
+	}
+	notes := fmt.Sprintf("%s by %s, sine waves written by gen-testlib\n", album.title, album.artist)
+	return os.WriteFile(filepath.Join(albumDir, "notes.txt"), []byte(notes), 0644)
+}
+
+// writes a track's tone to out, wavs directly and everything else through ffmpeg
+func (g *testlibGenerator) writeTrack(album testAlbum, track testTrack, format audioFormat, out string) error {
+	artist := album.artist
+	if track.artist != "" {
+		artist = track.artist
+	}
+	samples := g.nextTone()
+
+	target := out
+	if format.name != "wav" {
+		target = filepath.Join(g.tempDir, "tone.wav")
+	}
+	header := wavHeader(int64(len(samples)), []infoTag{{"INAM", track.title}, {"IART", artist}, {"IPRD", album.title}, {"ITRK", strconv.Itoa(track.number)}})
+	if err := os.WriteFile(target, append(header, samples...), 0644); err != nil {
+		return err
+	}
+	if format.name == "wav" {
+		return nil
+	}
+
+	// not buildFfmpegArgs, fixtures shouldn't look like they were converted already
+	args := []string{"-loglevel", "error", "-y", "-i", longPath(target), "-map_metadata", "-1"}
+	switch encoder := g.encoders[format.name]; {
+	case encoder != "":
+		args = append(args, "-c:a", encoder)
+	case format.name == "alac":
+		// ffmpeg would put aac in an m4a
+		args = append(args, "-c:a", "alac")
+	}
+	if format.isLossy {
+		args = append(args, "-b:a", strconv.Itoa(format.preferredBitrate)+"k")
+	}
+	args = append(args, format.ffmpegArguments...)
+	if format.muxer != "" {
+		args = append(args, "-f", format.muxer)
+	}
+	tags := []string{"title=" + track.title, "artist=" + artist, "album=" + album.title, "album_artist=" + album.artist, "track=" + strconv.Itoa(track.number)}
+	if track.disc != 0 {
+		tags = append(tags, "disc="+strconv.Itoa(track.disc))
+	}
+	if album.compilation {
+		tags = append(tags, "compilation=1")
+	}
+	for _, tag := range tags {
+		args = append(args, "-metadata", tag)
+	}
+	args = append(args, "-id3v2_version", "3", longPath(out))
+
+	if output, err := toolCommand(context.Background(), ffmpegPath, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// writes an album as the bin and cue sheet a ripper would, its tracks one after the other in the bin
+func (g *testlibGenerator) writeDiscImage(album testAlbum) error {
+	albumDir := filepath.Join(g.libDir, filepath.FromSlash(album.folder))
+	if err := os.MkdirAll(albumDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	var bin bytes.Buffer
+	var cue strings.Builder
+	fmt.Fprintf(&cue, "PERFORMER \"%s\"\nTITLE \"%s\"\nFILE \"%s.bin\" BINARY\n", album.artist, album.title, album.title)
+	for _, track := range album.tracks {
+		sector := bin.Len() / cdSectorSize
+		fmt.Fprintf(&cue, "  TRACK %02d AUDIO\n    TITLE \"%s\"\n    PERFORMER \"%s\"\n", track.number, track.title, album.artist)
+		fmt.Fprintf(&cue, "    INDEX 01 %02d:%02d:%02d\n", sector/cdSectorsPerSecond/60, sector/cdSectorsPerSecond%60, sector%cdSectorsPerSecond)
+		bin.Write(g.nextTone())
+		// tracks start on sector boundaries
+		if partial := bin.Len() % cdSectorSize; partial != 0 {
+			bin.Write(make([]byte, cdSectorSize-partial))
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(albumDir, album.title+".bin"), bin.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(albumDir, album.title+".cue"), []byte(cue.String()), 0644)
+}
+
+// the samples of the next track's tone, 16 bit little endian stereo. each goes a semitone up from the last, so tracks
+// can be told apart by ear and by spectrum
+func (g *testlibGenerator) nextTone() []byte {
+	frequency := 220 * math.Pow(2, float64(g.tones%36)/12)
+	g.tones++
+
+	samples := make([]byte, g.frames*4)
+	for i := 0; i < g.frames; i++ {
+		// a short fade in and out keeps the ends from clicking
+		gain := 0.3 * math.Min(1, math.Min(float64(i), float64(g.frames-1-i))/441)
+		value := int16(gain * math.MaxInt16 * math.Sin(2*math.Pi*frequency*float64(i)/44100))
+		binary.LittleEndian.PutUint16(samples[i*4:], uint16(value))
+		binary.LittleEndian.PutUint16(samples[i*4+2:], uint16(value))
+	}
+	return samples
+}
+
+// a gradient, to be copied along with an album as its cover
+func writeTestCover(path string) error {
+	cover := image.NewRGBA(image.Rect(0, 0, 300, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 300; x++ {
+			cover.Set(x, y, color.RGBA{uint8(x * 255 / 299), uint8(y * 255 / 299), 128, 255})
+		}
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = jpeg.Encode(out, cover, &jpeg.Options{Quality: 85}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,163 @@
+package convert
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// where a run's time went, for tuning the worker count
+type runTimings struct {
+	// by kind of job: copy, retag, or source extension -> output extension for encodes
+	kinds map[string]*kindTiming
+	// time each worker spent on jobs
+	busy map[int]time.Duration
+}
+
+type kindTiming struct {
+	jobs    int
+	elapsed time.Duration
+	// the size of the sources, and the length of those whose duration is known
+	sourceBytes int64
+	audio       time.Duration
+	// the time spent on the jobs with a known duration
+	audioElapsed time.Duration
+}
+
+func newRunTimings() *runTimings {
+	return &runTimings{kinds: make(map[string]*kindTiming), busy: make(map[int]time.Duration)}
+}
+
+// what kind of job a report is for
+func timingKind(j job) string {
+	switch {
+	case j.retag:
+		return "retag"
+	case !j.encode:
+		return "copy"
+	case j.remux:
+		return "remux"
+	}
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(j.sourceFile), ".")) + " -> " + strings.TrimPrefix(j.format.fileExtension, ".")
+}
+
+func (t *runTimings) add(report jobReport) {
+	if report.deferred || report.protected {
+		return
+	}
+	t.busy[report.workerId] += report.elaspedTime
+	if report.error != nil {
+		t.kinds["failed"] = t.addTo(t.kinds["failed"], report)
+		return
+	}
+
+	kind := timingKind(report.job)
+	if report.cached {
+		kind = "cached"
+	}
+	t.kinds[kind] = t.addTo(t.kinds[kind], report)
+}
+
+func (t *runTimings) addTo(timing *kindTiming, report jobReport) *kindTiming {
+	if timing == nil {
+		timing = &kindTiming{}
+	}
+	timing.jobs++
+	timing.elapsed += report.elaspedTime
+	if info, err := os.Stat(report.job.sourceFile); err == nil {
+		timing.sourceBytes += info.Size()
+	}
+	// only what's already been probed, timing isn't worth running ffprobe for
+	if probe, ok := probes.lookup(report.job.sourceFile); ok && probe.duration > 0 {
+		timing.audio += probe.duration
+		timing.audioElapsed += report.elaspedTime
+	}
+	return timing
+}
+
+// the breakdown as -json reports it
+func (t *runTimings) data(wall time.Duration, workerCount int) interface{} {
+	type kindData struct {
+		Kind    string  `json:"kind"`
+		Jobs    int     `json:"jobs"`
+		Elapsed float64 `json:"elapsed"`
+		// source megabytes per second of job time, and seconds of audio per second of job time
+		MegabytesPerSecond float64 `json:"megabytesPerSecond"`
+		Realtime           float64 `json:"realtime,omitempty"`
+	}
+	type workerData struct {
+		Worker      int     `json:"worker"`
+		Busy        float64 `json:"busy"`
+		Utilization float64 `json:"utilization"`
+	}
+	var data struct {
+		Kinds   []kindData   `json:"kinds"`
+		Workers []workerData `json:"workers"`
+	}
+
+	for _, kind := range t.sortedKinds() {
+		timing := t.kinds[kind]
+		entry := kindData{Kind: kind, Jobs: timing.jobs, Elapsed: timing.elapsed.Seconds()}
+		if timing.elapsed > 0 {
+			entry.MegabytesPerSecond = float64(timing.sourceBytes) / 1e6 / timing.elapsed.Seconds()
+		}
+		if timing.audioElapsed > 0 {
+			entry.Realtime = timing.audio.Seconds() / timing.audioElapsed.Seconds()
+		}
+		data.Kinds = append(data.Kinds, entry)
+	}
+	for w := 1; w <= workerCount; w++ {
+		entry := workerData{Worker: w, Busy: t.busy[w].Seconds()}
+		if wall > 0 {
+			entry.Utilization = t.busy[w].Seconds() / wall.Seconds()
+		}
+		data.Workers = append(data.Workers, entry)
+	}
+	return data
+}
+
+// kinds with the most time spent on them first
+func (t *runTimings) sortedKinds() []string {
+	var kinds []string
+	for kind := range t.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(a, b int) bool {
+		return t.kinds[kinds[a]].elapsed > t.kinds[kinds[b]].elapsed
+	})
+	return kinds
+}
+
+// prints the breakdown: speed by kind of job, then how busy each worker was over the run's wall time
+func (t *runTimings) print(wall time.Duration, workerCount int) {
+	fmt.Printf("\n%-16s %8s %10s %10s %10s\n", "job", "count", "time", "MB/s", "realtime")
+	for _, kind := range t.sortedKinds() {
+		timing := t.kinds[kind]
+		speed, realtime := "-", "-"
+		if timing.elapsed > 0 {
+			speed = fmt.Sprintf("%.1f", float64(timing.sourceBytes)/1e6/timing.elapsed.Seconds())
+		}
+		if timing.audioElapsed > 0 {
+			realtime = fmt.Sprintf("%.1fx", timing.audio.Seconds()/timing.audioElapsed.Seconds())
+		}
+		fmt.Printf("%-16s %8s %10s %10s %10s\n", kind, formatCount(timing.jobs), timing.elapsed.Round(time.Second), speed, realtime)
+	}
+
+	var total time.Duration
+	fmt.Printf("\n%-16s %10s %12s\n", "worker", "busy", "utilization")
+	for w := 1; w <= workerCount; w++ {
+		total += t.busy[w]
+		utilization := 0.0
+		if wall > 0 {
+			utilization = t.busy[w].Seconds() / wall.Seconds() * 100
+		}
+		fmt.Printf("%-16d %10s %11.0f%%\n", w, t.busy[w].Round(time.Second), utilization)
+	}
+	if wall > 0 && workerCount > 0 {
+		idle := time.Duration(workerCount)*wall - total
+		fmt.Printf("workers spent %s waiting for work, %.0f%% of their time\n", idle.Round(time.Second), idle.Seconds()/(float64(workerCount)*wall.Seconds())*100)
+	}
+}
@@ -0,0 +1,83 @@
+package convert
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// renames planned outputs to "01 Title" from their tags, so players sorting by name put track 2 before track 10.
+// tracks of multi-disc albums get the disc in front, ie "2-01 Title", and tracks without a track number tag keep their name
+func numberTrackNames(jobs []job, windowsNames bool) {
+	for i := range jobs {
+		if jobs[i].sidecar {
+			continue
+		}
+		probe, err := probeSource(jobs[i].sourceFile)
+		if err != nil {
+			console.debugf("couldn't read the tags of %s: %s\n", jobs[i].sourceFile, err)
+			continue
+		}
+
+		// ffmpeg reads vorbis TRACKNUMBER as track too
+		value, _ := findTag(probe.tags, "track")
+		track, total := parseTrackNumber(value)
+		if track == 0 {
+			continue
+		}
+		// 3/12 style tags carry the total, vorbis keeps it in a tag of its own
+		for _, key := range []string{"tracktotal", "totaltracks"} {
+			if value, ok := findTag(probe.tags, key); ok && total == 0 {
+				total, _ = strconv.Atoi(strings.TrimSpace(value))
+			}
+		}
+
+		width := len(strconv.Itoa(total))
+		if width < 2 {
+			width = 2
+		}
+
+		extension := filepath.Ext(jobs[i].destinationFile)
+		title, _ := findTag(probe.tags, "title")
+		title = tagFileName(title)
+		if title == "" {
+			// whatever the name had after its own, possibly unpadded, number
+			_, rest, _ := splitTrackNumber(strings.TrimSuffix(filepath.Base(jobs[i].destinationFile), extension))
+			title = strings.TrimLeft(rest, " .-_")
+		}
+
+		number := fmt.Sprintf("%0*d", width, track)
+		// every disc starts over at 1, and sharing a folder they'd collide. disc subfolders are already apart
+		if _, inDiscFolder := discNumber(filepath.Base(filepath.Dir(jobs[i].sourceFile))); !inDiscFolder {
+			value, _ := findTag(probe.tags, "disc")
+			if disc, discs := parseTrackNumber(value); disc > 1 || discs > 1 {
+				number = fmt.Sprintf("%d-%s", disc, number)
+			}
+		}
+
+		name := number + " " + title + extension
+		if title == "" {
+			name = number + extension
+		}
+		if windowsNames {
+			name = windowsSafeName(name)
+		}
+		jobs[i].destinationFile = filepath.Join(filepath.Dir(jobs[i].destinationFile), name)
+	}
+}
+
+// reads a track or disc number tag, ie "3" or "3/12", returning the number and the total if it has one
+func parseTrackNumber(value string) (int, int) {
+	parts := strings.SplitN(strings.TrimSpace(value), "/", 2)
+	track, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || track < 0 {
+		return 0, 0
+	}
+
+	total := 0
+	if len(parts) == 2 {
+		total, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	return track, total
+}
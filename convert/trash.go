@@ -0,0 +1,64 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// trash folders are named after when the clean that filled them ran, which is also how they expire
+const trashTimeLayout = "2006-01-02T15-04-05"
+
+// where clean moves the outputs it removes, one folder per run
+func trashDir(destDir string) string {
+	return filepath.Join(destDir, toolDirName, "trash")
+}
+
+// the trash folder for a clean starting now
+func newTrashRun(destDir string) string {
+	return filepath.Join(trashDir(destDir), time.Now().Format(trashTimeLayout))
+}
+
+// moves a file or directory of the destination into a trash folder, keeping its place in the library so it can be put back
+func moveToTrash(destDir string, runDir string, path string) error {
+	if err := checkWritable(path); err != nil {
+		return err
+	}
+	relativePath, err := filepath.Rel(destDir, path)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(runDir, relativePath)
+	if _, err = mkdirAllTracked(filepath.Dir(target)); err != nil {
+		return err
+	}
+	// the trash is in the destination, so this never crosses filesystems
+	return destination.Rename(path, target)
+}
+
+// removes trash folders older than maxAge, returning the ones removed
+func expireTrash(destDir string, maxAge time.Duration) ([]string, error) {
+	entries, err := destination.List(trashDir(destDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	for _, entry := range entries {
+		trashedAt, err := time.ParseInLocation(trashTimeLayout, entry.Name(), time.Local)
+		// not ours, leave it be
+		if err != nil || !entry.IsDir() || time.Since(trashedAt) < maxAge {
+			continue
+		}
+		path := filepath.Join(trashDir(destDir), entry.Name())
+		if err = removeAllDestination(path); err != nil {
+			return expired, err
+		}
+		expired = append(expired, path)
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,111 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// how far an output's duration can drift from its source's, lossy encoders pad the start and end a little
+const durationTolerance = time.Second
+
+// the tags an output has to carry over from its source to count as verified
+var verifiedTags = []string{"title", "artist", "album", "track"}
+
+// checks a finished output decodes cleanly from start to end, runs as long as its source and carries its tags
+func verifyOutput(j job) error {
+	out, err := toolCommand(context.Background(), ffmpegPath, "-loglevel", "error", "-i", longPath(j.destinationFile), "-map", "0:a:0", "-f", "null", "-").CombinedOutput()
+	if err != nil || len(strings.TrimSpace(string(out))) > 0 {
+		return withKind(errCorrupt, fmt.Errorf("%s doesn't decode cleanly: %s", j.destinationFile, strings.TrimSpace(string(out))))
+	}
+
+	sourceDuration, err := getDuration(j.sourceFile)
+	if err != nil {
+		return err
+	}
+	sourceDuration = outputDuration(j.options, sourceDuration)
+	outputDuration, err := getDuration(j.destinationFile)
+	if err != nil {
+		return err
+	}
+	if drift := outputDuration - sourceDuration; drift > durationTolerance || drift < -durationTolerance {
+		return withKind(errCorrupt, fmt.Errorf("%s runs %s but its source runs %s", j.destinationFile, outputDuration, sourceDuration))
+	}
+
+	sourceProbe, err := probeSource(j.sourceFile)
+	if err != nil {
+		return err
+	}
+	// outputs aren't worth a place in the probe cache
+	outputProbe, err := runProbe(j.destinationFile)
+	if err != nil {
+		return err
+	}
+	// the job's metadata is what the output was told to carry instead of the source's tags
+	expected := sourceProbe.tags
+	for _, metadata := range j.metadata {
+		parts := strings.SplitN(metadata, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for name := range expected {
+			if strings.EqualFold(name, parts[0]) {
+				delete(expected, name)
+			}
+		}
+		expected[parts[0]] = parts[1]
+	}
+	for _, tag := range verifiedTags {
+		want, ok := findTag(expected, tag)
+		if !ok || want == "" {
+			continue
+		}
+		got, _ := findTag(outputProbe.tags, tag)
+		matches := strings.TrimSpace(got) == strings.TrimSpace(want)
+		// mp4 and id3 write track numbers as 3/12 whether or not the source did
+		if tag == "track" {
+			wantNumber, _ := parseTrackNumber(want)
+			gotNumber, _ := parseTrackNumber(got)
+			matches = wantNumber == gotNumber
+		}
+		if !matches {
+			return fmt.Errorf("%s has %s %q but its source has %q", j.destinationFile, tag, got, want)
+		}
+	}
+
+	return nil
+}
+
+// hashes a file's decoded audio, files with the same pcm hash play back bit for bit the same whatever their codec.
+// samples are widened to 32 bit interleaved first, decoders disagree on sample layout, ie alac's is planar and flac's isn't
+func pcmHash(ctx context.Context, file string) (string, error) {
+	out, err := toolCommand(ctx, ffmpegPath, "-loglevel", "error", "-i", longPath(file), "-map", "0:a:0", "-c:a", "pcm_s32le", "-f", "hash", "-hash", "md5", "-").Output()
+	if err != nil {
+		return "", err
+	}
+
+	return parseHash(out)
+}
+
+// lossless encodes and remuxes can be checked bit for bit, lossy ones can't by definition
+func needsBitPerfectCheck(j job) bool {
+	return j.options.verifyLossless && j.encode && !j.retag && !j.format.isLossy && !changesAudio(j.options)
+}
+
+// checks an output decodes to exactly the audio its source does, returning the hash they share
+func verifyBitPerfect(ctx context.Context, sourceFile string, outputFile string) (string, error) {
+	sourceHash, err := pcmHash(ctx, sourceFile)
+	if err != nil {
+		return "", withKind(errSourceUnreadable, fmt.Errorf("couldn't decode %s to verify its output: %s", sourceFile, err))
+	}
+	outputHash, err := pcmHash(ctx, outputFile)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decode the output of %s to verify it: %s", sourceFile, err)
+	}
+	if sourceHash != outputHash {
+		return "", withKind(errCorrupt, fmt.Errorf("the output of %s doesn't decode to the same audio as it", sourceFile))
+	}
+
+	return sourceHash, nil
+}